@@ -0,0 +1,253 @@
+// Package auth is the single authorisation layer for the service.
+// Every handler authenticates the caller and checks their permissions through this package, rather than checking roles itself.
+package auth
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"bookings.com/m/data"
+	"bookings.com/m/session"
+)
+
+// TwoFactorPath is where users set up two-factor authentication, which stays open to users who must enrol before they can do anything else.
+const TwoFactorPath = "/2fa"
+
+// Role is the role a user holds, which decides what they are permitted to do.
+type Role string
+
+// roles that can be held by a user
+const (
+	RoleUser       Role = "user"
+	RoleLabManager Role = "lab_manager"
+	RoleAdmin      Role = "admin"
+	RoleFireWarden Role = "fire_warden"
+)
+
+// Permission is something a user may or may not be allowed to do.
+type Permission string
+
+// permissions checked by the handlers.
+// Authenticated is held by every logged in user, and is used where any logged in user is allowed.
+const (
+	Authenticated      Permission = ""
+	ManageHoods        Permission = "hoods:manage"
+	ManageMaintenance  Permission = "maintenance:manage"
+	ManageAnyBooking   Permission = "bookings:manage_any"
+	ManageLottery      Permission = "lottery:manage"
+	ViewReports        Permission = "reports:view"
+	ManageRecharge     Permission = "recharge:manage"
+	ManageWebhooks     Permission = "webhooks:manage"
+	ManageUsers        Permission = "users:manage"
+	ViewContactDetails Permission = "users:view_contact_details"
+	ManageLoneWorking  Permission = "lone_working:manage"
+	ViewRollCall       Permission = "safety:roll_call"
+)
+
+// labManagerPermissions are held by lab managers, and also by admins.
+var labManagerPermissions = []Permission{
+	ManageHoods,
+	ManageMaintenance,
+	ManageAnyBooking,
+	ManageLottery,
+	ViewReports,
+	ManageRecharge,
+	ViewContactDetails,
+	ManageLoneWorking,
+	ViewRollCall,
+}
+
+// rolePermissions maps each role to the permissions it holds.
+var rolePermissions = map[Role][]Permission{
+	RoleUser:       {},
+	RoleFireWarden: {ViewRollCall},
+	RoleLabManager: labManagerPermissions,
+	RoleAdmin:      append([]Permission{ManageWebhooks, ManageUsers}, labManagerPermissions...),
+}
+
+// ValidRole reports whether role is one of the roles a user can hold.
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[Role(role)]
+	return ok
+}
+
+// Scope limits what a request made with an API token may do. Requests made with a session cookie are not limited by scopes.
+type Scope string
+
+// scopes that can be given to an API token.
+// ScopeRead allows only GET requests, ScopeBookingsWrite also allows creating and cancelling bookings and lottery requests, and ScopeAll allows anything the user can do.
+const (
+	ScopeRead          Scope = "read"
+	ScopeBookingsWrite Scope = "bookings:write"
+	ScopeAll           Scope = "all"
+)
+
+// scopePaths lists the URL paths, below which requests other than GET are allowed by each scope.
+var scopePaths = map[Scope][]string{
+	ScopeBookingsWrite: {"/booking", "/lottery"},
+}
+
+// ValidScope reports whether scope is one of the scopes an API token can hold.
+func ValidScope(scope string) bool {
+	switch Scope(scope) {
+	case ScopeRead, ScopeBookingsWrite, ScopeAll:
+		return true
+	}
+	return false
+}
+
+// Principal is the authenticated user making a request.
+// Token is the session token for requests made with a cookie. Requests made with an API token have ViaAPIToken set, and are limited to the token's Scopes.
+// MustEnrolTwoFactor is set when the user's role requires two-factor authentication and they haven't turned it on yet.
+type Principal struct {
+	UserID             int
+	Name               string
+	Role               Role
+	Token              string
+	ViaAPIToken        bool
+	Scopes             []Scope
+	MustEnrolTwoFactor bool
+}
+
+// Can reports whether the principal holds the permission.
+func (p *Principal) Can(perm Permission) bool {
+	if perm == Authenticated {
+		return true
+	}
+	for _, held := range rolePermissions[p.Role] {
+		if held == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsRequest reports whether the principal's scopes allow the request.
+// GET and HEAD requests are allowed by every scope. Other requests need ScopeAll, or a scope that covers the request's path.
+func (p *Principal) allowsRequest(r *http.Request) bool {
+	if !p.ViaAPIToken || r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	for _, scope := range p.Scopes {
+		if scope == ScopeAll {
+			return true
+		}
+		for _, prefix := range scopePaths[scope] {
+			if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// BearerToken takes an http Request and returns the API token in its "Authorization: Bearer" header, or an empty string if there isn't one.
+func BearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// Authenticate takes an http Request and a sql DB connection and returns the Principal making the request.
+// Requests can authenticate with an API token in an "Authorization: Bearer" header, or with a session cookie.
+// ErrNoCredentials is returned if the request has neither, and ErrInvalidCredentials if the token or session is unknown or has expired.
+// Requests made with a session cookie that change anything must send the session's CSRF token too, and ErrCSRF is returned if it is missing or wrong.
+func Authenticate(r *http.Request, db *sql.DB) (*Principal, error) {
+	if bearer := BearerToken(r); bearer != "" {
+		return authenticateAPIToken(bearer, db)
+	}
+
+	token := session.RetrieveCookie(r)
+	if token == "" {
+		return nil, ErrNoCredentials
+	}
+
+	userID := session.UserTokenAuthentication(token, db)
+	if userID == -1 {
+		return nil, ErrInvalidCredentials
+	}
+
+	// a browser sends the cookie whichever site makes the request, so requests that change anything must also carry the CSRF token
+	if !session.SafeMethod(r.Method) && !session.CheckCSRF(r, token) {
+		return nil, ErrCSRF
+	}
+
+	user, err := data.GetUserByID(userID, db)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	role, err := data.GetUserRole(userID, db)
+	if err != nil {
+		return nil, err
+	}
+
+	mustEnrol, err := data.NeedsTwoFactorEnrolment(userID, role, db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Principal{UserID: userID, Name: user.Name, Role: Role(role), Token: token, MustEnrolTwoFactor: mustEnrol}, nil
+}
+
+// authenticateAPIToken takes an API token and a sql DB connection and returns the Principal the token belongs to, limited to the token's scopes.
+func authenticateAPIToken(token string, db *sql.DB) (*Principal, error) {
+	userID, scopes, err := data.AuthenticateAPIToken(token, db)
+	if err == data.ErrAPITokenNotFound {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := data.GetUserByID(userID, db)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	role, err := data.GetUserRole(userID, db)
+	if err != nil {
+		return nil, err
+	}
+
+	mustEnrol, err := data.NeedsTwoFactorEnrolment(userID, role, db)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Principal{UserID: userID, Name: user.Name, Role: Role(role), ViaAPIToken: true, MustEnrolTwoFactor: mustEnrol}
+	for _, s := range scopes {
+		p.Scopes = append(p.Scopes, Scope(s))
+	}
+	return p, nil
+}
+
+// Authorise takes an http Request, a sql DB connection and a permission, and returns the Principal making the request if they hold the permission.
+// ErrForbidden is returned if the user is authenticated but does not hold the permission, and ErrOutOfScope if the API token used doesn't have the scope for the request.
+// Users whose role requires two-factor authentication get ErrTwoFactorRequired for everything but the /2fa endpoints until they have turned it on.
+func Authorise(r *http.Request, db *sql.DB, perm Permission) (*Principal, error) {
+	p, err := Authenticate(r, db)
+	if err != nil {
+		return nil, err
+	}
+	if p.MustEnrolTwoFactor && r.URL.Path != TwoFactorPath && !strings.HasPrefix(r.URL.Path, TwoFactorPath+"/") {
+		return nil, ErrTwoFactorRequired
+	}
+	if !p.Can(perm) {
+		return nil, ErrForbidden
+	}
+	if !p.allowsRequest(r) {
+		return nil, ErrOutOfScope
+	}
+	return p, nil
+}
+
+// create structured errors
+var ErrNoCredentials = fmt.Errorf("unable to retrieve cookie")
+var ErrInvalidCredentials = fmt.Errorf("session is invalid or has expired, please log in again")
+var ErrForbidden = fmt.Errorf("permission denied")
+var ErrOutOfScope = fmt.Errorf("API token does not have the scope for this request")
+var ErrCSRF = fmt.Errorf("CSRF token is missing or invalid")
+var ErrTwoFactorRequired = fmt.Errorf("two-factor authentication must be turned on for this account")
@@ -3,8 +3,13 @@ package config
 import (
 	"encoding/json"
 	"os"
+	"strconv"
+	"time"
 )
 
+// FileName is the path of the JSON config file, relative to the directory the server is started from.
+const FileName = "config/config.json"
+
 // define the config struct, which has integrated structs to be used in JSON format when read.
 type Config struct {
 	Database struct {
@@ -15,8 +20,144 @@ type Config struct {
 		DBName   string `json:"dbname"`
 	} `json:"database"`
 	Server struct {
-		Port int `json:"port"`
+		Port           int      `json:"port"`
+		PublicURL      string   `json:"public_url"`
+		TrustedProxies []string `json:"trusted_proxies"`
 	} `json:"server"`
+	Email        Email        `json:"email"`
+	Reminders    Reminders    `json:"reminders"`
+	Sessions     Sessions     `json:"sessions"`
+	Login        Login        `json:"login"`
+	SSO          SSO          `json:"sso"`
+	Registration Registration `json:"registration"`
+	LoneWorking  LoneWorking  `json:"lone_working"`
+	Timezone     string       `json:"timezone"`
+	Bookings     struct {
+		Rules         BookingRules            `json:"rules"`
+		HoodOverrides map[string]BookingRules `json:"hood_overrides"`
+	} `json:"bookings"`
+}
+
+// BookingRules holds the limits that are applied to every booking request.
+// A zero value for any field means that rule is not enforced.
+// LatestStart is a 24 hour clock time in the form "HH:MM", e.g. "17:30".
+type BookingRules struct {
+	MaxAdvanceDays   int    `json:"max_advance_days"`
+	MinNoticeMinutes int    `json:"min_notice_minutes"`
+	MinLengthMinutes int    `json:"min_length_minutes"`
+	MaxLengthMinutes int    `json:"max_length_minutes"`
+	LatestStart      string `json:"latest_start"`
+}
+
+// Email holds the SMTP settings used to send notifications.
+// If Enabled is false, notifications are not sent. Username and Password can be left empty for a local mail server that doesn't need authentication.
+type Email struct {
+	Enabled           bool   `json:"enabled"`
+	Host              string `json:"host"`
+	Port              int    `json:"port"`
+	Username          string `json:"username"`
+	Password          string `json:"password"`
+	From              string `json:"from"`
+	MaxRetries        int    `json:"max_retries"`
+	RetryDelaySeconds int    `json:"retry_delay_seconds"`
+}
+
+// Reminders holds when reminder emails are sent for each booking.
+// StartOffsetsMinutes lists how long before the start of a booking a reminder is sent, e.g. [720, 15] for 12 hours and 15 minutes before.
+// EndNudgeMinutes is how long before the end of a booking the "your session ends soon" email is sent, or zero to not send it.
+type Reminders struct {
+	StartOffsetsMinutes []int `json:"start_offsets_minutes"`
+	EndNudgeMinutes     int   `json:"end_nudge_minutes"`
+}
+
+// Sessions holds how long login sessions last, and how their tokens and cookies are protected.
+// A session expires once it has not been used for IdleTimeoutMinutes, and always expires MaxLifetimeHours after login however often it is used.
+// TokenKey is the secret session tokens are hashed with before they are stored, and must be the same on every instance.
+// CookieSameSite is "strict", "lax" or "none", and CookieSecure stops browsers sending the cookies over plain HTTP.
+// Zero values fall back to the defaults in the session package.
+type Sessions struct {
+	IdleTimeoutMinutes int    `json:"idle_timeout_minutes"`
+	MaxLifetimeHours   int    `json:"max_lifetime_hours"`
+	TokenKey           string `json:"token_key"`
+	CookieSameSite     string `json:"cookie_same_site"`
+	CookieSecure       bool   `json:"cookie_secure"`
+}
+
+// Login holds the limits on failed login attempts.
+// An account is locked for LockoutMinutes once it has MaxFailuresPerUser failed attempts within WindowMinutes, and an IP address is refused once it has MaxFailuresPerIP failed attempts within WindowMinutes.
+// Zero values fall back to the defaults in the handlers package.
+type Login struct {
+	MaxFailuresPerUser int `json:"max_failures_per_user"`
+	MaxFailuresPerIP   int `json:"max_failures_per_ip"`
+	WindowMinutes      int `json:"window_minutes"`
+	LockoutMinutes     int `json:"lockout_minutes"`
+}
+
+// Registration holds who may register a local account and how email addresses are verified.
+// If RequireInvitation is true, every registration needs an admin-issued invitation code. Otherwise, if AllowedDomains is set, the email address must be at one of those domains unless an invitation code is given.
+// VerificationSecret signs the email verification links, and VerificationHours is how long they last (48 hours if unset).
+type Registration struct {
+	AllowedDomains     []string `json:"allowed_domains"`
+	RequireInvitation  bool     `json:"require_invitation"`
+	VerificationSecret string   `json:"verification_secret"`
+	VerificationHours  int      `json:"verification_hours"`
+}
+
+// LoneWorking holds the lone-worker protocol for hoods used out of hours.
+// Working hours run from WorkdayStart to WorkdayEnd ("HH:MM", in the lab's Timezone, or server local time if it isn't set) on WorkingDays ("mon" to "sun", Monday to Friday if unset), and any booking that runs outside them needs an acknowledgement.
+// While such a booking runs, the user must check in every CheckInMinutes (30 if unset). Once a check-in is GraceMinutes late (10 if unset), an alert is emailed to every address in SafetyContacts.
+type LoneWorking struct {
+	Enabled        bool     `json:"enabled"`
+	WorkdayStart   string   `json:"workday_start"`
+	WorkdayEnd     string   `json:"workday_end"`
+	WorkingDays    []string `json:"working_days"`
+	CheckInMinutes int      `json:"check_in_minutes"`
+	GraceMinutes   int      `json:"grace_minutes"`
+	SafetyContacts []string `json:"safety_contacts"`
+}
+
+// SSO holds the settings for logging in with institute accounts.
+// LocalLogin is "all" to let every local account log in with a password, or "admins" to keep local passwords for break-glass admin accounts only, which also turns off /register.
+type SSO struct {
+	LocalLogin string `json:"local_login"`
+	LDAP       LDAP   `json:"ldap"`
+	OIDC       OIDC   `json:"oidc"`
+}
+
+// LDAP holds the settings for logging in with a bind against the institute directory.
+// URL is either ldap://host:389 or ldaps://host:636. Setting StartTLS upgrades an ldap:// connection to TLS before any password is sent.
+// If UserDNTemplate is set, e.g. "uid=%s,ou=people,dc=example,dc=org", users bind directly with it. Otherwise the directory is searched under BaseDN for UserAttribute, binding first as BindDN if it is set.
+// SubjectAttribute names the attribute that identifies the user for good, such as entryUUID, so a reused uid can't log in to a former user's account.
+// GroupAttribute names the attribute holding the user's research group, and GroupMap translates its values into research group names.
+type LDAP struct {
+	Enabled          bool              `json:"enabled"`
+	URL              string            `json:"url"`
+	BindDN           string            `json:"bind_dn"`
+	BindPassword     string            `json:"bind_password"`
+	BaseDN           string            `json:"base_dn"`
+	UserDNTemplate   string            `json:"user_dn_template"`
+	UserAttribute    string            `json:"user_attribute"`
+	SubjectAttribute string            `json:"subject_attribute"`
+	EmailAttribute   string            `json:"email_attribute"`
+	GroupAttribute   string            `json:"group_attribute"`
+	GroupMap         map[string]string `json:"group_map"`
+	TimeoutSeconds   int               `json:"timeout_seconds"`
+	StartTLS         bool              `json:"start_tls"`
+}
+
+// OIDC holds the settings for logging in with an OpenID Connect provider using the authorisation code flow.
+// RedirectURL must be registered with the provider and point at /login/oidc/callback on this server.
+// UsernameClaim and GroupClaim name the ID token claims holding the username and research group, and GroupMap translates research group values as for LDAP.
+type OIDC struct {
+	Enabled       bool              `json:"enabled"`
+	Issuer        string            `json:"issuer"`
+	ClientID      string            `json:"client_id"`
+	ClientSecret  string            `json:"client_secret"`
+	RedirectURL   string            `json:"redirect_url"`
+	Scopes        []string          `json:"scopes"`
+	UsernameClaim string            `json:"username_claim"`
+	GroupClaim    string            `json:"group_claim"`
+	GroupMap      map[string]string `json:"group_map"`
 }
 
 // ReadConfigFile takes a filename as a string and returns a Config struct object and an error.
@@ -36,3 +177,41 @@ func ReadConfigFile(filename string) (Config, error) {
 	}
 	return config, err
 }
+
+// Location returns the lab's time zone and an error.
+// Booking rules and working hours are clock times on the lab's wall clock, so they are evaluated in this zone whatever zone a client sends.
+// The server's local time zone is used if no timezone is configured.
+func (c Config) Location() (*time.Location, error) {
+	if c.Timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(c.Timezone)
+}
+
+// BookingRulesFor takes a hood number and returns the BookingRules that apply to that hood.
+// The global rules are used as a base, and any non-zero field in the hood's override (keyed by hood number in the config file) replaces the global value.
+func (c Config) BookingRulesFor(hoodNumber int) BookingRules {
+	rules := c.Bookings.Rules
+
+	override, ok := c.Bookings.HoodOverrides[strconv.Itoa(hoodNumber)]
+	if !ok {
+		return rules
+	}
+
+	if override.MaxAdvanceDays != 0 {
+		rules.MaxAdvanceDays = override.MaxAdvanceDays
+	}
+	if override.MinNoticeMinutes != 0 {
+		rules.MinNoticeMinutes = override.MinNoticeMinutes
+	}
+	if override.MinLengthMinutes != 0 {
+		rules.MinLengthMinutes = override.MinLengthMinutes
+	}
+	if override.MaxLengthMinutes != 0 {
+		rules.MaxLengthMinutes = override.MaxLengthMinutes
+	}
+	if override.LatestStart != "" {
+		rules.LatestStart = override.LatestStart
+	}
+	return rules
+}
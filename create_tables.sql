@@ -1,4 +1,6 @@
-DROP TABLE IF EXISTS users, hoods, bookings, sessiontokens;
+DROP TABLE IF EXISTS users, hoods, bookings, sessiontokens, lottery_windows, booking_requests, hood_rates, invoice_periods, recharge_lines, notification_optouts, sent_reminders, webhooks, webhook_deliveries, stream_events, password_resets, login_attempts, account_lockouts, api_tokens, invitations, user_totp, totp_recovery_codes, role_settings, login_challenges, research_groups, research_group_memberships, group_move_requests, booking_delegates, lone_worker_acknowledgements, lone_worker_checkins, lone_worker_escalations, maintenance_windows, password_reset_requests;
+
+CREATE EXTENSION IF NOT EXISTS btree_gist;
 
 CREATE TABLE users (
     id SERIAL PRIMARY KEY,
@@ -6,25 +8,318 @@ CREATE TABLE users (
     passhash VARCHAR(255) NOT NULL,
     email VARCHAR(255) NOT NULL,
     emergency_telephone INT NOT NULL,
-    research_group VARCHAR(255) NOT NULL
+    research_group VARCHAR(255) NOT NULL,
+    role VARCHAR(32) NOT NULL DEFAULT 'user',
+    auth_provider VARCHAR(32) NOT NULL DEFAULT 'local',
+    external_id VARCHAR(255),
+    email_verified_at TIMESTAMP WITH TIME ZONE,
+    erased_at TIMESTAMP WITH TIME ZONE,
+    UNIQUE (auth_provider, external_id)
 );
 
+CREATE UNIQUE INDEX users_username ON users (LOWER(username));
+
 CREATE TABLE hoods (
     id SERIAL PRIMARY KEY,
-    hood_number INT NOT NULL,
-    room VARCHAR(255) NOT NULL
+    hood_number INT NOT NULL UNIQUE,
+    room VARCHAR(255) NOT NULL,
+    retired_at TIMESTAMP WITH TIME ZONE
 );
 
 CREATE TABLE bookings (
     id SERIAL PRIMARY KEY,
     username VARCHAR(255) NOT NULL,
     hoodnumber INT NOT NULL,
-    booking_date TIMESTAMP WITH TIME ZONE
+    booking_date TIMESTAMP WITH TIME ZONE NOT NULL,
+    end_date TIMESTAMP WITH TIME ZONE NOT NULL,
+    grant_code VARCHAR(64) NOT NULL DEFAULT '',
+    booked_by VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    cancelled_at TIMESTAMP WITH TIME ZONE,
+    CONSTRAINT bookings_no_overlap EXCLUDE USING gist (hoodnumber WITH =, tstzrange(booking_date, end_date) WITH &&) WHERE (cancelled_at IS NULL)
 );
 
 CREATE TABLE sessiontokens (
     id SERIAL PRIMARY KEY,
-    token VARCHAR(255) NOT NULL,
-    user_id INT NOT NULL
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    user_id INT NOT NULL,
+    device_label VARCHAR(255) NOT NULL DEFAULT '',
+    user_agent VARCHAR(512) NOT NULL DEFAULT '',
+    ip_address VARCHAR(64) NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    last_seen_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE TABLE lottery_windows (
+    id SERIAL PRIMARY KEY,
+    opens_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    closes_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    slots_from TIMESTAMP WITH TIME ZONE NOT NULL,
+    slots_until TIMESTAMP WITH TIME ZONE NOT NULL,
+    status VARCHAR(32) NOT NULL,
+    claimed_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE TABLE booking_requests (
+    id SERIAL PRIMARY KEY,
+    window_id INT NOT NULL REFERENCES lottery_windows(id),
+    username VARCHAR(255) NOT NULL,
+    hoodnumber INT NOT NULL,
+    booking_date TIMESTAMP WITH TIME ZONE NOT NULL,
+    end_date TIMESTAMP WITH TIME ZONE NOT NULL,
+    rank INT NOT NULL,
+    status VARCHAR(32) NOT NULL,
+    reason VARCHAR(255) NOT NULL DEFAULT '',
+    booking_id INT,
+    lone_worker_acknowledged BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE hood_rates (
+    id SERIAL PRIMARY KEY,
+    hood_number INT NOT NULL,
+    hourly_rate NUMERIC(10, 2) NOT NULL,
+    effective_from TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE TABLE invoice_periods (
+    month VARCHAR(7) PRIMARY KEY,
+    locked_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE TABLE recharge_lines (
+    id SERIAL PRIMARY KEY,
+    month VARCHAR(7) NOT NULL REFERENCES invoice_periods(month),
+    research_group VARCHAR(255) NOT NULL,
+    grant_code VARCHAR(64) NOT NULL,
+    hood_number INT NOT NULL,
+    hours NUMERIC(10, 2) NOT NULL,
+    cost NUMERIC(12, 2) NOT NULL
+);
+
+CREATE TABLE notification_optouts (
+    user_id INT NOT NULL,
+    event VARCHAR(64) NOT NULL,
+    PRIMARY KEY (user_id, event)
+);
+
+CREATE TABLE sent_reminders (
+    booking_id INT NOT NULL,
+    kind VARCHAR(32) NOT NULL,
+    sent_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (booking_id, kind)
+);
+
+CREATE TABLE webhooks (
+    id SERIAL PRIMARY KEY,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    events TEXT[] NOT NULL,
+    active BOOLEAN NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE TABLE webhook_deliveries (
+    id SERIAL PRIMARY KEY,
+    webhook_id INT NOT NULL REFERENCES webhooks(id),
+    event VARCHAR(64) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(32) NOT NULL,
+    attempts INT NOT NULL,
+    next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    last_error TEXT NOT NULL,
+    response_code INT,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    delivered_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX webhook_deliveries_pending ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+
+CREATE TABLE stream_events (
+    id BIGSERIAL PRIMARY KEY,
+    event VARCHAR(64) NOT NULL,
+    hood_number INT NOT NULL,
+    room VARCHAR(255) NOT NULL,
+    data JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    txid BIGINT NOT NULL
+);
+
+CREATE INDEX stream_events_txid ON stream_events (txid, id);
+
+CREATE TABLE password_resets (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE TABLE login_attempts (
+    id BIGSERIAL PRIMARY KEY,
+    username VARCHAR(255) NOT NULL,
+    user_id INT,
+    provider VARCHAR(32) NOT NULL,
+    ip_address VARCHAR(64) NOT NULL,
+    user_agent TEXT NOT NULL,
+    outcome VARCHAR(32) NOT NULL,
+    attempted_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX login_attempts_username ON login_attempts (username, attempted_at);
+CREATE INDEX login_attempts_ip ON login_attempts (ip_address, attempted_at);
+
+CREATE TABLE account_lockouts (
+    username VARCHAR(255) PRIMARY KEY,
+    failed_count INT NOT NULL,
+    locked_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    locked_until TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE TABLE api_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE TABLE invitations (
+    id SERIAL PRIMARY KEY,
+    code_hash CHAR(64) NOT NULL UNIQUE,
+    research_group VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL DEFAULT '',
+    created_by INT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    used_by INT
+);
+
+CREATE TABLE user_totp (
+    user_id INT PRIMARY KEY,
+    secret VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    confirmed_at TIMESTAMP WITH TIME ZONE,
+    last_step BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE totp_recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX totp_recovery_codes_user ON totp_recovery_codes (user_id);
+
+CREATE TABLE role_settings (
+    role VARCHAR(50) PRIMARY KEY,
+    require_two_factor BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE login_challenges (
+    token_hash CHAR(64) PRIMARY KEY,
+    user_id INT NOT NULL,
+    username VARCHAR(255) NOT NULL,
+    provider VARCHAR(32) NOT NULL DEFAULT '',
+    device_label VARCHAR(255) NOT NULL DEFAULT '',
+    attempts INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE TABLE research_groups (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL UNIQUE,
+    name_key VARCHAR(255) NOT NULL UNIQUE,
+    leader_id INT,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE TABLE research_group_memberships (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    group_id INT NOT NULL REFERENCES research_groups(id),
+    joined_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    left_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX research_group_memberships_group ON research_group_memberships (group_id, joined_at);
+
+CREATE TABLE group_move_requests (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL,
+    group_id INT NOT NULL REFERENCES research_groups(id),
+    requested_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    decided_at TIMESTAMP WITH TIME ZONE,
+    decided_by INT,
+    approved BOOLEAN
+);
+
+CREATE UNIQUE INDEX group_move_requests_pending ON group_move_requests (user_id) WHERE decided_at IS NULL;
+CREATE INDEX group_move_requests_group ON group_move_requests (group_id, requested_at);
+
+CREATE TABLE booking_delegates (
+    user_id INT NOT NULL,
+    delegate_id INT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (user_id, delegate_id)
+);
+
+CREATE TABLE lone_worker_acknowledgements (
+    booking_id INT PRIMARY KEY,
+    username VARCHAR(255) NOT NULL,
+    acknowledged_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE TABLE lone_worker_checkins (
+    id SERIAL PRIMARY KEY,
+    booking_id INT NOT NULL,
+    checked_in_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX lone_worker_checkins_booking ON lone_worker_checkins (booking_id, checked_in_at);
+
+CREATE TABLE lone_worker_escalations (
+    id SERIAL PRIMARY KEY,
+    booking_id INT NOT NULL,
+    username VARCHAR(255) NOT NULL,
+    hood_number INT NOT NULL,
+    room VARCHAR(255) NOT NULL DEFAULT '',
+    emergency_telephone INT NOT NULL DEFAULT 0,
+    due_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    escalated_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    contacts TEXT[] NOT NULL DEFAULT '{}',
+    resolved_at TIMESTAMP WITH TIME ZONE,
+    resolved_by VARCHAR(255) NOT NULL DEFAULT '',
+    UNIQUE (booking_id, due_at)
+);
+
+CREATE TABLE maintenance_windows (
+    id SERIAL PRIMARY KEY,
+    hood_number INT NOT NULL,
+    starts_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    ends_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    reason VARCHAR(255) NOT NULL DEFAULT '',
+    created_by VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    cancelled_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX maintenance_windows_hood ON maintenance_windows (hood_number, starts_at);
+
+CREATE TABLE password_reset_requests (
+    id SERIAL PRIMARY KEY,
+    user_id INT,
+    ip_address VARCHAR(64) NOT NULL,
+    requested_at TIMESTAMP WITH TIME ZONE NOT NULL
 );
 
+CREATE INDEX password_reset_requests_ip ON password_reset_requests (ip_address, requested_at);
+CREATE INDEX password_reset_requests_user ON password_reset_requests (user_id, requested_at);
@@ -0,0 +1,110 @@
+package data
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// APIToken is a named personal access token that a user creates for scripts and instruments.
+// Only a hash of the token is stored, so Token is only set in the response to the request that created it.
+type APIToken struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Token      string     `json:"token,omitempty"`
+}
+
+// APITokens is a list of APIToken objects.
+type APITokens []*APIToken
+
+// ToJSON is called on an APITokens object and takes an io.Writer, returning an error.
+func (at *APITokens) ToJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(at)
+}
+
+// hashAPIToken returns the SHA-256 of an API token, which is what is stored in the database in place of the token itself.
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// AddAPIToken takes a user ID, an APIToken with its Token field set and a sql DB connection, and stores a hash of the token for the user.
+// The token's ID and creation time are set from the database.
+func AddAPIToken(userID int, t *APIToken, db *sql.DB) error {
+	return db.QueryRow("INSERT INTO api_tokens (user_id, name, token_hash, scopes, created_at, expires_at) VALUES ($1, $2, $3, $4, NOW(), $5) RETURNING id, created_at;",
+		userID, t.Name, hashAPIToken(t.Token), pq.Array(t.Scopes), t.ExpiresAt).Scan(&t.ID, &t.CreatedAt)
+}
+
+// GetAPITokens takes a user ID and a sql DB connection and returns the user's tokens that have not been revoked, newest first.
+// Expired tokens are included so the user can see why a script stopped working.
+func GetAPITokens(userID int, db *sql.DB) (APITokens, error) {
+	rows, err := db.Query("SELECT id, name, scopes, created_at, expires_at, last_used_at FROM api_tokens WHERE user_id = $1 AND revoked_at IS NULL ORDER BY created_at DESC;", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := APITokens{}
+	for rows.Next() {
+		var t APIToken
+		if err := rows.Scan(&t.ID, &t.Name, pq.Array(&t.Scopes), &t.CreatedAt, &t.ExpiresAt, &t.LastUsedAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, &t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeAPIToken takes a user ID, a token ID and a sql DB connection and revokes the token, as long as it belongs to the user.
+// If the user has no such token, the structured ErrAPITokenNotFound is returned.
+func RevokeAPIToken(userID, id int, db *sql.DB) error {
+	res, err := db.Exec("UPDATE api_tokens SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL;", id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAPITokenNotFound
+	}
+	return nil
+}
+
+// RevokeAPITokenByValue takes an API token and a sql DB connection and revokes it, so a script can log itself out.
+func RevokeAPITokenByValue(token string, db *sql.DB) error {
+	_, err := db.Exec("UPDATE api_tokens SET revoked_at = NOW() WHERE token_hash = $1 AND revoked_at IS NULL;", hashAPIToken(token))
+	return err
+}
+
+// RevokeUserAPITokens takes a user ID and revokes every API token the user has, for example when their password is reset.
+// It can run inside a transaction or directly on the database.
+func RevokeUserAPITokens(ex execer, userID int) error {
+	_, err := ex.Exec("UPDATE api_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL;", userID)
+	return err
+}
+
+// AuthenticateAPIToken takes an API token and a sql DB connection and returns the ID of the user it belongs to and the token's scopes.
+// The token's last used time is updated. If the token is unknown, revoked or expired, the structured ErrAPITokenNotFound is returned.
+func AuthenticateAPIToken(token string, db *sql.DB) (int, []string, error) {
+	var userID int
+	var scopes []string
+	err := db.QueryRow(`UPDATE api_tokens SET last_used_at = NOW()
+		WHERE token_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+		RETURNING user_id, scopes;`, hashAPIToken(token)).Scan(&userID, pq.Array(&scopes))
+	if err == sql.ErrNoRows {
+		return 0, nil, ErrAPITokenNotFound
+	}
+	return userID, scopes, err
+}
+
+// create structured error
+var ErrAPITokenNotFound = fmt.Errorf("API token not found")
@@ -2,31 +2,60 @@
 package data
 
 import (
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"io"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 // Booking is the struct that contains the fields defining a booking.
 // This includes;
 // the user ID of the user that booked the slot,
 // the ID of the hood that was booked,
-// the time and date of the booking.
+// the time and date the booking starts and ends,
+// the grant or cost-centre code the booking should be charged to, if any,
+// the name of the user who made the booking on the booked user's behalf, if it was made by a delegate,
+// the time the booking was cancelled, if it has been,
+// and, in booking requests only, whether the user acknowledges the lone-worker protocol for a booking outside working hours.
 type Booking struct {
-	ID          int       `json:"id"`
-	UserName    string    `json:"user_name"`
-	HoodNumber  int       `json:"hood_number"`
-	BookingDate time.Time `json:"booking_time"`
+	ID          int        `json:"id"`
+	UserName    string     `json:"user_name"`
+	HoodNumber  int        `json:"hood_number"`
+	BookingDate time.Time  `json:"booking_time"`
+	EndDate     time.Time  `json:"end_time"`
+	GrantCode   string     `json:"grant_code,omitempty"`
+	BookedBy    string     `json:"booked_by,omitempty"`
+	CancelledAt *time.Time `json:"cancelled_at,omitempty"`
+
+	LoneWorkerAck bool `json:"lone_worker_acknowledged,omitempty"`
 }
 
 // BookingsList is a type defined to characterise an array of the Booking struct type variables.
-// This is mainly used for defining the temporary booking list, and also in GET requests of bookings where the bookingList is queried.
+// This is mainly used in GET requests of bookings where the bookings table is queried.
 type BookingsList []*Booking
 
-// GetBookings returns the bookinglist above.
-// This bookingList is to be used as a test for HTTP requests while the database is not linked.
-func GetBookings() BookingsList {
-	return BookingList
+// GetBookings queries the bookings table of the database and returns every booking that has not been cancelled as a BookingsList.
+// If the query fails, nil is returned.
+func GetBookings(db *sql.DB) BookingsList {
+	rows, err := db.Query("SELECT id, username, hoodnumber, booking_date, end_date, grant_code, booked_by FROM bookings WHERE cancelled_at IS NULL ORDER BY booking_date;")
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	var bookingList BookingsList
+	for rows.Next() {
+		var booking Booking
+		err := rows.Scan(&booking.ID, &booking.UserName, &booking.HoodNumber, &booking.BookingDate, &booking.EndDate, &booking.GrantCode, &booking.BookedBy)
+		if err != nil {
+			return nil
+		}
+		bookingList = append(bookingList, &booking)
+	}
+	return bookingList
 }
 
 // FromJSON can be used on Booking type variables.
@@ -45,32 +74,158 @@ func (b *BookingsList) ToJSON(w io.Writer) error {
 	return enc.Encode(b)
 }
 
-// AddBooking takes in a Booking struct, and is used to add the passed struct to the temporary bookingList (this will be deprecated once connected to a database).
-// The function calls a secondary helper function, GetNextBookingId, see below for details.
-func AddBooking(b *Booking) {
-	b.ID = GetNextBookingID()
-	BookingList = append(BookingList, b)
+// AddBooking takes in a Booking struct and a sql DB connection, and is used to insert the passed struct into the bookings table, setting its ID.
+// The hood's row is locked while the booking is added, so it can't be retired part way through. The structured ErrHoodRetired is returned if it is no longer in service,
+// and ErrBookingClash if another booking of the hood overlaps it, which the bookings_no_overlap constraint enforces even when two requests race.
+func AddBooking(b *Booking, db *sql.DB) error {
+	return insertBooking(db, b)
+}
+
+// insertBooking adds the booking through q, which may be a transaction, and sets its ID.
+func insertBooking(q queryer, b *Booking) error {
+	// the ID comes from the table's sequence, so two bookings added at once can't be given the same one
+	err := q.QueryRow(`INSERT INTO bookings (username, hoodnumber, booking_date, end_date, grant_code, booked_by)
+		SELECT $1, $2, $3, $4, $5, $6 WHERE `+hoodInService("$2")+` RETURNING id;`,
+		b.UserName, b.HoodNumber, b.BookingDate, b.EndDate, b.GrantCode, b.BookedBy).Scan(&b.ID)
+	if isBookingOverlap(err) {
+		return ErrBookingClash
+	}
+	if err == sql.ErrNoRows {
+		return ErrHoodRetired
+	}
+	return err
+}
+
+// hoodInService takes the query parameter holding a hood number, and returns a condition that the hood is in service.
+// The condition locks the hood's row, so RetireHood waits for the statement's transaction to end, and the statement sees the hood as retired if RetireHood got there first.
+func hoodInService(param string) string {
+	return "EXISTS (SELECT 1 FROM hoods WHERE hood_number = " + param + " AND retired_at IS NULL FOR SHARE)"
+}
+
+// isBookingOverlap reports whether err is a violation of the bookings_no_overlap exclusion constraint.
+func isBookingOverlap(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23P01" && pqErr.Constraint == "bookings_no_overlap"
+}
+
+// FindClashingBooking takes a Booking struct and a sql DB connection and returns the first stored booking that overlaps it, or nil if there is none.
+// A booking clashes if it has not been cancelled, is for the same user or the same hood, and its time range overlaps the time range of the passed booking.
+// The booking with the same ID as the passed booking is ignored, so this can also be used when a booking is being moved.
+func FindClashingBooking(b *Booking, db *sql.DB) (*Booking, error) {
+	var clash Booking
+	err := db.QueryRow("SELECT id, username, hoodnumber, booking_date, end_date FROM bookings WHERE cancelled_at IS NULL AND (username = $1 OR hoodnumber = $2) AND booking_date < $4 AND end_date > $3 AND id <> $5 LIMIT 1;",
+		b.UserName, b.HoodNumber, b.BookingDate, b.EndDate, b.ID).Scan(&clash.ID, &clash.UserName, &clash.HoodNumber, &clash.BookingDate, &clash.EndDate)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &clash, nil
 }
 
-// GetNextBookingID is used to find the next numerical ID number and returns an integer of that value.
-// Using the length of the bookingList, it finds the ID of the last added booking and returns that value plus 1.
-func GetNextBookingID() int {
-	lastBooking := BookingList[len(BookingList)-1]
-	return lastBooking.ID + 1
+// GetBooking takes a booking ID and a sql DB connection and returns the matching Booking struct object, including cancelled bookings.
+// If no booking has that ID, the structured ErrBookingNotFound is returned.
+func GetBooking(id int, db *sql.DB) (*Booking, error) {
+	var booking Booking
+	err := db.QueryRow("SELECT id, username, hoodnumber, booking_date, end_date, grant_code, booked_by, cancelled_at FROM bookings WHERE id = $1;", id).
+		Scan(&booking.ID, &booking.UserName, &booking.HoodNumber, &booking.BookingDate, &booking.EndDate, &booking.GrantCode, &booking.BookedBy, &booking.CancelledAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrBookingNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &booking, nil
 }
 
-// bookingList is a temporary list of bookings used for testing purposes, that will be deprecated once a database is incorporated into this project.
-var BookingList = BookingsList{
-	{
-		ID:          1,
-		UserName:    "dan",
-		HoodNumber:  101,
-		BookingDate: time.Date(2022, time.January, 15, 0, 0, 0, 0, time.UTC),
-	},
-	{
-		ID:          2,
-		UserName:    "warren",
-		HoodNumber:  201,
-		BookingDate: time.Date(2022, time.January, 16, 0, 0, 0, 0, time.UTC),
-	},
+// CancelBooking takes a booking ID and a sql DB connection and marks the booking as cancelled.
+// Cancelled bookings are kept in the bookings table so they can still be counted in usage statistics, but they no longer block the slot.
+func CancelBooking(id int, db *sql.DB) error {
+	res, err := db.Exec("UPDATE bookings SET cancelled_at = NOW() WHERE id = $1 AND cancelled_at IS NULL;", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrBookingNotFound
+	}
+	return nil
 }
+
+// MoveBookingToHood takes a booking ID, a hood number and a sql DB connection, and moves the booking to that hood at the same time.
+// Callers should check the booking against the new hood with CheckBookable first. The clash check is repeated by the bookings_no_overlap constraint as the booking is moved,
+// so the structured ErrBookingClash is returned if the hood has been booked since, and ErrHoodRetired if it has been retired.
+func MoveBookingToHood(id, hoodNumber int, db *sql.DB) error {
+	res, err := db.Exec("UPDATE bookings SET hoodnumber = $2 WHERE id = $1 AND cancelled_at IS NULL AND "+hoodInService("$2")+";", id, hoodNumber)
+	if isBookingOverlap(err) {
+		return ErrBookingClash
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return bookingNotMoved(hoodNumber, db)
+	}
+	return nil
+}
+
+// MoveBooking takes a Booking struct and a sql DB connection, and moves the stored booking with the same ID to the hood and times in the struct.
+// Callers should check the booking with CheckBookable first. As with MoveBookingToHood, the structured ErrBookingClash or ErrHoodRetired is returned if the hood has been booked or retired since.
+// Reminders already sent for the old start or end time are forgotten in the same transaction, so the user is reminded again for the new time.
+func MoveBooking(b *Booking, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldStart, oldEnd time.Time
+	err = tx.QueryRow("SELECT booking_date, end_date FROM bookings WHERE id = $1 AND cancelled_at IS NULL FOR UPDATE;", b.ID).Scan(&oldStart, &oldEnd)
+	if err == sql.ErrNoRows {
+		return ErrBookingNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec("UPDATE bookings SET hoodnumber = $2, booking_date = $3, end_date = $4 WHERE id = $1 AND "+hoodInService("$2")+";",
+		b.ID, b.HoodNumber, b.BookingDate, b.EndDate)
+	if isBookingOverlap(err) {
+		return ErrBookingClash
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return bookingNotMoved(b.HoodNumber, db)
+	}
+
+	// start reminders are keyed "start-{minutes}" and end nudges "end-{minutes}"
+	if !oldStart.Equal(b.BookingDate) {
+		if _, err := tx.Exec("DELETE FROM sent_reminders WHERE booking_id = $1 AND kind LIKE 'start-%';", b.ID); err != nil {
+			return err
+		}
+	}
+	if !oldEnd.Equal(b.EndDate) {
+		if _, err := tx.Exec("DELETE FROM sent_reminders WHERE booking_id = $1 AND kind LIKE 'end-%';", b.ID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// bookingNotMoved works out why a booking couldn't be moved to a hood: ErrHoodRetired if the hood is no longer in service, and otherwise ErrBookingNotFound.
+func bookingNotMoved(hoodNumber int, db *sql.DB) error {
+	hood, err := GetHoodByNumber(hoodNumber, db)
+	if err != nil {
+		return err
+	}
+	if hood.RetiredAt != nil {
+		return ErrHoodRetired
+	}
+	return ErrBookingNotFound
+}
+
+// create structured errors
+var ErrBookingNotFound = fmt.Errorf("booking not found")
+var ErrBookingClash = fmt.Errorf("booking failed as previous booking exists at this time")
@@ -0,0 +1,95 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Delegate is a grant from one user to a colleague, letting the colleague book hoods on their behalf.
+type Delegate struct {
+	UserID       int       `json:"user_id"`
+	UserName     string    `json:"user_name"`
+	DelegateID   int       `json:"delegate_id"`
+	DelegateName string    `json:"delegate_name"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Delegates is a list of Delegate objects.
+type Delegates []*Delegate
+
+// ToJSON is called on a Delegates object and takes an io.Writer, returning an error.
+func (d *Delegates) ToJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(d)
+}
+
+// delegateColumns are the columns selected for a Delegate, in the order scanDelegates expects.
+const delegateColumns = `d.user_id, u.username, d.delegate_id, c.username, d.created_at
+	FROM booking_delegates d JOIN users u ON u.id = d.user_id JOIN users c ON c.id = d.delegate_id`
+
+// scanDelegates reads every Delegate from the rows of a query selecting delegateColumns.
+func scanDelegates(rows *sql.Rows) (Delegates, error) {
+	defer rows.Close()
+
+	delegates := Delegates{}
+	for rows.Next() {
+		var d Delegate
+		if err := rows.Scan(&d.UserID, &d.UserName, &d.DelegateID, &d.DelegateName, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		delegates = append(delegates, &d)
+	}
+	return delegates, rows.Err()
+}
+
+// GetDelegates takes a user ID and a sql DB connection and returns the colleagues the user has allowed to book for them.
+func GetDelegates(userID int, db *sql.DB) (Delegates, error) {
+	rows, err := db.Query("SELECT "+delegateColumns+" WHERE d.user_id = $1 ORDER BY c.username;", userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanDelegates(rows)
+}
+
+// GetDelegatedTo takes a user ID and a sql DB connection and returns the users who have allowed the user to book for them.
+func GetDelegatedTo(delegateID int, db *sql.DB) (Delegates, error) {
+	rows, err := db.Query("SELECT "+delegateColumns+" WHERE d.delegate_id = $1 ORDER BY u.username;", delegateID)
+	if err != nil {
+		return nil, err
+	}
+	return scanDelegates(rows)
+}
+
+// AddDelegate takes a user ID, the ID of the colleague they are allowing to book for them and a sql DB connection, and stores the grant.
+// Granting the same colleague twice is not an error.
+func AddDelegate(userID, delegateID int, db *sql.DB) error {
+	_, err := db.Exec("INSERT INTO booking_delegates (user_id, delegate_id, created_at) VALUES ($1, $2, NOW()) ON CONFLICT (user_id, delegate_id) DO NOTHING;", userID, delegateID)
+	return err
+}
+
+// RemoveDelegate takes a user ID, the ID of one of their delegates and a sql DB connection, and withdraws the delegate's right to book for the user.
+// If there is no such grant, the structured ErrDelegateNotFound is returned.
+func RemoveDelegate(userID, delegateID int, db *sql.DB) error {
+	res, err := db.Exec("DELETE FROM booking_delegates WHERE user_id = $1 AND delegate_id = $2;", userID, delegateID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrDelegateNotFound
+	}
+	return nil
+}
+
+// IsDelegateFor takes a user ID, a username and a sql DB connection, and reports whether the user named has allowed the user to book for them.
+func IsDelegateFor(delegateID int, username string, db *sql.DB) (bool, error) {
+	var ok bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM booking_delegates d JOIN users u ON u.id = d.user_id
+		WHERE d.delegate_id = $1 AND u.username = $2 AND u.erased_at IS NULL);`, delegateID, username).Scan(&ok)
+	return ok, err
+}
+
+// create structured error
+var ErrDelegateNotFound = fmt.Errorf("delegate not found")
@@ -0,0 +1,154 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StreamChannel is the PostgreSQL NOTIFY channel used to tell every running instance that a new stream event has been stored.
+const StreamChannel = "hood_events"
+
+// StreamEvent is a booking or hood change that is pushed to clients of the live stream.
+// Events are stored in the stream_events table, so their Cursor can be used by clients to catch up after reconnecting.
+// TxID is the ID of the transaction that stored the event, which is used to read events in the order they were committed.
+type StreamEvent struct {
+	ID         int64           `json:"id"`
+	TxID       int64           `json:"-"`
+	Event      string          `json:"event"`
+	HoodNumber int             `json:"hood_number"`
+	Room       string          `json:"room"`
+	Data       json.RawMessage `json:"data"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+// PublishEvent takes an event, the data describing it and a sql DB connection, and publishes the event everywhere it is needed.
+// It is added to the webhook outbox, and if it concerns a hood, booking or maintenance window it is also added to the live stream.
+func PublishEvent(event string, v interface{}, db *sql.DB) error {
+	if err := PublishWebhookEvent(event, v, db); err != nil {
+		return err
+	}
+
+	switch x := v.(type) {
+	case *Booking:
+		return PublishStreamEvent(event, x.HoodNumber, v, db)
+	case *Hood:
+		return PublishStreamEvent(event, x.Hood_Number, v, db)
+	case *MaintenanceWindow:
+		return PublishStreamEvent(event, x.HoodNumber, v, db)
+	}
+	return nil
+}
+
+// PublishStreamEvent takes an event, the hood it concerns, the data describing it and a sql DB connection.
+// The event is stored in the stream_events table along with the hood's room, and every instance is notified so it can push the event to its clients.
+func PublishStreamEvent(event string, hoodNumber int, v interface{}, db *sql.DB) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var id int64
+	err = db.QueryRow(`INSERT INTO stream_events (event, hood_number, room, data, created_at, txid)
+		VALUES ($1, $2, COALESCE((SELECT room FROM hoods WHERE hood_number = $2 LIMIT 1), ''), $3, NOW(), txid_current()) RETURNING id;`,
+		event, hoodNumber, payload).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("SELECT pg_notify($1, $2);", StreamChannel, id)
+	return err
+}
+
+// StreamCursor is a position in the live stream: the transaction ID and event ID of the last event a client has been sent.
+// Event IDs are taken when an event is stored, so two events can commit in the opposite order to their IDs, and a reader that only remembered the highest ID would skip the one that committed last.
+// Events are instead read in transaction order, and only once every transaction that started before them has finished, so an event can never become visible behind the cursor.
+type StreamCursor struct {
+	TxID int64
+	ID   int64
+}
+
+// Cursor returns the position of the event in the stream.
+func (e *StreamEvent) Cursor() StreamCursor {
+	return StreamCursor{e.TxID, e.ID}
+}
+
+// Before reports whether the cursor is earlier in the stream than other.
+func (c StreamCursor) Before(other StreamCursor) bool {
+	return c.TxID < other.TxID || (c.TxID == other.TxID && c.ID < other.ID)
+}
+
+// String returns the cursor in the form sent to clients as the SSE event ID.
+func (c StreamCursor) String() string {
+	return fmt.Sprintf("%d-%d", c.TxID, c.ID)
+}
+
+// ParseStreamCursor takes a cursor sent back by a client and a sql DB connection, and returns the StreamCursor it represents.
+// A plain event ID, as sent by earlier versions of the stream, is also accepted and is looked up to find its transaction.
+func ParseStreamCursor(v string, db *sql.DB) (StreamCursor, error) {
+	tx, id, found := strings.Cut(v, "-")
+	if !found {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return StreamCursor{}, ErrInvalidStreamCursor
+		}
+		if id <= 0 {
+			return StreamCursor{}, nil
+		}
+		var c StreamCursor
+		err = db.QueryRow("SELECT txid, id FROM stream_events WHERE id = $1;", id).Scan(&c.TxID, &c.ID)
+		if err == sql.ErrNoRows {
+			return StreamCursor{}, ErrInvalidStreamCursor
+		}
+		return c, err
+	}
+
+	txID, err := strconv.ParseInt(tx, 10, 64)
+	if err != nil {
+		return StreamCursor{}, ErrInvalidStreamCursor
+	}
+	eventID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return StreamCursor{}, ErrInvalidStreamCursor
+	}
+	return StreamCursor{txID, eventID}, nil
+}
+
+// GetStreamEventsAfter takes a cursor, a limit and a sql DB connection, and returns up to limit events stored after the cursor, in commit order.
+// Events from transactions that might still be followed by an earlier transaction committing are held back until that transaction has finished.
+func GetStreamEventsAfter(after StreamCursor, limit int, db *sql.DB) ([]*StreamEvent, error) {
+	rows, err := db.Query(`SELECT id, txid, event, hood_number, room, data, created_at FROM stream_events
+		WHERE (txid, id) > ($1, $2) AND txid < txid_snapshot_xmin(txid_current_snapshot())
+		ORDER BY txid, id LIMIT $3;`, after.TxID, after.ID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*StreamEvent
+	for rows.Next() {
+		var e StreamEvent
+		if err := rows.Scan(&e.ID, &e.TxID, &e.Event, &e.HoodNumber, &e.Room, &e.Data, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, &e)
+	}
+	return events, rows.Err()
+}
+
+// GetLatestStreamCursor returns the cursor of the newest stream event that can be read, or the zero cursor if there are none.
+func GetLatestStreamCursor(db *sql.DB) (StreamCursor, error) {
+	var c StreamCursor
+	err := db.QueryRow(`SELECT txid, id FROM stream_events WHERE txid < txid_snapshot_xmin(txid_current_snapshot())
+		ORDER BY txid DESC, id DESC LIMIT 1;`).Scan(&c.TxID, &c.ID)
+	if err == sql.ErrNoRows {
+		return StreamCursor{}, nil
+	}
+	return c, err
+}
+
+// create structured error
+var ErrInvalidStreamCursor = fmt.Errorf("invalid stream event ID")
@@ -0,0 +1,101 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// LocalProvider is the auth_provider of users who registered with a password through /register.
+const LocalProvider = "local"
+
+// ExternalIdentity is a user as described by an external identity provider, such as the institute's LDAP directory or OpenID Connect provider.
+// Subject is the provider's stable identifier for the user, and is used to find the user again on later logins.
+// LegacySubject is the identifier an older version of the provider stored for the user, if any, so their account can be moved over to Subject on their next login.
+type ExternalIdentity struct {
+	Provider      string
+	Subject       string
+	LegacySubject string
+	Name          string
+	Email         string
+	ResearchGroup string
+}
+
+// ProvisionExternalUser takes an ExternalIdentity and a sql DB connection and returns the ID of the matching user, creating the user on their first login.
+// On later logins the user's email address and research group are refreshed from the directory, as long as the directory supplies them.
+// Research groups the directory names that don't exist yet are created.
+// A user provisioned this way has no password, so they can't log in locally or request a password reset.
+// If the username already belongs to a different account, the structured ErrUsernameTaken is returned rather than linking the two.
+func ProvisionExternalUser(id *ExternalIdentity, db *sql.DB) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// serialise provisioning so two first logins can't create the same user twice
+	if _, err := tx.Exec("LOCK TABLE users IN SHARE ROW EXCLUSIVE MODE;"); err != nil {
+		return 0, err
+	}
+
+	// use the existing spelling of the directory's group, or add it if it is new
+	group, err := ensureResearchGroup(tx, id.ResearchGroup)
+	if err != nil {
+		return 0, err
+	}
+
+	var userID int
+	err = tx.QueryRow("SELECT id FROM users WHERE auth_provider = $1 AND external_id = $2;", id.Provider, id.Subject).Scan(&userID)
+	if err == sql.ErrNoRows && id.LegacySubject != "" {
+		// relink an account stored under the provider's old identifier to its stable one
+		err = tx.QueryRow("UPDATE users SET external_id = $3 WHERE auth_provider = $1 AND external_id = $2 RETURNING id;", id.Provider, id.LegacySubject, id.Subject).Scan(&userID)
+	}
+	if err == nil {
+		_, err = tx.Exec(`UPDATE users SET email = COALESCE(NULLIF($1, ''), email), research_group = COALESCE(NULLIF($2, ''), research_group) WHERE id = $3;`,
+			id.Email, group, userID)
+		if err != nil {
+			return 0, err
+		}
+		if group != "" {
+			if err := recordMembership(tx, userID, group); err != nil {
+				return 0, err
+			}
+		}
+		return userID, tx.Commit()
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	var taken bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE LOWER(username) = LOWER(TRIM($1)));", id.Name).Scan(&taken); err != nil {
+		return 0, err
+	}
+	if taken || IsReservedUsername(id.Name) {
+		return 0, ErrUsernameTaken
+	}
+
+	// the directory vouches for the email address, so it doesn't need verifying
+	err = tx.QueryRow(`INSERT INTO users (username, passhash, email, emergency_telephone, research_group, auth_provider, external_id, email_verified_at)
+		VALUES ($1, '', $2, 0, $3, $4, $5, NOW()) RETURNING id;`,
+		id.Name, id.Email, group, id.Provider, id.Subject).Scan(&userID)
+	if err != nil {
+		return 0, err
+	}
+	if err := recordMembership(tx, userID, group); err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
+
+// GetAuthProvider takes a user ID and a sql DB connection and returns the provider the user logs in with, e.g. "local" or "ldap".
+func GetAuthProvider(id int, db *sql.DB) (string, error) {
+	var provider string
+	err := db.QueryRow("SELECT auth_provider FROM users WHERE id = $1;", id).Scan(&provider)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	return provider, err
+}
+
+// create structured error
+var ErrUsernameTaken = fmt.Errorf("username already belongs to another account")
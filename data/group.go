@@ -0,0 +1,330 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// ResearchGroup is a research group users belong to, such as "Smith Lab".
+// LeaderID is the group leader or PI, who can see and manage the bookings of the group's members.
+type ResearchGroup struct {
+	ID         int       `json:"id"`
+	Name       string    `json:"name"`
+	LeaderID   *int      `json:"leader_id"`
+	LeaderName string    `json:"leader_name,omitempty"`
+	Members    int       `json:"members"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ResearchGroupsList is a type defined to characterise an array of the ResearchGroup struct type variables.
+type ResearchGroupsList []*ResearchGroup
+
+// GroupMembership is one entry in a research group's membership history.
+// LeftAt is nil while the user is still a member.
+type GroupMembership struct {
+	UserID    int        `json:"user_id"`
+	UserName  string     `json:"user_name"`
+	GroupName string     `json:"group_name"`
+	JoinedAt  time.Time  `json:"joined_at"`
+	LeftAt    *time.Time `json:"left_at"`
+}
+
+// FromJSON can be used on ResearchGroup type variables.
+// It takes in an io.Reader parameter and decodes the data stored in it into the group.
+func (g *ResearchGroup) FromJSON(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	return dec.Decode(g)
+}
+
+// ToJSON can be used on ResearchGroupsList type variables.
+// It takes in an io.Writer parameter and encodes the groups to the io.Writer.
+func (gl *ResearchGroupsList) ToJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(gl)
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx, so helpers can run inside or outside a transaction.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// GroupKey takes a research group name and returns the key used to tell whether two names are the same group.
+// Case, spaces and punctuation are ignored, so "Smith Lab", "smith lab" and "Smith-lab" all have the key "smithlab".
+func GroupKey(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+}
+
+// groupColumns are the columns selected for a ResearchGroup, in the order scanGroup expects.
+const groupColumns = `g.id, g.name, g.leader_id, COALESCE(l.username, ''), g.created_at,
+	(SELECT COUNT(*) FROM users u WHERE u.research_group = g.name AND u.erased_at IS NULL)
+	FROM research_groups g LEFT JOIN users l ON l.id = g.leader_id`
+
+// scanGroup scans a row selected with groupColumns into a ResearchGroup.
+func scanGroup(row interface{ Scan(...interface{}) error }) (*ResearchGroup, error) {
+	var g ResearchGroup
+	if err := row.Scan(&g.ID, &g.Name, &g.LeaderID, &g.LeaderName, &g.CreatedAt, &g.Members); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// GetResearchGroups takes a sql DB connection and returns every research group, in name order.
+func GetResearchGroups(db *sql.DB) (ResearchGroupsList, error) {
+	rows, err := db.Query("SELECT " + groupColumns + " ORDER BY g.name;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := ResearchGroupsList{}
+	for rows.Next() {
+		g, err := scanGroup(rows)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+// GetResearchGroup takes a group ID and a sql DB connection and returns the group.
+// If there is no group with the ID, the structured ErrGroupNotFound is returned.
+func GetResearchGroup(id int, db *sql.DB) (*ResearchGroup, error) {
+	g, err := scanGroup(db.QueryRow("SELECT "+groupColumns+" WHERE g.id = $1;", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrGroupNotFound
+	}
+	return g, err
+}
+
+// FindResearchGroup takes a group name as a user typed it and a sql DB connection, and returns the group it refers to.
+// Names are matched by GroupKey, so the group's own spelling can be used in place of the user's.
+// If no group matches, the structured ErrGroupNotFound is returned.
+func FindResearchGroup(name string, db *sql.DB) (*ResearchGroup, error) {
+	g, err := scanGroup(db.QueryRow("SELECT "+groupColumns+" WHERE g.name_key = $1;", GroupKey(name)))
+	if err == sql.ErrNoRows {
+		return nil, ErrGroupNotFound
+	}
+	return g, err
+}
+
+// AddResearchGroup takes a ResearchGroup and a sql DB connection and adds the group, setting its ID and creation time.
+// If a group with the same key already exists, the structured ErrGroupExists is returned.
+func AddResearchGroup(g *ResearchGroup, db *sql.DB) error {
+	err := db.QueryRow("INSERT INTO research_groups (name, name_key, leader_id, created_at) VALUES ($1, $2, $3, NOW()) RETURNING id, created_at;",
+		g.Name, GroupKey(g.Name), g.LeaderID).Scan(&g.ID, &g.CreatedAt)
+	if isUniqueViolation(err) {
+		return ErrGroupExists
+	}
+	return err
+}
+
+// UpdateResearchGroup takes a ResearchGroup and a sql DB connection and updates the group's name and leader.
+// Renaming a group renames it for every member and pending invitation too. Recharge reports that have already been locked keep the old name.
+// If another group already has the new name's key, the structured ErrGroupExists is returned.
+func UpdateResearchGroup(g *ResearchGroup, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldName string
+	err = tx.QueryRow("SELECT name FROM research_groups WHERE id = $1 FOR UPDATE;", g.ID).Scan(&oldName)
+	if err == sql.ErrNoRows {
+		return ErrGroupNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE research_groups SET name = $2, name_key = $3, leader_id = $4 WHERE id = $1;", g.ID, g.Name, GroupKey(g.Name), g.LeaderID)
+	if isUniqueViolation(err) {
+		return ErrGroupExists
+	}
+	if err != nil {
+		return err
+	}
+	if oldName != g.Name {
+		if _, err := tx.Exec("UPDATE users SET research_group = $2 WHERE research_group = $1;", oldName, g.Name); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE invitations SET research_group = $2 WHERE research_group = $1 AND used_at IS NULL;", oldName, g.Name); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteResearchGroup takes a group ID and a sql DB connection and deletes the group along with any requests to join it, for example a group added by mistake.
+// Groups that still have members can't be deleted, and the structured ErrGroupHasMembers is returned.
+// Groups that anyone has ever belonged to, including users who have since been erased, can't be deleted either, as recharge reports use the membership history to charge bookings to the group held at the time, so ErrGroupHasHistory is returned.
+func DeleteResearchGroup(id int, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var members int
+	var history bool
+	err = tx.QueryRow(`SELECT (SELECT COUNT(*) FROM users u WHERE u.research_group = g.name AND u.erased_at IS NULL),
+		EXISTS (SELECT 1 FROM research_group_memberships m WHERE m.group_id = g.id)
+		OR EXISTS (SELECT 1 FROM users u WHERE u.research_group = g.name)
+		FROM research_groups g WHERE g.id = $1 FOR UPDATE;`, id).Scan(&members, &history)
+	if err == sql.ErrNoRows {
+		return ErrGroupNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if members > 0 {
+		return ErrGroupHasMembers
+	}
+	if history {
+		return ErrGroupHasHistory
+	}
+
+	if _, err := tx.Exec("DELETE FROM group_move_requests WHERE group_id = $1;", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM research_groups WHERE id = $1;", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetGroupMembers takes a group ID and a sql DB connection and returns the group's current members, in name order.
+func GetGroupMembers(id int, db *sql.DB) (UsersList, error) {
+	rows, err := db.Query(`SELECT u.id, u.username, u.email, u.emergency_telephone, u.research_group
+		FROM users u JOIN research_groups g ON g.name = u.research_group
+		WHERE g.id = $1 AND u.erased_at IS NULL ORDER BY u.username;`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := UsersList{}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.Emergency_Telephone, &u.Research_Group); err != nil {
+			return nil, err
+		}
+		users = append(users, &u)
+	}
+	return users, rows.Err()
+}
+
+// GetMembershipHistory takes a group ID and a sql DB connection and returns everyone who has joined or left the group, most recent first.
+func GetMembershipHistory(id int, db *sql.DB) ([]*GroupMembership, error) {
+	return getMemberships("m.group_id = $1", id, db)
+}
+
+// GetUserMemberships takes a user ID and a sql DB connection and returns every research group the user has belonged to, most recent first.
+func GetUserMemberships(userID int, db *sql.DB) ([]*GroupMembership, error) {
+	return getMemberships("m.user_id = $1", userID, db)
+}
+
+// getMemberships returns the membership history entries matching a condition on the memberships table, most recent first.
+func getMemberships(where string, arg int, db *sql.DB) ([]*GroupMembership, error) {
+	rows, err := db.Query(`SELECT m.user_id, u.username, g.name, m.joined_at, m.left_at
+		FROM research_group_memberships m JOIN users u ON u.id = m.user_id JOIN research_groups g ON g.id = m.group_id
+		WHERE `+where+` ORDER BY m.joined_at DESC, m.id DESC;`, arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []*GroupMembership{}
+	for rows.Next() {
+		var m GroupMembership
+		if err := rows.Scan(&m.UserID, &m.UserName, &m.GroupName, &m.JoinedAt, &m.LeftAt); err != nil {
+			return nil, err
+		}
+		history = append(history, &m)
+	}
+	return history, rows.Err()
+}
+
+// GetGroupBookings takes a group ID and a sql DB connection and returns every booking of the group's current members that has not been cancelled.
+func GetGroupBookings(id int, db *sql.DB) (BookingsList, error) {
+	rows, err := db.Query(`SELECT b.id, b.username, b.hoodnumber, b.booking_date, b.end_date, b.grant_code, b.booked_by
+		FROM bookings b JOIN users u ON u.username = b.username JOIN research_groups g ON g.name = u.research_group
+		WHERE g.id = $1 AND b.cancelled_at IS NULL ORDER BY b.booking_date;`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bookings := BookingsList{}
+	for rows.Next() {
+		var b Booking
+		if err := rows.Scan(&b.ID, &b.UserName, &b.HoodNumber, &b.BookingDate, &b.EndDate, &b.GrantCode, &b.BookedBy); err != nil {
+			return nil, err
+		}
+		bookings = append(bookings, &b)
+	}
+	return bookings, rows.Err()
+}
+
+// LeadsGroupOf takes a user ID, a username and a sql DB connection, and reports whether the user leads the research group the username belongs to.
+func LeadsGroupOf(leaderID int, username string, db *sql.DB) (bool, error) {
+	var leads bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM research_groups g JOIN users u ON u.research_group = g.name
+		WHERE g.leader_id = $1 AND u.username = $2);`, leaderID, username).Scan(&leads)
+	return leads, err
+}
+
+// recordMembership takes a user ID and the name of the research group they now belong to, and updates the membership history.
+// Any membership of a different group is ended, and a new one is started unless the user is already a member. It does nothing if the user's group hasn't changed.
+func recordMembership(ex execer, userID int, groupName string) error {
+	_, err := ex.Exec(`UPDATE research_group_memberships SET left_at = NOW()
+		WHERE user_id = $1 AND left_at IS NULL AND group_id IS DISTINCT FROM (SELECT id FROM research_groups WHERE name = $2);`, userID, groupName)
+	if err != nil {
+		return err
+	}
+	_, err = ex.Exec(`INSERT INTO research_group_memberships (user_id, group_id, joined_at)
+		SELECT $1, g.id, NOW() FROM research_groups g WHERE g.name = $2
+		AND NOT EXISTS (SELECT 1 FROM research_group_memberships m WHERE m.user_id = $1 AND m.group_id = g.id AND m.left_at IS NULL);`, userID, groupName)
+	return err
+}
+
+// ensureResearchGroup takes a transaction and a group name supplied by an identity provider, and returns the name of the matching group, creating it if there isn't one.
+// An empty name is returned unchanged.
+func ensureResearchGroup(tx *sql.Tx, name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", nil
+	}
+	_, err := tx.Exec("INSERT INTO research_groups (name, name_key, created_at) VALUES ($1, $2, NOW()) ON CONFLICT (name_key) DO NOTHING;", name, GroupKey(name))
+	if err != nil {
+		return "", err
+	}
+	var canonical string
+	err = tx.QueryRow("SELECT name FROM research_groups WHERE name_key = $1;", GroupKey(name)).Scan(&canonical)
+	return canonical, err
+}
+
+// isUniqueViolation reports whether err is a PostgreSQL unique constraint violation.
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+// create structured errors
+var ErrGroupNotFound = fmt.Errorf("research group not found")
+var ErrGroupExists = fmt.Errorf("a research group with that name already exists")
+var ErrGroupHasMembers = fmt.Errorf("research group still has members, move them to another group first")
+var ErrGroupHasHistory = fmt.Errorf("research group has had members, so it is kept for recharge reports")
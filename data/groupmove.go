@@ -0,0 +1,121 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// GroupMoveRequest is a user's request to move into a research group, which the group's leader or a lab manager decides.
+// Approved is nil until the request has been decided.
+type GroupMoveRequest struct {
+	ID          int        `json:"id"`
+	UserID      int        `json:"user_id"`
+	UserName    string     `json:"user_name"`
+	GroupID     int        `json:"group_id"`
+	GroupName   string     `json:"group_name"`
+	RequestedAt time.Time  `json:"requested_at"`
+	DecidedAt   *time.Time `json:"decided_at"`
+	Approved    *bool      `json:"approved"`
+}
+
+// RequestGroupMove takes a user ID, the ID of the group they want to join and a sql DB connection, and records the request for the group's leader to decide.
+// A user only has one request waiting at a time, so a request the user made earlier that hasn't been decided is withdrawn.
+func RequestGroupMove(userID, groupID int, db *sql.DB) (*GroupMoveRequest, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM group_move_requests WHERE user_id = $1 AND decided_at IS NULL;", userID); err != nil {
+		return nil, err
+	}
+	req := &GroupMoveRequest{UserID: userID, GroupID: groupID}
+	err = tx.QueryRow("INSERT INTO group_move_requests (user_id, group_id, requested_at) VALUES ($1, $2, NOW()) RETURNING id, requested_at;",
+		userID, groupID).Scan(&req.ID, &req.RequestedAt)
+	if err != nil {
+		return nil, err
+	}
+	return req, tx.Commit()
+}
+
+// groupMoveColumns are the columns selected for a GroupMoveRequest, in the order scanGroupMove expects.
+const groupMoveColumns = `r.id, r.user_id, u.username, r.group_id, g.name, r.requested_at, r.decided_at, r.approved
+	FROM group_move_requests r JOIN users u ON u.id = r.user_id JOIN research_groups g ON g.id = r.group_id`
+
+// scanGroupMove scans a row selected with groupMoveColumns into a GroupMoveRequest.
+func scanGroupMove(row interface{ Scan(...interface{}) error }) (*GroupMoveRequest, error) {
+	var req GroupMoveRequest
+	if err := row.Scan(&req.ID, &req.UserID, &req.UserName, &req.GroupID, &req.GroupName, &req.RequestedAt, &req.DecidedAt, &req.Approved); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// GetGroupMoveRequest takes a request ID and a sql DB connection and returns the request.
+// If there is no request with the ID, the structured ErrMoveRequestNotFound is returned.
+func GetGroupMoveRequest(id int, db *sql.DB) (*GroupMoveRequest, error) {
+	req, err := scanGroupMove(db.QueryRow("SELECT "+groupMoveColumns+" WHERE r.id = $1;", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrMoveRequestNotFound
+	}
+	return req, err
+}
+
+// GetPendingGroupMoves takes a group ID and a sql DB connection and returns the requests to join the group that haven't been decided, oldest first.
+func GetPendingGroupMoves(groupID int, db *sql.DB) ([]*GroupMoveRequest, error) {
+	rows, err := db.Query("SELECT "+groupMoveColumns+" WHERE r.group_id = $1 AND r.decided_at IS NULL ORDER BY r.requested_at, r.id;", groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := []*GroupMoveRequest{}
+	for rows.Next() {
+		req, err := scanGroupMove(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, req)
+	}
+	return requests, rows.Err()
+}
+
+// DecideGroupMove takes a request ID, whether it is approved, the ID of the user deciding it and a sql DB connection.
+// An approved request moves the user into the group and updates their membership history, in the same transaction as the decision is recorded.
+// If the request doesn't exist or has already been decided, the structured ErrMoveRequestNotFound is returned.
+func DecideGroupMove(id int, approved bool, deciderID int, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var groupName string
+	err = tx.QueryRow(`SELECT r.user_id, g.name FROM group_move_requests r JOIN research_groups g ON g.id = r.group_id
+		WHERE r.id = $1 AND r.decided_at IS NULL FOR UPDATE OF r;`, id).Scan(&userID, &groupName)
+	if err == sql.ErrNoRows {
+		return ErrMoveRequestNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if approved {
+		if _, err := tx.Exec("UPDATE users SET research_group = $2 WHERE id = $1 AND erased_at IS NULL;", userID, groupName); err != nil {
+			return err
+		}
+		if err := recordMembership(tx, userID, groupName); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE group_move_requests SET decided_at = NOW(), decided_by = $2, approved = $3 WHERE id = $1;", id, deciderID, approved); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// create structured error
+var ErrMoveRequestNotFound = fmt.Errorf("group move request not found or already decided")
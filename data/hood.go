@@ -5,41 +5,41 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"time"
 
 	"bookings.com/m/database"
 )
 
-// Hoods is a type defined to characterise an array of the User struct type variables.
-// This is mainly used for defining the temporary hoodlist, and also in GET/PUT requests of the current registered hoods.
+// HoodsList is a type defined to characterise an array of the Hood struct type variables.
+// This is mainly used in GET requests of the current registered hoods.
 type HoodsList []*Hood
 
 // Hood struct created with necessary information to identify each hood.
+// RetiredAt is set once a hood is taken out of service. Retired hoods are kept so their past bookings still count towards statistics and recharge reports, but they can't be booked.
 type Hood struct {
-	ID          int    `json:"id"`
-	Hood_Number int    `json:"hood_number"`
-	Room        string `json:"room"`
+	ID          int        `json:"id"`
+	Hood_Number int        `json:"hood_number"`
+	Room        string     `json:"room"`
+	RetiredAt   *time.Time `json:"retired_at,omitempty"`
 }
 
-var HoodList HoodsList
-
-// GetHoods returns the hoodlist above.
-// This hoodList is to be used as a test for HTTP requests while the database is not linked.
-func GetHoods(db *sql.DB) HoodsList {
-
-	rows, err := db.Query("SELECT id, hood_number, room FROM hoods;")
+// GetHoods takes whether to include retired hoods and a sql DB connection, and returns the hoods in hood number order.
+func GetHoods(includeRetired bool, db *sql.DB) (HoodsList, error) {
+	rows, err := db.Query("SELECT id, hood_number, room, retired_at FROM hoods WHERE $1 OR retired_at IS NULL ORDER BY hood_number;", includeRetired)
 	if err != nil {
-		return nil
+		return nil, err
 	}
+	defer rows.Close()
 
+	hoodList := HoodsList{}
 	for rows.Next() {
 		var hood Hood
-		err := rows.Scan(&hood.ID, &hood.Hood_Number, &hood.Room)
-		if err != nil {
-			return nil
+		if err := rows.Scan(&hood.ID, &hood.Hood_Number, &hood.Room, &hood.RetiredAt); err != nil {
+			return nil, err
 		}
-		HoodList = append(HoodList, &hood)
+		hoodList = append(hoodList, &hood)
 	}
-	return HoodList
+	return hoodList, rows.Err()
 }
 
 // FromJSON can be used on Hood struct objects.
@@ -58,20 +58,21 @@ func (h *HoodsList) ToJSON(w io.Writer) error {
 	return enc.Encode(h)
 }
 
-// AddHood takes a Hood struct object as a parameter.
-// This function is used to collect the next available hood ID and assign this to the passed Hood object, before appending this hood object to the hoodList.
+// AddHood takes a Hood struct object and a sql DB connection as parameters.
+// This function is used to collect the next available hood ID and assign this to the passed Hood object, before adding the hood to the hoods table.
+// If another hood already has the same number, the structured ErrHoodExists is returned.
 func AddHood(h *Hood, db *sql.DB) error {
 	h.ID = GetNextHoodID(db)
 	if h.ID == -1 {
 		return database.ErrDBQueryError
 	}
 
-	// Add user object to database.
+	// Add hood object to database.
 	_, err := db.Exec("INSERT INTO hoods (id, hood_number, room) VALUES ($1, $2, $3)", h.ID, h.Hood_Number, h.Room)
-	if err != nil {
-		return err
+	if isUniqueViolation(err) {
+		return ErrHoodExists
 	}
-	return nil
+	return err
 }
 
 // GetNextHoodID returns the next available ID as an integer.
@@ -99,25 +100,180 @@ func GetNextHoodID(db *sql.DB) int {
 	return maxID + 1
 }
 
-// func UpdateHood(id int, h *Hood) error {
-// 	_, pos, err := findUser(id)
-// 	if err != nil {
-// 		return err
-// 	}
+// GetHoodByNumber takes a hood number and a sql DB connection and returns the matching Hood struct object and an error.
+// Retired hoods are returned too, so callers that book hoods must check RetiredAt.
+// If no hood has that number, the structured ErrHoodNotFound is returned.
+func GetHoodByNumber(hoodNumber int, db *sql.DB) (*Hood, error) {
+	return getHood("hood_number", hoodNumber, db)
+}
 
-// 	h.ID = id
-// 	hoodList[pos] = h
-// 	return err
-// }
+// GetHood takes a hood ID and a sql DB connection and returns the matching Hood struct object and an error, including retired hoods.
+// If no hood has that ID, the structured ErrHoodNotFound is returned.
+func GetHood(id int, db *sql.DB) (*Hood, error) {
+	return getHood("id", id, db)
+}
 
-// create structured error
-var ErrHoodNotFound = fmt.Errorf("Hood Not Found")
+// getHood runs the query shared by GetHood and GetHoodByNumber against the given column.
+// column is only ever one of the two constants passed by those functions.
+func getHood(column string, value int, db *sql.DB) (*Hood, error) {
+	var hood Hood
+	err := db.QueryRow("SELECT id, hood_number, room, retired_at FROM hoods WHERE "+column+" = $1;", value).Scan(&hood.ID, &hood.Hood_Number, &hood.Room, &hood.RetiredAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrHoodNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &hood, nil
+}
+
+// UpdateHood takes a Hood struct object, with the ID of the hood to update, and a sql DB connection, and stores its number and room.
+// If the hood number changes, its bookings, lottery requests and hood rates are moved to the new number in the same transaction, so they stay with the hood.
+// If the hood doesn't exist the structured ErrHoodNotFound is returned, and if another hood already has the number, ErrHoodExists.
+func UpdateHood(h *Hood, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var oldNumber int
+	err = tx.QueryRow("SELECT hood_number FROM hoods WHERE id = $1 FOR UPDATE;", h.ID).Scan(&oldNumber)
+	if err == sql.ErrNoRows {
+		return ErrHoodNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE hoods SET hood_number = $2, room = $3 WHERE id = $1;", h.ID, h.Hood_Number, h.Room)
+	if isUniqueViolation(err) {
+		return ErrHoodExists
+	}
+	if err != nil {
+		return err
+	}
+
+	if oldNumber != h.Hood_Number {
+		for _, query := range []string{
+			"UPDATE bookings SET hoodnumber = $2 WHERE hoodnumber = $1;",
+			"UPDATE booking_requests SET hoodnumber = $2 WHERE hoodnumber = $1;",
+			"UPDATE hood_rates SET hood_number = $2 WHERE hood_number = $1;",
+			"UPDATE maintenance_windows SET hood_number = $2 WHERE hood_number = $1;",
+		} {
+			if _, err := tx.Exec(query, oldNumber, h.Hood_Number); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// RetireHood takes a hood ID, whether to refuse if the hood has future bookings, and a sql DB connection, and takes the hood out of service, so it can no longer be booked.
+// The hood's row is locked while its future bookings are counted and it is retired, and bookings are only added or moved to a hood while its row is locked in service,
+// so no booking can be made between the check and the retirement.
+// Existing bookings are left alone, see GetFutureHoodBookings for the ones that still need handling.
+// A hood that is already retired but still has future bookings, because handling them failed part way, can be retired again so they are handled; it keeps its original retirement time.
+// If the hood doesn't exist the structured ErrHoodNotFound is returned, if it is already retired with nothing left to handle ErrHoodRetired, and if refuseBooked is set and it has bookings that start later, ErrHoodHasFutureBookings.
+func RetireHood(id int, refuseBooked bool, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var number int
+	var retiredAt *time.Time
+	err = tx.QueryRow("SELECT hood_number, retired_at FROM hoods WHERE id = $1 FOR UPDATE;", id).Scan(&number, &retiredAt)
+	if err == sql.ErrNoRows {
+		return ErrHoodNotFound
+	}
+	if err != nil {
+		return err
+	}
+	var booked bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM bookings WHERE hoodnumber = $1 AND cancelled_at IS NULL AND booking_date > NOW());", number).Scan(&booked); err != nil {
+		return err
+	}
+	if retiredAt != nil {
+		if !booked || refuseBooked {
+			return ErrHoodRetired
+		}
+		return nil
+	}
+	if booked && refuseBooked {
+		return ErrHoodHasFutureBookings
+	}
+
+	if _, err := tx.Exec("UPDATE hoods SET retired_at = NOW() WHERE id = $1;", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetFutureHoodBookings takes a hood number, a time and a sql DB connection, and returns every booking of the hood that has not been cancelled and starts after that time.
+func GetFutureHoodBookings(hoodNumber int, after time.Time, db *sql.DB) (BookingsList, error) {
+	rows, err := db.Query("SELECT id, username, hoodnumber, booking_date, end_date, grant_code, booked_by FROM bookings WHERE hoodnumber = $1 AND cancelled_at IS NULL AND booking_date > $2 ORDER BY booking_date;", hoodNumber, after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bookings := BookingsList{}
+	for rows.Next() {
+		var b Booking
+		if err := rows.Scan(&b.ID, &b.UserName, &b.HoodNumber, &b.BookingDate, &b.EndDate, &b.GrantCode, &b.BookedBy); err != nil {
+			return nil, err
+		}
+		bookings = append(bookings, &b)
+	}
+	return bookings, rows.Err()
+}
 
-// func findHood(id int) (*Hood, int, error) {
-// 	for i, h := range hoodList {
-// 		if h.ID == id {
-// 			return h, i, nil
-// 		}
-// 	}
-// 	return nil, 0, ErrHoodNotFound
-// }
+// DeleteHood takes a hood ID and a sql DB connection and permanently deletes the hood, its rates and its maintenance windows.
+// Hoods that have ever been booked can't be deleted, as their bookings are needed for statistics and recharge reports, so the structured ErrHoodHasBookings is returned and the hood should be retired instead.
+// If the hood doesn't exist, ErrHoodNotFound is returned.
+func DeleteHood(id int, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var hoodNumber int
+	err = tx.QueryRow("SELECT hood_number FROM hoods WHERE id = $1 FOR UPDATE;", id).Scan(&hoodNumber)
+	if err == sql.ErrNoRows {
+		return ErrHoodNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var booked bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM bookings WHERE hoodnumber = $1) OR EXISTS (SELECT 1 FROM booking_requests WHERE hoodnumber = $1);", hoodNumber).Scan(&booked); err != nil {
+		return err
+	}
+	if booked {
+		return ErrHoodHasBookings
+	}
+
+	for _, query := range []string{
+		"DELETE FROM hood_rates WHERE hood_number = $1;",
+		"DELETE FROM maintenance_windows WHERE hood_number = $1;",
+	} {
+		if _, err := tx.Exec(query, hoodNumber); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM hoods WHERE id = $1;", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// create structured errors
+var ErrHoodNotFound = fmt.Errorf("Hood Not Found")
+var ErrHoodExists = fmt.Errorf("a hood with that number already exists")
+var ErrHoodRetired = fmt.Errorf("hood has been retired")
+var ErrHoodHasFutureBookings = fmt.Errorf("hood has future bookings")
+var ErrHoodHasBookings = fmt.Errorf("hood has bookings, retire it instead")
@@ -0,0 +1,113 @@
+package data
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Invitation is an admin-issued code that lets someone register and places them in a research group.
+// If Email is set, the code can only be used to register that address. Only a hash of the code is stored, so Code is only set when the invitation is created.
+type Invitation struct {
+	ID            int        `json:"id"`
+	ResearchGroup string     `json:"research_group"`
+	Email         string     `json:"email,omitempty"`
+	CreatedBy     int        `json:"created_by"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	UsedAt        *time.Time `json:"used_at"`
+	UsedBy        *int       `json:"used_by"`
+	Code          string     `json:"code,omitempty"`
+}
+
+// Invitations is a list of Invitation objects.
+type Invitations []*Invitation
+
+// ToJSON is called on an Invitations object and takes an io.Writer, returning an error.
+func (in *Invitations) ToJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(in)
+}
+
+// hashInvitationCode returns the SHA-256 of an invitation code, which is what is stored in the database in place of the code itself.
+func hashInvitationCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// AddInvitation takes an Invitation with its Code set and a sql DB connection, and stores it. The invitation's ID and creation time are set from the database.
+func AddInvitation(in *Invitation, db *sql.DB) error {
+	return db.QueryRow(`INSERT INTO invitations (code_hash, research_group, email, created_by, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, NOW(), $5) RETURNING id, created_at;`,
+		hashInvitationCode(in.Code), in.ResearchGroup, in.Email, in.CreatedBy, in.ExpiresAt).Scan(&in.ID, &in.CreatedAt)
+}
+
+// GetInvitations takes a sql DB connection and returns every invitation, newest first.
+func GetInvitations(db *sql.DB) (Invitations, error) {
+	rows, err := db.Query("SELECT id, research_group, email, created_by, created_at, expires_at, used_at, used_by FROM invitations ORDER BY created_at DESC;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := Invitations{}
+	for rows.Next() {
+		var in Invitation
+		if err := rows.Scan(&in.ID, &in.ResearchGroup, &in.Email, &in.CreatedBy, &in.CreatedAt, &in.ExpiresAt, &in.UsedAt, &in.UsedBy); err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, &in)
+	}
+	return invitations, rows.Err()
+}
+
+// DeleteInvitation takes an invitation ID and a sql DB connection and withdraws the invitation, as long as it hasn't been used.
+// If there is no such unused invitation, the structured ErrInvitationNotFound is returned.
+func DeleteInvitation(id int, db *sql.DB) error {
+	res, err := db.Exec("DELETE FROM invitations WHERE id = $1 AND used_at IS NULL;", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInvitationNotFound
+	}
+	return nil
+}
+
+// ClaimInvitation takes an invitation code, the email address registering and a sql DB connection, and marks the invitation as used, returning it.
+// The code must exist, be unused and unexpired, and if the invitation is for a particular address it must match. Otherwise the structured ErrInvitationNotFound is returned.
+// The check and claim happen in one UPDATE, so a code can't be used by two registrations at once.
+func ClaimInvitation(code, email string, db *sql.DB) (*Invitation, error) {
+	var in Invitation
+	err := db.QueryRow(`UPDATE invitations SET used_at = NOW()
+		WHERE code_hash = $1 AND used_at IS NULL AND expires_at > NOW() AND (email = '' OR LOWER(email) = LOWER($2))
+		RETURNING id, research_group, email, created_by, created_at, expires_at, used_at;`,
+		hashInvitationCode(code), email).Scan(&in.ID, &in.ResearchGroup, &in.Email, &in.CreatedBy, &in.CreatedAt, &in.ExpiresAt, &in.UsedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvitationNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &in, nil
+}
+
+// ReleaseInvitation takes an invitation ID and a sql DB connection and makes a claimed invitation usable again, for when registration fails after the code was claimed.
+func ReleaseInvitation(id int, db *sql.DB) error {
+	_, err := db.Exec("UPDATE invitations SET used_at = NULL WHERE id = $1 AND used_by IS NULL;", id)
+	return err
+}
+
+// SetInvitationUser takes an invitation ID, the ID of the user who registered with it and a sql DB connection, and records who used the invitation.
+func SetInvitationUser(id, userID int, db *sql.DB) error {
+	_, err := db.Exec("UPDATE invitations SET used_by = $1 WHERE id = $2;", userID, id)
+	return err
+}
+
+// create structured error
+var ErrInvitationNotFound = fmt.Errorf("invitation code is invalid, expired or has already been used")
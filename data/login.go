@@ -0,0 +1,175 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Login attempt outcomes stored in the audit log.
+const (
+	LoginSucceeded     = "success"
+	LoginBadCredential = "invalid_credentials"
+	LoginAccountLocked = "account_locked"
+	LoginIPLimited     = "ip_rate_limited"
+	LoginNotAllowed    = "local_login_disabled"
+	LoginUnverified    = "email_unverified"
+	LoginProvisionFail = "provisioning_failed"
+	LoginTwoFactorWait = "two_factor_required"
+	LoginBadTwoFactor  = "invalid_two_factor"
+)
+
+// LoginAttempt is one entry in the login audit log.
+// UserID is nil when the username doesn't belong to a user.
+type LoginAttempt struct {
+	ID          int       `json:"id"`
+	Username    string    `json:"username"`
+	UserID      *int      `json:"user_id"`
+	Provider    string    `json:"provider"`
+	IPAddress   string    `json:"ip_address"`
+	UserAgent   string    `json:"user_agent"`
+	Outcome     string    `json:"outcome"`
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+// LoginAttempts is a list of LoginAttempt objects.
+type LoginAttempts []*LoginAttempt
+
+// Lockout is a username that has been temporarily locked after repeated failed logins.
+type Lockout struct {
+	Username    string    `json:"username"`
+	FailedCount int       `json:"failed_count"`
+	LockedAt    time.Time `json:"locked_at"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// Lockouts is a list of Lockout objects.
+type Lockouts []*Lockout
+
+// ToJSON is called on a LoginAttempts object and takes an io.Writer, returning an error.
+func (la *LoginAttempts) ToJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(la)
+}
+
+// ToJSON is called on a Lockouts object and takes an io.Writer, returning an error.
+func (lo *Lockouts) ToJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(lo)
+}
+
+// normaliseUsername returns the form of a username used to key the audit log and lockouts, so "Alice" and "alice " count as the same account.
+func normaliseUsername(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// RecordLoginAttempt takes a LoginAttempt and a sql DB connection and adds it to the login audit log.
+func RecordLoginAttempt(a *LoginAttempt, db *sql.DB) error {
+	if a.Provider == "" {
+		a.Provider = LocalProvider
+	}
+	_, err := db.Exec("INSERT INTO login_attempts (username, user_id, provider, ip_address, user_agent, outcome, attempted_at) VALUES ($1, $2, $3, $4, $5, $6, NOW());",
+		normaliseUsername(a.Username), a.UserID, a.Provider, a.IPAddress, a.UserAgent, a.Outcome)
+	return err
+}
+
+// CountFailedLoginsForUser takes a username, the start of the counting window and a sql DB connection, and returns how many failed logins there have been for the username since then.
+// Wrong passwords and wrong two-factor codes are both counted, and failures before the most recent successful login are not.
+func CountFailedLoginsForUser(username string, since time.Time, db *sql.DB) (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM login_attempts
+		WHERE username = $1 AND outcome IN ($2, $5)
+		AND attempted_at > GREATEST($3, COALESCE((SELECT MAX(attempted_at) FROM login_attempts WHERE username = $1 AND outcome = $4), $3));`,
+		normaliseUsername(username), LoginBadCredential, since, LoginSucceeded, LoginBadTwoFactor).Scan(&count)
+	return count, err
+}
+
+// CountFailedLoginsForIP takes an IP address, the start of the counting window and a sql DB connection, and returns how many failed logins have come from the address since then.
+func CountFailedLoginsForIP(ip string, since time.Time, db *sql.DB) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM login_attempts WHERE ip_address = $1 AND outcome IN ($2, $4) AND attempted_at > $3;",
+		ip, LoginBadCredential, since, LoginBadTwoFactor).Scan(&count)
+	return count, err
+}
+
+// LockAccount takes a username, the number of failed attempts that caused the lock, when the lock ends and a sql DB connection, and locks the username until then.
+// Usernames are locked whether or not they belong to a user, so a lock doesn't reveal which usernames exist.
+func LockAccount(username string, failedCount int, until time.Time, db *sql.DB) error {
+	_, err := db.Exec(`INSERT INTO account_lockouts (username, failed_count, locked_at, locked_until) VALUES ($1, $2, NOW(), $3)
+		ON CONFLICT (username) DO UPDATE SET failed_count = EXCLUDED.failed_count, locked_at = EXCLUDED.locked_at, locked_until = EXCLUDED.locked_until;`,
+		normaliseUsername(username), failedCount, until)
+	return err
+}
+
+// GetActiveLockout takes a username and a sql DB connection and returns the lock on the username, or nil if it is not locked.
+func GetActiveLockout(username string, db *sql.DB) (*Lockout, error) {
+	var lo Lockout
+	err := db.QueryRow("SELECT username, failed_count, locked_at, locked_until FROM account_lockouts WHERE username = $1 AND locked_until > NOW();",
+		normaliseUsername(username)).Scan(&lo.Username, &lo.FailedCount, &lo.LockedAt, &lo.LockedUntil)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &lo, nil
+}
+
+// GetActiveLockouts takes a sql DB connection and returns every username that is currently locked, soonest to unlock first.
+func GetActiveLockouts(db *sql.DB) (Lockouts, error) {
+	rows, err := db.Query("SELECT username, failed_count, locked_at, locked_until FROM account_lockouts WHERE locked_until > NOW() ORDER BY locked_until;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lockouts := Lockouts{}
+	for rows.Next() {
+		var lo Lockout
+		if err := rows.Scan(&lo.Username, &lo.FailedCount, &lo.LockedAt, &lo.LockedUntil); err != nil {
+			return nil, err
+		}
+		lockouts = append(lockouts, &lo)
+	}
+	return lockouts, rows.Err()
+}
+
+// UnlockAccount takes a username and a sql DB connection and removes any lock on the username.
+// If the username is not locked, the structured ErrLockoutNotFound is returned.
+func UnlockAccount(username string, db *sql.DB) error {
+	res, err := db.Exec("DELETE FROM account_lockouts WHERE username = $1 AND locked_until > NOW();", normaliseUsername(username))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrLockoutNotFound
+	}
+	return nil
+}
+
+// GetLoginAttempts takes an optional username and IP address to filter by, a maximum number of entries and a sql DB connection, and returns the most recent login attempts.
+func GetLoginAttempts(username, ip string, limit int, db *sql.DB) (LoginAttempts, error) {
+	rows, err := db.Query(`SELECT id, username, user_id, provider, ip_address, user_agent, outcome, attempted_at FROM login_attempts
+		WHERE ($1 = '' OR username = $1) AND ($2 = '' OR ip_address = $2)
+		ORDER BY attempted_at DESC, id DESC LIMIT $3;`, normaliseUsername(username), ip, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := LoginAttempts{}
+	for rows.Next() {
+		var a LoginAttempt
+		if err := rows.Scan(&a.ID, &a.Username, &a.UserID, &a.Provider, &a.IPAddress, &a.UserAgent, &a.Outcome, &a.AttemptedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, &a)
+	}
+	return attempts, rows.Err()
+}
+
+// create structured error
+var ErrLockoutNotFound = fmt.Errorf("account is not locked")
@@ -0,0 +1,230 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"bookings.com/m/config"
+	"github.com/lib/pq"
+)
+
+// defaultWorkingDays are the working days used when none are configured.
+var defaultWorkingDays = []string{"mon", "tue", "wed", "thu", "fri"}
+
+// Escalation is an entry in the lone-worker escalation log, written when a user misses a check-in during an out of hours booking.
+// DueAt is when the missed check-in was due, and ResolvedAt is set once the user checks in again or the alert is closed by a lab manager.
+type Escalation struct {
+	ID                  int        `json:"id"`
+	BookingID           int        `json:"booking_id"`
+	UserName            string     `json:"user_name"`
+	HoodNumber          int        `json:"hood_number"`
+	Room                string     `json:"room"`
+	Emergency_Telephone int        `json:"emergency_telephone"`
+	DueAt               time.Time  `json:"due_at"`
+	EscalatedAt         time.Time  `json:"escalated_at"`
+	Contacts            []string   `json:"contacts"`
+	ResolvedAt          *time.Time `json:"resolved_at"`
+	ResolvedBy          string     `json:"resolved_by,omitempty"`
+}
+
+// Escalations is a list of Escalation objects.
+type Escalations []*Escalation
+
+// ToJSON is called on an Escalations object and takes an io.Writer, returning an error.
+func (e *Escalations) ToJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(e)
+}
+
+// OutOfHours takes the start and end of a booking, the lone working config and the lab's timezone, and reports whether any part of the booking falls outside working hours.
+// Working hours are read as times in the lab's timezone, whatever the server's local time is.
+// An error is returned if the configured working hours are not in HH:MM format.
+func OutOfHours(start, end time.Time, cfg config.LoneWorking, loc *time.Location) (bool, error) {
+	dayStart, err := time.Parse("15:04", cfg.WorkdayStart)
+	if err != nil {
+		return false, fmt.Errorf("lone working workday_start is not in HH:MM format")
+	}
+	dayEnd, err := time.Parse("15:04", cfg.WorkdayEnd)
+	if err != nil {
+		return false, fmt.Errorf("lone working workday_end is not in HH:MM format")
+	}
+	days := cfg.WorkingDays
+	if len(days) == 0 {
+		days = defaultWorkingDays
+	}
+
+	// walk through the booking a working day at a time, stopping at the first moment outside working hours
+	for t := start.In(loc); t.Before(end); {
+		if !workingDay(t.Weekday(), days) {
+			return true, nil
+		}
+		y, m, d := t.Date()
+		opens := time.Date(y, m, d, dayStart.Hour(), dayStart.Minute(), 0, 0, loc)
+		closes := time.Date(y, m, d, dayEnd.Hour(), dayEnd.Minute(), 0, 0, loc)
+		if t.Before(opens) || !t.Before(closes) {
+			return true, nil
+		}
+		t = closes
+	}
+	return false, nil
+}
+
+// workingDay reports whether a weekday is one of the configured working days, which are given by the first three letters of their names.
+func workingDay(day time.Weekday, days []string) bool {
+	name := strings.ToLower(day.String()[:3])
+	for _, d := range days {
+		if strings.ToLower(strings.TrimSpace(d)) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// AcknowledgeLoneWorking takes a booking ID, the name of the user acknowledging the lone-worker protocol and a sql DB connection, and records the acknowledgement.
+func AcknowledgeLoneWorking(bookingID int, username string, db *sql.DB) error {
+	return acknowledgeLoneWorking(db, bookingID, username)
+}
+
+// acknowledgeLoneWorking records the acknowledgement through ex, which may be a transaction.
+func acknowledgeLoneWorking(ex execer, bookingID int, username string) error {
+	_, err := ex.Exec("INSERT INTO lone_worker_acknowledgements (booking_id, username, acknowledged_at) VALUES ($1, $2, NOW()) ON CONFLICT DO NOTHING;", bookingID, username)
+	return err
+}
+
+// HasAcknowledgedLoneWorking takes a booking ID, a username and a sql DB connection, and reports whether that user has acknowledged the lone-worker protocol for the booking.
+func HasAcknowledgedLoneWorking(bookingID int, username string, db *sql.DB) (bool, error) {
+	var acknowledged bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM lone_worker_acknowledgements WHERE booking_id = $1 AND username = $2);", bookingID, username).Scan(&acknowledged)
+	return acknowledged, err
+}
+
+// CheckIn takes a booking ID and a sql DB connection and records that the user is safe, closing any open escalation for the booking.
+func CheckIn(bookingID int, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO lone_worker_checkins (booking_id, checked_in_at) VALUES ($1, NOW());", bookingID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE lone_worker_escalations SET resolved_at = NOW(), resolved_by = 'check-in' WHERE booking_id = $1 AND resolved_at IS NULL;", bookingID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// NextCheckIn takes a booking, the lone working config and a sql DB connection, and returns when the user's next check-in is due.
+// The first check-in is due one interval after the booking starts, and each later one an interval after the last check-in.
+func NextCheckIn(b *Booking, cfg config.LoneWorking, db *sql.DB) (time.Time, error) {
+	last := b.BookingDate
+	var checkedIn sql.NullTime
+	if err := db.QueryRow("SELECT MAX(checked_in_at) FROM lone_worker_checkins WHERE booking_id = $1;", b.ID).Scan(&checkedIn); err != nil {
+		return time.Time{}, err
+	}
+	if checkedIn.Valid && checkedIn.Time.After(last) {
+		last = checkedIn.Time
+	}
+	return last.Add(CheckInInterval(cfg)), nil
+}
+
+// CheckInInterval returns how often users must check in during an out of hours booking.
+func CheckInInterval(cfg config.LoneWorking) time.Duration {
+	if cfg.CheckInMinutes <= 0 {
+		return 30 * time.Minute
+	}
+	return time.Duration(cfg.CheckInMinutes) * time.Minute
+}
+
+// CheckInGrace returns how late a check-in can be before it is escalated.
+func CheckInGrace(cfg config.LoneWorking) time.Duration {
+	if cfg.GraceMinutes <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(cfg.GraceMinutes) * time.Minute
+}
+
+// GetBookingsRunningSince takes two times and a sql DB connection, and returns every booking that has not been cancelled, had started by at, and was still running after since.
+// Bookings that have just ended are included, as a check-in that fell due shortly before the end is only escalated once its grace period has passed.
+func GetBookingsRunningSince(since, at time.Time, db *sql.DB) (BookingsList, error) {
+	rows, err := db.Query("SELECT id, username, hoodnumber, booking_date, end_date FROM bookings WHERE cancelled_at IS NULL AND booking_date <= $2 AND end_date > $1 ORDER BY booking_date;", since, at)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bookings := BookingsList{}
+	for rows.Next() {
+		var b Booking
+		if err := rows.Scan(&b.ID, &b.UserName, &b.HoodNumber, &b.BookingDate, &b.EndDate); err != nil {
+			return nil, err
+		}
+		bookings = append(bookings, &b)
+	}
+	return bookings, rows.Err()
+}
+
+// ClaimEscalation takes an Escalation and a sql DB connection and adds it to the escalation log, setting its ID.
+// It returns true only to the first caller for each booking and missed check-in, so safety contacts are alerted once, even when several instances are running.
+func ClaimEscalation(e *Escalation, db *sql.DB) (bool, error) {
+	err := db.QueryRow(`INSERT INTO lone_worker_escalations (booking_id, username, hood_number, room, emergency_telephone, due_at, escalated_at, contacts)
+		VALUES ($1, $2, $3, $4, $5, $6, NOW(), $7) ON CONFLICT (booking_id, due_at) DO NOTHING RETURNING id, escalated_at;`,
+		e.BookingID, e.UserName, e.HoodNumber, e.Room, e.Emergency_Telephone, e.DueAt, pq.Array(e.Contacts)).Scan(&e.ID, &e.EscalatedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetEscalations takes whether to only return escalations that are still open, a maximum number of entries and a sql DB connection, and returns the most recent escalations.
+func GetEscalations(openOnly bool, limit int, db *sql.DB) (Escalations, error) {
+	return getEscalations("($1 = FALSE OR resolved_at IS NULL)", openOnly, limit, db)
+}
+
+// getUserEscalations returns every escalation raised for a username, newest first.
+func getUserEscalations(username string, db *sql.DB) (Escalations, error) {
+	return getEscalations("username = $1", username, -1, db)
+}
+
+// getEscalations runs the query shared by GetEscalations and getUserEscalations, filtered by the given condition on $1.
+// A negative limit returns every matching escalation.
+func getEscalations(where string, arg interface{}, limit int, db *sql.DB) (Escalations, error) {
+	rows, err := db.Query(`SELECT id, booking_id, username, hood_number, room, emergency_telephone, due_at, escalated_at, contacts, resolved_at, resolved_by
+		FROM lone_worker_escalations WHERE `+where+` ORDER BY escalated_at DESC, id DESC LIMIT NULLIF($2, -1);`, arg, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	escalations := Escalations{}
+	for rows.Next() {
+		var e Escalation
+		if err := rows.Scan(&e.ID, &e.BookingID, &e.UserName, &e.HoodNumber, &e.Room, &e.Emergency_Telephone, &e.DueAt, &e.EscalatedAt,
+			pq.Array(&e.Contacts), &e.ResolvedAt, &e.ResolvedBy); err != nil {
+			return nil, err
+		}
+		escalations = append(escalations, &e)
+	}
+	return escalations, rows.Err()
+}
+
+// ResolveEscalation takes an escalation ID, the name of the user closing it and a sql DB connection, and marks the escalation as resolved.
+// If there is no open escalation with that ID, the structured ErrEscalationNotFound is returned.
+func ResolveEscalation(id int, resolvedBy string, db *sql.DB) error {
+	res, err := db.Exec("UPDATE lone_worker_escalations SET resolved_at = NOW(), resolved_by = $2 WHERE id = $1 AND resolved_at IS NULL;", id, resolvedBy)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrEscalationNotFound
+	}
+	return nil
+}
+
+// create structured error
+var ErrEscalationNotFound = fmt.Errorf("open escalation not found")
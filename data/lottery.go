@@ -0,0 +1,383 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// LotteryWindow is the struct that defines a request window for contested slots.
+// While the window is open (between OpensAt and ClosesAt), bookings that start between SlotsFrom and SlotsUntil can only be requested, not booked directly.
+// Once the window closes, the requests are allocated and the winners are confirmed as bookings.
+type LotteryWindow struct {
+	ID         int       `json:"id"`
+	OpensAt    time.Time `json:"opens_at"`
+	ClosesAt   time.Time `json:"closes_at"`
+	SlotsFrom  time.Time `json:"slots_from"`
+	SlotsUntil time.Time `json:"slots_until"`
+	Status     string    `json:"status"`
+}
+
+// LotteryWindowsList is a type defined to characterise an array of the LotteryWindow struct type variables.
+type LotteryWindowsList []*LotteryWindow
+
+// BookingRequest is a single ranked preference submitted by a user during a lottery window.
+// Rank 1 is the user's first choice. Once the window has been allocated, Status is either "won" or "lost", and Reason explains why a request lost.
+// LoneWorkerAck records that the user acknowledged the lone-worker protocol for a request outside working hours, and is recorded against the booking if the request wins.
+type BookingRequest struct {
+	ID          int       `json:"id"`
+	WindowID    int       `json:"window_id"`
+	UserName    string    `json:"user_name"`
+	HoodNumber  int       `json:"hood_number"`
+	BookingDate time.Time `json:"booking_time"`
+	EndDate     time.Time `json:"end_time"`
+	Rank        int       `json:"rank"`
+	Status      string    `json:"status"`
+	Reason      string    `json:"reason,omitempty"`
+	BookingID   int       `json:"booking_id,omitempty"`
+
+	LoneWorkerAck bool `json:"lone_worker_acknowledged,omitempty"`
+}
+
+// BookingRequestsList is a type defined to characterise an array of the BookingRequest struct type variables.
+type BookingRequestsList []*BookingRequest
+
+// statuses used by lottery windows and booking requests
+const (
+	LotteryOpen       = "open"
+	LotteryAllocating = "allocating"
+	LotteryAllocated  = "allocated"
+
+	RequestPending = "pending"
+	RequestWon     = "won"
+	RequestLost    = "lost"
+)
+
+// FromJSON can be used on LotteryWindow struct objects.
+// It takes in an io.Reader parameter and decodes the data stored in it into the LotteryWindow object.
+func (w *LotteryWindow) FromJSON(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	return dec.Decode(w)
+}
+
+// ToJSON can be used on LotteryWindowsList type variables.
+// It takes in an io.Writer parameter and encodes the windows to the io.Writer.
+func (w *LotteryWindowsList) ToJSON(wr io.Writer) error {
+	enc := json.NewEncoder(wr)
+	return enc.Encode(w)
+}
+
+// FromJSON can be used on BookingRequestsList type variables.
+// It takes in an io.Reader parameter and decodes the ranked list of requests stored in it.
+func (br *BookingRequestsList) FromJSON(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	return dec.Decode(br)
+}
+
+// ToJSON can be used on BookingRequestsList type variables.
+// It takes in an io.Writer parameter and encodes the requests to the io.Writer.
+func (br *BookingRequestsList) ToJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(br)
+}
+
+// AddLotteryWindow takes a LotteryWindow struct and a sql DB connection, and inserts the window into the lottery_windows table.
+// The window is always created with the "open" status.
+func AddLotteryWindow(w *LotteryWindow, db *sql.DB) error {
+	w.Status = LotteryOpen
+	return db.QueryRow("INSERT INTO lottery_windows (opens_at, closes_at, slots_from, slots_until, status) VALUES ($1, $2, $3, $4, $5) RETURNING id;",
+		w.OpensAt, w.ClosesAt, w.SlotsFrom, w.SlotsUntil, w.Status).Scan(&w.ID)
+}
+
+// GetLotteryWindows returns every lottery window stored in the database, newest first.
+func GetLotteryWindows(db *sql.DB) (LotteryWindowsList, error) {
+	rows, err := db.Query("SELECT id, opens_at, closes_at, slots_from, slots_until, status FROM lottery_windows ORDER BY opens_at DESC;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var windows LotteryWindowsList
+	for rows.Next() {
+		var w LotteryWindow
+		if err := rows.Scan(&w.ID, &w.OpensAt, &w.ClosesAt, &w.SlotsFrom, &w.SlotsUntil, &w.Status); err != nil {
+			return nil, err
+		}
+		windows = append(windows, &w)
+	}
+	return windows, rows.Err()
+}
+
+// GetLotteryWindow takes a window ID and a sql DB connection and returns the matching LotteryWindow.
+// If no window has that ID, the structured ErrLotteryWindowNotFound is returned.
+func GetLotteryWindow(id int, db *sql.DB) (*LotteryWindow, error) {
+	var w LotteryWindow
+	err := db.QueryRow("SELECT id, opens_at, closes_at, slots_from, slots_until, status FROM lottery_windows WHERE id = $1;", id).
+		Scan(&w.ID, &w.OpensAt, &w.ClosesAt, &w.SlotsFrom, &w.SlotsUntil, &w.Status)
+	if err == sql.ErrNoRows {
+		return nil, ErrLotteryWindowNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// FindOpenLotteryWindow takes a booking start time and returns the window that is still taking requests for that time, or nil if there is none.
+// This is used to stop slots that are being allocated by lottery from being booked directly.
+func FindOpenLotteryWindow(start time.Time, db *sql.DB) (*LotteryWindow, error) {
+	var w LotteryWindow
+	err := db.QueryRow("SELECT id, opens_at, closes_at, slots_from, slots_until, status FROM lottery_windows WHERE status <> $1 AND slots_from <= $2 AND slots_until > $2 LIMIT 1;", LotteryAllocated, start).
+		Scan(&w.ID, &w.OpensAt, &w.ClosesAt, &w.SlotsFrom, &w.SlotsUntil, &w.Status)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// ReplaceBookingRequests takes a window ID, a username and the user's ranked requests, and replaces any requests the user had already submitted in that window.
+// The position of each request in the list is stored as its rank.
+func ReplaceBookingRequests(windowID int, userName string, requests BookingRequestsList, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM booking_requests WHERE window_id = $1 AND username = $2;", windowID, userName); err != nil {
+		return err
+	}
+
+	for i, req := range requests {
+		req.WindowID = windowID
+		req.UserName = userName
+		req.Rank = i + 1
+		req.Status = RequestPending
+		err := tx.QueryRow("INSERT INTO booking_requests (window_id, username, hoodnumber, booking_date, end_date, rank, status, lone_worker_acknowledged) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id;",
+			req.WindowID, req.UserName, req.HoodNumber, req.BookingDate, req.EndDate, req.Rank, req.Status, req.LoneWorkerAck).Scan(&req.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetBookingRequests takes a window ID and a username and returns the requests that user submitted in the window, in rank order.
+// If userName is empty, the requests of every user in the window are returned.
+func GetBookingRequests(windowID int, userName string, db *sql.DB) (BookingRequestsList, error) {
+	rows, err := db.Query("SELECT id, window_id, username, hoodnumber, booking_date, end_date, rank, status, reason, COALESCE(booking_id, 0), lone_worker_acknowledged FROM booking_requests WHERE window_id = $1 AND ($2 = '' OR username = $2) ORDER BY username, rank;", windowID, userName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests BookingRequestsList
+	for rows.Next() {
+		var req BookingRequest
+		if err := rows.Scan(&req.ID, &req.WindowID, &req.UserName, &req.HoodNumber, &req.BookingDate, &req.EndDate, &req.Rank, &req.Status, &req.Reason, &req.BookingID, &req.LoneWorkerAck); err != nil {
+			return nil, err
+		}
+		requests = append(requests, &req)
+	}
+	return requests, rows.Err()
+}
+
+// ClaimClosedLotteryWindow marks one window whose request period has ended as "allocating" and returns it, or nil if there is nothing to allocate.
+// The status change is made in a single UPDATE, so if several instances of the service are running only one of them will claim each window.
+// A window that was claimed before staleBefore and is still allocating is assumed to have been left behind by an instance that stopped part way through, and is claimed again.
+func ClaimClosedLotteryWindow(now, staleBefore time.Time, db *sql.DB) (*LotteryWindow, error) {
+	var w LotteryWindow
+	err := db.QueryRow(`UPDATE lottery_windows SET status = $1, claimed_at = $3
+		WHERE id = (SELECT id FROM lottery_windows WHERE ((status = $2 AND closes_at <= $3) OR (status = $1 AND claimed_at < $4)) ORDER BY closes_at LIMIT 1 FOR UPDATE SKIP LOCKED)
+		RETURNING id, opens_at, closes_at, slots_from, slots_until, status;`, LotteryAllocating, LotteryOpen, now, staleBefore).
+		Scan(&w.ID, &w.OpensAt, &w.ClosesAt, &w.SlotsFrom, &w.SlotsUntil, &w.Status)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+// GetBookingsBetween returns every booking that has not been cancelled and overlaps the time range between from and until.
+func GetBookingsBetween(from, until time.Time, db *sql.DB) (BookingsList, error) {
+	rows, err := db.Query("SELECT id, username, hoodnumber, booking_date, end_date FROM bookings WHERE cancelled_at IS NULL AND booking_date < $2 AND end_date > $1 ORDER BY booking_date;", from, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bookingList BookingsList
+	for rows.Next() {
+		var booking Booking
+		if err := rows.Scan(&booking.ID, &booking.UserName, &booking.HoodNumber, &booking.BookingDate, &booking.EndDate); err != nil {
+			return nil, err
+		}
+		bookingList = append(bookingList, &booking)
+	}
+	return bookingList, rows.Err()
+}
+
+// GetUsageHours returns the number of hours each user has had booked between from and until, keyed by username.
+// This is used to weight the lottery in favour of people who have had less hood time recently.
+func GetUsageHours(from, until time.Time, db *sql.DB) (map[string]float64, error) {
+	rows, err := db.Query("SELECT username, SUM(EXTRACT(EPOCH FROM (end_date - booking_date))) / 3600 FROM bookings WHERE cancelled_at IS NULL AND booking_date >= $1 AND booking_date < $2 GROUP BY username;", from, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := make(map[string]float64)
+	for rows.Next() {
+		var name string
+		var hours float64
+		if err := rows.Scan(&name, &hours); err != nil {
+			return nil, err
+		}
+		usage[name] = hours
+	}
+	return usage, rows.Err()
+}
+
+// AllocateRequests takes every request submitted in a window, the bookings that already exist over the same period, each user's recent usage in hours and a random source.
+// It sets the Status and Reason of every request, and returns the winning requests.
+//
+// Users are put into a random order that is weighted by usage, so a user with fewer recent hours is more likely to be placed early.
+// Allocation then happens in rounds: in each round every user, in that order, is given their highest ranked request that is still free.
+// This means nobody can win a second slot until everyone has had the chance to win their first.
+func AllocateRequests(requests BookingRequestsList, existing BookingsList, usage map[string]float64, rnd *rand.Rand) BookingRequestsList {
+	byUser := make(map[string]BookingRequestsList)
+	for _, req := range requests {
+		byUser[req.UserName] = append(byUser[req.UserName], req)
+	}
+	for _, reqs := range byUser {
+		sort.Slice(reqs, func(i, j int) bool { return reqs[i].Rank < reqs[j].Rank })
+	}
+
+	// weighted random order using exponential keys, where the weight of each user is 1 / (1 + hours used)
+	type entry struct {
+		name string
+		key  float64
+	}
+	var order []entry
+	for name := range byUser {
+		weight := 1 / (1 + usage[name])
+		order = append(order, entry{name, -math.Log(1-rnd.Float64()) / weight})
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if order[i].key == order[j].key {
+			return order[i].name < order[j].name
+		}
+		return order[i].key < order[j].key
+	})
+
+	taken := append(BookingsList{}, existing...)
+	won := make(map[*Booking]bool)
+	var winners BookingRequestsList
+
+	for progress := true; progress; {
+		progress = false
+		for _, e := range order {
+			reqs := byUser[e.name]
+			for len(reqs) > 0 {
+				req := reqs[0]
+				reqs = reqs[1:]
+				b := &Booking{UserName: req.UserName, HoodNumber: req.HoodNumber, BookingDate: req.BookingDate, EndDate: req.EndDate}
+
+				if clash := findOverlap(b, taken); clash != nil {
+					req.Status = RequestLost
+					switch {
+					case clash.UserName == req.UserName:
+						req.Reason = "clashes with another booking you already hold at this time"
+					case won[clash]:
+						req.Reason = "slot was allocated to another user who was drawn earlier"
+					default:
+						req.Reason = "slot was already booked"
+					}
+					continue
+				}
+
+				req.Status = RequestWon
+				taken = append(taken, b)
+				won[b] = true
+				winners = append(winners, req)
+				progress = true
+				break
+			}
+			byUser[e.name] = reqs
+		}
+	}
+	return winners
+}
+
+// findOverlap returns the first booking in the list that is for the same user or hood as b and overlaps it in time, or nil if there is none.
+func findOverlap(b *Booking, list BookingsList) *Booking {
+	for _, other := range list {
+		if other.UserName != b.UserName && other.HoodNumber != b.HoodNumber {
+			continue
+		}
+		if other.BookingDate.Before(b.EndDate) && other.EndDate.After(b.BookingDate) {
+			return other
+		}
+	}
+	return nil
+}
+
+// SaveRequestOutcome stores the status, reason and (for winning requests) booking ID of an allocated request.
+func SaveRequestOutcome(req *BookingRequest, db *sql.DB) error {
+	return saveRequestOutcome(db, req)
+}
+
+// saveRequestOutcome stores the outcome of the request through ex, which may be a transaction.
+func saveRequestOutcome(ex execer, req *BookingRequest) error {
+	var bookingID interface{}
+	if req.BookingID != 0 {
+		bookingID = req.BookingID
+	}
+	_, err := ex.Exec("UPDATE booking_requests SET status = $1, reason = $2, booking_id = $3 WHERE id = $4;", req.Status, req.Reason, bookingID, req.ID)
+	return err
+}
+
+// ConfirmRequestBooking takes a winning request, the booking made for it, whether to record the user's lone-worker acknowledgement for it and a sql DB connection.
+// It adds the booking and saves the request as won with the booking's ID in one transaction, so a window claimed again after a crash never finds a booking for a request that isn't marked as won.
+// If the booking can't be added, the same structured errors as AddBooking are returned and nothing is stored.
+func ConfirmRequestBooking(req *BookingRequest, b *Booking, acknowledge bool, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertBooking(tx, b); err != nil {
+		return err
+	}
+	if acknowledge {
+		if err := acknowledgeLoneWorking(tx, b.ID, req.UserName); err != nil {
+			return err
+		}
+	}
+	req.Status = RequestWon
+	req.BookingID = b.ID
+	if err := saveRequestOutcome(tx, req); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetLotteryWindowStatus updates the status of the window with the given ID.
+func SetLotteryWindowStatus(id int, status string, db *sql.DB) error {
+	_, err := db.Exec("UPDATE lottery_windows SET status = $1 WHERE id = $2;", status, id)
+	return err
+}
+
+// create structured error
+var ErrLotteryWindowNotFound = fmt.Errorf("lottery window not found")
@@ -0,0 +1,130 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// MaintenanceWindow is a period when a hood is out of use, e.g. for servicing or airflow certification.
+// Bookings can't be made on the hood during the window, and bookings that were already made are cancelled when it is scheduled.
+// CancelledAt is set if the window is called off. Cancelled windows are kept, but no longer block bookings.
+type MaintenanceWindow struct {
+	ID          int        `json:"id"`
+	HoodNumber  int        `json:"hood_number"`
+	StartsAt    time.Time  `json:"starts_at"`
+	EndsAt      time.Time  `json:"ends_at"`
+	Reason      string     `json:"reason"`
+	CreatedBy   string     `json:"created_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CancelledAt *time.Time `json:"cancelled_at,omitempty"`
+}
+
+// MaintenanceWindows is a type defined to characterise an array of the MaintenanceWindow struct type variables.
+type MaintenanceWindows []*MaintenanceWindow
+
+// FromJSON can be used on MaintenanceWindow struct objects.
+// It takes in an io.Reader parameter and decodes the data stored in it into the MaintenanceWindow object.
+func (m *MaintenanceWindow) FromJSON(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	return dec.Decode(m)
+}
+
+// ToJSON can be used on MaintenanceWindows type variables.
+// It takes in an io.Writer parameter and encodes the windows to the io.Writer.
+func (m *MaintenanceWindows) ToJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(m)
+}
+
+// AddMaintenanceWindow takes a MaintenanceWindow struct and a sql DB connection and inserts the window into the maintenance_windows table, filling in its ID and creation time.
+func AddMaintenanceWindow(m *MaintenanceWindow, db *sql.DB) error {
+	return db.QueryRow("INSERT INTO maintenance_windows (hood_number, starts_at, ends_at, reason, created_by, created_at) VALUES ($1, $2, $3, $4, $5, NOW()) RETURNING id, created_at;",
+		m.HoodNumber, m.StartsAt, m.EndsAt, m.Reason, m.CreatedBy).Scan(&m.ID, &m.CreatedAt)
+}
+
+// GetMaintenanceWindows takes a time and a sql DB connection, and returns every window that hasn't been cancelled and ends after that time, soonest first.
+func GetMaintenanceWindows(after time.Time, db *sql.DB) (MaintenanceWindows, error) {
+	rows, err := db.Query("SELECT id, hood_number, starts_at, ends_at, reason, created_by, created_at, cancelled_at FROM maintenance_windows WHERE cancelled_at IS NULL AND ends_at > $1 ORDER BY starts_at, hood_number;", after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	windows := MaintenanceWindows{}
+	for rows.Next() {
+		var m MaintenanceWindow
+		if err := rows.Scan(&m.ID, &m.HoodNumber, &m.StartsAt, &m.EndsAt, &m.Reason, &m.CreatedBy, &m.CreatedAt, &m.CancelledAt); err != nil {
+			return nil, err
+		}
+		windows = append(windows, &m)
+	}
+	return windows, rows.Err()
+}
+
+// GetMaintenanceWindow takes a window ID and a sql DB connection and returns the matching MaintenanceWindow, including cancelled windows.
+// If no window has that ID, the structured ErrMaintenanceNotFound is returned.
+func GetMaintenanceWindow(id int, db *sql.DB) (*MaintenanceWindow, error) {
+	var m MaintenanceWindow
+	err := db.QueryRow("SELECT id, hood_number, starts_at, ends_at, reason, created_by, created_at, cancelled_at FROM maintenance_windows WHERE id = $1;", id).
+		Scan(&m.ID, &m.HoodNumber, &m.StartsAt, &m.EndsAt, &m.Reason, &m.CreatedBy, &m.CreatedAt, &m.CancelledAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrMaintenanceNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// CancelMaintenanceWindow takes a window ID and a sql DB connection and marks the window as cancelled, so the hood can be booked again.
+// Bookings that were cancelled when the window was scheduled are not restored.
+func CancelMaintenanceWindow(id int, db *sql.DB) error {
+	res, err := db.Exec("UPDATE maintenance_windows SET cancelled_at = NOW() WHERE id = $1 AND cancelled_at IS NULL;", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrMaintenanceNotFound
+	}
+	return nil
+}
+
+// FindMaintenanceClash takes a Booking struct and a sql DB connection and returns the first maintenance window on the booked hood that overlaps the booking, or nil if there is none.
+func FindMaintenanceClash(b *Booking, db *sql.DB) (*MaintenanceWindow, error) {
+	var m MaintenanceWindow
+	err := db.QueryRow("SELECT id, hood_number, starts_at, ends_at, reason FROM maintenance_windows WHERE cancelled_at IS NULL AND hood_number = $1 AND starts_at < $3 AND ends_at > $2 ORDER BY starts_at LIMIT 1;",
+		b.HoodNumber, b.BookingDate, b.EndDate).Scan(&m.ID, &m.HoodNumber, &m.StartsAt, &m.EndsAt, &m.Reason)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// GetHoodBookingsBetween takes a hood number, a time range and a sql DB connection, and returns every booking of the hood that has not been cancelled and overlaps the range, in start time order.
+func GetHoodBookingsBetween(hoodNumber int, from, until time.Time, db *sql.DB) (BookingsList, error) {
+	rows, err := db.Query("SELECT id, username, hoodnumber, booking_date, end_date, grant_code, booked_by FROM bookings WHERE hoodnumber = $1 AND cancelled_at IS NULL AND booking_date < $3 AND end_date > $2 ORDER BY booking_date;", hoodNumber, from, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bookings := BookingsList{}
+	for rows.Next() {
+		var b Booking
+		if err := rows.Scan(&b.ID, &b.UserName, &b.HoodNumber, &b.BookingDate, &b.EndDate, &b.GrantCode, &b.BookedBy); err != nil {
+			return nil, err
+		}
+		bookings = append(bookings, &b)
+	}
+	return bookings, rows.Err()
+}
+
+// create structured errors
+var ErrMaintenanceNotFound = fmt.Errorf("maintenance window not found")
+var ErrHoodUnderMaintenance = fmt.Errorf("the hood is closed for maintenance at that time")
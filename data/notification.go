@@ -0,0 +1,92 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+)
+
+// NotificationEvents lists every event that users can be notified about by email.
+var NotificationEvents = []string{
+	"booking.created",
+	"booking.moved",
+	"booking.cancelled",
+	"booking.bumped",
+	"booking.retired",
+	"booking.reminder",
+	"booking.ending",
+}
+
+// NotificationPreferences holds the events a user has opted out of being emailed about.
+type NotificationPreferences struct {
+	OptedOut []string `json:"opted_out"`
+}
+
+// FromJSON can be used on NotificationPreferences struct objects.
+// It takes in an io.Reader parameter and decodes the data stored in it into the NotificationPreferences object.
+func (np *NotificationPreferences) FromJSON(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	return dec.Decode(np)
+}
+
+// ToJSON can be used on NotificationPreferences struct objects.
+// It takes in an io.Writer parameter and encodes the preferences to the io.Writer.
+func (np *NotificationPreferences) ToJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(np)
+}
+
+// ValidNotificationEvent reports whether event is one of the NotificationEvents.
+func ValidNotificationEvent(event string) bool {
+	for _, e := range NotificationEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// GetNotificationPreferences takes a user ID and a sql DB connection and returns the events the user has opted out of.
+func GetNotificationPreferences(userID int, db *sql.DB) (*NotificationPreferences, error) {
+	rows, err := db.Query("SELECT event FROM notification_optouts WHERE user_id = $1 ORDER BY event;", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prefs := &NotificationPreferences{OptedOut: []string{}}
+	for rows.Next() {
+		var event string
+		if err := rows.Scan(&event); err != nil {
+			return nil, err
+		}
+		prefs.OptedOut = append(prefs.OptedOut, event)
+	}
+	return prefs, rows.Err()
+}
+
+// SetNotificationPreferences takes a user ID, the user's new preferences and a sql DB connection, and replaces the events the user has opted out of.
+func SetNotificationPreferences(userID int, prefs *NotificationPreferences, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM notification_optouts WHERE user_id = $1;", userID); err != nil {
+		return err
+	}
+	for _, event := range prefs.OptedOut {
+		if _, err := tx.Exec("INSERT INTO notification_optouts (user_id, event) VALUES ($1, $2) ON CONFLICT DO NOTHING;", userID, event); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// IsOptedOut takes a user ID, an event and a sql DB connection and reports whether the user has opted out of emails for that event.
+func IsOptedOut(userID int, event string, db *sql.DB) (bool, error) {
+	var optedOut bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM notification_optouts WHERE user_id = $1 AND event = $2);", userID, event).Scan(&optedOut)
+	return optedOut, err
+}
@@ -0,0 +1,131 @@
+package data
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// GetLocalUserByEmail takes an email address and a sql DB connection and returns the matching User struct object and an error.
+// Only users with a local password are returned, as users who log in through the directory have no password to reset.
+// The stored password hash is cleared before the user is returned.
+func GetLocalUserByEmail(email string, db *sql.DB) (*User, error) {
+	var user User
+	err := db.QueryRow("SELECT id, username, email, emergency_telephone, research_group FROM users WHERE LOWER(email) = LOWER($1) AND auth_provider = $2 LIMIT 1;", email, LocalProvider).
+		Scan(&user.ID, &user.Name, &user.Email, &user.Emergency_Telephone, &user.Research_Group)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetPasswordHash takes a user ID and a sql DB connection and returns the user's stored bcrypt password hash.
+// It is only used to check a password, and the hash is never returned to a client.
+func GetPasswordHash(id int, db *sql.DB) (string, error) {
+	var hash string
+	err := db.QueryRow("SELECT passhash FROM users WHERE id = $1;", id).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	return hash, err
+}
+
+// SetPasswordHash takes a user ID, a new bcrypt password hash and a sql DB connection and replaces the user's password.
+// This is the only way a password hash can be changed, as UpdateUser rejects any change to it.
+func SetPasswordHash(id int, hash string, db *sql.DB) error {
+	res, err := db.Exec("UPDATE users SET passhash = $1 WHERE id = $2;", hash, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// hashResetToken returns the SHA-256 of a password reset token, which is what is stored in the database in place of the token itself.
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// AddPasswordReset takes a user ID, a reset token, how long the token is valid for and a sql DB connection, and stores a hash of the token.
+// Any earlier reset tokens for the user that have not been used are removed, so only the latest emailed link works.
+func AddPasswordReset(userID int, token string, validFor time.Duration, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM password_resets WHERE user_id = $1 AND used_at IS NULL;", userID); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO password_resets (user_id, token_hash, created_at, expires_at) VALUES ($1, $2, NOW(), $3);",
+		userID, hashResetToken(token), time.Now().Add(validFor))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ResetPassword takes a reset token, a new bcrypt password hash and a sql DB connection, and replaces the password of the user the token belongs to, returning their ID.
+// The token is used up, the password stored and the user's API tokens revoked in a single transaction, so the token is only spent if the password is actually changed.
+// If the token is unknown, has expired or has already been used, the structured ErrInvalidResetToken is returned.
+func ResetPassword(token, hash string, db *sql.DB) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRow("UPDATE password_resets SET used_at = NOW() WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW() RETURNING user_id;",
+		hashResetToken(token)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidResetToken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec("UPDATE users SET passhash = $1 WHERE id = $2;", hash, userID)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, ErrUserNotFound
+	}
+	if err := RevokeUserAPITokens(tx, userID); err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
+
+// RecordResetRequest takes the ID of the user a password reset was requested for (nil if the email address wasn't registered), the IP address it came from and a sql DB connection, and stores the request so it can be rate limited.
+func RecordResetRequest(userID *int, ip string, db *sql.DB) error {
+	_, err := db.Exec("INSERT INTO password_reset_requests (user_id, ip_address, requested_at) VALUES ($1, $2, NOW());", userID, ip)
+	return err
+}
+
+// CountResetRequestsForUser takes a user ID, the start of the counting window and a sql DB connection, and returns how many password resets have been requested for the user since then.
+func CountResetRequestsForUser(userID int, since time.Time, db *sql.DB) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM password_reset_requests WHERE user_id = $1 AND requested_at > $2;", userID, since).Scan(&n)
+	return n, err
+}
+
+// CountResetRequestsFromIP takes an IP address, the start of the counting window and a sql DB connection, and returns how many password resets have been requested from the address since then, for any email address.
+func CountResetRequestsFromIP(ip string, since time.Time, db *sql.DB) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM password_reset_requests WHERE ip_address = $1 AND requested_at > $2;", ip, since).Scan(&n)
+	return n, err
+}
+
+// create structured error
+var ErrInvalidResetToken = fmt.Errorf("reset token is invalid, expired or has already been used")
@@ -0,0 +1,240 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErasedProvider is the auth_provider given to erased accounts, so nobody can log in to them again.
+const ErasedProvider = "erased"
+
+// UserExport is the personal data held about a user, as returned by GET /user/{id}/export.
+// The user's sessions are added by the handler, as they are kept by the session package.
+type UserExport struct {
+	ExportedAt      time.Time           `json:"exported_at"`
+	Profile         ExportedProfile     `json:"profile"`
+	Bookings        BookingsList        `json:"bookings"`
+	BookingRequests BookingRequestsList `json:"lottery_requests"`
+	LoginAttempts   LoginAttempts       `json:"login_attempts"`
+	APITokens       APITokens           `json:"api_tokens"`
+	Notifications   []string            `json:"notification_opt_outs"`
+	TwoFactor       bool                `json:"two_factor_enabled"`
+	Memberships     []*GroupMembership  `json:"research_group_memberships"`
+	Delegates       Delegates           `json:"booking_delegates"`
+	DelegatedTo     Delegates           `json:"booking_for"`
+	Escalations     Escalations         `json:"lone_worker_escalations"`
+}
+
+// ExportedProfile is the profile part of a UserExport. It includes the fields kept out of the User struct, but never the password hash.
+type ExportedProfile struct {
+	ID                  int        `json:"id"`
+	Name                string     `json:"name"`
+	Email               string     `json:"email"`
+	Emergency_Telephone int        `json:"emergency_telephone"`
+	Research_Group      string     `json:"research_group"`
+	Role                string     `json:"role"`
+	AuthProvider        string     `json:"auth_provider"`
+	EmailVerifiedAt     *time.Time `json:"email_verified_at"`
+}
+
+// ExportUser takes a user ID and a sql DB connection and returns all the personal data held about the user.
+// Bookings include cancelled ones, and the login audit entries are every attempt made for the user's username or account.
+// If the user doesn't exist or has been erased, the structured ErrUserNotFound is returned.
+func ExportUser(userID int, db *sql.DB) (*UserExport, error) {
+	e := &UserExport{ExportedAt: time.Now().UTC()}
+	p := &e.Profile
+	err := db.QueryRow(`SELECT id, username, email, emergency_telephone, research_group, role, auth_provider, email_verified_at
+		FROM users WHERE id = $1 AND erased_at IS NULL;`, userID).
+		Scan(&p.ID, &p.Name, &p.Email, &p.Emergency_Telephone, &p.Research_Group, &p.Role, &p.AuthProvider, &p.EmailVerifiedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if e.Bookings, err = exportBookings(p.Name, db); err != nil {
+		return nil, err
+	}
+	if e.BookingRequests, err = exportBookingRequests(p.Name, db); err != nil {
+		return nil, err
+	}
+	if e.LoginAttempts, err = exportLoginAttempts(userID, p.Name, db); err != nil {
+		return nil, err
+	}
+	if e.APITokens, err = GetAPITokens(userID, db); err != nil {
+		return nil, err
+	}
+	prefs, err := GetNotificationPreferences(userID, db)
+	if err != nil {
+		return nil, err
+	}
+	e.Notifications = prefs.OptedOut
+	if e.TwoFactor, err = TwoFactorEnabled(userID, db); err != nil {
+		return nil, err
+	}
+	if e.Memberships, err = GetUserMemberships(userID, db); err != nil {
+		return nil, err
+	}
+	if e.Delegates, err = GetDelegates(userID, db); err != nil {
+		return nil, err
+	}
+	if e.DelegatedTo, err = GetDelegatedTo(userID, db); err != nil {
+		return nil, err
+	}
+	if e.Escalations, err = getUserEscalations(p.Name, db); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// exportBookings returns every booking made under a username or made by them for someone else, including cancelled ones, oldest first.
+func exportBookings(username string, db *sql.DB) (BookingsList, error) {
+	rows, err := db.Query("SELECT id, username, hoodnumber, booking_date, end_date, grant_code, booked_by, cancelled_at FROM bookings WHERE username = $1 OR booked_by = $1 ORDER BY booking_date;", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bookings := BookingsList{}
+	for rows.Next() {
+		var b Booking
+		if err := rows.Scan(&b.ID, &b.UserName, &b.HoodNumber, &b.BookingDate, &b.EndDate, &b.GrantCode, &b.BookedBy, &b.CancelledAt); err != nil {
+			return nil, err
+		}
+		bookings = append(bookings, &b)
+	}
+	return bookings, rows.Err()
+}
+
+// exportBookingRequests returns every lottery request submitted under a username, in every window.
+func exportBookingRequests(username string, db *sql.DB) (BookingRequestsList, error) {
+	rows, err := db.Query(`SELECT id, window_id, username, hoodnumber, booking_date, end_date, rank, status, reason, COALESCE(booking_id, 0), lone_worker_acknowledged
+		FROM booking_requests WHERE username = $1 ORDER BY window_id, rank;`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	requests := BookingRequestsList{}
+	for rows.Next() {
+		var req BookingRequest
+		if err := rows.Scan(&req.ID, &req.WindowID, &req.UserName, &req.HoodNumber, &req.BookingDate, &req.EndDate, &req.Rank, &req.Status, &req.Reason, &req.BookingID, &req.LoneWorkerAck); err != nil {
+			return nil, err
+		}
+		requests = append(requests, &req)
+	}
+	return requests, rows.Err()
+}
+
+// exportLoginAttempts returns every login attempt made for a user's account or username, newest first.
+func exportLoginAttempts(userID int, username string, db *sql.DB) (LoginAttempts, error) {
+	rows, err := db.Query(`SELECT id, username, user_id, provider, ip_address, user_agent, outcome, attempted_at FROM login_attempts
+		WHERE user_id = $1 OR username = $2 ORDER BY attempted_at DESC, id DESC;`, userID, normaliseUsername(username))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := LoginAttempts{}
+	for rows.Next() {
+		var a LoginAttempt
+		if err := rows.Scan(&a.ID, &a.Username, &a.UserID, &a.Provider, &a.IPAddress, &a.UserAgent, &a.Outcome, &a.AttemptedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, &a)
+	}
+	return attempts, rows.Err()
+}
+
+// erasedPrefix starts the name an erased user's bookings are kept under. It is reserved, so nobody can register a name that an erasure will later need.
+const erasedPrefix = "erased-user-"
+
+// ErasedName returns the name an erased user's bookings are kept under.
+func ErasedName(userID int) string {
+	return fmt.Sprintf("%s%d", erasedPrefix, userID)
+}
+
+// IsReservedUsername takes a username and reports whether it is kept for erased accounts, ignoring case and surrounding spaces as logins do.
+func IsReservedUsername(name string) bool {
+	return strings.HasPrefix(normaliseUsername(name), erasedPrefix)
+}
+
+// EraseUser takes a user ID and a sql DB connection and erases the user's personal data, returning the name their bookings are now kept under.
+// The user's row is kept with only their ID, role and research group, and their name is replaced everywhere it appears, so bookings still count towards usage statistics and recharge reports.
+// Bookings that haven't started yet are cancelled, and sessions, API tokens, two-factor secrets and other credentials are deleted.
+// If the user doesn't exist or has already been erased, the structured ErrUserNotFound is returned.
+func EraseUser(userID int, db *sql.DB) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var oldName string
+	err = tx.QueryRow("SELECT username FROM users WHERE id = $1 AND erased_at IS NULL FOR UPDATE;", userID).Scan(&oldName)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	newName := ErasedName(userID)
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`UPDATE users SET username = $2, passhash = '', email = '', emergency_telephone = 0, role = 'user',
+			auth_provider = $3, external_id = NULL, email_verified_at = NULL, erased_at = NOW() WHERE id = $1;`, []interface{}{userID, newName, ErasedProvider}},
+
+		// free the hoods the user had booked; every booking is kept under the new name by updateUsernameColumns below
+		{"UPDATE bookings SET cancelled_at = NOW() WHERE username = $1 AND cancelled_at IS NULL AND booking_date > NOW();", []interface{}{oldName}},
+		{"UPDATE lone_worker_escalations SET emergency_telephone = 0 WHERE username = $1;", []interface{}{oldName}},
+
+		// keep the audit log's outcomes, but not who or where they came from
+		{"UPDATE login_attempts SET username = $3, user_id = $1, ip_address = '', user_agent = '' WHERE user_id = $1 OR username = $2;", []interface{}{userID, normaliseUsername(oldName), newName}},
+		{"DELETE FROM account_lockouts WHERE username = $1;", []interface{}{normaliseUsername(oldName)}},
+		{"UPDATE invitations SET email = '' WHERE used_by = $1;", []interface{}{userID}},
+		{"UPDATE research_groups SET leader_id = NULL WHERE leader_id = $1;", []interface{}{userID}},
+
+		// the name also appears in the payloads of stored events
+		{"UPDATE stream_events SET data = jsonb_set(data, '{user_name}', to_jsonb($2::text)) WHERE data->>'user_name' = $1;", []interface{}{oldName, newName}},
+		{"UPDATE webhook_deliveries SET payload = jsonb_set(payload, '{data,user_name}', to_jsonb($2::text)) WHERE payload->'data'->>'user_name' = $1;", []interface{}{oldName, newName}},
+		{"UPDATE stream_events SET data = jsonb_set(data, '{booked_by}', to_jsonb($2::text)) WHERE data->>'booked_by' = $1;", []interface{}{oldName, newName}},
+		{"UPDATE webhook_deliveries SET payload = jsonb_set(payload, '{data,booked_by}', to_jsonb($2::text)) WHERE payload->'data'->>'booked_by' = $1;", []interface{}{oldName, newName}},
+		{"UPDATE stream_events SET data = jsonb_set(data, '{created_by}', to_jsonb($2::text)) WHERE event = 'hood.maintenance' AND data->>'created_by' = $1;", []interface{}{oldName, newName}},
+		{"UPDATE webhook_deliveries SET payload = jsonb_set(payload, '{data,created_by}', to_jsonb($2::text)) WHERE event = 'hood.maintenance' AND payload->'data'->>'created_by' = $1;", []interface{}{oldName, newName}},
+		{"UPDATE webhook_deliveries SET payload = jsonb_set(payload, '{data,name}', to_jsonb($2::text)) WHERE event = 'user.created' AND payload->'data'->>'id' = $1::text;", []interface{}{userID, newName}},
+		{"UPDATE webhook_deliveries SET payload = jsonb_set(payload, '{data,emergency_telephone}', '0') WHERE event = 'lone_worker.escalated' AND payload->'data'->>'user_name' = $1;", []interface{}{newName}},
+
+		{"DELETE FROM sessiontokens WHERE user_id = $1;", []interface{}{userID}},
+		{"DELETE FROM api_tokens WHERE user_id = $1;", []interface{}{userID}},
+		{"DELETE FROM password_resets WHERE user_id = $1;", []interface{}{userID}},
+		{"DELETE FROM password_reset_requests WHERE user_id = $1;", []interface{}{userID}},
+		{"DELETE FROM login_challenges WHERE user_id = $1;", []interface{}{userID}},
+		{"DELETE FROM user_totp WHERE user_id = $1;", []interface{}{userID}},
+		{"DELETE FROM totp_recovery_codes WHERE user_id = $1;", []interface{}{userID}},
+		{"DELETE FROM notification_optouts WHERE user_id = $1;", []interface{}{userID}},
+		{"DELETE FROM booking_delegates WHERE user_id = $1 OR delegate_id = $1;", []interface{}{userID}},
+		{"DELETE FROM group_move_requests WHERE user_id = $1 AND decided_at IS NULL;", []interface{}{userID}},
+	}
+	for _, s := range statements {
+		if _, err := tx.Exec(s.query, s.args...); err != nil {
+			return "", err
+		}
+	}
+	if err := updateUsernameColumns(tx, oldName, newName); err != nil {
+		return "", err
+	}
+	return newName, tx.Commit()
+}
+
+// CountOtherAdmins takes a user ID and a sql DB connection and returns how many admins there are apart from that user.
+func CountOtherAdmins(userID int, db *sql.DB) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM users WHERE role = 'admin' AND id <> $1 AND erased_at IS NULL;", userID).Scan(&n)
+	return n, err
+}
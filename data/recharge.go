@@ -0,0 +1,245 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// HoodRate is the hourly charge for a hood, which applies to bookings starting on or after EffectiveFrom until a later rate for the same hood takes over.
+type HoodRate struct {
+	ID            int       `json:"id"`
+	HoodNumber    int       `json:"hood_number"`
+	HourlyRate    float64   `json:"hourly_rate"`
+	EffectiveFrom time.Time `json:"effective_from"`
+}
+
+// HoodRatesList is a type defined to characterise an array of the HoodRate struct type variables.
+type HoodRatesList []*HoodRate
+
+// RechargeLine is one row of a monthly recharge report: the hours and cost of one research group's bookings of one hood under one grant code.
+type RechargeLine struct {
+	ResearchGroup string  `json:"research_group"`
+	GrantCode     string  `json:"grant_code"`
+	HoodNumber    int     `json:"hood_number"`
+	Hours         float64 `json:"hours"`
+	Cost          float64 `json:"cost"`
+}
+
+// RechargeReport is the recharge report for a single month.
+// Once a month has been invoiced it is locked, and the report is read from the lines stored at that time rather than being recalculated.
+type RechargeReport struct {
+	Month    string          `json:"month"`
+	Locked   bool            `json:"locked"`
+	LockedAt *time.Time      `json:"locked_at,omitempty"`
+	Lines    []*RechargeLine `json:"lines"`
+}
+
+// FromJSON can be used on HoodRate struct objects.
+// It takes in an io.Reader parameter and decodes the data stored in it into the HoodRate object.
+func (h *HoodRate) FromJSON(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	return dec.Decode(h)
+}
+
+// ToJSON can be used on HoodRatesList type variables.
+// It takes in an io.Writer parameter and encodes the rates to the io.Writer.
+func (h *HoodRatesList) ToJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(h)
+}
+
+// ToJSON can be used on RechargeReport struct objects.
+// It takes in an io.Writer parameter and encodes the report to the io.Writer.
+func (rr *RechargeReport) ToJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(rr)
+}
+
+// ToCSV can be used on RechargeReport struct objects.
+// It takes in an io.Writer parameter and writes one CSV row per report line, with a header row, for export to finance.
+func (rr *RechargeReport) ToCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"month", "research_group", "grant_code", "hood_number", "hours", "cost"})
+
+	for _, line := range rr.Lines {
+		cw.Write([]string{
+			rr.Month,
+			line.ResearchGroup,
+			line.GrantCode,
+			strconv.Itoa(line.HoodNumber),
+			strconv.FormatFloat(line.Hours, 'f', 2, 64),
+			strconv.FormatFloat(line.Cost, 'f', 2, 64),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// AddHoodRate takes a HoodRate struct and a sql DB connection and inserts the rate into the hood_rates table.
+func AddHoodRate(h *HoodRate, db *sql.DB) error {
+	return db.QueryRow("INSERT INTO hood_rates (hood_number, hourly_rate, effective_from) VALUES ($1, $2, $3) RETURNING id;", h.HoodNumber, h.HourlyRate, h.EffectiveFrom).Scan(&h.ID)
+}
+
+// GetHoodRates returns every hood rate stored in the database, ordered by hood and then effective date.
+func GetHoodRates(db *sql.DB) (HoodRatesList, error) {
+	rows, err := db.Query("SELECT id, hood_number, hourly_rate, effective_from FROM hood_rates ORDER BY hood_number, effective_from;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rates := HoodRatesList{}
+	for rows.Next() {
+		var rate HoodRate
+		if err := rows.Scan(&rate.ID, &rate.HoodNumber, &rate.HourlyRate, &rate.EffectiveFrom); err != nil {
+			return nil, err
+		}
+		rates = append(rates, &rate)
+	}
+	return rates, rows.Err()
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx, so a report can be built inside or outside a transaction.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// MonthBounds takes a month in the form YYYY-MM and the lab's time zone, and returns the first instant of that month and the first instant of the next month on the lab's clock.
+func MonthBounds(month string, loc *time.Location) (time.Time, time.Time, error) {
+	start, err := time.ParseInLocation("2006-01", month, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, ErrInvalidMonth
+	}
+	return start, start.AddDate(0, 1, 0), nil
+}
+
+// GetRechargeReport takes a month in the form YYYY-MM, the lab's time zone and a sql DB connection and returns the recharge report for that month.
+// If the month has been locked, the stored lines are returned. Otherwise the report is calculated from the bookings that start in the month and have not been cancelled,
+// each charged at the rate for its hood that was in effect when the booking started. Bookings of hoods with no rate are charged at zero.
+// Each booking is charged to the research group the user belonged to when the booking started, taken from the membership history, so moving group later doesn't move old charges.
+// The user's current group is only used for bookings from before the membership history was kept.
+func GetRechargeReport(month string, loc *time.Location, db *sql.DB) (*RechargeReport, error) {
+	start, end, err := MonthBounds(month, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RechargeReport{Month: month, Lines: []*RechargeLine{}}
+
+	err = db.QueryRow("SELECT locked_at FROM invoice_periods WHERE month = $1;", month).Scan(&report.LockedAt)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if report.LockedAt != nil {
+		report.Locked = true
+		rows, err := db.Query("SELECT research_group, grant_code, hood_number, hours, cost FROM recharge_lines WHERE month = $1 ORDER BY research_group, grant_code, hood_number;", month)
+		if err != nil {
+			return nil, err
+		}
+		report.Lines, err = scanRechargeLines(rows)
+		return report, err
+	}
+
+	report.Lines, err = calculateRechargeLines(start, end, db)
+	return report, err
+}
+
+// calculateRechargeLines takes the bounds of a period and a database or transaction, and works out the recharge lines for the bookings that start in the period.
+func calculateRechargeLines(start, end time.Time, q queryer) ([]*RechargeLine, error) {
+	rows, err := q.Query(`SELECT COALESCE(m.name, u.research_group, ''), b.grant_code, b.hoodnumber,
+		ROUND(SUM(EXTRACT(EPOCH FROM (b.end_date - b.booking_date)) / 3600)::numeric, 2),
+		ROUND(SUM(EXTRACT(EPOCH FROM (b.end_date - b.booking_date)) / 3600 * COALESCE(r.hourly_rate, 0))::numeric, 2)
+		FROM bookings b
+		LEFT JOIN users u ON u.username = b.username
+		LEFT JOIN LATERAL (
+			SELECT g.name FROM research_group_memberships gm JOIN research_groups g ON g.id = gm.group_id
+			WHERE gm.user_id = u.id AND gm.joined_at <= b.booking_date AND (gm.left_at IS NULL OR gm.left_at > b.booking_date)
+			ORDER BY gm.joined_at DESC LIMIT 1
+		) m ON true
+		LEFT JOIN LATERAL (
+			SELECT hourly_rate FROM hood_rates WHERE hood_number = b.hoodnumber AND effective_from <= b.booking_date ORDER BY effective_from DESC LIMIT 1
+		) r ON true
+		WHERE b.cancelled_at IS NULL AND b.booking_date >= $1 AND b.booking_date < $2
+		GROUP BY 1, 2, 3 ORDER BY 1, 2, 3;`, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return scanRechargeLines(rows)
+}
+
+// scanRechargeLines reads every row of a query selecting the research group, grant code, hood number, hours and cost of recharge lines, and closes the rows.
+func scanRechargeLines(rows *sql.Rows) ([]*RechargeLine, error) {
+	defer rows.Close()
+
+	lines := []*RechargeLine{}
+	for rows.Next() {
+		var line RechargeLine
+		if err := rows.Scan(&line.ResearchGroup, &line.GrantCode, &line.HoodNumber, &line.Hours, &line.Cost); err != nil {
+			return nil, err
+		}
+		lines = append(lines, &line)
+	}
+	return lines, rows.Err()
+}
+
+// LockRechargePeriod takes a month in the form YYYY-MM, the lab's time zone and a sql DB connection, and locks the month once it has been invoiced.
+// The report for the month is calculated and its lines are stored, so later edits to bookings or rates can't change the invoiced numbers.
+// The month's lock row is taken first and the report is calculated in the same transaction, so two requests can't both lock the month and the stored lines are the ones worked out under the lock.
+// If the month is already locked, the structured ErrPeriodLocked is returned, and if it hasn't ended yet, ErrPeriodNotEnded is returned, as bookings could still be added to it.
+func LockRechargePeriod(month string, loc *time.Location, db *sql.DB) (*RechargeReport, error) {
+	start, end, err := MonthBounds(month, loc)
+	if err != nil {
+		return nil, err
+	}
+	if end.After(time.Now()) {
+		return nil, ErrPeriodNotEnded
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// the primary key on month stops two concurrent requests from both locking the same month.
+	report := &RechargeReport{Month: month, Locked: true}
+	err = tx.QueryRow("INSERT INTO invoice_periods (month, locked_at) VALUES ($1, NOW()) RETURNING locked_at;", month).Scan(&report.LockedAt)
+	if isUniqueViolation(err) {
+		return nil, ErrPeriodLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if report.Lines, err = calculateRechargeLines(start, end, tx); err != nil {
+		return nil, err
+	}
+	for _, line := range report.Lines {
+		_, err := tx.Exec("INSERT INTO recharge_lines (month, research_group, grant_code, hood_number, hours, cost) VALUES ($1, $2, $3, $4, $5, $6);",
+			month, line.ResearchGroup, line.GrantCode, line.HoodNumber, line.Hours, line.Cost)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return report, tx.Commit()
+}
+
+// IsPeriodLocked takes a time, the lab's time zone and a sql DB connection and reports whether the month containing that time on the lab's clock has been invoiced and locked.
+// Bookings that start in a locked month can't be created, moved or cancelled.
+func IsPeriodLocked(t time.Time, loc *time.Location, db *sql.DB) (bool, error) {
+	var locked bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM invoice_periods WHERE month = $1);", t.In(loc).Format("2006-01")).Scan(&locked)
+	return locked, err
+}
+
+// create structured errors
+var ErrInvalidMonth = fmt.Errorf("invalid month, use YYYY-MM")
+var ErrPeriodLocked = fmt.Errorf("this period has been invoiced and is locked")
+var ErrPeriodNotEnded = fmt.Errorf("this period hasn't ended yet and can't be locked")
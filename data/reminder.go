@@ -0,0 +1,52 @@
+package data
+
+import (
+	"database/sql"
+	"time"
+)
+
+// GetBookingsStartingBetween returns every booking that has not been cancelled, starts after from and no later than until, and has not yet had the reminder of the given kind.
+// offset is how long before the start the reminder is sent. Bookings that were made less than offset before they start are skipped, as the reminder was already late when they were made.
+func GetBookingsStartingBetween(kind string, offset time.Duration, from, until time.Time, db *sql.DB) (BookingsList, error) {
+	return getBookingsForReminder("booking_date", kind, offset, from, until, db)
+}
+
+// GetBookingsEndingBetween returns every booking that has not been cancelled, ends after from and no later than until, and has not yet had the reminder of the given kind.
+// As with start reminders, bookings that were made less than offset before they end are skipped.
+func GetBookingsEndingBetween(kind string, offset time.Duration, from, until time.Time, db *sql.DB) (BookingsList, error) {
+	return getBookingsForReminder("end_date", kind, offset, from, until, db)
+}
+
+// getBookingsForReminder runs the query shared by GetBookingsStartingBetween and GetBookingsEndingBetween against the given column.
+// column is only ever one of the two constants passed by those functions.
+func getBookingsForReminder(column, kind string, offset time.Duration, from, until time.Time, db *sql.DB) (BookingsList, error) {
+	rows, err := db.Query(`SELECT b.id, b.username, b.hoodnumber, b.booking_date, b.end_date FROM bookings b
+		WHERE b.cancelled_at IS NULL AND b.`+column+` > $1 AND b.`+column+` <= $2
+		AND b.created_at <= b.`+column+` - $4 * INTERVAL '1 second'
+		AND NOT EXISTS (SELECT 1 FROM sent_reminders s WHERE s.booking_id = b.id AND s.kind = $3);`, from, until, kind, int64(offset/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var bookingList BookingsList
+	for rows.Next() {
+		var booking Booking
+		if err := rows.Scan(&booking.ID, &booking.UserName, &booking.HoodNumber, &booking.BookingDate, &booking.EndDate); err != nil {
+			return nil, err
+		}
+		bookingList = append(bookingList, &booking)
+	}
+	return bookingList, rows.Err()
+}
+
+// ClaimReminder takes a booking ID, a reminder kind and a sql DB connection and records that the reminder is being sent.
+// It returns true only to the first caller for each booking and kind, so a reminder is never sent twice, even after a restart or when several instances are running.
+func ClaimReminder(bookingID int, kind string, db *sql.DB) (bool, error) {
+	res, err := db.Exec("INSERT INTO sent_reminders (booking_id, kind, sent_at) VALUES ($1, $2, NOW()) ON CONFLICT DO NOTHING;", bookingID, kind)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
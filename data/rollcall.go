@@ -0,0 +1,129 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"io"
+	"time"
+)
+
+// UnknownRoom is the room shown for bookings on hoods that aren't in the hoods table.
+const UnknownRoom = "Unknown room"
+
+// Occupant is someone on the roll-call: a user who is booked on a hood now, or whose booking ended recently.
+// Present is true while the booking is running. LastCheckIn is the user's latest lone-worker check-in for the booking, if they have made one.
+type Occupant struct {
+	BookingID           int        `json:"booking_id"`
+	UserName            string     `json:"user_name"`
+	Email               string     `json:"email"`
+	Emergency_Telephone int        `json:"emergency_telephone"`
+	HoodNumber          int        `json:"hood_number"`
+	BookingDate         time.Time  `json:"booking_time"`
+	EndDate             time.Time  `json:"end_time"`
+	Present             bool       `json:"present"`
+	LastCheckIn         *time.Time `json:"last_check_in"`
+}
+
+// RollCallRoom is the list of occupants of one room.
+type RollCallRoom struct {
+	Room      string      `json:"room"`
+	Occupants []*Occupant `json:"occupants"`
+}
+
+// RollCall is the list of everyone in, or recently in, each room, as used by fire wardens.
+type RollCall struct {
+	GeneratedAt time.Time       `json:"generated_at"`
+	Since       time.Time       `json:"since"`
+	Rooms       []*RollCallRoom `json:"rooms"`
+}
+
+// GetRollCall takes the current time, how far back to include bookings that have ended, an optional room to filter by and a sql DB connection, and returns the roll-call.
+// Rooms are in alphabetical order, and the people in each room are those still present first, then by hood.
+// Only rooms with someone in them are included.
+func GetRollCall(now time.Time, recent time.Duration, room string, db *sql.DB) (*RollCall, error) {
+	rc := &RollCall{GeneratedAt: now, Since: now.Add(-recent), Rooms: []*RollCallRoom{}}
+
+	rows, err := db.Query(`SELECT b.id, b.username, COALESCE(u.email, ''), COALESCE(u.emergency_telephone, 0), b.hoodnumber, b.booking_date, b.end_date,
+		COALESCE(h.room, $4), (SELECT MAX(c.checked_in_at) FROM lone_worker_checkins c WHERE c.booking_id = b.id)
+		FROM bookings b LEFT JOIN users u ON u.username = b.username LEFT JOIN hoods h ON h.hood_number = b.hoodnumber
+		WHERE b.cancelled_at IS NULL AND b.booking_date <= $1 AND b.end_date > $2 AND ($3 = '' OR h.room = $3)
+		ORDER BY COALESCE(h.room, $4), b.end_date <= $1, b.hoodnumber, b.booking_date;`, now, rc.Since, room, UnknownRoom)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var current *RollCallRoom
+	for rows.Next() {
+		var o Occupant
+		var roomName string
+		if err := rows.Scan(&o.BookingID, &o.UserName, &o.Email, &o.Emergency_Telephone, &o.HoodNumber, &o.BookingDate, &o.EndDate, &roomName, &o.LastCheckIn); err != nil {
+			return nil, err
+		}
+		o.Present = o.EndDate.After(now)
+
+		if current == nil || current.Room != roomName {
+			current = &RollCallRoom{Room: roomName}
+			rc.Rooms = append(rc.Rooms, current)
+		}
+		current.Occupants = append(current.Occupants, &o)
+	}
+	return rc, rows.Err()
+}
+
+// ToJSON is called on a RollCall object and takes an io.Writer, returning an error.
+func (rc *RollCall) ToJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(rc)
+}
+
+// ToHTML is called on a RollCall object and takes an io.Writer and the lab's time zone, returning an error.
+// It writes a standalone page laid out to be printed, with one table per room and a column to tick people off.
+// Times are shown in the lab's time zone, which is named on the page.
+func (rc *RollCall) ToHTML(w io.Writer, loc *time.Location) error {
+	return rollCallPage.Execute(w, struct {
+		*RollCall
+		Location *time.Location
+	}{rc, loc})
+}
+
+// rollCallPage is the printable roll-call.
+var rollCallPage = template.Must(template.New("rollcall").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Roll-call {{(.GeneratedAt.In .Location).Format "15:04 Mon 2 Jan 2006"}}</title>
+<style>
+body { font-family: sans-serif; margin: 1.5em; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 1.5em; }
+th, td { border: 1px solid #000; padding: 0.3em 0.5em; text-align: left; }
+th { background: #ddd; }
+td.tick { width: 3em; }
+.left { color: #555; }
+section { page-break-inside: avoid; }
+</style>
+</head>
+<body>
+<h1>Roll-call</h1>
+<p>Generated {{(.GeneratedAt.In .Location).Format "15:04:05 MST Mon 2 Jan 2006"}}. Includes everyone booked on a hood now, and everyone whose booking ended since {{(.Since.In .Location).Format "15:04 MST"}}.</p>
+{{range .Rooms}}<section>
+<h2>{{.Room}}</h2>
+<table>
+<tr><th>Accounted for</th><th>Name</th><th>Hood</th><th>Booked ({{($.GeneratedAt.In $.Location).Format "MST"}})</th><th>Status</th><th>Last check-in</th><th>Emergency telephone</th><th>Email</th></tr>
+{{range .Occupants}}<tr{{if not .Present}} class="left"{{end}}>
+<td class="tick"></td>
+<td>{{.UserName}}</td>
+<td>{{.HoodNumber}}</td>
+<td>{{(.BookingDate.In $.Location).Format "15:04"}} to {{(.EndDate.In $.Location).Format "15:04"}}</td>
+<td>{{if .Present}}Booked on{{else}}Left {{(.EndDate.In $.Location).Format "15:04"}}{{end}}</td>
+<td>{{if .LastCheckIn}}{{(.LastCheckIn.In $.Location).Format "15:04"}}{{end}}</td>
+<td>{{if .Emergency_Telephone}}{{.Emergency_Telephone}}{{end}}</td>
+<td>{{.Email}}</td>
+</tr>
+{{end}}</table>
+</section>
+{{else}}<p>Nobody is booked on a hood.</p>
+{{end}}</body>
+</html>
+`))
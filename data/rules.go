@@ -0,0 +1,116 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"bookings.com/m/config"
+)
+
+// RuleError is returned when a booking breaks one of the configured booking rules.
+// Rule holds the name of the rule as it appears in the config file, so the user can see exactly which limit was hit.
+type RuleError struct {
+	Rule   string
+	Reason string
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("booking rule %s failed: %s", e.Rule, e.Reason)
+}
+
+// CheckBookingRules takes a Booking struct, the BookingRules for the booked hood, the current time and the lab's time zone, and returns an error.
+// Each rule is checked in turn and a *RuleError naming the first rule that is broken is returned.
+// Clock time rules such as latest_start are read on the lab's clock, whatever time zone the booking was sent in.
+// Rules with a zero value are skipped, and nil is returned if the booking passes every rule.
+func CheckBookingRules(b *Booking, rules config.BookingRules, now time.Time, loc *time.Location) error {
+	length := b.EndDate.Sub(b.BookingDate)
+	if length <= 0 {
+		return &RuleError{"end_time", "the booking must end after it starts"}
+	}
+
+	if rules.MaxAdvanceDays > 0 && b.BookingDate.After(now.AddDate(0, 0, rules.MaxAdvanceDays)) {
+		return &RuleError{"max_advance_days", fmt.Sprintf("bookings can only be made up to %d days ahead", rules.MaxAdvanceDays)}
+	}
+
+	if rules.MinNoticeMinutes > 0 && b.BookingDate.Before(now.Add(time.Duration(rules.MinNoticeMinutes)*time.Minute)) {
+		return &RuleError{"min_notice_minutes", fmt.Sprintf("bookings must be made at least %d minutes before they start", rules.MinNoticeMinutes)}
+	}
+
+	if rules.MinLengthMinutes > 0 && length < time.Duration(rules.MinLengthMinutes)*time.Minute {
+		return &RuleError{"min_length_minutes", fmt.Sprintf("bookings must be at least %d minutes long", rules.MinLengthMinutes)}
+	}
+
+	if rules.MaxLengthMinutes > 0 && length > time.Duration(rules.MaxLengthMinutes)*time.Minute {
+		return &RuleError{"max_length_minutes", fmt.Sprintf("bookings can be at most %d minutes long", rules.MaxLengthMinutes)}
+	}
+
+	if rules.LatestStart != "" {
+		latest, err := time.Parse("15:04", rules.LatestStart)
+		if err != nil {
+			return &RuleError{"latest_start", "the configured latest start time is not in HH:MM format"}
+		}
+		local := b.BookingDate.In(loc)
+		start := local.Hour()*60 + local.Minute()
+		if start > latest.Hour()*60+latest.Minute() {
+			return &RuleError{"latest_start", fmt.Sprintf("bookings cannot start later than %s", rules.LatestStart)}
+		}
+	}
+
+	return nil
+}
+
+// CheckBookable takes a Booking struct, the config, the current time and a sql DB connection, and returns an error if the booking can't be stored.
+// It runs every check that a new or moved booking has to pass: the hood must exist and be in service, the booking rules for the hood must be met, the month must not be locked for recharge, the hood must not be closed for maintenance, and the hood and user must be free.
+// The structured errors ErrHoodNotFound, ErrHoodRetired, ErrPeriodLocked, ErrHoodUnderMaintenance and ErrBookingClash, or a *RuleError, are returned for bookings that fail a check, and any other error means the check itself failed.
+// This should be called by every path that creates or moves a booking.
+func CheckBookable(b *Booking, cfg config.Config, now time.Time, db *sql.DB) error {
+	hood, err := GetHoodByNumber(b.HoodNumber, db)
+	if err != nil {
+		return err
+	}
+	if hood.RetiredAt != nil {
+		return ErrHoodRetired
+	}
+
+	loc, err := cfg.Location()
+	if err != nil {
+		return err
+	}
+	if err := CheckBookingRules(b, cfg.BookingRulesFor(b.HoodNumber), now, loc); err != nil {
+		return err
+	}
+
+	locked, err := IsPeriodLocked(b.BookingDate, loc, db)
+	if err != nil {
+		return err
+	}
+	if locked {
+		return ErrPeriodLocked
+	}
+
+	maintenance, err := FindMaintenanceClash(b, db)
+	if err != nil {
+		return err
+	}
+	if maintenance != nil {
+		return ErrHoodUnderMaintenance
+	}
+
+	clash, err := FindClashingBooking(b, db)
+	if err != nil {
+		return err
+	}
+	if clash != nil {
+		return ErrBookingClash
+	}
+	return nil
+}
+
+// IsBookingRejection takes an error returned by CheckBookable and reports whether it means the booking was rejected, rather than that the check failed.
+func IsBookingRejection(err error) bool {
+	if _, ok := err.(*RuleError); ok {
+		return true
+	}
+	return err == ErrHoodNotFound || err == ErrHoodRetired || err == ErrPeriodLocked || err == ErrHoodUnderMaintenance || err == ErrBookingClash
+}
@@ -0,0 +1,155 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// UsageStat holds the booking statistics for one group, e.g. one hood or one research group, over a date range.
+// Only out of hours bookings have lone-worker check-ins, so CheckedBookings, UsedHours, NoShows and NoShowRate only cover those bookings.
+type UsageStat struct {
+	Group            string  `json:"group"`
+	Bookings         int     `json:"bookings"`
+	Cancelled        int     `json:"cancelled"`
+	BookedHours      float64 `json:"booked_hours"`
+	CancellationRate float64 `json:"cancellation_rate"`
+	CheckedBookings  int     `json:"checked_bookings"`
+	UsedHours        float64 `json:"used_hours"`
+	NoShows          int     `json:"no_shows"`
+	NoShowRate       float64 `json:"no_show_rate"`
+}
+
+// UsageStatsList is a type defined to characterise an array of the UsageStat struct type variables.
+type UsageStatsList []*UsageStat
+
+// statGrouping holds the SQL expression used to group bookings, and the expression used to put the groups in a sensible order.
+type statGrouping struct {
+	key   string
+	order string
+}
+
+// statGroupings maps each group_by value accepted by the stats endpoint to its SQL.
+// Only these expressions are ever placed in the query, so the group_by value can't be used for SQL injection.
+// Weekdays and hours are on the lab's clock, with the time zone passed as $4.
+var statGroupings = map[string]statGrouping{
+	"hood":           {"b.hoodnumber::text", "b.hoodnumber"},
+	"room":           {"COALESCE(h.room, '')", "COALESCE(h.room, '')"},
+	"research_group": {"COALESCE(u.research_group, '')", "COALESCE(u.research_group, '')"},
+	"user":           {"b.username", "b.username"},
+	"weekday":        {"TRIM(TO_CHAR(b.booking_date AT TIME ZONE $4, 'Day'))", "EXTRACT(ISODOW FROM b.booking_date AT TIME ZONE $4)"},
+	"hour":           {"LPAD(EXTRACT(HOUR FROM b.booking_date AT TIME ZONE $4)::int::text, 2, '0')", "EXTRACT(HOUR FROM b.booking_date AT TIME ZONE $4)"},
+}
+
+// ValidStatGrouping reports whether groupBy is one of the values accepted by GetUsageStats.
+func ValidStatGrouping(groupBy string) bool {
+	_, ok := statGroupings[groupBy]
+	return ok
+}
+
+// GetUsageStats takes a grouping, a date range, the current time, the lab's time zone and a sql DB connection and returns the usage statistics for every group with bookings starting in that range.
+// Cancelled bookings count towards the number of bookings and the cancellation rate, but not towards booked hours.
+// Check-ins are only asked for during out of hours bookings, so use is measured from those: an out of hours booking that has ended with no check-in is a no-show,
+// and one with check-ins is counted as used from its start until the last check-in.
+func GetUsageStats(groupBy string, from, until, now time.Time, loc *time.Location, db *sql.DB) (UsageStatsList, error) {
+	grouping, ok := statGroupings[groupBy]
+	if !ok {
+		return nil, ErrInvalidGrouping
+	}
+
+	query := fmt.Sprintf(`SELECT %s, COUNT(*), COUNT(b.cancelled_at),
+		COALESCE(SUM(EXTRACT(EPOCH FROM (b.end_date - b.booking_date))) FILTER (WHERE b.cancelled_at IS NULL), 0) / 3600,
+		COUNT(*) FILTER (WHERE b.cancelled_at IS NULL AND b.end_date <= $3 AND lw.lone),
+		COALESCE(SUM(EXTRACT(EPOCH FROM (LEAST(lw.last_check_in, b.end_date) - b.booking_date))) FILTER (WHERE b.cancelled_at IS NULL AND lw.last_check_in IS NOT NULL), 0) / 3600,
+		COUNT(*) FILTER (WHERE b.cancelled_at IS NULL AND b.end_date <= $3 AND lw.lone AND lw.last_check_in IS NULL)
+		FROM bookings b
+		LEFT JOIN hoods h ON h.hood_number = b.hoodnumber
+		LEFT JOIN users u ON u.username = b.username
+		LEFT JOIN LATERAL (
+			SELECT EXISTS (SELECT 1 FROM lone_worker_acknowledgements a WHERE a.booking_id = b.id) AS lone,
+			(SELECT MAX(c.checked_in_at) FROM lone_worker_checkins c WHERE c.booking_id = b.id) AS last_check_in
+		) lw ON true
+		WHERE b.booking_date >= $1 AND b.booking_date < $2
+		GROUP BY 1 ORDER BY MIN(%s);`, grouping.key, grouping.order)
+
+	args := []interface{}{from, until, now}
+	if groupBy == "weekday" || groupBy == "hour" {
+		args = append(args, zoneName(loc))
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := UsageStatsList{}
+	for rows.Next() {
+		var stat UsageStat
+		if err := rows.Scan(&stat.Group, &stat.Bookings, &stat.Cancelled, &stat.BookedHours, &stat.CheckedBookings, &stat.UsedHours, &stat.NoShows); err != nil {
+			return nil, err
+		}
+		if stat.Bookings > 0 {
+			stat.CancellationRate = float64(stat.Cancelled) / float64(stat.Bookings)
+		}
+		if stat.CheckedBookings > 0 {
+			stat.NoShowRate = float64(stat.NoShows) / float64(stat.CheckedBookings)
+		}
+		stats = append(stats, &stat)
+	}
+	return stats, rows.Err()
+}
+
+// zoneName takes a time zone and returns its name for PostgreSQL's AT TIME ZONE.
+// The server's local zone has no name Go can report, so the zone set by the TZ environment variable is used for it, or UTC if that isn't set either.
+func zoneName(loc *time.Location) string {
+	if loc != time.Local {
+		return loc.String()
+	}
+	if tz := os.Getenv("TZ"); tz != "" {
+		return tz
+	}
+	return "UTC"
+}
+
+// ToJSON can be used on UsageStatsList type variables.
+// It takes in an io.Writer parameter, and encodes the statistics to the io.Writer.
+func (s *UsageStatsList) ToJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(s)
+}
+
+// ToCSV can be used on UsageStatsList type variables.
+// It takes in an io.Writer parameter, and writes the statistics to it as CSV with a header row.
+func (s *UsageStatsList) ToCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"group", "bookings", "cancelled", "booked_hours", "cancellation_rate", "checked_bookings", "used_hours", "no_shows", "no_show_rate"})
+
+	for _, stat := range *s {
+		cw.Write([]string{
+			stat.Group,
+			strconv.Itoa(stat.Bookings),
+			strconv.Itoa(stat.Cancelled),
+			formatFloat(stat.BookedHours),
+			formatFloat(stat.CancellationRate),
+			strconv.Itoa(stat.CheckedBookings),
+			formatFloat(stat.UsedHours),
+			strconv.Itoa(stat.NoShows),
+			formatFloat(stat.NoShowRate),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// formatFloat returns the value rounded to 2 decimal places as a string.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 2, 64)
+}
+
+// create structured error
+var ErrInvalidGrouping = fmt.Errorf("invalid grouping")
@@ -0,0 +1,234 @@
+package data
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// maxChallengeAttempts is how many codes can be tried against one login challenge before the password has to be entered again.
+const maxChallengeAttempts = 5
+
+// TOTPSettings is a user's TOTP two-factor enrolment. Confirmed is false until the user has entered a code from their authenticator app.
+// LastStep is the time step of the last code accepted, so a code can't be used twice.
+type TOTPSettings struct {
+	Secret    string
+	Confirmed bool
+	LastStep  int64
+}
+
+// LoginChallenge is a login that has passed the password check and is waiting for a two-factor code.
+type LoginChallenge struct {
+	UserID      int
+	Username    string
+	Provider    string
+	DeviceLabel string
+}
+
+// hashSecret returns the SHA-256 of a recovery code or challenge token, which is what is stored in the database in its place.
+func hashSecret(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// normaliseRecoveryCode removes the dashes and spaces users type in recovery codes, and ignores case.
+func normaliseRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// GetTOTP takes a user ID and a sql DB connection and returns the user's TOTP enrolment.
+// If the user has never started enrolling, the structured ErrTwoFactorNotEnrolled is returned.
+func GetTOTP(userID int, db *sql.DB) (*TOTPSettings, error) {
+	var t TOTPSettings
+	err := db.QueryRow("SELECT secret, confirmed_at IS NOT NULL, last_step FROM user_totp WHERE user_id = $1;", userID).Scan(&t.Secret, &t.Confirmed, &t.LastStep)
+	if err == sql.ErrNoRows {
+		return nil, ErrTwoFactorNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// TwoFactorEnabled takes a user ID and a sql DB connection and reports whether the user has turned on two-factor authentication.
+func TwoFactorEnabled(userID int, db *sql.DB) (bool, error) {
+	var enabled bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL);", userID).Scan(&enabled)
+	return enabled, err
+}
+
+// SetPendingTOTP takes a user ID, a new TOTP secret and a sql DB connection, and starts the user's enrolment with the secret.
+// Starting again replaces an unconfirmed secret. If two-factor is already enabled, the structured ErrTwoFactorEnabled is returned.
+func SetPendingTOTP(userID int, secret string, db *sql.DB) error {
+	res, err := db.Exec(`INSERT INTO user_totp (user_id, secret, created_at, last_step) VALUES ($1, $2, NOW(), 0)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, created_at = EXCLUDED.created_at, last_step = 0
+		WHERE user_totp.confirmed_at IS NULL;`, userID, secret)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTwoFactorEnabled
+	}
+	return nil
+}
+
+// ConfirmTOTP takes a user ID, the time step of the code the user entered and a sql DB connection, and turns on two-factor for the user.
+func ConfirmTOTP(userID int, step int64, db *sql.DB) error {
+	res, err := db.Exec("UPDATE user_totp SET confirmed_at = NOW(), last_step = $2 WHERE user_id = $1 AND confirmed_at IS NULL;", userID, step)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTwoFactorNotEnrolled
+	}
+	return nil
+}
+
+// UseTOTPStep takes a user ID, the time step of an accepted code and a sql DB connection, and records the step as used.
+// It returns false if the step, or a later one, has already been used, so the same code can't be replayed.
+func UseTOTPStep(userID int, step int64, db *sql.DB) (bool, error) {
+	res, err := db.Exec("UPDATE user_totp SET last_step = $2 WHERE user_id = $1 AND last_step < $2;", userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// DeleteTOTP takes a user ID and a sql DB connection and turns off two-factor for the user, removing their secret and recovery codes.
+func DeleteTOTP(userID int, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM user_totp WHERE user_id = $1;", userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTwoFactorNotEnrolled
+	}
+	if _, err := tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = $1;", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReplaceRecoveryCodes takes a user ID, a new set of recovery codes and a sql DB connection, and replaces the user's recovery codes with hashes of the new ones.
+func ReplaceRecoveryCodes(userID int, codes []string, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM totp_recovery_codes WHERE user_id = $1;", userID); err != nil {
+		return err
+	}
+	for _, code := range codes {
+		if _, err := tx.Exec("INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES ($1, $2);", userID, hashSecret(normaliseRecoveryCode(code))); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UseRecoveryCode takes a user ID, a recovery code and a sql DB connection, and marks the code as used.
+// It returns false if the code is wrong or has already been used.
+func UseRecoveryCode(userID int, code string, db *sql.DB) (bool, error) {
+	res, err := db.Exec("UPDATE totp_recovery_codes SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL;",
+		userID, hashSecret(normaliseRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// CountRecoveryCodes takes a user ID and a sql DB connection and returns how many unused recovery codes the user has left.
+func CountRecoveryCodes(userID int, db *sql.DB) (int, error) {
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM totp_recovery_codes WHERE user_id = $1 AND used_at IS NULL;", userID).Scan(&n)
+	return n, err
+}
+
+// GetTwoFactorRoles takes a sql DB connection and returns the roles that must use two-factor authentication.
+func GetTwoFactorRoles(db *sql.DB) ([]string, error) {
+	var roles []string
+	err := db.QueryRow("SELECT COALESCE(ARRAY_AGG(role ORDER BY role), '{}') FROM role_settings WHERE require_two_factor;").Scan(pq.Array(&roles))
+	return roles, err
+}
+
+// SetRoleRequiresTwoFactor takes a role, whether its users must use two-factor authentication and a sql DB connection, and stores the setting.
+func SetRoleRequiresTwoFactor(role string, required bool, db *sql.DB) error {
+	_, err := db.Exec(`INSERT INTO role_settings (role, require_two_factor) VALUES ($1, $2)
+		ON CONFLICT (role) DO UPDATE SET require_two_factor = EXCLUDED.require_two_factor;`, role, required)
+	return err
+}
+
+// RoleRequiresTwoFactor takes a role and a sql DB connection and reports whether users with the role must use two-factor authentication.
+func RoleRequiresTwoFactor(role string, db *sql.DB) (bool, error) {
+	var required bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM role_settings WHERE role = $1 AND require_two_factor);", role).Scan(&required)
+	return required, err
+}
+
+// NeedsTwoFactorEnrolment takes a user ID, their role and a sql DB connection, and reports whether the user's role requires two-factor authentication but they haven't turned it on.
+// Users who log in with OpenID Connect are left out, as their identity provider handles the second factor.
+func NeedsTwoFactorEnrolment(userID int, role string, db *sql.DB) (bool, error) {
+	var needs bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM role_settings WHERE role = $2 AND require_two_factor)
+		AND NOT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL)
+		AND NOT EXISTS (SELECT 1 FROM users WHERE id = $1 AND auth_provider = 'oidc');`, userID, role).Scan(&needs)
+	return needs, err
+}
+
+// AddLoginChallenge takes a login that has passed the password check, the challenge token given to the client, how long the challenge lasts and a sql DB connection, and stores a hash of the token.
+func AddLoginChallenge(c *LoginChallenge, token string, validFor time.Duration, db *sql.DB) error {
+	_, err := db.Exec(`INSERT INTO login_challenges (token_hash, user_id, username, provider, device_label, attempts, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, 0, NOW(), $6);`, hashSecret(token), c.UserID, c.Username, c.Provider, c.DeviceLabel, time.Now().Add(validFor))
+	return err
+}
+
+// TryLoginChallenge takes a challenge token and a sql DB connection and returns the waiting login, counting this as one attempt at a code.
+// If the challenge is unknown, has expired or has had too many attempts, the structured ErrChallengeNotFound is returned.
+func TryLoginChallenge(token string, db *sql.DB) (*LoginChallenge, error) {
+	var c LoginChallenge
+	err := db.QueryRow(`UPDATE login_challenges SET attempts = attempts + 1
+		WHERE token_hash = $1 AND expires_at > NOW() AND attempts < $2
+		RETURNING user_id, username, provider, device_label;`, hashSecret(token), maxChallengeAttempts).Scan(&c.UserID, &c.Username, &c.Provider, &c.DeviceLabel)
+	if err == sql.ErrNoRows {
+		return nil, ErrChallengeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// DeleteLoginChallenge takes a challenge token and a sql DB connection and removes the challenge once the login has finished.
+func DeleteLoginChallenge(token string, db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM login_challenges WHERE token_hash = $1;", hashSecret(token))
+	return err
+}
+
+// DeleteExpiredLoginChallenges takes a sql DB connection and removes every login challenge that has expired, returning how many were removed.
+func DeleteExpiredLoginChallenges(db *sql.DB) (int64, error) {
+	res, err := db.Exec("DELETE FROM login_challenges WHERE expires_at <= NOW();")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// create structured errors
+var ErrTwoFactorNotEnrolled = fmt.Errorf("two-factor authentication is not set up")
+var ErrTwoFactorEnabled = fmt.Errorf("two-factor authentication is already turned on")
+var ErrChallengeNotFound = fmt.Errorf("login challenge is invalid or has expired, please log in again")
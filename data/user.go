@@ -2,112 +2,77 @@ package data
 
 import (
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"reflect"
+	"strings"
 
-	"bookings.com/m/database"
+	"github.com/lib/pq"
 )
 
 // User struct created with necessary information to identify each user.
+// This is the storage struct for the users table. Handlers decode requests into, and encode responses from, their own types, so the password hash is never serialised.
 type User struct {
 	ID                  int    `json:"id"`
 	Name                string `json:"name"`
-	Hash                string `json:"hash"`
+	Hash                string `json:"-"`
 	Email               string `json:"email"`
 	Emergency_Telephone int    `json:"emergency_telephone"`
 	Research_Group      string `json:"research_group"`
 }
 
 // UsersList is a type defined to characterise an array of the User struct type variables.
-// This is mainly used for defining the temporary userlist, and also in GET/PUT requests of the current registered users.
+// This is used in GET requests of the current registered users.
 type UsersList []*User
 
-var UserList UsersList
-
-// GetUsers returns the temporary userlist.
-// This userList is to be used as a test for HTTP requests while a database is not incorporated into the project.
-func GetUsers(db *sql.DB) UsersList {
-	rows, err := db.Query("SELECT id, username, email, emergency_telephone, research_group FROM users;")
+// GetUsers takes a sql DB connection and returns every user who hasn't been erased, in ID order.
+// A new list is built on every call, so users are never repeated between requests.
+func GetUsers(db *sql.DB) (UsersList, error) {
+	rows, err := db.Query("SELECT id, username, email, emergency_telephone, research_group FROM users WHERE erased_at IS NULL ORDER BY id;")
 	if err != nil {
-		return nil
+		return nil, err
 	}
+	defer rows.Close()
 
+	users := UsersList{}
 	for rows.Next() {
 		var user User
 		err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.Emergency_Telephone, &user.Research_Group)
 		if err != nil {
-			return nil
+			return nil, err
 		}
-		UserList = append(UserList, &user)
+		users = append(users, &user)
 	}
-	return UserList
-}
-
-// FromJSON can be used on User type objects.
-// It takes in an io.Reader parameter, and instantiates a decoder that writes to the io.Reader.
-// Uses the json decoder to decode the data stored in the io.Reader and store this data in the User object.
-func (u *User) FromJSON(r io.Reader) error {
-	dec := json.NewDecoder(r)
-	return dec.Decode(u)
-}
-
-// ToJSON can be used on UsersList type objects.
-// It takes in an io.Writer parameter, and instantiates an encoder that writes to the io.Writer.
-// Uses the json encoder to encode the data stored in the User object to the io.Writer.
-func (u *UsersList) ToJSON(w io.Writer) error {
-	enc := json.NewEncoder(w)
-	return enc.Encode(u)
+	return users, rows.Err()
 }
 
 // AddUser takes a User struct object as a parameter.
-// It calls the function GetNextUserID to collect the next available user ID and assign it to the passed User struct object.
-// The user object is then inserted into the database.
+// The user's ID is assigned by the database and set on the passed User struct object.
+// The user object is then inserted into the database, and the user's membership of their research group is recorded.
 func AddUser(u *User, db *sql.DB) error {
-	u.ID = GetNextUserID(db)
-	if u.ID == -1 {
-		return database.ErrDBQueryError
+	// Add user object to database, taking the ID from the table's sequence.
+	err := db.QueryRow("INSERT INTO users (username, passhash, email, emergency_telephone, research_group) VALUES ($1, $2, $3, $4, $5) RETURNING id;",
+		u.Name, u.Hash, u.Email, u.Emergency_Telephone, u.Research_Group).Scan(&u.ID)
+	if isUsernameViolation(err) {
+		return ErrUsernameTaken
 	}
-
-	// Add user object to database.
-	_, err := db.Exec("INSERT INTO users (id, username, passhash, email, emergency_telephone, research_group) VALUES ($1, $2, $3, $4, $5, $6)", u.ID, u.Name, u.Hash, u.Email, u.Emergency_Telephone, u.Research_Group)
 	if err != nil {
 		return err
 	}
-	return nil
+	return recordMembership(db, u.ID, u.Research_Group)
 }
 
-// GetNextUserID is used to find the next numerical ID number and returns an integer of that value.
-// Using the length of the UserList, it finds the ID of the last added booking and returns that value plus 1.
-func GetNextUserID(db *sql.DB) int {
-	var maxID int
-	// db query
-	rows, err := db.Query("SELECT MAX(id) FROM users;")
-	if err != nil {
-		return -1
-	}
-
-	// check if no rows found
-	if !rows.Next() {
-		if err = rows.Err(); err != nil {
-			if err == sql.ErrNoRows {
-				return 1
-			} else {
-				fmt.Println(err)
-				return -1
-			}
-		}
-	}
-	rows.Scan(&maxID)
-	return maxID + 1
+// isUsernameViolation reports whether an error is a breach of the unique index on usernames, which two registrations of the same name at once can cause.
+func isUsernameViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505" && pqErr.Constraint == "users_username"
 }
 
 // UpdateUser takes a user ID and a User struct object as parameters and returns an error.
 // This function finds the position of the user in the UserList based on their ID, and assigns the passed id to the User struct object.
 // The User object at the position located during the function is then overwritten by the passed User parameter.
 // TODO: currently all user info is overwritten apart from ID, so need to ensure that if no data was supplied in the PUT that the field is not changed.
+// Changing the email address clears its verification, so the account can't be logged in to again until the new address is verified.
 func UpdateUser(rw http.ResponseWriter, id int, u *User, db *sql.DB) {
 	// TODO: update findUser to query db
 	matchedUser, err := findUser(id, db)
@@ -125,34 +90,178 @@ func UpdateUser(rw http.ResponseWriter, id int, u *User, db *sql.DB) {
 	// go through the data from the request, and any empty fields replace with the data currently stored before updating the userList.
 	replaceEmptyFields(matchedUser, u)
 
+	if IsReservedUsername(u.Name) && !strings.EqualFold(u.Name, matchedUser.Name) {
+		http.Error(rw, "Usernames starting with erased-user- are reserved", http.StatusBadRequest)
+		return
+	}
+
+	// usernames are unique ignoring case, as logins and lockouts treat "Alice" and "alice" as the same account
+	var taken bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE LOWER(username) = LOWER(TRIM($1)) AND id <> $2);", u.Name, id).Scan(&taken); err != nil {
+		http.Error(rw, "Error checking username", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(rw, "A user with that name already exists", http.StatusBadRequest)
+		return
+	}
+
+	// the user, every table that refers to them by name and their membership history are updated together
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(rw, "Error updating user database record", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
 	// update database entry for the user, not local storage
-	_, err = db.Exec("UPDATE users SET username = $1, email = $2, emergency_telephone = $3, research_group = $4 WHERE id = $5;", u.Name, u.Email, u.Emergency_Telephone, u.Research_Group, id)
+	// a new email address isn't verified until the user follows the link sent to it
+	_, err = tx.Exec(`UPDATE users SET username = $1, email = $2, emergency_telephone = $3, research_group = $4,
+		email_verified_at = CASE WHEN LOWER(email) = LOWER($2) THEN email_verified_at END WHERE id = $5;`,
+		u.Name, u.Email, u.Emergency_Telephone, u.Research_Group, id)
+	if isUsernameViolation(err) {
+		http.Error(rw, "A user with that name already exists", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(rw, "Error updating user database record", http.StatusBadRequest)
 		return
 	}
+
+	if u.Name != matchedUser.Name {
+		if err := renameUsername(tx, id, matchedUser.Name, u.Name); err != nil {
+			http.Error(rw, "Error renaming user", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// keep the research group membership history up to date
+	if err := recordMembership(tx, id, u.Research_Group); err != nil {
+		http.Error(rw, "Error updating research group membership", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(rw, "Error updating user database record", http.StatusInternalServerError)
+		return
+	}
+}
+
+// usernameColumns are the columns outside the users table that refer to a user by name.
+// Renaming or erasing a user updates every one of them, so a column added here is kept in step by both.
+var usernameColumns = []struct{ table, column string }{
+	{"bookings", "username"},
+	{"bookings", "booked_by"},
+	{"booking_requests", "username"},
+	{"lone_worker_acknowledgements", "username"},
+	{"lone_worker_escalations", "username"},
+	{"lone_worker_escalations", "resolved_by"},
+	{"maintenance_windows", "created_by"},
+	{"login_challenges", "username"},
+}
+
+// updateUsernameColumns takes a transaction and a user's old and new names, and updates every column in usernameColumns to the new name.
+func updateUsernameColumns(tx *sql.Tx, oldName, newName string) error {
+	for _, c := range usernameColumns {
+		if _, err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s = $2 WHERE %s = $1;", c.table, c.column, c.column), oldName, newName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renameUsername takes a transaction, a user ID and the user's old and new names, and moves everything that refers to the user by name over to the new name.
+// The login audit log and any lockout follow the account too, so a rename can't be used to get round a lockout.
+// Events that have already been sent keep the name the user had at the time.
+func renameUsername(tx *sql.Tx, userID int, oldName, newName string) error {
+	if err := updateUsernameColumns(tx, oldName, newName); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE login_attempts SET username = $3 WHERE user_id = $1 OR username = $2;", userID, normaliseUsername(oldName), normaliseUsername(newName)); err != nil {
+		return err
+	}
+	if normaliseUsername(oldName) == normaliseUsername(newName) {
+		return nil
+	}
+	// names are unique ignoring case, so a lockout of the new name can only be from attempts on an account that didn't exist
+	if _, err := tx.Exec("DELETE FROM account_lockouts WHERE username = $1;", normaliseUsername(newName)); err != nil {
+		return err
+	}
+	_, err := tx.Exec("UPDATE account_lockouts SET username = $2 WHERE username = $1;", normaliseUsername(oldName), normaliseUsername(newName))
+	return err
 }
 
 // findUser takes a user ID as a parameter and returns the corresponding User object, the position of this user in the UserList, and an error.
 // If no corresponding ID is found, the function returns the structured ErrUserNotFound alongside nil values for the other return values.
 func findUser(id int, db *sql.DB) (*User, error) {
 	// query db for user
-	rows, err := db.Query("SELECT id, username, passhash, email, emergency_telephone, research_group FROM users WHERE id = $1;", id)
+	rows, err := db.Query("SELECT id, username, passhash, email, emergency_telephone, research_group FROM users WHERE id = $1 AND erased_at IS NULL;", id)
 	if err != nil {
 		return nil, ErrUserNotFound
 	}
 
+	defer rows.Close()
+
 	var user User
 
-	for rows.Next() {
-		err := rows.Scan(&user.ID, &user.Name, &user.Hash, &user.Email, &user.Emergency_Telephone, &user.Research_Group)
-		if err != nil {
-			return nil, ErrUserNotFound
-		}
+	if !rows.Next() {
+		return nil, ErrUserNotFound
+	}
+	err = rows.Scan(&user.ID, &user.Name, &user.Hash, &user.Email, &user.Emergency_Telephone, &user.Research_Group)
+	if err != nil {
+		return nil, ErrUserNotFound
+	}
+	return &user, nil
+}
+
+// GetUserByID takes a user ID and a sql DB connection and returns the matching User struct object and an error.
+// The stored password hash is cleared before the user is returned, so it can't be leaked by callers outside this package.
+func GetUserByID(id int, db *sql.DB) (*User, error) {
+	user, err := findUser(id, db)
+	if err != nil {
+		return nil, err
+	}
+	user.Hash = ""
+	return user, nil
+}
+
+// GetUserByName takes a username and a sql DB connection and returns the matching User struct object and an error.
+// As with GetUserByID, the stored password hash is cleared before the user is returned.
+func GetUserByName(name string, db *sql.DB) (*User, error) {
+	var user User
+	err := db.QueryRow("SELECT id, username, email, emergency_telephone, research_group FROM users WHERE username = $1;", name).
+		Scan(&user.ID, &user.Name, &user.Email, &user.Emergency_Telephone, &user.Research_Group)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
 	}
 	return &user, nil
 }
 
+// GetUserRole takes a user ID and a sql DB connection and returns the role the user holds.
+// Roles are kept out of the User struct so they can't be changed through a profile update.
+func GetUserRole(id int, db *sql.DB) (string, error) {
+	var role string
+	err := db.QueryRow("SELECT role FROM users WHERE id = $1;", id).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	return role, err
+}
+
+// SetUserRole takes a user ID, a role and a sql DB connection and gives the user that role.
+func SetUserRole(id int, role string, db *sql.DB) error {
+	res, err := db.Exec("UPDATE users SET role = $1 WHERE id = $2;", role, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
 // replaceEmptyFields takes two pointers to User struct objects.
 // One of these is pulled from the userList and contains the current data.
 // One contains data that has been passed by a user in a PUT request.
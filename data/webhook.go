@@ -0,0 +1,267 @@
+package data
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// WebhookEvents lists every event type that webhooks can subscribe to.
+var WebhookEvents = []string{
+	"booking.created",
+	"booking.moved",
+	"booking.cancelled",
+	"hood.created",
+	"hood.updated",
+	"hood.retired",
+	"hood.deleted",
+	"hood.maintenance",
+	"user.created",
+	"user.erased",
+	"lone_worker.escalated",
+}
+
+// Webhook is an endpoint registered by an admin to be sent the events it subscribes to.
+// Secret is used to sign every delivery. It is only returned when the webhook is created.
+type Webhook struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhooksList is a type defined to characterise an array of the Webhook struct type variables.
+type WebhooksList []*Webhook
+
+// WebhookDelivery is a single event waiting to be, or having been, sent to a webhook.
+// Deliveries are stored in the database as an outbox, so events that have not been delivered survive a crash or restart.
+type WebhookDelivery struct {
+	ID            int             `json:"id"`
+	WebhookID     int             `json:"webhook_id"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	LastError     string          `json:"last_error,omitempty"`
+	ResponseCode  int             `json:"response_code,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
+	DeliveredAt   *time.Time      `json:"delivered_at,omitempty"`
+
+	// URL and Secret are filled in from the webhook when a delivery is claimed to be sent.
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// WebhookDeliveriesList is a type defined to characterise an array of the WebhookDelivery struct type variables.
+type WebhookDeliveriesList []*WebhookDelivery
+
+// statuses used by webhook deliveries
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// FromJSON can be used on Webhook struct objects.
+// It takes in an io.Reader parameter and decodes the data stored in it into the Webhook object.
+func (wh *Webhook) FromJSON(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	return dec.Decode(wh)
+}
+
+// ToJSON can be used on Webhook struct objects.
+// It takes in an io.Writer parameter and encodes the webhook to the io.Writer.
+func (wh *Webhook) ToJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(wh)
+}
+
+// ToJSON can be used on WebhooksList type variables.
+// It takes in an io.Writer parameter and encodes the webhooks to the io.Writer.
+func (wl *WebhooksList) ToJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(wl)
+}
+
+// ToJSON can be used on WebhookDeliveriesList type variables.
+// It takes in an io.Writer parameter and encodes the deliveries to the io.Writer.
+func (dl *WebhookDeliveriesList) ToJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(dl)
+}
+
+// ValidWebhookEvent reports whether event is one of the WebhookEvents.
+func ValidWebhookEvent(event string) bool {
+	for _, e := range WebhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// AddWebhook takes a Webhook struct and a sql DB connection and inserts the webhook into the webhooks table as active.
+func AddWebhook(wh *Webhook, db *sql.DB) error {
+	wh.Active = true
+	return db.QueryRow("INSERT INTO webhooks (url, secret, events, active, created_at) VALUES ($1, $2, $3, $4, NOW()) RETURNING id, created_at;",
+		wh.URL, wh.Secret, pq.Array(wh.Events), wh.Active).Scan(&wh.ID, &wh.CreatedAt)
+}
+
+// GetWebhooks returns every registered webhook, without their secrets.
+func GetWebhooks(db *sql.DB) (WebhooksList, error) {
+	rows, err := db.Query("SELECT id, url, events, active, created_at FROM webhooks ORDER BY id;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := WebhooksList{}
+	for rows.Next() {
+		var wh Webhook
+		if err := rows.Scan(&wh.ID, &wh.URL, pq.Array(&wh.Events), &wh.Active, &wh.CreatedAt); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, &wh)
+	}
+	return webhooks, rows.Err()
+}
+
+// DeactivateWebhook takes a webhook ID and a sql DB connection and stops any further events being sent to it.
+// Deliveries that are still waiting to be sent are marked as failed in the same transaction.
+// The webhook is kept, rather than deleted, so its delivery log is still available.
+func DeactivateWebhook(id int, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE webhooks SET active = false WHERE id = $1;", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrWebhookNotFound
+	}
+	if _, err := tx.Exec("UPDATE webhook_deliveries SET status = $1, last_error = 'webhook deactivated' WHERE webhook_id = $2 AND status = $3;",
+		DeliveryFailed, id, DeliveryPending); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PublishWebhookEvent takes an event, the data describing it and a sql DB connection, and adds a pending delivery to the outbox for every active webhook subscribed to the event.
+// The data is wrapped in an envelope with the event name and the time it happened.
+func PublishWebhookEvent(event string, v interface{}, db *sql.DB) error {
+	payload, err := json.Marshal(struct {
+		Event      string      `json:"event"`
+		OccurredAt time.Time   `json:"occurred_at"`
+		Data       interface{} `json:"data"`
+	}{event, time.Now().UTC(), v})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`INSERT INTO webhook_deliveries (webhook_id, event, payload, status, attempts, next_attempt_at, last_error, created_at)
+		SELECT id, $1, $2, $3, 0, NOW(), '', NOW() FROM webhooks WHERE active AND $1 = ANY(events);`, event, payload, DeliveryPending)
+	return err
+}
+
+// ClaimWebhookDeliveries takes a limit and a sql DB connection, and returns up to that many pending deliveries that are due to be sent.
+// Each claimed delivery has its next attempt pushed back by lease, so if several instances are running, or this one crashes mid-send, the delivery is only retried once the lease runs out.
+// Deliveries to webhooks that have been deactivated are never claimed.
+func ClaimWebhookDeliveries(limit int, lease time.Duration, db *sql.DB) (WebhookDeliveriesList, error) {
+	rows, err := db.Query(`UPDATE webhook_deliveries d SET next_attempt_at = NOW() + $3 * INTERVAL '1 second'
+		FROM webhooks w
+		WHERE w.id = d.webhook_id AND w.active AND d.id IN (
+			SELECT id FROM webhook_deliveries WHERE status = $1 AND next_attempt_at <= NOW()
+			AND webhook_id IN (SELECT id FROM webhooks WHERE active) ORDER BY id LIMIT $2 FOR UPDATE SKIP LOCKED
+		)
+		RETURNING d.id, d.webhook_id, d.event, d.payload, d.attempts, w.url, w.secret;`, DeliveryPending, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries WebhookDeliveriesList
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Attempts, &d.URL, &d.Secret); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, &d)
+	}
+	return deliveries, rows.Err()
+}
+
+// RecordWebhookDelivered marks a delivery as delivered, along with the response code returned by the endpoint.
+func RecordWebhookDelivered(id, responseCode int, db *sql.DB) error {
+	_, err := db.Exec("UPDATE webhook_deliveries SET status = $1, attempts = attempts + 1, response_code = $2, last_error = '', delivered_at = NOW() WHERE id = $3;",
+		DeliveryDelivered, responseCode, id)
+	return err
+}
+
+// RecordWebhookFailure records a failed attempt at a delivery.
+// If retryAt is zero, the delivery has run out of retries and is marked as failed, otherwise it stays pending until retryAt.
+func RecordWebhookFailure(id, responseCode int, lastError string, retryAt time.Time, db *sql.DB) error {
+	status := DeliveryPending
+	if retryAt.IsZero() {
+		status = DeliveryFailed
+		retryAt = time.Now()
+	}
+	_, err := db.Exec("UPDATE webhook_deliveries SET status = $1, attempts = attempts + 1, response_code = $2, last_error = $3, next_attempt_at = $4 WHERE id = $5;",
+		status, responseCode, lastError, retryAt, id)
+	return err
+}
+
+// GetWebhookDeliveries takes a webhook ID and a sql DB connection and returns the delivery log for that webhook, newest first, up to 100 entries.
+func GetWebhookDeliveries(webhookID int, db *sql.DB) (WebhookDeliveriesList, error) {
+	rows, err := db.Query(`SELECT id, webhook_id, event, payload, status, attempts, next_attempt_at, last_error, COALESCE(response_code, 0), created_at, delivered_at
+		FROM webhook_deliveries WHERE webhook_id = $1 ORDER BY id DESC LIMIT 100;`, webhookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := WebhookDeliveriesList{}
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Payload, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.LastError, &d.ResponseCode, &d.CreatedAt, &d.DeliveredAt); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, &d)
+	}
+	return deliveries, rows.Err()
+}
+
+// RedeliverWebhook takes a delivery ID and a sql DB connection and puts the delivery back in the outbox to be sent straight away, whatever its current status.
+// The attempt count is reset so it gets the full set of retries again.
+// Deliveries to a webhook that has been deactivated can't be sent again, and the structured ErrWebhookInactive is returned.
+func RedeliverWebhook(id int, db *sql.DB) error {
+	var active bool
+	err := db.QueryRow("SELECT w.active FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id WHERE d.id = $1;", id).Scan(&active)
+	if err == sql.ErrNoRows {
+		return ErrWebhookDeliveryNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !active {
+		return ErrWebhookInactive
+	}
+
+	_, err = db.Exec("UPDATE webhook_deliveries SET status = $1, attempts = 0, next_attempt_at = NOW(), delivered_at = NULL WHERE id = $2;", DeliveryPending, id)
+	return err
+}
+
+// create structured errors
+var ErrWebhookNotFound = fmt.Errorf("webhook not found")
+var ErrWebhookDeliveryNotFound = fmt.Errorf("webhook delivery not found")
+var ErrWebhookInactive = fmt.Errorf("webhook has been deactivated")
@@ -10,15 +10,12 @@ import (
 )
 
 func InitialiseConnection(l *log.Logger) (*sql.DB, error) {
-	configFileName := "config/config.json"
-
-	config, err := config.ReadConfigFile(configFileName)
+	config, err := config.ReadConfigFile(config.FileName)
 	if err != nil {
 		return nil, err
 	}
 
-	connStr := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", config.Database.Host, config.Database.Port, config.Database.Username, config.Database.Password, config.Database.DBName)
-	db, err := sql.Open("postgres", connStr)
+	db, err := sql.Open("postgres", ConnectionString(config))
 	if err != nil {
 		return nil, err
 	}
@@ -33,4 +30,9 @@ func InitialiseConnection(l *log.Logger) (*sql.DB, error) {
 	return db, nil
 }
 
+// ConnectionString takes a Config struct and returns the connection string for the PostgreSQL database it describes.
+func ConnectionString(cfg config.Config) string {
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", cfg.Database.Host, cfg.Database.Port, cfg.Database.Username, cfg.Database.Password, cfg.Database.DBName)
+}
+
 var ErrDBQueryError = fmt.Errorf("error querying database")
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"bookings.com/m/auth"
+	"bookings.com/m/data"
+	"bookings.com/m/database"
+	"bookings.com/m/session"
+)
+
+// apiTokenPrefix starts every API token, so they are easy to recognise in scripts and secret scanners.
+const apiTokenPrefix = "hbk_"
+
+// APITokens struct is created to enable dependency injection of a logger.
+type APITokens struct {
+	l *log.Logger
+}
+
+// apiTokenRequest is the body of a POST request to /tokens.
+// ExpiresAt is optional, and a token without it lasts until it is revoked.
+type apiTokenRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// NewAPITokenHandler takes a logger object and returns an APITokens object.
+// This function is used in the main() function to return the APITokens handler that is required to pass to the created servemux.
+func NewAPITokenHandler(l *log.Logger) *APITokens {
+	return &APITokens{l}
+}
+
+// ServeHTTP is called on an APITokens object.
+// It takes an http ResponseWriter and Request as parameters.
+// GET /tokens lists the logged in user's API tokens, POST /tokens creates one and DELETE /tokens/{id} revokes one.
+// New tokens can only be created from a logged in session, so a leaked token can't be used to create more.
+func (at *APITokens) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	// Initialise database connection
+	db, err := database.InitialiseConnection(at.l)
+	if err != nil {
+		at.l.Println("Database connection error", err)
+		return
+	}
+	defer db.Close()
+
+	p := authorise(rw, r, db, auth.Authenticated)
+	if p == nil {
+		return
+	}
+
+	collection := r.URL.Path == "/tokens" || r.URL.Path == "/tokens/"
+
+	switch {
+	case collection && r.Method == http.MethodGet:
+		at.getTokens(rw, p.UserID, db)
+	case collection && r.Method == http.MethodPost:
+		if p.ViaAPIToken {
+			http.Error(rw, "Permission Denied, API tokens can only be created from a logged in session", http.StatusForbidden)
+			return
+		}
+		at.addToken(rw, r, p.UserID, db)
+	case !collection && r.Method == http.MethodDelete:
+		id, err := getIDFromURI(r.URL.Path)
+		if err != nil {
+			http.Error(rw, "Invalid URI", http.StatusBadRequest)
+			return
+		}
+		at.revokeToken(rw, p.UserID, id, db)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// getTokens encodes the user's API tokens to the ResponseWriter. The tokens themselves are never included.
+func (at *APITokens) getTokens(rw http.ResponseWriter, userID int, db *sql.DB) {
+	at.l.Println("Handling GET request for API tokens")
+
+	tokens, err := data.GetAPITokens(userID, db)
+	if err != nil {
+		at.l.Println(err)
+		http.Error(rw, "Error retrieving API tokens", http.StatusInternalServerError)
+		return
+	}
+	if err := tokens.ToJSON(rw); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+// addToken creates a new API token for the user and returns it.
+// This is the only time the token is shown, as only a hash of it is stored.
+func (at *APITokens) addToken(rw http.ResponseWriter, r *http.Request, userID int, db *sql.DB) {
+	at.l.Println("Handling POST request for API tokens")
+
+	var req apiTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Scopes) == 0 {
+		http.Error(rw, "Please give the token a name and at least one scope", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !auth.ValidScope(scope) {
+			http.Error(rw, "Unknown scope "+scope+", use read, bookings:write or all", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		http.Error(rw, "expires_at must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	secret, err := session.GenerateSecureToken(32)
+	if err != nil {
+		http.Error(rw, "Error creating API token", http.StatusInternalServerError)
+		return
+	}
+	token := &data.APIToken{Name: req.Name, Scopes: req.Scopes, ExpiresAt: req.ExpiresAt, Token: apiTokenPrefix + secret}
+	if err := data.AddAPIToken(userID, token, db); err != nil {
+		at.l.Println(err)
+		http.Error(rw, "Error creating API token", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusCreated)
+	json.NewEncoder(rw).Encode(token)
+}
+
+// revokeToken revokes one of the user's API tokens, so it can no longer be used.
+func (at *APITokens) revokeToken(rw http.ResponseWriter, userID, id int, db *sql.DB) {
+	at.l.Println("Handling DELETE request for API token", id)
+
+	err := data.RevokeAPIToken(userID, id, db)
+	if err == data.ErrAPITokenNotFound {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		at.l.Println(err)
+		http.Error(rw, "Error revoking API token", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+
+	"bookings.com/m/auth"
+	"bookings.com/m/session"
+)
+
+// authorise takes an http ResponseWriter and Request, a sql DB connection and the permission needed for the request.
+// It returns the authenticated user if they hold the permission. Otherwise the matching error response is written and nil is returned, and the handler should return straight away.
+// Pass auth.Authenticated where any logged in user is allowed.
+func authorise(rw http.ResponseWriter, r *http.Request, db *sql.DB, perm auth.Permission) *auth.Principal {
+	p, err := auth.Authorise(r, db, perm)
+	switch err {
+	case nil:
+		return p
+	case auth.ErrNoCredentials:
+		http.Error(rw, "Unable to retrieve cookie or API token", http.StatusBadRequest)
+	case auth.ErrInvalidCredentials:
+		http.Error(rw, "Session is invalid or has expired, please log in again", http.StatusUnauthorized)
+	case auth.ErrCSRF:
+		http.Error(rw, "Permission Denied, send the csrf_token cookie's value in the "+session.CSRFHeader+" header", http.StatusForbidden)
+	case auth.ErrForbidden:
+		http.Error(rw, "Permission Denied", http.StatusForbidden)
+	case auth.ErrOutOfScope:
+		http.Error(rw, "Permission Denied, the API token does not have the scope for this request", http.StatusForbidden)
+	case auth.ErrTwoFactorRequired:
+		http.Error(rw, "Permission Denied, your role requires two-factor authentication, please set it up at "+auth.TwoFactorPath, http.StatusForbidden)
+	default:
+		http.Error(rw, "Error whilst trying to authenticate user", http.StatusInternalServerError)
+	}
+	return nil
+}
@@ -2,30 +2,38 @@ package handlers
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
-	"reflect"
+	"strings"
+	"time"
 
+	"bookings.com/m/auth"
+	"bookings.com/m/config"
 	"bookings.com/m/data"
 	"bookings.com/m/database"
-	"bookings.com/m/session"
+	"bookings.com/m/notify"
 )
 
-// Bookings struct is created to enable dependency injection of a logger.
+// Bookings struct is created to enable dependency injection of a logger and the email notifier.
 type Bookings struct {
 	l *log.Logger
+	n *notify.Notifier
 }
 
-// NewBookingHandler takes a logger object and returns a Bookings object.
-// The logger passed will be assigned to the Bookings object logger field.
+// NewBookingHandler takes a logger object and a notifier and returns a Bookings object.
+// The logger and notifier passed will be assigned to the Bookings object fields.
 // This function is used in the main() function to return the Bookings handler that is required to pass to the created servemux.
-func NewBookingHandler(l *log.Logger) *Bookings {
-	return &Bookings{l}
+func NewBookingHandler(l *log.Logger, n *notify.Notifier) *Bookings {
+	return &Bookings{l, n}
 }
 
 // ServeHTTP is called on a Bookings object.
 // It takes an http ResponseWriter and Request as parameters.
 // This function deals with all HTTP request methods that are queried.
+// PUT /booking/{id} moves a booking to another hood or time.
+// POST /booking/{id}/checkin records a lone-worker check-in during an out of hours booking.
 // Before each request is handled, the session token is authenticated to ensure login has been performed.
 func (b *Bookings) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
@@ -37,26 +45,52 @@ func (b *Bookings) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
+	// every booking request needs a logged in user
+	p := authorise(rw, r, db, auth.Authenticated)
+	if p == nil {
+		return
+	}
+
 	if r.Method == http.MethodGet {
-		token := session.RetrieveCookie(r)
-		if token == "" {
-			http.Error(rw, "Unable to retrieve cookie", http.StatusBadRequest)
+		b.getBookings(rw, r, db)
+		return
+	}
+
+	if r.Method == http.MethodPost && strings.HasSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/checkin") {
+		id, err := getIDFromURI(r.URL.Path)
+		if err != nil {
+			http.Error(rw, "Invalid URI", http.StatusBadRequest)
 			return
 		}
 
-		b.getBookings(rw, r)
+		b.checkIn(rw, id, p, db)
 		return
 	}
 
-	// TODO: Need to ensure the user can only create a booking with their ID.
 	if r.Method == http.MethodPost {
-		token := session.RetrieveCookie(r)
-		if token == "" {
-			http.Error(rw, "Unable to retrieve cookie", http.StatusBadRequest)
+		b.addBooking(rw, r, p, db)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		id, err := getIDFromURI(r.URL.Path)
+		if err != nil {
+			http.Error(rw, "Invalid URI", http.StatusBadRequest)
 			return
 		}
 
-		b.addBooking(rw, r, token, db)
+		b.moveBooking(rw, r, id, p, db)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		id, err := getIDFromURI(r.URL.Path)
+		if err != nil {
+			http.Error(rw, "Invalid URI", http.StatusBadRequest)
+			return
+		}
+
+		b.cancelBooking(rw, id, p, db)
 		return
 	}
 
@@ -66,11 +100,11 @@ func (b *Bookings) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 // getBookings can be called on a Bookings object and takes an http ResponseWriter and Request as parameters.
 // This function is responsible for handling GET requests for bookings.
 // It calls functions "GetBookings" and "ToJSON" from the booking data file to retrieve and encode the data to be presented to the user.
-func (b *Bookings) getBookings(rw http.ResponseWriter, r *http.Request) {
+func (b *Bookings) getBookings(rw http.ResponseWriter, r *http.Request, db *sql.DB) {
 	b.l.Println("Handling GET request")
 
-	// retrieve bookingList
-	bookingList := data.GetBookings()
+	// retrieve bookings from the database
+	bookingList := data.GetBookings(db)
 
 	// encode data
 	err := bookingList.ToJSON(rw)
@@ -82,8 +116,10 @@ func (b *Bookings) getBookings(rw http.ResponseWriter, r *http.Request) {
 // addBooking can be called on a Bookings object and takes an http ResponseWriter and Request as parameters.
 // This function is responsible for handling POST requests for bookings.
 // It calls the function "FromJSON" from the booking data file to decode the data being passed by the user.
-// The decoded data is then passed to the function AddBooking from the booking data file to add the file to the bookingList.
-func (b *Bookings) addBooking(rw http.ResponseWriter, r *http.Request, token string, db *sql.DB) {
+// If no end time is supplied the booking is treated as a full-day booking.
+// Users can book for someone else if they are allowed to by checkDelegation, and the booking then records them as the delegate who made it.
+// The booking is checked by checkBookable and checkSlot, and then passed to the function AddBooking from the booking data file to add it to the database.
+func (b *Bookings) addBooking(rw http.ResponseWriter, r *http.Request, p *auth.Principal, db *sql.DB) {
 
 	b.l.Println("Handling POST request")
 
@@ -92,99 +128,401 @@ func (b *Bookings) addBooking(rw http.ResponseWriter, r *http.Request, token str
 	err := book.FromJSON(r.Body)
 	if err != nil {
 		http.Error(rw, "Unable to Marshal JSON", http.StatusBadRequest)
+		return
+	}
+
+	// bookings without an end time keep the original full-day behaviour
+	if book.EndDate.IsZero() && !book.BookingDate.IsZero() {
+		book.EndDate = book.BookingDate.Add(24 * time.Hour)
 	}
 
-	// TODO: check for missing values
 	if result := checkMissingValuesBooking(book); !result {
 		http.Error(rw, "Please ensure there is no missing data entered", http.StatusBadRequest)
 		return
 	}
 
-	// TODO: Ensure that ID value from `SessionTokens` token key matches the ID the user is trying to book for.
-	idCheck := session.UserTokenAuthentication(token, db)
-	if idCheck == -1 {
-		http.Error(rw, "Error whilst trying to retrieve matching user ID using token", http.StatusBadRequest)
+	// bookings for another user need the right to book for them, and record who made them.
+	book.BookedBy = ""
+	if p.Name != book.UserName {
+		if err := b.checkDelegation(book.UserName, p, db); err != nil {
+			if err == ErrNotDelegate {
+				http.Error(rw, err.Error(), http.StatusForbidden)
+				return
+			}
+			if err == data.ErrUserNotFound {
+				http.Error(rw, "That user does not exist", http.StatusBadRequest)
+				return
+			}
+			b.l.Println(err)
+			http.Error(rw, "Error checking delegation", http.StatusInternalServerError)
+			return
+		}
+		book.BookedBy = p.Name
+	}
+
+	// check the hood, booking rules, recharge period and clashes.
+	if !b.checkBookable(rw, book, db) {
 		return
 	}
 
-	// verify the hood exists in the hoodList
-	if hoodCheck := checkHoodExists(book.HoodNumber); !hoodCheck {
-		http.Error(rw, "That hood number does not exist", http.StatusBadRequest)
+	loneWorking, ok := b.checkSlot(rw, book, p, db)
+	if !ok {
 		return
 	}
 
-	// the following two functions can be reworked once the database is connected, can get user ID verification via session token.
-	// and query the db with the user ID to get the relevant information to do booking checks, won't need position in list.
-	// get the position of the user in the userlist (deprecated once database connection added here).
-	pos := getUserListPos(idCheck)
-	if pos == -1 {
-		http.Error(rw, "User does not exist in the user list, consider registration", http.StatusBadRequest)
+	b.l.Printf("Booking: %#v", book)
+	// the hood may have been booked or retired since it was checked
+	if err := data.AddBooking(book, db); err != nil {
+		b.bookingError(rw, err, "Error adding booking to database")
 		return
 	}
+	if loneWorking && p.Name == book.UserName {
+		if err := data.AcknowledgeLoneWorking(book.ID, p.Name, db); err != nil {
+			b.l.Println(err)
+		}
+	}
+	b.n.NotifyBooking("booking.created", book, db)
+	publishEvent(b.l, "booking.created", book, db)
+}
+
+// checkIn can be called on a Bookings object and takes an http ResponseWriter, the booking ID, the authenticated user and a sql DB connection as parameters.
+// It records that the user working alone on the booking is safe, and returns when their next check-in is due.
+// Only the user the booking is for can check in, and only while it is running.
+func (b *Bookings) checkIn(rw http.ResponseWriter, id int, p *auth.Principal, db *sql.DB) {
+	b.l.Println("Handling check-in for booking", id)
 
-	// ensure that the user booking is the same as the user being booked for (also depracated once session tokens added).
-	userName := data.UserList[pos].Name
-	if userName != book.UserName {
-		http.Error(rw, "Currently cannot book a hood for another user", http.StatusBadRequest)
+	booking, err := data.GetBooking(id, db)
+	if err == data.ErrBookingNotFound || (err == nil && booking.CancelledAt != nil) {
+		http.Error(rw, "Booking not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		b.l.Println(err)
+		http.Error(rw, "Error retrieving booking", http.StatusInternalServerError)
+		return
+	}
+	if booking.UserName != p.Name {
+		http.Error(rw, "Permission Denied, you can only check in to your own bookings", http.StatusForbidden)
+		return
+	}
+	now := time.Now()
+	if now.Before(booking.BookingDate) || !now.Before(booking.EndDate) {
+		http.Error(rw, "You can only check in while the booking is running", http.StatusBadRequest)
 		return
 	}
 
-	// verify hood and user are free at the booked time.
-	for _, booking := range data.BookingList {
-		if booking.BookingDate.Equal(book.BookingDate) {
-			if booking.UserName == userName {
-				b.l.Printf("You are already booked into hood %d at the requested time!", booking.HoodNumber)
-				http.Error(rw, "Booking failed as previous booking exists at this time", http.StatusBadRequest)
-				return
-			}
-			if booking.HoodNumber == book.HoodNumber {
-				b.l.Printf("This hood is already booked at that time by %s!", booking.UserName)
-				http.Error(rw, "Booking failed as previous booking exists at this time", http.StatusBadRequest)
-				return
-			}
-		}
+	// the check-in interval comes from the config file, so it is read before anything is recorded
+	cfg, err := config.ReadConfigFile(config.FileName)
+	if err != nil {
+		b.l.Println(err)
+		http.Error(rw, "Error reading config file", http.StatusInternalServerError)
+		return
 	}
 
-	b.l.Printf("Booking: %#v", book)
-	data.AddBooking(book)
+	if err := data.CheckIn(id, db); err != nil {
+		b.l.Println(err)
+		http.Error(rw, "Error recording check-in", http.StatusInternalServerError)
+		return
+	}
+
+	due, err := data.NextCheckIn(booking, cfg.LoneWorking, db)
+	if err != nil {
+		b.l.Println(err)
+		http.Error(rw, "Check-in recorded, but the next check-in time could not be worked out", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(struct {
+		NextCheckIn time.Time `json:"next_check_in"`
+	}{due})
 }
 
-// checkMissingValues ensures that the user has entered all required data for the booking.
-// The function takes the previously created Booking struct as a pointer.
-// The Booking struct is then dereferenced to allow the use of reflect.NumField() to calculate the number of fields within the struct.
-// If the count of missing values is 1, then no data is missing and the function returns true to enable continuation of the request.
-func checkMissingValuesBooking(b *data.Booking) bool {
-	var count int
+// checkDelegation takes the name of the user a booking is for, the principal making it and a sql DB connection, and returns an error if the principal can't book for that user.
+// Lab managers and admins can book for anyone, group leaders for their group's members, and other users for anyone who has made them a delegate.
+// The structured ErrNotDelegate is returned if the principal isn't allowed, and data.ErrUserNotFound if the user doesn't exist.
+func (b *Bookings) checkDelegation(username string, p *auth.Principal, db *sql.DB) error {
+	if _, err := data.GetUserByName(username, db); err != nil {
+		return err
+	}
+	if p.Can(auth.ManageAnyBooking) {
+		return nil
+	}
+	if leads, err := data.LeadsGroupOf(p.UserID, username, db); err != nil || leads {
+		return err
+	}
+	delegate, err := data.IsDelegateFor(p.UserID, username, db)
+	if err != nil {
+		return err
+	}
+	if !delegate {
+		return ErrNotDelegate
+	}
+	return nil
+}
+
+// checkLoneWorking takes a Booking struct and reports whether it falls under the lone-worker protocol.
+// The config file is read to collect the working hours and the lab's timezone, and false is always returned if lone working checks are turned off.
+func checkLoneWorking(book *data.Booking) (bool, error) {
+	cfg, err := config.ReadConfigFile(config.FileName)
+	if err != nil {
+		return false, err
+	}
+	if !cfg.LoneWorking.Enabled {
+		return false, nil
+	}
+	loc, err := cfg.Location()
+	if err != nil {
+		return false, err
+	}
+	return data.OutOfHours(book.BookingDate, book.EndDate, cfg.LoneWorking, loc)
+}
+
+// checkBookable can be called on a Bookings object and takes an http ResponseWriter, a Booking struct and a sql DB connection, and returns true if the booking can be stored.
+// The config file is read and the booking is checked by data.CheckBookable.
+// Bookings that fail a check are refused with a 400 naming the reason, and a 500 is returned if the checks can't be run, e.g. because the config file can't be read.
+func (b *Bookings) checkBookable(rw http.ResponseWriter, book *data.Booking, db *sql.DB) bool {
+	cfg, err := config.ReadConfigFile(config.FileName)
+	if err != nil {
+		b.l.Println(err)
+		http.Error(rw, "Error reading config file", http.StatusInternalServerError)
+		return false
+	}
+
+	if err := data.CheckBookable(book, cfg, time.Now(), db); err != nil {
+		b.bookingError(rw, err, "Error checking booking")
+		return false
+	}
+	return true
+}
 
-	vals := reflect.ValueOf(b).Elem()
+// bookingError can be called on a Bookings object and takes an http ResponseWriter, an error from checking or storing a booking, and the message to use if the error isn't a rejection.
+// Bookings that were rejected are answered with a 400 naming the reason, and any other error is logged and answered with a 500.
+func (b *Bookings) bookingError(rw http.ResponseWriter, err error, message string) {
+	switch {
+	case err == data.ErrHoodNotFound:
+		http.Error(rw, "That hood number does not exist", http.StatusBadRequest)
+	case err == data.ErrHoodRetired:
+		http.Error(rw, "That hood has been retired", http.StatusBadRequest)
+	case err == data.ErrBookingClash:
+		http.Error(rw, "Booking failed as previous booking exists at this time", http.StatusBadRequest)
+	case data.IsBookingRejection(err):
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+	default:
+		b.l.Println(err)
+		http.Error(rw, message, http.StatusInternalServerError)
+	}
+}
 
-	for i := 0; i < vals.NumField(); i++ {
-		if fieldValue := vals.Field(i); fieldValue.IsZero() {
-			count++
+// checkSlot can be called on a Bookings object and takes an http ResponseWriter, a Booking struct, the authenticated user and a sql DB connection.
+// It checks the slot isn't being allocated by a lottery window, and that bookings outside working hours acknowledge the lone-worker protocol.
+// Only the person working alone can acknowledge the protocol, so someone else can only make or move a booking outside working hours if the user has already acknowledged it for that booking.
+// It returns whether the booking is lone working, and false for ok if the request has already been answered.
+func (b *Bookings) checkSlot(rw http.ResponseWriter, book *data.Booking, p *auth.Principal, db *sql.DB) (loneWorking bool, ok bool) {
+	// bookings outside working hours need the lone-worker protocol to be acknowledged.
+	loneWorking, err := checkLoneWorking(book)
+	if err != nil {
+		b.l.Println(err)
+		http.Error(rw, "Error checking working hours", http.StatusInternalServerError)
+		return false, false
+	}
+	if loneWorking && p.Name != book.UserName {
+		acknowledged, err := data.HasAcknowledgedLoneWorking(book.ID, book.UserName, db)
+		if err != nil {
+			b.l.Println(err)
+			http.Error(rw, "Error checking lone-worker acknowledgement", http.StatusInternalServerError)
+			return false, false
 		}
+		if !acknowledged {
+			http.Error(rw, "This booking is outside working hours, so "+book.UserName+" has to make it themselves to acknowledge the lone-worker protocol", http.StatusForbidden)
+			return false, false
+		}
+	} else if loneWorking && !book.LoneWorkerAck {
+		http.Error(rw, "This booking is outside working hours. Resend it with \"lone_worker_acknowledged\": true to confirm you will check in at /booking/{id}/checkin while you work", http.StatusBadRequest)
+		return false, false
+	}
+
+	// slots that are being allocated by lottery can't be booked directly until the window has been allocated.
+	window, err := data.FindOpenLotteryWindow(book.BookingDate, db)
+	if err != nil {
+		b.l.Println(err)
+		http.Error(rw, "Error checking lottery windows", http.StatusInternalServerError)
+		return false, false
+	}
+	if window != nil {
+		http.Error(rw, fmt.Sprintf("This slot is allocated by lottery window %d, submit a request to /lottery/%d instead", window.ID, window.ID), http.StatusBadRequest)
+		return false, false
 	}
-	return count == 1
+	return loneWorking, true
 }
 
-// getUserListPos takes an id as an int and returns an int.
-// This function is used to iterate over the UserList and return the position of the user with the matching ID in the userList.
-// If no matching ID is found, then -1 is returned.
-func getUserListPos(id int) int {
-	for i, u := range data.UserList {
-		if u.ID == id {
-			return i
+// moveBooking can be called on a Bookings object and takes an http ResponseWriter and Request, the booking ID, the authenticated user and a sql DB connection as parameters.
+// This function is responsible for handling PUT requests for bookings.
+// The request may change the hood_number, booking_time and end_time, and fields that are left out keep their current value. If only the start is changed the booking keeps its length.
+// The moved booking goes through the same checks as a new booking, and neither the old nor the new time can be in a locked recharge period.
+// The same users who can cancel a booking can move it.
+func (b *Bookings) moveBooking(rw http.ResponseWriter, r *http.Request, id int, p *auth.Principal, db *sql.DB) {
+	b.l.Println("Handling PUT request")
+
+	booking, err := data.GetBooking(id, db)
+	if err == data.ErrBookingNotFound || (err == nil && booking.CancelledAt != nil) {
+		http.Error(rw, "Booking not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		b.l.Println(err)
+		http.Error(rw, "Error retrieving booking", http.StatusInternalServerError)
+		return
+	}
+	allowed, err := b.canManageBooking(booking, p, db)
+	if err != nil {
+		b.l.Println(err)
+		http.Error(rw, "Error moving booking", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(rw, "Permission Denied, you can only move your own bookings or those of your research group", http.StatusForbidden)
+		return
+	}
+
+	req := &data.Booking{}
+	if err := req.FromJSON(r.Body); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusBadRequest)
+		return
+	}
+
+	moved := *booking
+	if req.HoodNumber != 0 {
+		moved.HoodNumber = req.HoodNumber
+	}
+	if !req.BookingDate.IsZero() {
+		moved.EndDate = req.BookingDate.Add(booking.EndDate.Sub(booking.BookingDate))
+		moved.BookingDate = req.BookingDate
+	}
+	if !req.EndDate.IsZero() {
+		moved.EndDate = req.EndDate
+	}
+	moved.LoneWorkerAck = req.LoneWorkerAck
+
+	// the booking can't be taken out of a month that has already been invoiced either.
+	if err := checkPeriodUnlocked(booking.BookingDate, db); err != nil {
+		if err == data.ErrPeriodLocked {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
 		}
+		b.l.Println(err)
+		http.Error(rw, "Error checking recharge periods", http.StatusInternalServerError)
+		return
 	}
-	return -1
+
+	if !b.checkBookable(rw, &moved, db) {
+		return
+	}
+	loneWorking, ok := b.checkSlot(rw, &moved, p, db)
+	if !ok {
+		return
+	}
+
+	if err := data.MoveBooking(&moved, db); err != nil {
+		b.bookingError(rw, err, "Error moving booking")
+		return
+	}
+	if loneWorking && p.Name == moved.UserName {
+		if err := data.AcknowledgeLoneWorking(moved.ID, p.Name, db); err != nil {
+			b.l.Println(err)
+		}
+	}
+	b.l.Println("Booking moved", id)
+	b.n.NotifyBooking("booking.moved", &moved, db)
+	publishEvent(b.l, "booking.moved", &moved, db)
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(moved)
+}
+
+// canManageBooking can be called on a Bookings object and takes a Booking struct, the authenticated user and a sql DB connection, and reports whether the user can move or cancel the booking.
+// Users can manage their own bookings and, if they lead a research group, those of its members. Lab managers and admins can manage any booking.
+// Bookings made for someone else can be managed by whoever made them only while they are still allowed to book for that user, so removing a delegate or moving group takes away their access.
+func (b *Bookings) canManageBooking(booking *data.Booking, p *auth.Principal, db *sql.DB) (bool, error) {
+	if booking.UserName == p.Name || p.Can(auth.ManageAnyBooking) {
+		return true, nil
+	}
+	// group leaders can manage their members' bookings
+	if leads, err := data.LeadsGroupOf(p.UserID, booking.UserName, db); err != nil || leads {
+		return leads, err
+	}
+	if booking.BookedBy != p.Name {
+		return false, nil
+	}
+	return data.IsDelegateFor(p.UserID, booking.UserName, db)
 }
 
-// checkHoodExists takes a hood number as an int and returns a bool.
-// This function is used to ensure that the hood number included in the users POST request exists.
-func checkHoodExists(hoodNumber int) bool {
-	for _, hood := range data.HoodList {
-		if hood.Hood_Number == hoodNumber {
-			return true
+// cancelBooking can be called on a Bookings object and takes an http ResponseWriter, the booking ID, the authenticated user and a sql DB connection as parameters.
+// This function is responsible for handling DELETE requests for bookings.
+// Users can only cancel their own bookings, bookings they made for someone they can still book for and, if they lead a research group, those of its members, unless they are a lab manager or admin. The booking is kept in the database and marked as cancelled.
+func (b *Bookings) cancelBooking(rw http.ResponseWriter, id int, p *auth.Principal, db *sql.DB) {
+	b.l.Println("Handling DELETE request")
+
+	booking, err := data.GetBooking(id, db)
+	if err != nil || booking.CancelledAt != nil {
+		http.Error(rw, "Booking not found", http.StatusNotFound)
+		return
+	}
+	allowed, err := b.canManageBooking(booking, p, db)
+	if err != nil {
+		b.l.Println(err)
+		http.Error(rw, "Error cancelling booking", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(rw, "Permission Denied, you can only cancel your own bookings or those of your research group", http.StatusForbidden)
+		return
+	}
+
+	if err := checkPeriodUnlocked(booking.BookingDate, db); err != nil {
+		if err == data.ErrPeriodLocked {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
 		}
+		b.l.Println(err)
+		http.Error(rw, "Error checking recharge periods", http.StatusInternalServerError)
+		return
+	}
+
+	if err := data.CancelBooking(id, db); err != nil {
+		b.l.Println(err)
+		http.Error(rw, "Error cancelling booking", http.StatusInternalServerError)
+		return
+	}
+	b.l.Println("Booking cancelled", id)
+	b.n.NotifyBooking("booking.cancelled", booking, db)
+	publishEvent(b.l, "booking.cancelled", booking, db)
+}
+
+// checkPeriodUnlocked takes the start time of a booking and a sql DB connection and returns an error if the booking falls in a month that has been invoiced and locked.
+// Months are on the lab's clock, so the lab timezone is read from the config file.
+// This should be called by every path that creates, moves or cancels a booking.
+func checkPeriodUnlocked(start time.Time, db *sql.DB) error {
+	cfg, err := config.ReadConfigFile(config.FileName)
+	if err != nil {
+		return err
 	}
-	return false
+	loc, err := cfg.Location()
+	if err != nil {
+		return err
+	}
+	locked, err := data.IsPeriodLocked(start, loc, db)
+	if err != nil {
+		return err
+	}
+	if locked {
+		return data.ErrPeriodLocked
+	}
+	return nil
+}
+
+// checkMissingValuesBooking ensures that the user has entered all required data for the booking.
+// The function takes the previously created Booking struct as a pointer.
+// The user name, hood number, start time and end time must all be supplied, and the function returns true to enable continuation of the request if they are.
+func checkMissingValuesBooking(b *data.Booking) bool {
+	return b.UserName != "" && b.HoodNumber != 0 && !b.BookingDate.IsZero() && !b.EndDate.IsZero()
 }
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"bookings.com/m/auth"
+	"bookings.com/m/data"
+	"bookings.com/m/database"
+)
+
+// Delegations struct is created to enable dependency injection of a logger.
+type Delegations struct {
+	l *log.Logger
+}
+
+// delegateRequest is the body of a POST request to /delegates, naming the colleague to allow to book for the logged in user.
+type delegateRequest struct {
+	DelegateID int `json:"delegate_id"`
+}
+
+// delegateList is returned by GET /delegates: the colleagues who can book for the user, and the users the user can book for.
+type delegateList struct {
+	Delegates  data.Delegates `json:"delegates"`
+	BookingFor data.Delegates `json:"booking_for"`
+}
+
+// NewDelegateHandler takes a logger object and returns a Delegations object.
+// This function is used in the main() function to return the Delegations handler that is required to pass to the created servemux.
+func NewDelegateHandler(l *log.Logger) *Delegations {
+	return &Delegations{l}
+}
+
+// ServeHTTP is called on a Delegations object.
+// It takes an http ResponseWriter and Request as parameters.
+// GET /delegates lists who the logged in user has allowed to book hoods for them, and who has allowed the user to book for them.
+// POST /delegates allows a colleague to book for the user, and DELETE /delegates/{id} withdraws that again.
+func (d *Delegations) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	// Initialise database connection
+	db, err := database.InitialiseConnection(d.l)
+	if err != nil {
+		d.l.Println("Database connection error", err)
+		return
+	}
+	defer db.Close()
+
+	p := authorise(rw, r, db, auth.Authenticated)
+	if p == nil {
+		return
+	}
+
+	if strings.TrimSuffix(r.URL.Path, "/") == "/delegates" {
+		switch r.Method {
+		case http.MethodGet:
+			d.getDelegates(rw, p.UserID, db)
+		case http.MethodPost:
+			d.addDelegate(rw, r, p.UserID, db)
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := getIDFromURI(r.URL.Path)
+	if err != nil {
+		http.Error(rw, "Invalid URI", http.StatusBadRequest)
+		return
+	}
+	d.removeDelegate(rw, p.UserID, id, db)
+}
+
+// getDelegates encodes the user's delegates, and the users they can book for, to the ResponseWriter.
+func (d *Delegations) getDelegates(rw http.ResponseWriter, userID int, db *sql.DB) {
+	d.l.Println("Handling GET request for delegates")
+
+	var list delegateList
+	var err error
+	if list.Delegates, err = data.GetDelegates(userID, db); err == nil {
+		list.BookingFor, err = data.GetDelegatedTo(userID, db)
+	}
+	if err != nil {
+		d.l.Println(err)
+		http.Error(rw, "Error retrieving delegates", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(list)
+}
+
+// addDelegate allows the colleague named in the request body to book hoods for the user.
+func (d *Delegations) addDelegate(rw http.ResponseWriter, r *http.Request, userID int, db *sql.DB) {
+	d.l.Println("Handling POST request for delegates")
+
+	var req delegateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusBadRequest)
+		return
+	}
+	if req.DelegateID == userID {
+		http.Error(rw, "You can already book for yourself", http.StatusBadRequest)
+		return
+	}
+	if _, err := data.GetUserByID(req.DelegateID, db); err != nil {
+		http.Error(rw, "That delegate is not a user", http.StatusBadRequest)
+		return
+	}
+
+	if err := data.AddDelegate(userID, req.DelegateID, db); err != nil {
+		d.l.Println(err)
+		http.Error(rw, "Error adding delegate", http.StatusInternalServerError)
+		return
+	}
+	rw.WriteHeader(http.StatusCreated)
+}
+
+// removeDelegate stops a colleague booking hoods for the user.
+// Bookings the colleague has already made are kept.
+func (d *Delegations) removeDelegate(rw http.ResponseWriter, userID, delegateID int, db *sql.DB) {
+	d.l.Println("Handling DELETE request for delegate", delegateID)
+
+	err := data.RemoveDelegate(userID, delegateID, db)
+	if err == data.ErrDelegateNotFound {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		d.l.Println(err)
+		http.Error(rw, "Error removing delegate", http.StatusInternalServerError)
+	}
+}
+
+// create structured error
+var ErrNotDelegate = fmt.Errorf("you can only book for yourself, your research group's members or users who have made you their delegate")
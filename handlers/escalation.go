@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"bookings.com/m/auth"
+	"bookings.com/m/data"
+	"bookings.com/m/database"
+)
+
+// maxEscalations is the most escalation log entries returned by a single request.
+const maxEscalations = 1000
+
+// Escalations struct is created to enable dependency injection of a logger.
+type Escalations struct {
+	l *log.Logger
+}
+
+// NewEscalationHandler takes a logger object and returns an Escalations object.
+// This function is used in the main() function to return the Escalations handler that is required to pass to the created servemux.
+func NewEscalationHandler(l *log.Logger) *Escalations {
+	return &Escalations{l}
+}
+
+// ServeHTTP is called on an Escalations object.
+// It takes an http ResponseWriter and Request as parameters.
+// GET /escalations returns the lone-worker escalation log, and POST /escalations/{id}/resolve closes an escalation once the lone worker has been reached.
+// Both are restricted to lab managers and admins.
+func (e *Escalations) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	// Initialise database connection
+	db, err := database.InitialiseConnection(e.l)
+	if err != nil {
+		e.l.Println("Database connection error", err)
+		return
+	}
+	defer db.Close()
+
+	p := authorise(rw, r, db, auth.ManageLoneWorking)
+	if p == nil {
+		return
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == "/escalations" && r.Method == http.MethodGet:
+		e.getEscalations(rw, r, db)
+	case strings.HasSuffix(path, "/resolve") && r.Method == http.MethodPost:
+		id, err := getIDFromURI(path)
+		if err != nil {
+			http.Error(rw, "Invalid URI", http.StatusBadRequest)
+			return
+		}
+		e.resolveEscalation(rw, id, p, db)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// getEscalations encodes the most recent escalations to the ResponseWriter.
+// The optional open query parameter only returns escalations that haven't been resolved, and limit sets how many entries are returned, up to maxEscalations.
+func (e *Escalations) getEscalations(rw http.ResponseWriter, r *http.Request, db *sql.DB) {
+	e.l.Println("Handling GET request for escalations")
+
+	q := r.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(rw, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if limit > maxEscalations {
+		limit = maxEscalations
+	}
+
+	escalations, err := data.GetEscalations(q.Get("open") == "true", limit, db)
+	if err != nil {
+		e.l.Println(err)
+		http.Error(rw, "Error retrieving escalations", http.StatusInternalServerError)
+		return
+	}
+	if err := escalations.ToJSON(rw); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+// resolveEscalation closes an open escalation, recording who closed it.
+func (e *Escalations) resolveEscalation(rw http.ResponseWriter, id int, p *auth.Principal, db *sql.DB) {
+	e.l.Println("Handling POST request to resolve escalation", id)
+
+	err := data.ResolveEscalation(id, p.Name, db)
+	if err == data.ErrEscalationNotFound {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		e.l.Println(err)
+		http.Error(rw, "Error resolving escalation", http.StatusInternalServerError)
+	}
+}
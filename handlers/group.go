@@ -0,0 +1,379 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"bookings.com/m/auth"
+	"bookings.com/m/data"
+	"bookings.com/m/database"
+)
+
+// Groups struct is created to enable dependency injection of a logger.
+type Groups struct {
+	l *log.Logger
+}
+
+// unknownGroupMessage is the error shown when a research group name doesn't match an existing group.
+const unknownGroupMessage = "Unknown research group, choose one from GET /groups"
+
+// groupRequest is the body of a POST request to /groups or a PUT request to /groups/{id}.
+// LeaderID is optional, and is the user who leads the group.
+type groupRequest struct {
+	Name     string `json:"name"`
+	LeaderID *int   `json:"leader_id"`
+}
+
+// moveDecision is the body of a PUT request to /groups/requests/{id}.
+type moveDecision struct {
+	Approved *bool `json:"approved"`
+}
+
+// groupDetail is returned by GET /groups/{id}: the group and its current members.
+type groupDetail struct {
+	*data.ResearchGroup
+	MemberList []interface{} `json:"member_list"`
+}
+
+// NewGroupHandler takes a logger object and returns a Groups object.
+// This function is used in the main() function to return the Groups handler that is required to pass to the created servemux.
+func NewGroupHandler(l *log.Logger) *Groups {
+	return &Groups{l}
+}
+
+// ServeHTTP is called on a Groups object.
+// It takes an http ResponseWriter and Request as parameters.
+// GET /groups lists the research groups, and doesn't need a login so the list can be shown at registration.
+// GET /groups/{id} shows a group and its members. GET /groups/{id}/requests lists the requests to move into it, which PUT /groups/requests/{id} approves or refuses. GET /groups/{id}/history shows who has joined and left it, and GET /groups/{id}/bookings shows its members' bookings, to the group's leader and admins.
+// POST /groups, PUT /groups/{id} and DELETE /groups/{id} create, update and delete groups, and are restricted to admins.
+func (gr *Groups) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	// Initialise database connection
+	db, err := database.InitialiseConnection(gr.l)
+	if err != nil {
+		gr.l.Println("Database connection error", err)
+		return
+	}
+	defer db.Close()
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	if path == "/groups" {
+		switch r.Method {
+		case http.MethodGet:
+			gr.getGroups(rw, db)
+		case http.MethodPost:
+			if p := authorise(rw, r, db, auth.ManageUsers); p == nil {
+				return
+			}
+			gr.addGroup(rw, r, db)
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, err := getIDFromURI(path)
+	if err != nil {
+		http.Error(rw, "Invalid URI", http.StatusBadRequest)
+		return
+	}
+
+	// PUT /groups/requests/{id} decides a request to move into a group
+	if strings.HasPrefix(path, "/groups/requests/") {
+		if r.Method != http.MethodPut {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		gr.decideMove(rw, r, id, db)
+		return
+	}
+
+	switch {
+	case strings.HasSuffix(path, "/requests") && r.Method == http.MethodGet:
+		if p := gr.authoriseLeader(rw, r, id, db); p == nil {
+			return
+		}
+		gr.getMoveRequests(rw, id, db)
+	case strings.HasSuffix(path, "/history") && r.Method == http.MethodGet:
+		if p := gr.authoriseLeader(rw, r, id, db); p == nil {
+			return
+		}
+		gr.getHistory(rw, id, db)
+	case strings.HasSuffix(path, "/bookings") && r.Method == http.MethodGet:
+		if p := gr.authoriseLeader(rw, r, id, db); p == nil {
+			return
+		}
+		gr.getBookings(rw, id, db)
+	case r.Method == http.MethodGet:
+		p := authorise(rw, r, db, auth.Authenticated)
+		if p == nil {
+			return
+		}
+		gr.getGroup(rw, id, p, db)
+	case r.Method == http.MethodPut:
+		if p := authorise(rw, r, db, auth.ManageUsers); p == nil {
+			return
+		}
+		gr.updateGroup(rw, r, id, db)
+	case r.Method == http.MethodDelete:
+		if p := authorise(rw, r, db, auth.ManageUsers); p == nil {
+			return
+		}
+		gr.deleteGroup(rw, id, db)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// authoriseLeader authenticates the request and returns the principal if they lead the group, or can manage users or any booking.
+// Otherwise the error response is written and nil is returned.
+func (gr *Groups) authoriseLeader(rw http.ResponseWriter, r *http.Request, id int, db *sql.DB) *auth.Principal {
+	p := authorise(rw, r, db, auth.Authenticated)
+	if p == nil {
+		return nil
+	}
+	if p.Can(auth.ManageUsers) || p.Can(auth.ManageAnyBooking) {
+		return p
+	}
+
+	g, err := data.GetResearchGroup(id, db)
+	if err == data.ErrGroupNotFound {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		gr.l.Println(err)
+		http.Error(rw, "Error retrieving research group", http.StatusInternalServerError)
+		return nil
+	}
+	if g.LeaderID == nil || *g.LeaderID != p.UserID {
+		http.Error(rw, "Permission Denied, only the group leader can see this", http.StatusForbidden)
+		return nil
+	}
+	return p
+}
+
+// getGroups encodes every research group to the ResponseWriter.
+func (gr *Groups) getGroups(rw http.ResponseWriter, db *sql.DB) {
+	gr.l.Println("Handling GET request for research groups")
+
+	groups, err := data.GetResearchGroups(db)
+	if err != nil {
+		gr.l.Println(err)
+		http.Error(rw, "Error retrieving research groups", http.StatusInternalServerError)
+		return
+	}
+	if err := groups.ToJSON(rw); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+// getGroup encodes a research group and its current members to the ResponseWriter.
+// Members are shown as the principal is allowed to see them, so contact details are only included for safety roles.
+func (gr *Groups) getGroup(rw http.ResponseWriter, id int, p *auth.Principal, db *sql.DB) {
+	gr.l.Println("Handling GET request for research group", id)
+
+	g, err := data.GetResearchGroup(id, db)
+	if err == data.ErrGroupNotFound {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		gr.l.Println(err)
+		http.Error(rw, "Error retrieving research group", http.StatusInternalServerError)
+		return
+	}
+	members, err := data.GetGroupMembers(id, db)
+	if err != nil {
+		gr.l.Println(err)
+		http.Error(rw, "Error retrieving research group", http.StatusInternalServerError)
+		return
+	}
+
+	detail := groupDetail{ResearchGroup: g, MemberList: make([]interface{}, len(members))}
+	for i, m := range members {
+		detail.MemberList[i] = userView(m, p)
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(detail)
+}
+
+// getHistory encodes the membership history of a research group to the ResponseWriter.
+func (gr *Groups) getHistory(rw http.ResponseWriter, id int, db *sql.DB) {
+	gr.l.Println("Handling GET request for research group history", id)
+
+	history, err := data.GetMembershipHistory(id, db)
+	if err != nil {
+		gr.l.Println(err)
+		http.Error(rw, "Error retrieving membership history", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(history)
+}
+
+// getBookings encodes the bookings of a research group's current members to the ResponseWriter.
+func (gr *Groups) getBookings(rw http.ResponseWriter, id int, db *sql.DB) {
+	gr.l.Println("Handling GET request for research group bookings", id)
+
+	bookings, err := data.GetGroupBookings(id, db)
+	if err != nil {
+		gr.l.Println(err)
+		http.Error(rw, "Error retrieving bookings", http.StatusInternalServerError)
+		return
+	}
+	if err := bookings.ToJSON(rw); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+// getMoveRequests encodes the requests to move into a research group that haven't been decided to the ResponseWriter.
+func (gr *Groups) getMoveRequests(rw http.ResponseWriter, id int, db *sql.DB) {
+	gr.l.Println("Handling GET request for research group move requests", id)
+
+	requests, err := data.GetPendingGroupMoves(id, db)
+	if err != nil {
+		gr.l.Println(err)
+		http.Error(rw, "Error retrieving move requests", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(requests)
+}
+
+// decideMove approves or refuses a request to move into a research group, from the approved field of the request body.
+// Only the leader of the group the user wants to join, lab managers and admins can decide it. Approving it moves the user into the group.
+func (gr *Groups) decideMove(rw http.ResponseWriter, r *http.Request, id int, db *sql.DB) {
+	gr.l.Println("Handling PUT request for research group move request", id)
+
+	req, err := data.GetGroupMoveRequest(id, db)
+	if err == data.ErrMoveRequestNotFound {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		gr.l.Println(err)
+		http.Error(rw, "Error retrieving move request", http.StatusInternalServerError)
+		return
+	}
+	p := gr.authoriseLeader(rw, r, req.GroupID, db)
+	if p == nil {
+		return
+	}
+
+	var decision moveDecision
+	if err := json.NewDecoder(r.Body).Decode(&decision); err != nil || decision.Approved == nil {
+		http.Error(rw, "Please set approved to true or false", http.StatusBadRequest)
+		return
+	}
+	err = data.DecideGroupMove(id, *decision.Approved, p.UserID, db)
+	if err == data.ErrMoveRequestNotFound {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		gr.l.Println(err)
+		http.Error(rw, "Error deciding move request", http.StatusInternalServerError)
+		return
+	}
+	gr.l.Printf("Move request %d decided by user %d, approved: %t", id, p.UserID, *decision.Approved)
+}
+
+// addGroup creates a research group.
+// Names that only differ from an existing group's by case, spaces or punctuation are refused, so the same group can't be added twice.
+func (gr *Groups) addGroup(rw http.ResponseWriter, r *http.Request, db *sql.DB) {
+	gr.l.Println("Handling POST request for research groups")
+
+	g, ok := gr.decodeGroup(rw, r, db)
+	if !ok {
+		return
+	}
+	err := data.AddResearchGroup(g, db)
+	if err == data.ErrGroupExists {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		gr.l.Println(err)
+		http.Error(rw, "Error adding research group", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusCreated)
+	json.NewEncoder(rw).Encode(g)
+}
+
+// updateGroup renames a research group or changes its leader.
+func (gr *Groups) updateGroup(rw http.ResponseWriter, r *http.Request, id int, db *sql.DB) {
+	gr.l.Println("Handling PUT request for research group", id)
+
+	g, ok := gr.decodeGroup(rw, r, db)
+	if !ok {
+		return
+	}
+	g.ID = id
+	err := data.UpdateResearchGroup(g, db)
+	switch err {
+	case nil:
+	case data.ErrGroupNotFound:
+		http.Error(rw, err.Error(), http.StatusNotFound)
+	case data.ErrGroupExists:
+		http.Error(rw, err.Error(), http.StatusConflict)
+	default:
+		gr.l.Println(err)
+		http.Error(rw, "Error updating research group", http.StatusInternalServerError)
+	}
+}
+
+// deleteGroup deletes a research group that nobody has ever belonged to, for example one added by mistake.
+func (gr *Groups) deleteGroup(rw http.ResponseWriter, id int, db *sql.DB) {
+	gr.l.Println("Handling DELETE request for research group", id)
+
+	err := data.DeleteResearchGroup(id, db)
+	switch err {
+	case nil:
+	case data.ErrGroupNotFound:
+		http.Error(rw, err.Error(), http.StatusNotFound)
+	case data.ErrGroupHasMembers, data.ErrGroupHasHistory:
+		http.Error(rw, err.Error(), http.StatusConflict)
+	default:
+		gr.l.Println(err)
+		http.Error(rw, "Error deleting research group", http.StatusInternalServerError)
+	}
+}
+
+// decodeGroup decodes a groupRequest from the request body and checks it, returning the group it describes.
+// If the request is invalid the error response is written and false is returned.
+func (gr *Groups) decodeGroup(rw http.ResponseWriter, r *http.Request, db *sql.DB) (*data.ResearchGroup, bool) {
+	var req groupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusBadRequest)
+		return nil, false
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if data.GroupKey(req.Name) == "" {
+		http.Error(rw, "Please enter a name for the research group", http.StatusBadRequest)
+		return nil, false
+	}
+	if req.LeaderID != nil {
+		if _, err := data.GetUserByID(*req.LeaderID, db); err != nil {
+			http.Error(rw, fmt.Sprintf("Leader %d is not a user", *req.LeaderID), http.StatusBadRequest)
+			return nil, false
+		}
+	}
+	return &data.ResearchGroup{Name: req.Name, LeaderID: req.LeaderID}, true
+}
+
+// resolveResearchGroup takes a research group name as a user typed it and a sql DB connection, and returns the matching group's name in its own spelling.
+// The structured ErrGroupNotFound is returned if there is no such group.
+func resolveResearchGroup(name string, db *sql.DB) (string, error) {
+	g, err := data.FindResearchGroup(name, db)
+	if err != nil {
+		return "", err
+	}
+	return g.Name, nil
+}
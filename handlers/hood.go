@@ -3,103 +3,419 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
+	"bookings.com/m/auth"
+	"bookings.com/m/config"
 	"bookings.com/m/data"
 	"bookings.com/m/database"
-	"bookings.com/m/session"
+	"bookings.com/m/notify"
 )
 
-// Hoods struct is created to enable dependency injection of a logger.
+// what to do with a hood's future bookings when it is retired.
+const (
+	futureBookingsRefuse   = "refuse"
+	futureBookingsCancel   = "cancel"
+	futureBookingsReassign = "reassign"
+)
+
+// Hoods struct is created to enable dependency injection of a logger and the email notifier.
 type Hoods struct {
 	l *log.Logger
+	n *notify.Notifier
+}
+
+// hoodRequest is the body of a POST, PUT or PATCH request for a hood.
+// Fields are pointers so a PATCH can tell which ones were sent. POST and PUT need both.
+type hoodRequest struct {
+	Hood_Number *int    `json:"hood_number"`
+	Room        *string `json:"room"`
+}
+
+// retireRequest is the body of a POST request to /hood/{id}/retire.
+// FutureBookings is "refuse" (the default), "cancel" or "reassign". ReassignTo is the hood number bookings are moved to when reassigning.
+type retireRequest struct {
+	FutureBookings string `json:"future_bookings"`
+	ReassignTo     int    `json:"reassign_to"`
+}
+
+// retireResult is returned once a hood has been retired, listing what happened to its future bookings.
+type retireResult struct {
+	Hood       *data.Hood `json:"hood"`
+	Reassigned []int      `json:"reassigned"`
+	Cancelled  []int      `json:"cancelled"`
+	Failed     []int      `json:"failed"`
 }
 
-// NewHoodHandler takes a logger object and returns a Hoods object.
-// The logger passed will be assigned to the Hoods object logger field.
+// NewHoodHandler takes a logger object and a notifier and returns a Hoods object.
+// The logger and notifier passed will be assigned to the Hoods object fields.
 // This function is used in the main() function to return the Hoods handler that is required to pass to the created servemux.
-func NewHoodHandler(l *log.Logger) *Hoods {
-	return &Hoods{l}
+func NewHoodHandler(l *log.Logger, n *notify.Notifier) *Hoods {
+	return &Hoods{l, n}
 }
 
 // ServeHTTP is called on a Hoods object.
 // It takes an http ResponseWriter and Request as parameters.
-// This function deals with all HTTP request methods that are queried, so far GET and POST requests are handled.
-// Before each request is handled, the session token is authenticated to ensure login has been performed.
+// GET /hood lists the hoods in service (add include_retired=true for every hood), and GET /hood/{id} returns one hood.
+// POST /hood creates a hood, PUT and PATCH /hood/{id} update one, POST /hood/{id}/retire takes one out of service and DELETE /hood/{id} deletes one that has never been booked.
+// Before each request is handled, the session is authenticated and the user's permissions are checked.
 func (h *Hoods) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
+	// Initialise database connection
+	db, err := database.InitialiseConnection(h.l)
+	if err != nil {
+		h.l.Println("Database connection error", err)
+		return
+	}
+	defer db.Close()
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+
 	if r.Method == http.MethodGet {
-		token := session.RetrieveCookie(r)
-		if token == "" {
-			http.Error(rw, "Unable to retrieve cookie", http.StatusBadRequest)
+		if p := authorise(rw, r, db, auth.Authenticated); p == nil {
 			return
 		}
 
-		// Initialise database connection
-		db, err := database.InitialiseConnection(h.l)
+		if path == "/hood" {
+			h.getHoods(rw, r, db)
+			return
+		}
+		id, err := getIDFromURI(path)
 		if err != nil {
-			h.l.Println("Database connection error", err)
+			http.Error(rw, "Invalid URI", http.StatusBadRequest)
 			return
 		}
-		defer db.Close()
-
-		h.getHoods(rw, r, db)
+		h.getHood(rw, id, db)
 		return
 	}
 
-	if r.Method == http.MethodPost {
-		token := session.RetrieveCookie(r)
-		if token == "" {
-			http.Error(rw, "Unable to retrieve cookie", http.StatusBadRequest)
-			return
-		}
+	// only lab managers and admins can change hoods
+	if p := authorise(rw, r, db, auth.ManageHoods); p == nil {
+		return
+	}
 
-		// Initialise database connection
-		db, err := database.InitialiseConnection(h.l)
-		if err != nil {
-			h.l.Println("Database connection error", err)
+	if path == "/hood" {
+		if r.Method == http.MethodPost {
+			h.addHood(rw, r, db)
 			return
 		}
-		defer db.Close()
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
 
-		h.addHood(rw, r, db)
+	id, err := getIDFromURI(path)
+	if err != nil {
+		http.Error(rw, "Invalid URI", http.StatusBadRequest)
 		return
 	}
 
-	rw.WriteHeader(http.StatusMethodNotAllowed)
+	switch {
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/retire"):
+		h.retireHood(rw, r, id, db)
+	case r.Method == http.MethodPut:
+		h.updateHood(rw, r, id, false, db)
+	case r.Method == http.MethodPatch:
+		h.updateHood(rw, r, id, true, db)
+	case r.Method == http.MethodDelete:
+		h.deleteHood(rw, id, db)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
 }
 
 // getHoods is called on a Hoods object and takes an http ResponseWriter and Request as parameters.
 // This function is responsible for handling GET requests for Hoods.
-// It calls functions "GetHoods" and "ToJSON" from the booking data file to retrieve and encode the data to be presented to the user.
+// It calls functions "GetHoods" and "ToJSON" from the hood data file to retrieve and encode the data to be presented to the user.
 func (h *Hoods) getHoods(rw http.ResponseWriter, r *http.Request, db *sql.DB) {
 	h.l.Println("Handling GET request for hoods")
 
 	// retrieve hoodList
-	hoodList := data.GetHoods(db)
+	hoodList, err := data.GetHoods(r.URL.Query().Get("include_retired") == "true", db)
+	if err != nil {
+		h.l.Println(err)
+		http.Error(rw, "Error retrieving hoods", http.StatusInternalServerError)
+		return
+	}
 
 	// encode data
-	err := hoodList.ToJSON(rw)
+	err = hoodList.ToJSON(rw)
 	if err != nil {
 		http.Error(rw, "Unable to Marshal JSON", http.StatusInternalServerError)
 	}
 }
 
+// getHood encodes a single hood to the ResponseWriter, whether or not it has been retired.
+func (h *Hoods) getHood(rw http.ResponseWriter, id int, db *sql.DB) {
+	h.l.Println("Handling GET request for hood", id)
+
+	hd, err := data.GetHood(id, db)
+	if err == data.ErrHoodNotFound {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.l.Println(err)
+		http.Error(rw, "Error retrieving hood", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(hd)
+}
+
 // addHood is called on a Hoods struct object and takes an HTTP ResponseWriter and Request as parameters.
 // This function is responsible for handling POST requests for Hoods.
-// It calls the function "FromJSON" from the Hood data file to decode the data being passed by the user.
-// The decoded data is then passed to the function AddHood from the Hood data file to add the file to the hoodList.
+// The request must give a positive hood number that no other hood has, and a room.
+// The decoded data is then passed to the function AddHood from the Hood data file to add the hood to the hoods table.
 func (h *Hoods) addHood(rw http.ResponseWriter, r *http.Request, db *sql.DB) {
 	h.l.Println("Handling POST request for hoods")
 
+	var req hoodRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "Unable to unmarshal JSON", http.StatusBadRequest)
+		return
+	}
+
 	hd := &data.Hood{}
+	if err := req.apply(hd, false); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.l.Printf("Hood: %#v", hd)
+	err := data.AddHood(hd, db)
+	if err == data.ErrHoodExists {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		h.l.Println(err)
+		http.Error(rw, "Error adding hood to database", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusCreated)
+	json.NewEncoder(rw).Encode(hd)
+	publishEvent(h.l, "hood.created", hd, db)
+}
+
+// updateHood changes a hood's number or room.
+// A PUT must give both, and a PATCH only changes the fields it gives. Changing the number moves the hood's bookings, lottery requests and rates with it.
+func (h *Hoods) updateHood(rw http.ResponseWriter, r *http.Request, id int, partial bool, db *sql.DB) {
+	h.l.Println("Handling", r.Method, "request for hood", id)
 
-	if err := json.NewDecoder(r.Body).Decode(hd); err != nil {
+	var req hoodRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(rw, "Unable to unmarshal JSON", http.StatusBadRequest)
 		return
 	}
 
-	h.l.Printf("Hood: %#v", hd)
-	data.AddHood(hd, db)
+	hd, err := data.GetHood(id, db)
+	if err == data.ErrHoodNotFound {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.l.Println(err)
+		http.Error(rw, "Error retrieving hood", http.StatusInternalServerError)
+		return
+	}
+	if err := req.apply(hd, partial); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = data.UpdateHood(hd, db)
+	switch err {
+	case nil:
+	case data.ErrHoodNotFound:
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	case data.ErrHoodExists:
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	default:
+		h.l.Println(err)
+		http.Error(rw, "Error updating hood", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(hd)
+	publishEvent(h.l, "hood.updated", hd, db)
+}
+
+// retireHood takes a hood out of service so it can't be booked any more.
+// Bookings that have already started are left to finish. What happens to bookings that start later is chosen in the request:
+// "refuse" doesn't retire a hood that has any, "cancel" cancels them, and "reassign" moves each one to the reassign_to hood if it can be booked there, cancelling it otherwise.
+// The users whose bookings are moved or cancelled are notified, with booking.moved or booking.retired.
+// Bookings that couldn't be handled are listed as failed, and retiring the hood again handles whatever is left.
+func (h *Hoods) retireHood(rw http.ResponseWriter, r *http.Request, id int, db *sql.DB) {
+	h.l.Println("Handling POST request to retire hood", id)
+
+	req := retireRequest{FutureBookings: futureBookingsRefuse}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(rw, "Unable to unmarshal JSON", http.StatusBadRequest)
+		return
+	}
+
+	hd, err := data.GetHood(id, db)
+	if err == data.ErrHoodNotFound {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.l.Println(err)
+		http.Error(rw, "Error retrieving hood", http.StatusInternalServerError)
+		return
+	}
+
+	// bookings are reassigned under the booking rules of the other hood
+	var cfg config.Config
+	switch req.FutureBookings {
+	case futureBookingsRefuse, futureBookingsCancel:
+	case futureBookingsReassign:
+		target, err := data.GetHoodByNumber(req.ReassignTo, db)
+		if err != nil || target.RetiredAt != nil || target.ID == hd.ID {
+			http.Error(rw, "reassign_to must be the number of another hood in service", http.StatusBadRequest)
+			return
+		}
+		if cfg, err = config.ReadConfigFile(config.FileName); err != nil {
+			h.l.Println(err)
+			http.Error(rw, "Error reading config file", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(rw, "future_bookings must be one of refuse, cancel or reassign", http.StatusBadRequest)
+		return
+	}
+
+	// retire the hood first, so no new bookings can be made while the existing ones are handled
+	// with "refuse", the hood's future bookings are checked in the same transaction
+	err = data.RetireHood(id, req.FutureBookings == futureBookingsRefuse, db)
+	switch err {
+	case nil:
+	case data.ErrHoodRetired:
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	case data.ErrHoodHasFutureBookings:
+		http.Error(rw, fmt.Sprintf("Hood %d has future bookings, retire it with \"future_bookings\": \"cancel\" or \"reassign\"", hd.Hood_Number), http.StatusConflict)
+		return
+	case data.ErrHoodNotFound:
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	default:
+		h.l.Println(err)
+		http.Error(rw, "Error retiring hood", http.StatusInternalServerError)
+		return
+	}
+
+	result := retireResult{Reassigned: []int{}, Cancelled: []int{}, Failed: []int{}}
+	future, err := data.GetFutureHoodBookings(hd.Hood_Number, time.Now(), db)
+	if err != nil {
+		h.l.Println(err)
+		http.Error(rw, "Hood retired, but its future bookings could not be found, retire it again to handle them", http.StatusInternalServerError)
+		return
+	}
+	for _, booking := range future {
+		if req.FutureBookings == futureBookingsReassign && h.reassignBooking(booking, req.ReassignTo, cfg, db) {
+			result.Reassigned = append(result.Reassigned, booking.ID)
+			continue
+		}
+		if err := data.CancelBooking(booking.ID, db); err != nil {
+			h.l.Println("Error cancelling booking on retired hood", booking.ID, err)
+			result.Failed = append(result.Failed, booking.ID)
+			continue
+		}
+		result.Cancelled = append(result.Cancelled, booking.ID)
+		h.n.NotifyBooking("booking.retired", booking, db)
+		publishEvent(h.l, "booking.cancelled", booking, db)
+	}
+
+	if result.Hood, err = data.GetHood(id, db); err != nil {
+		h.l.Println(err)
+		result.Hood = hd
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(result)
+	// a hood retired again to handle the bookings left over has already been announced
+	if hd.RetiredAt == nil {
+		publishEvent(h.l, "hood.retired", result.Hood, db)
+	}
+}
+
+// reassignBooking moves a booking to another hood if it can be booked there, notifying the user.
+// The booking has to pass the same checks as a booking made on the other hood, including its booking rules and maintenance windows.
+// The move itself is refused by the bookings_no_overlap constraint if the hood has been booked since it was checked, so two bookings can never end up on the hood at once.
+// It returns false if the booking couldn't be moved, so the caller can cancel it instead.
+func (h *Hoods) reassignBooking(booking *data.Booking, hoodNumber int, cfg config.Config, db *sql.DB) bool {
+	moved := *booking
+	moved.HoodNumber = hoodNumber
+	if err := data.CheckBookable(&moved, cfg, time.Now(), db); err != nil {
+		if !data.IsBookingRejection(err) {
+			h.l.Println("Error checking booking against hood", hoodNumber, err)
+		}
+		return false
+	}
+
+	err := data.MoveBookingToHood(booking.ID, hoodNumber, db)
+	if data.IsBookingRejection(err) {
+		return false
+	}
+	if err != nil {
+		h.l.Println("Error moving booking", booking.ID, err)
+		return false
+	}
+	h.n.NotifyBooking("booking.moved", &moved, db)
+	publishEvent(h.l, "booking.moved", &moved, db)
+	return true
+}
+
+// deleteHood permanently deletes a hood that has never been booked, for example one added by mistake.
+// Hoods with bookings have to be retired instead, so their history is kept.
+func (h *Hoods) deleteHood(rw http.ResponseWriter, id int, db *sql.DB) {
+	h.l.Println("Handling DELETE request for hood", id)
+
+	hd, err := data.GetHood(id, db)
+	if err == nil {
+		err = data.DeleteHood(id, db)
+	}
+	switch err {
+	case nil:
+		publishEvent(h.l, "hood.deleted", hd, db)
+	case data.ErrHoodNotFound:
+		http.Error(rw, err.Error(), http.StatusNotFound)
+	case data.ErrHoodHasBookings:
+		http.Error(rw, err.Error(), http.StatusConflict)
+	default:
+		h.l.Println(err)
+		http.Error(rw, "Error deleting hood", http.StatusInternalServerError)
+	}
+}
+
+// apply takes a hood and whether the request is a partial update, and copies the request's fields onto the hood.
+// An error describing the problem is returned if a required field is missing or a value is invalid.
+func (req *hoodRequest) apply(hd *data.Hood, partial bool) error {
+	if !partial && (req.Hood_Number == nil || req.Room == nil) {
+		return fmt.Errorf("Please enter both the hood_number and room")
+	}
+	if req.Hood_Number != nil {
+		if *req.Hood_Number <= 0 {
+			return fmt.Errorf("The hood number must be a positive number")
+		}
+		hd.Hood_Number = *req.Hood_Number
+	}
+	if req.Room != nil {
+		room := strings.TrimSpace(*req.Room)
+		if room == "" {
+			return fmt.Errorf("Please enter the room the hood is in")
+		}
+		hd.Room = room
+	}
+	return nil
 }
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"bookings.com/m/auth"
+	"bookings.com/m/data"
+	"bookings.com/m/database"
+	"bookings.com/m/session"
+)
+
+// defaultInvitationDays is how long an invitation lasts when the request doesn't say.
+const defaultInvitationDays = 14
+
+// Invitations struct is created to enable dependency injection of a logger.
+type Invitations struct {
+	l *log.Logger
+}
+
+// invitationRequest is the body of a POST request to /invitations.
+// Email is optional, and limits the invitation to that address.
+type invitationRequest struct {
+	ResearchGroup string `json:"research_group"`
+	Email         string `json:"email"`
+	ExpiresInDays int    `json:"expires_in_days"`
+}
+
+// NewInvitationHandler takes a logger object and returns an Invitations object.
+// This function is used in the main() function to return the Invitations handler that is required to pass to the created servemux.
+func NewInvitationHandler(l *log.Logger) *Invitations {
+	return &Invitations{l}
+}
+
+// ServeHTTP is called on an Invitations object.
+// It takes an http ResponseWriter and Request as parameters.
+// GET /invitations lists invitations, POST /invitations creates one and DELETE /invitations/{id} withdraws an unused one.
+// Every request needs the permission to manage users.
+func (in *Invitations) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	// Initialise database connection
+	db, err := database.InitialiseConnection(in.l)
+	if err != nil {
+		in.l.Println("Database connection error", err)
+		return
+	}
+	defer db.Close()
+
+	p := authorise(rw, r, db, auth.ManageUsers)
+	if p == nil {
+		return
+	}
+
+	collection := r.URL.Path == "/invitations" || r.URL.Path == "/invitations/"
+
+	switch {
+	case collection && r.Method == http.MethodGet:
+		in.getInvitations(rw, db)
+	case collection && r.Method == http.MethodPost:
+		in.addInvitation(rw, r, p.UserID, db)
+	case !collection && r.Method == http.MethodDelete:
+		id, err := getIDFromURI(r.URL.Path)
+		if err != nil {
+			http.Error(rw, "Invalid URI", http.StatusBadRequest)
+			return
+		}
+		in.deleteInvitation(rw, id, db)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// getInvitations encodes every invitation to the ResponseWriter. The codes themselves are never included.
+func (in *Invitations) getInvitations(rw http.ResponseWriter, db *sql.DB) {
+	in.l.Println("Handling GET request for invitations")
+
+	invitations, err := data.GetInvitations(db)
+	if err != nil {
+		in.l.Println(err)
+		http.Error(rw, "Error retrieving invitations", http.StatusInternalServerError)
+		return
+	}
+	if err := invitations.ToJSON(rw); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+// addInvitation creates a single-use invitation code for a research group and returns it.
+// This is the only time the code is shown, as only a hash of it is stored.
+func (in *Invitations) addInvitation(rw http.ResponseWriter, r *http.Request, createdBy int, db *sql.DB) {
+	in.l.Println("Handling POST request for invitations")
+
+	var req invitationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusBadRequest)
+		return
+	}
+	req.ResearchGroup = strings.TrimSpace(req.ResearchGroup)
+	if req.ResearchGroup == "" {
+		http.Error(rw, "Please enter the research group to invite the user to", http.StatusBadRequest)
+		return
+	}
+	group, err := resolveResearchGroup(req.ResearchGroup, db)
+	if err != nil {
+		if err == data.ErrGroupNotFound {
+			http.Error(rw, unknownGroupMessage, http.StatusBadRequest)
+			return
+		}
+		in.l.Println(err)
+		http.Error(rw, "Error creating invitation", http.StatusInternalServerError)
+		return
+	}
+	req.ResearchGroup = group
+	if req.ExpiresInDays <= 0 {
+		req.ExpiresInDays = defaultInvitationDays
+	}
+
+	code, err := session.GenerateSecureToken(12)
+	if err != nil {
+		http.Error(rw, "Error creating invitation", http.StatusInternalServerError)
+		return
+	}
+	invitation := &data.Invitation{
+		ResearchGroup: req.ResearchGroup,
+		Email:         strings.TrimSpace(req.Email),
+		CreatedBy:     createdBy,
+		ExpiresAt:     time.Now().AddDate(0, 0, req.ExpiresInDays),
+		Code:          code,
+	}
+	if err := data.AddInvitation(invitation, db); err != nil {
+		in.l.Println(err)
+		http.Error(rw, "Error creating invitation", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusCreated)
+	json.NewEncoder(rw).Encode(invitation)
+}
+
+// deleteInvitation withdraws an invitation that hasn't been used yet.
+func (in *Invitations) deleteInvitation(rw http.ResponseWriter, id int, db *sql.DB) {
+	in.l.Println("Handling DELETE request for invitation", id)
+
+	err := data.DeleteInvitation(id, db)
+	if err == data.ErrInvitationNotFound {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		in.l.Println(err)
+		http.Error(rw, "Error withdrawing invitation", http.StatusInternalServerError)
+	}
+}
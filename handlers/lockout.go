@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"bookings.com/m/auth"
+	"bookings.com/m/data"
+	"bookings.com/m/database"
+)
+
+// maxLoginAttempts is the most login audit log entries returned by one request.
+const maxLoginAttempts = 1000
+
+// LoginAudits struct is created to enable dependency injection of a logger.
+type LoginAudits struct {
+	l *log.Logger
+}
+
+// NewLoginAuditHandler takes a logger object and returns a LoginAudits object.
+// This function is used in the main() function to return the LoginAudits handler that is required to pass to the created servemux.
+func NewLoginAuditHandler(l *log.Logger) *LoginAudits {
+	return &LoginAudits{l}
+}
+
+// ServeHTTP is called on a LoginAudits object.
+// It takes an http ResponseWriter and Request as parameters.
+// GET /lockouts lists the usernames that are locked after failed logins, DELETE /lockouts/{username} removes a lock and GET /login-attempts returns the login audit log.
+// Every request needs the permission to manage users.
+func (la *LoginAudits) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	// Initialise database connection
+	db, err := database.InitialiseConnection(la.l)
+	if err != nil {
+		la.l.Println("Database connection error", err)
+		return
+	}
+	defer db.Close()
+
+	if p := authorise(rw, r, db, auth.ManageUsers); p == nil {
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "lockouts" && r.Method == http.MethodGet:
+		la.getLockouts(rw, db)
+	case len(parts) == 2 && parts[0] == "lockouts" && r.Method == http.MethodDelete:
+		username, err := url.PathUnescape(parts[1])
+		if err != nil {
+			http.Error(rw, "Invalid URI", http.StatusBadRequest)
+			return
+		}
+		la.unlock(rw, username, db)
+	case len(parts) == 1 && parts[0] == "login-attempts" && r.Method == http.MethodGet:
+		la.getAttempts(rw, r, db)
+	case len(parts) <= 2:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	default:
+		http.Error(rw, "Invalid URI", http.StatusBadRequest)
+	}
+}
+
+// getLockouts encodes every username that is currently locked to the ResponseWriter.
+func (la *LoginAudits) getLockouts(rw http.ResponseWriter, db *sql.DB) {
+	la.l.Println("Handling GET request for lockouts")
+
+	lockouts, err := data.GetActiveLockouts(db)
+	if err != nil {
+		la.l.Println(err)
+		http.Error(rw, "Error retrieving lockouts", http.StatusInternalServerError)
+		return
+	}
+	if err := lockouts.ToJSON(rw); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+// unlock removes the lock on a username, so the user can log in again straight away.
+func (la *LoginAudits) unlock(rw http.ResponseWriter, username string, db *sql.DB) {
+	la.l.Println("Handling DELETE request for lockout", username)
+
+	err := data.UnlockAccount(username, db)
+	if err == data.ErrLockoutNotFound {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		la.l.Println(err)
+		http.Error(rw, "Error removing lockout", http.StatusInternalServerError)
+	}
+}
+
+// getAttempts encodes the most recent login attempts to the ResponseWriter.
+// The optional username and ip query parameters filter the log, and limit sets how many entries are returned, up to maxLoginAttempts.
+func (la *LoginAudits) getAttempts(rw http.ResponseWriter, r *http.Request, db *sql.DB) {
+	la.l.Println("Handling GET request for login attempts")
+
+	q := r.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(rw, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if limit > maxLoginAttempts {
+		limit = maxLoginAttempts
+	}
+
+	attempts, err := data.GetLoginAttempts(q.Get("username"), q.Get("ip"), limit, db)
+	if err != nil {
+		la.l.Println(err)
+		http.Error(rw, "Error retrieving login attempts", http.StatusInternalServerError)
+		return
+	}
+	if err := attempts.ToJSON(rw); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusInternalServerError)
+	}
+}
@@ -5,29 +5,41 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"bookings.com/m/auth"
+	"bookings.com/m/config"
 	"bookings.com/m/data"
 	"bookings.com/m/database"
 	"bookings.com/m/session"
+	"bookings.com/m/sso"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// create a Hoods struct to enable dependency injection of a logger.
+// create a Hoods struct to enable dependency injection of a logger and the identity providers users can log in with.
 type Logins struct {
-	l *log.Logger
+	l              *log.Logger
+	authenticators map[string]sso.Authenticator
 }
 
-// NewBookingHandler takes a logger object and returns a Logins object.
+// NewBookingHandler takes a logger object and any identity providers that check passwords, such as the LDAP directory, and returns a Logins object.
 // The logger passed will be assigned to the Logins object logger field.
+// Local accounts are always available, and logins choose a provider by name with the "provider" field of the request.
 // This function is used in the main() function to return the Bookings handler that is required to pass to the created servemux to handle http requests at the specified url path.
-func NewLoginHandler(l *log.Logger) *Logins {
-	return &Logins{l}
+func NewLoginHandler(l *log.Logger, authenticators ...sso.Authenticator) *Logins {
+	byName := map[string]sso.Authenticator{}
+	for _, a := range authenticators {
+		byName[a.Name()] = a
+	}
+	return &Logins{l, byName}
 }
 
 // ServeHTTP is called on a Logins struct.
 // It takes an http ResponseWriter and Request as parameters.
 // This function deals with all HTTP request methods that are queried.
-// For logins, only POST requests are permitted and handled.
+// For logins, only POST requests are permitted and handled: POST /login checks the password, and POST /login/2fa checks the two-factor code of users who have it turned on.
 func (l *Logins) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
 	// Initialise database connection
@@ -38,87 +50,414 @@ func (l *Logins) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
-	if r.Method == http.MethodPost {
-		l.login(rw, r, db)
+	if r.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
-	rw.WriteHeader(http.StatusMethodNotAllowed)
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/login":
+		l.login(rw, r, db)
+	case "/login/2fa":
+		l.secondFactor(rw, r, db)
+	default:
+		http.Error(rw, "Invalid URI", http.StatusNotFound)
+	}
+}
+
+// loginRequest is the body of a login request.
+// The password is sent in the "hash" field, matching the field name used at registration.
+// DeviceLabel is optional, and is shown when the user lists their sessions, e.g. "Lab tablet".
+// Provider is optional, and names the identity provider to check the password with, e.g. "ldap". It defaults to the local accounts.
+type loginRequest struct {
+	Name        string `json:"name"`
+	Password    string `json:"hash"`
+	DeviceLabel string `json:"device_label"`
+	Provider    string `json:"provider"`
 }
 
+// Default limits on failed logins, used when the login section of the config file leaves them unset.
+const (
+	defaultMaxFailuresPerUser = 5
+	defaultMaxFailuresPerIP   = 20
+	defaultLoginWindow        = 15 * time.Minute
+	defaultLockout            = 15 * time.Minute
+)
+
+// challengeValidFor is how long a user has to enter their two-factor code after entering their password.
+const challengeValidFor = 5 * time.Minute
+
+// twoFactorLoginRequest is the body of a POST request to /login/2fa.
+// Code is either the current code from the user's authenticator app or one of their recovery codes.
+type twoFactorLoginRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// twoFactorChallenge is returned by /login when the password is right but the user has two-factor turned on.
+// The challenge is sent back to /login/2fa with the code.
+type twoFactorChallenge struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	Challenge         string `json:"challenge"`
+	ExpiresIn         int    `json:"expires_in"`
+}
+
+// loginFailedMessage is returned for every failed login, so the response doesn't reveal whether the username or the password was wrong.
+const loginFailedMessage = "Invalid username or password"
+
+// dummyHash is compared against when the username doesn't exist, so failed logins take the same time whether or not the user exists.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
 // login is called on a Logins struct, and takes an http ResponseWriter and request as arguments.
 // This function handles logging in a user.
-// It calls various helper functions to authenticate provided data.
-// Once the user is authenticated, a session cookie is created and stored
+// Requests from an IP address with too many recent failures, or for a locked username, are refused before the password is checked.
+// Every attempt is recorded in the login audit log, and a username is locked once it has too many recent failures.
+// Once the user is authenticated, a session cookie is created and stored.
+// Users with two-factor authentication turned on are instead given a challenge, and the session is only created once they send a code to /login/2fa.
 func (l *Logins) login(rw http.ResponseWriter, r *http.Request, db *sql.DB) {
 	l.l.Println("Logging in...")
 
-	usr := &data.User{}
+	req := &loginRequest{}
 
-	// attempt to decode http request into usr
-	err := json.NewDecoder(r.Body).Decode(usr)
+	// attempt to decode http request into req
+	err := json.NewDecoder(r.Body).Decode(req)
 	if err != nil {
 		http.Error(rw, "Unable to unmarshal JSON", http.StatusBadRequest)
 		return
 	}
 
-	// Ensure the username exists within the database
-	matchedUser := checkUsername(usr.Name, db)
-	if matchedUser == nil {
-		http.Error(rw, "Invalid username", http.StatusBadRequest)
+	limits := loginLimits()
+	attempt := &data.LoginAttempt{Username: req.Name, IPAddress: session.ClientIP(r), UserAgent: r.UserAgent()}
+	windowStart := time.Now().Add(-limits.window)
+
+	// refuse addresses guessing passwords across many accounts, and locked usernames, without checking the password
+	if refused(l.l, rw, attempt, windowStart, limits, db) {
+		return
+	}
+
+	// check the credentials locally or with the chosen identity provider
+	var userID int
+	if req.Provider == "" || req.Provider == data.LocalProvider {
+		userID, attempt.Outcome, err = l.checkLocal(req, attempt, db)
+		if err != nil {
+			l.l.Println(err)
+			http.Error(rw, "Error checking login details", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		authn, ok := l.authenticators[req.Provider]
+		if !ok {
+			http.Error(rw, "Unknown login provider", http.StatusBadRequest)
+			return
+		}
+		attempt.Provider = req.Provider
+		userID, attempt.Outcome, err = l.checkExternal(r, authn, req, attempt, db)
+		if err != nil {
+			l.l.Println(err)
+			recordAttempt(l.l, attempt, db)
+			if err == data.ErrUsernameTaken {
+				http.Error(rw, "That username belongs to a local account, please ask an admin to resolve this", http.StatusConflict)
+				return
+			}
+			http.Error(rw, "Unable to log in with the "+req.Provider+" provider", http.StatusBadGateway)
+			return
+		}
+	}
+	if attempt.Outcome == data.LoginUnverified {
+		// the password was right, so it is safe to say why the login failed
+		recordAttempt(l.l, attempt, db)
+		http.Error(rw, "Please verify your email address with the link emailed to you before logging in", http.StatusForbidden)
+		return
+	}
+	if attempt.Outcome != data.LoginSucceeded {
+		recordAttempt(l.l, attempt, db)
+		if attempt.Outcome == data.LoginBadCredential {
+			lockIfNeeded(l.l, req.Name, windowStart, limits, db)
+		}
+		http.Error(rw, loginFailedMessage, http.StatusUnauthorized)
+		return
+	}
+
+	// users with two-factor turned on must send a code before they get a session
+	twoFactor, err := data.TwoFactorEnabled(userID, db)
+	if err != nil {
+		l.l.Println(err)
+		http.Error(rw, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+	if twoFactor {
+		l.challenge(rw, req, userID, attempt, db)
 		return
 	}
-	if err = comparePasswords(matchedUser.Hash, usr.Hash); err != nil {
-		http.Error(rw, "Incorrect password", http.StatusBadRequest)
+
+	// generate secure token and store the session in the database, alongside any sessions the user has on other devices
+	token, err := session.CreateSession(userID, r, req.DeviceLabel, db)
+	if err != nil {
+		l.l.Println(err)
+		http.Error(rw, "Failed to create session", http.StatusInternalServerError)
 		return
 	}
+	recordAttempt(l.l, attempt, db)
 
-	// generate secure token and store in session map
+	// Store cookie in Postman
+	session.StoreCookie(rw, token)
+	l.l.Println("User successfully logged in, welcome", req.Name)
+}
+
+// challenge is called on a Logins struct once a user with two-factor turned on has entered the right password.
+// A short-lived challenge is stored in place of a session, and returned with a 202 Accepted status for the client to send back to /login/2fa with the code.
+func (l *Logins) challenge(rw http.ResponseWriter, req *loginRequest, userID int, attempt *data.LoginAttempt, db *sql.DB) {
 	token, err := session.GenerateSecureToken(32)
 	if err != nil {
-		http.Error(rw, "Failed to generate secure token", http.StatusBadRequest)
+		http.Error(rw, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+	c := &data.LoginChallenge{UserID: userID, Username: req.Name, Provider: attempt.Provider, DeviceLabel: req.DeviceLabel}
+	if err := data.AddLoginChallenge(c, token, challengeValidFor, db); err != nil {
+		l.l.Println(err)
+		http.Error(rw, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+	attempt.Outcome = data.LoginTwoFactorWait
+	recordAttempt(l.l, attempt, db)
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(rw).Encode(twoFactorChallenge{TwoFactorRequired: true, Challenge: token, ExpiresIn: int(challengeValidFor.Seconds())})
+}
+
+// secondFactor is called on a Logins struct, and takes an http ResponseWriter and request as arguments.
+// This function finishes logging in a user with two-factor turned on, by checking the code sent with the challenge given by /login.
+// Each challenge allows a handful of attempts, and wrong codes count towards locking the username just like wrong passwords.
+// Once the code is accepted, the challenge is used up and a session cookie is created and stored.
+func (l *Logins) secondFactor(rw http.ResponseWriter, r *http.Request, db *sql.DB) {
+	l.l.Println("Checking two-factor code...")
+
+	req := &twoFactorLoginRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(rw, "Unable to unmarshal JSON", http.StatusBadRequest)
 		return
 	}
 
-	// clear sessiontokens table (should be done in logout, not yet implemented) to avoid pkey error
-	_, err = db.Exec("DELETE FROM sessiontokens WHERE user_id = $1;", matchedUser.ID)
+	c, err := data.TryLoginChallenge(req.Challenge, db)
+	if err == data.ErrChallengeNotFound {
+		http.Error(rw, err.Error(), http.StatusUnauthorized)
+		return
+	}
 	if err != nil {
-		http.Error(rw, "Failed to clear previously stored token", http.StatusBadRequest)
+		l.l.Println(err)
+		http.Error(rw, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+
+	limits := loginLimits()
+	attempt := &data.LoginAttempt{Username: c.Username, UserID: &c.UserID, Provider: c.Provider, IPAddress: session.ClientIP(r), UserAgent: r.UserAgent()}
+	windowStart := time.Now().Add(-limits.window)
+	if refused(l.l, rw, attempt, windowStart, limits, db) {
+		return
+	}
+
+	ok, err := verifySecondFactor(c.UserID, req.Code, db)
+	if err != nil && err != data.ErrTwoFactorNotEnrolled {
+		l.l.Println(err)
+		http.Error(rw, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		attempt.Outcome = data.LoginBadTwoFactor
+		recordAttempt(l.l, attempt, db)
+		lockIfNeeded(l.l, c.Username, windowStart, limits, db)
+		http.Error(rw, "Invalid two-factor code", http.StatusUnauthorized)
 		return
 	}
 
-	// Add session token to the database, not the local storage
-	_, err = db.Exec("INSERT INTO sessiontokens (token, user_id) VALUES ($1, $2);", token, matchedUser.ID)
+	if err := data.DeleteLoginChallenge(req.Challenge, db); err != nil {
+		l.l.Println(err)
+	}
+	token, err := session.CreateSession(c.UserID, r, c.DeviceLabel, db)
 	if err != nil {
-		http.Error(rw, "Failed to store secure token in database", http.StatusBadRequest)
+		l.l.Println(err)
+		http.Error(rw, "Failed to create session", http.StatusInternalServerError)
 		return
 	}
+	attempt.Outcome = data.LoginSucceeded
+	recordAttempt(l.l, attempt, db)
 
-	// Store cookie in Postman
 	session.StoreCookie(rw, token)
-	l.l.Println("User successfully logged in, welcome", matchedUser.Name)
+	l.l.Println("User successfully logged in with two-factor, welcome", c.Username)
 }
 
-// checekUsername takes a string containing the name provided during login.
-// If the name matches a name that is already stored in the userList, then this user is returned.
-// This allows checking of the hashed password with the password provided during the login.
-func checkUsername(name string, db *sql.DB) *data.User {
-	rows, err := db.Query("SELECT id, username, passhash FROM users;")
+// refused takes a logger and is called before any credential is checked, whether at login or when a logged in user confirms a two-factor code.
+// If the request's IP address has too many recent failures, or the username is locked, the attempt is recorded, a 429 response is written and true is returned.
+func refused(l *log.Logger, rw http.ResponseWriter, attempt *data.LoginAttempt, windowStart time.Time, limits loginThresholds, db *sql.DB) bool {
+	ipFailures, err := data.CountFailedLoginsForIP(attempt.IPAddress, windowStart, db)
+	if err != nil {
+		l.Println(err)
+		http.Error(rw, "Error logging in", http.StatusInternalServerError)
+		return true
+	}
+	if ipFailures >= limits.maxPerIP {
+		attempt.Outcome = data.LoginIPLimited
+		recordAttempt(l, attempt, db)
+		rw.Header().Set("Retry-After", strconv.Itoa(int(limits.window.Seconds())))
+		http.Error(rw, "Too many failed login attempts, please try again later", http.StatusTooManyRequests)
+		return true
+	}
+
+	lock, err := data.GetActiveLockout(attempt.Username, db)
 	if err != nil {
-		return nil
+		l.Println(err)
+		http.Error(rw, "Error logging in", http.StatusInternalServerError)
+		return true
+	}
+	if lock != nil {
+		attempt.Outcome = data.LoginAccountLocked
+		recordAttempt(l, attempt, db)
+		rw.Header().Set("Retry-After", strconv.Itoa(int(time.Until(lock.LockedUntil).Seconds())+1))
+		http.Error(rw, "Too many failed login attempts, please try again later", http.StatusTooManyRequests)
+		return true
+	}
+	return false
+}
+
+// checkLocal is called on a Logins struct and checks a login against the local users table.
+// It returns the user's ID and the outcome of the attempt.
+// When local logins are kept for admins only, other users are refused even with the right password, and users who haven't verified their email address are refused too.
+// An error is returned if the database couldn't be read, so the login can fail with a server error rather than look like a wrong password.
+func (l *Logins) checkLocal(req *loginRequest, attempt *data.LoginAttempt, db *sql.DB) (int, string, error) {
+	matchedUser, err := checkUsername(req.Name, db)
+	if err != nil {
+		return 0, "", err
+	}
+	if matchedUser == nil {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(req.Password))
+		return 0, data.LoginBadCredential, nil
+	}
+	attempt.UserID = &matchedUser.ID
+
+	if err := comparePasswords(matchedUser.Hash, req.Password); err != nil {
+		return 0, data.LoginBadCredential, nil
 	}
 
-	for rows.Next() {
-		var user data.User
-		err := rows.Scan(&user.ID, &user.Name, &user.Hash)
+	if localLoginAdminsOnly() {
+		role, err := data.GetUserRole(matchedUser.ID, db)
 		if err != nil {
-			return nil
+			return 0, "", err
 		}
-		if user.Name == name {
-			return &user
+		if auth.Role(role) != auth.RoleAdmin {
+			return 0, data.LoginNotAllowed, nil
 		}
 	}
-	return nil
+
+	// accounts stay inactive until the email address is verified
+	verified, err := data.IsEmailVerified(matchedUser.ID, db)
+	if err != nil {
+		return 0, "", err
+	}
+	if !verified {
+		return 0, data.LoginUnverified, nil
+	}
+	return matchedUser.ID, data.LoginSucceeded, nil
+}
+
+// checkExternal is called on a Logins struct and checks a login with an identity provider such as the LDAP directory.
+// On success the user is found, or provisioned on their first login, and their ID returned.
+// A wrong password gives the LoginBadCredential outcome, while an error means the provider couldn't be used or the user couldn't be provisioned.
+func (l *Logins) checkExternal(r *http.Request, authn sso.Authenticator, req *loginRequest, attempt *data.LoginAttempt, db *sql.DB) (int, string, error) {
+	identity, err := authn.Authenticate(r.Context(), req.Name, req.Password)
+	if err == sso.ErrInvalidCredentials {
+		return 0, data.LoginBadCredential, nil
+	}
+	if err != nil {
+		return 0, data.LoginProvisionFail, err
+	}
+
+	userID, err := data.ProvisionExternalUser(identity, db)
+	if err != nil {
+		return 0, data.LoginProvisionFail, err
+	}
+	attempt.UserID = &userID
+	return userID, data.LoginSucceeded, nil
+}
+
+// localLoginAdminsOnly reads the config file and reports whether local password logins are kept for admins only.
+func localLoginAdminsOnly() bool {
+	cfg, err := config.ReadConfigFile(config.FileName)
+	return err == nil && cfg.SSO.LocalLogin == "admins"
+}
+
+// recordAttempt takes a logger and adds a login attempt to the audit log.
+// A failure to write the audit log is logged but does not stop the login.
+func recordAttempt(l *log.Logger, a *data.LoginAttempt, db *sql.DB) {
+	if err := data.RecordLoginAttempt(a, db); err != nil {
+		l.Println("Unable to record login attempt", err)
+	}
+}
+
+// lockIfNeeded takes a logger and is called after a failed login or two-factor code, and locks the username if it has reached the maximum number of failures in the window.
+func lockIfNeeded(l *log.Logger, username string, windowStart time.Time, limits loginThresholds, db *sql.DB) {
+	failures, err := data.CountFailedLoginsForUser(username, windowStart, db)
+	if err != nil {
+		l.Println(err)
+		return
+	}
+	if failures < limits.maxPerUser {
+		return
+	}
+	if err := data.LockAccount(username, failures, time.Now().Add(limits.lockout), db); err != nil {
+		l.Println(err)
+		return
+	}
+	l.Printf("Locked login for %q after %d failed attempts", username, failures)
+}
+
+// loginThresholds holds the login limits in force, with defaults filled in.
+type loginThresholds struct {
+	maxPerUser int
+	maxPerIP   int
+	window     time.Duration
+	lockout    time.Duration
+}
+
+// loginLimits reads the login section of the config file and returns the limits to apply, using the defaults for anything that isn't set.
+func loginLimits() loginThresholds {
+	lim := loginThresholds{defaultMaxFailuresPerUser, defaultMaxFailuresPerIP, defaultLoginWindow, defaultLockout}
+
+	cfg, err := config.ReadConfigFile(config.FileName)
+	if err != nil {
+		return lim
+	}
+	if cfg.Login.MaxFailuresPerUser > 0 {
+		lim.maxPerUser = cfg.Login.MaxFailuresPerUser
+	}
+	if cfg.Login.MaxFailuresPerIP > 0 {
+		lim.maxPerIP = cfg.Login.MaxFailuresPerIP
+	}
+	if cfg.Login.WindowMinutes > 0 {
+		lim.window = time.Duration(cfg.Login.WindowMinutes) * time.Minute
+	}
+	if cfg.Login.LockoutMinutes > 0 {
+		lim.lockout = time.Duration(cfg.Login.LockoutMinutes) * time.Minute
+	}
+	return lim
+}
+
+// checkUsername takes a string containing the name provided during login.
+// If the name matches a stored user, then this user is returned along with their password hash.
+// This allows checking of the hashed password with the password provided during the login.
+// Names are matched ignoring case and surrounding spaces, the same way the lockouts are keyed, so "Alice" and "alice" are one account for both.
+// If no user matches, nil is returned with a nil error; any other error means the users table couldn't be read.
+func checkUsername(name string, db *sql.DB) (*data.User, error) {
+	var user data.User
+	err := db.QueryRow("SELECT id, username, passhash FROM users WHERE LOWER(username) = LOWER(TRIM($1));", name).
+		Scan(&user.ID, &user.Name, &user.Hash)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
 }
 
 // comparePasswords takes in the hashedPassword that was generated during registration and assigned to the User struct in the userList for this specific user.
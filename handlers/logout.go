@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"bookings.com/m/auth"
+	"bookings.com/m/data"
+	"bookings.com/m/database"
+	"bookings.com/m/session"
+)
+
+// Logouts struct is created to enable dependency injection of a logger.
+type Logouts struct {
+	l *log.Logger
+}
+
+// NewLogoutHandler takes a logger object and returns a Logouts object.
+// This function is used in the main() function to return the Logouts handler that is required to pass to the created servemux.
+func NewLogoutHandler(l *log.Logger) *Logouts {
+	return &Logouts{l}
+}
+
+// ServeHTTP is called on a Logouts struct.
+// It takes an http ResponseWriter and Request as parameters.
+// For logouts, only POST requests are permitted. The session token in the cookie is revoked and the client is told to delete the cookie.
+// Logging out with the cookie needs the session's CSRF token, like every other request that changes something.
+// If the request uses an API token instead, that token is revoked.
+func (lo *Logouts) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	bearer := auth.BearerToken(r)
+	token := session.RetrieveCookie(r)
+	if token == "" && bearer == "" {
+		http.Error(rw, "Unable to retrieve cookie or API token", http.StatusBadRequest)
+		return
+	}
+
+	// Initialise database connection
+	db, err := database.InitialiseConnection(lo.l)
+	if err != nil {
+		lo.l.Println("Database connection error", err)
+		return
+	}
+	defer db.Close()
+
+	// a script logging out with an API token revokes that token
+	if bearer != "" {
+		if err := data.RevokeAPITokenByValue(bearer, db); err != nil {
+			lo.l.Println(err)
+			http.Error(rw, "Failed to revoke API token", http.StatusInternalServerError)
+			return
+		}
+		lo.l.Println("API token revoked")
+		return
+	}
+
+	// stop other sites logging the user out
+	if !session.CheckCSRF(r, token) {
+		http.Error(rw, "Permission Denied, send the csrf_token cookie's value in the "+session.CSRFHeader+" header", http.StatusForbidden)
+		return
+	}
+
+	if err := session.RevokeSession(token, db); err != nil {
+		lo.l.Println(err)
+		http.Error(rw, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+
+	session.ClearCookie(rw)
+	lo.l.Println("User logged out")
+}
@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"bookings.com/m/auth"
+	"bookings.com/m/config"
+	"bookings.com/m/data"
+	"bookings.com/m/database"
+)
+
+// Lotteries struct is created to enable dependency injection of a logger.
+type Lotteries struct {
+	l *log.Logger
+}
+
+// NewLotteryHandler takes a logger object and returns a Lotteries object.
+// This function is used in the main() function to return the Lotteries handler that is required to pass to the created servemux.
+func NewLotteryHandler(l *log.Logger) *Lotteries {
+	return &Lotteries{l}
+}
+
+// ServeHTTP is called on a Lotteries object.
+// It takes an http ResponseWriter and Request as parameters.
+// GET and POST on /lottery list and create request windows.
+// GET and POST on /lottery/{id} show and submit the logged in user's ranked requests for that window.
+func (lt *Lotteries) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	// Initialise database connection
+	db, err := database.InitialiseConnection(lt.l)
+	if err != nil {
+		lt.l.Println("Database connection error", err)
+		return
+	}
+	defer db.Close()
+
+	p := authorise(rw, r, db, auth.Authenticated)
+	if p == nil {
+		return
+	}
+
+	if r.URL.Path == "/lottery" || r.URL.Path == "/lottery/" {
+		switch r.Method {
+		case http.MethodGet:
+			lt.getWindows(rw, db)
+		case http.MethodPost:
+			// only lab managers and admins can open request windows
+			if !p.Can(auth.ManageLottery) {
+				http.Error(rw, "Permission Denied", http.StatusForbidden)
+				return
+			}
+			lt.addWindow(rw, r, db)
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, err := getIDFromURI(r.URL.Path)
+	if err != nil {
+		http.Error(rw, "Invalid URI", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		lt.getRequests(rw, id, p.Name, db)
+	case http.MethodPost:
+		lt.submitRequests(rw, r, id, p.Name, db)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// getWindows encodes every lottery window to the ResponseWriter.
+func (lt *Lotteries) getWindows(rw http.ResponseWriter, db *sql.DB) {
+	lt.l.Println("Handling GET request for lottery windows")
+
+	windows, err := data.GetLotteryWindows(db)
+	if err != nil {
+		lt.l.Println(err)
+		http.Error(rw, "Error retrieving lottery windows", http.StatusInternalServerError)
+		return
+	}
+
+	if err := windows.ToJSON(rw); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+// addWindow decodes a new lottery window from the request body, validates its times and stores it.
+func (lt *Lotteries) addWindow(rw http.ResponseWriter, r *http.Request, db *sql.DB) {
+	lt.l.Println("Handling POST request for lottery windows")
+
+	window := &data.LotteryWindow{}
+	if err := window.FromJSON(r.Body); err != nil {
+		http.Error(rw, "Unable to unmarshal JSON", http.StatusBadRequest)
+		return
+	}
+
+	if window.OpensAt.IsZero() || window.ClosesAt.IsZero() || window.SlotsFrom.IsZero() || window.SlotsUntil.IsZero() {
+		http.Error(rw, "Please ensure there is no missing data entered", http.StatusBadRequest)
+		return
+	}
+	if !window.ClosesAt.After(window.OpensAt) || !window.SlotsUntil.After(window.SlotsFrom) {
+		http.Error(rw, "Each window must end after it starts", http.StatusBadRequest)
+		return
+	}
+	if window.SlotsFrom.Before(window.ClosesAt) {
+		http.Error(rw, "Requested slots must start after the request window closes", http.StatusBadRequest)
+		return
+	}
+
+	if err := data.AddLotteryWindow(window, db); err != nil {
+		lt.l.Println(err)
+		http.Error(rw, "Error adding lottery window to database", http.StatusInternalServerError)
+		return
+	}
+	lt.l.Printf("Lottery window: %#v", window)
+}
+
+// getRequests encodes the user's requests in the window to the ResponseWriter.
+// Once the window has been allocated, each request shows whether it won or lost, and why.
+func (lt *Lotteries) getRequests(rw http.ResponseWriter, windowID int, userName string, db *sql.DB) {
+	lt.l.Println("Handling GET request for lottery requests")
+
+	if _, err := data.GetLotteryWindow(windowID, db); err != nil {
+		http.Error(rw, "Lottery window not found", http.StatusNotFound)
+		return
+	}
+
+	requests, err := data.GetBookingRequests(windowID, userName, db)
+	if err != nil {
+		lt.l.Println(err)
+		http.Error(rw, "Error retrieving lottery requests", http.StatusInternalServerError)
+		return
+	}
+
+	if err := requests.ToJSON(rw); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+// submitRequests decodes a ranked list of requests from the request body, first choice first, and stores them for the window.
+// Any requests the user previously submitted in the window are replaced.
+// Each request is checked against the window and the booking rules for its hood, using the time the window closes as the booking time.
+// Requests outside working hours must acknowledge the lone-worker protocol, as bookings made directly do.
+func (lt *Lotteries) submitRequests(rw http.ResponseWriter, r *http.Request, windowID int, userName string, db *sql.DB) {
+	lt.l.Println("Handling POST request for lottery requests")
+
+	window, err := data.GetLotteryWindow(windowID, db)
+	if err != nil {
+		http.Error(rw, "Lottery window not found", http.StatusNotFound)
+		return
+	}
+	now := time.Now()
+	if window.Status != data.LotteryOpen || now.Before(window.OpensAt) || !now.Before(window.ClosesAt) {
+		http.Error(rw, "This lottery window is not taking requests", http.StatusBadRequest)
+		return
+	}
+
+	var requests data.BookingRequestsList
+	if err := requests.FromJSON(r.Body); err != nil {
+		http.Error(rw, "Unable to unmarshal JSON", http.StatusBadRequest)
+		return
+	}
+
+	cfg, err := config.ReadConfigFile(config.FileName)
+	if err != nil {
+		lt.l.Println(err)
+		http.Error(rw, "Error reading booking rules", http.StatusInternalServerError)
+		return
+	}
+	loc, err := cfg.Location()
+	if err != nil {
+		lt.l.Println(err)
+		http.Error(rw, "Error reading lab timezone", http.StatusInternalServerError)
+		return
+	}
+
+	for i, req := range requests {
+		if req.HoodNumber == 0 || req.BookingDate.IsZero() {
+			http.Error(rw, fmt.Sprintf("Request %d: please ensure there is no missing data entered", i+1), http.StatusBadRequest)
+			return
+		}
+		if req.EndDate.IsZero() {
+			req.EndDate = req.BookingDate.Add(24 * time.Hour)
+		}
+		if req.BookingDate.Before(window.SlotsFrom) || !req.BookingDate.Before(window.SlotsUntil) {
+			http.Error(rw, fmt.Sprintf("Request %d: booking time is outside the slots covered by this window", i+1), http.StatusBadRequest)
+			return
+		}
+		if hood, err := data.GetHoodByNumber(req.HoodNumber, db); err != nil {
+			http.Error(rw, fmt.Sprintf("Request %d: that hood number does not exist", i+1), http.StatusBadRequest)
+			return
+		} else if hood.RetiredAt != nil {
+			http.Error(rw, fmt.Sprintf("Request %d: that hood has been retired", i+1), http.StatusBadRequest)
+			return
+		}
+		book := &data.Booking{UserName: userName, HoodNumber: req.HoodNumber, BookingDate: req.BookingDate, EndDate: req.EndDate}
+		if err := data.CheckBookingRules(book, cfg.BookingRulesFor(req.HoodNumber), window.ClosesAt, loc); err != nil {
+			http.Error(rw, fmt.Sprintf("Request %d: %s", i+1, err), http.StatusBadRequest)
+			return
+		}
+		// the user acknowledges the lone-worker protocol now, as nobody can do it for them once the booking is allocated
+		if cfg.LoneWorking.Enabled {
+			outOfHours, err := data.OutOfHours(req.BookingDate, req.EndDate, cfg.LoneWorking, loc)
+			if err != nil {
+				lt.l.Println(err)
+				http.Error(rw, "Error checking working hours", http.StatusInternalServerError)
+				return
+			}
+			if outOfHours && !req.LoneWorkerAck {
+				http.Error(rw, fmt.Sprintf("Request %d: this slot is outside working hours. Resend it with \"lone_worker_acknowledged\": true to confirm you will check in at /booking/{id}/checkin while you work", i+1), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	if err := data.ReplaceBookingRequests(windowID, userName, requests, db); err != nil {
+		lt.l.Println(err)
+		http.Error(rw, "Error storing lottery requests", http.StatusInternalServerError)
+		return
+	}
+	lt.l.Printf("Stored %d lottery requests for %s", len(requests), userName)
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"bookings.com/m/auth"
+	"bookings.com/m/data"
+	"bookings.com/m/database"
+	"bookings.com/m/notify"
+)
+
+// Maintenance struct is created to enable dependency injection of a logger and the email notifier.
+type Maintenance struct {
+	l *log.Logger
+	n *notify.Notifier
+}
+
+// maintenanceResult is returned when a maintenance window is scheduled.
+// Bumped lists the IDs of the bookings that were cancelled to make way for it, and Running those that had already started and were left to finish.
+type maintenanceResult struct {
+	Window  *data.MaintenanceWindow `json:"window"`
+	Bumped  []int                   `json:"bumped"`
+	Running []int                   `json:"running"`
+}
+
+// NewMaintenanceHandler takes a logger object and a notifier and returns a Maintenance object.
+// This function is used in the main() function to return the Maintenance handler that is required to pass to the created servemux.
+func NewMaintenanceHandler(l *log.Logger, n *notify.Notifier) *Maintenance {
+	return &Maintenance{l, n}
+}
+
+// ServeHTTP is called on a Maintenance object.
+// It takes an http ResponseWriter and Request as parameters.
+// GET /maintenance lists the maintenance windows that haven't finished, so any logged in user can see when a hood will be unavailable.
+// POST /maintenance schedules a window and DELETE /maintenance/{id} calls one off, and are restricted to lab managers and admins.
+func (m *Maintenance) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	// Initialise database connection
+	db, err := database.InitialiseConnection(m.l)
+	if err != nil {
+		m.l.Println("Database connection error", err)
+		return
+	}
+	defer db.Close()
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == "/maintenance" && r.Method == http.MethodGet:
+		if p := authorise(rw, r, db, auth.Authenticated); p == nil {
+			return
+		}
+		m.getWindows(rw, db)
+	case path == "/maintenance" && r.Method == http.MethodPost:
+		p := authorise(rw, r, db, auth.ManageMaintenance)
+		if p == nil {
+			return
+		}
+		m.addWindow(rw, r, p, db)
+	case r.Method == http.MethodDelete:
+		if p := authorise(rw, r, db, auth.ManageMaintenance); p == nil {
+			return
+		}
+		id, err := getIDFromURI(path)
+		if err != nil {
+			http.Error(rw, "Invalid URI", http.StatusBadRequest)
+			return
+		}
+		m.cancelWindow(rw, id, db)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// getWindows encodes every maintenance window that hasn't finished or been cancelled to the ResponseWriter.
+func (m *Maintenance) getWindows(rw http.ResponseWriter, db *sql.DB) {
+	m.l.Println("Handling GET request for maintenance windows")
+
+	windows, err := data.GetMaintenanceWindows(time.Now(), db)
+	if err != nil {
+		m.l.Println(err)
+		http.Error(rw, "Error retrieving maintenance windows", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := windows.ToJSON(rw); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+// addWindow schedules a maintenance window from the hood_number, starts_at, ends_at and optional reason in the request body.
+// The window is stored first, so no new bookings can be made in it, and then every booking of the hood that overlaps the window and hasn't started yet is cancelled and its user emailed.
+// Bookings that are already running are left to finish, and are listed in the response so the lab manager can speak to the user.
+// A hood.maintenance event is published once the bookings have been handled.
+func (m *Maintenance) addWindow(rw http.ResponseWriter, r *http.Request, p *auth.Principal, db *sql.DB) {
+	m.l.Println("Handling POST request for maintenance windows")
+
+	window := &data.MaintenanceWindow{}
+	if err := window.FromJSON(r.Body); err != nil {
+		http.Error(rw, "Unable to unmarshal JSON", http.StatusBadRequest)
+		return
+	}
+	if window.HoodNumber == 0 || window.StartsAt.IsZero() || window.EndsAt.IsZero() {
+		http.Error(rw, "Please ensure hood_number, starts_at and ends_at are entered", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	if !window.EndsAt.After(window.StartsAt) || !window.EndsAt.After(now) {
+		http.Error(rw, "ends_at must be after starts_at and in the future", http.StatusBadRequest)
+		return
+	}
+	if hood, err := data.GetHoodByNumber(window.HoodNumber, db); err != nil {
+		http.Error(rw, "That hood number does not exist", http.StatusBadRequest)
+		return
+	} else if hood.RetiredAt != nil {
+		http.Error(rw, "That hood has been retired", http.StatusBadRequest)
+		return
+	}
+	window.CreatedBy = p.Name
+
+	if err := data.AddMaintenanceWindow(window, db); err != nil {
+		m.l.Println(err)
+		http.Error(rw, "Error adding maintenance window", http.StatusInternalServerError)
+		return
+	}
+
+	result := maintenanceResult{Window: window, Bumped: []int{}, Running: []int{}}
+	bookings, err := data.GetHoodBookingsBetween(window.HoodNumber, window.StartsAt, window.EndsAt, db)
+	if err != nil {
+		m.l.Println(err)
+		http.Error(rw, "Maintenance window added, but the bookings it overlaps could not be found", http.StatusInternalServerError)
+		return
+	}
+	for _, booking := range bookings {
+		if !booking.BookingDate.After(now) {
+			result.Running = append(result.Running, booking.ID)
+			continue
+		}
+		if err := data.CancelBooking(booking.ID, db); err != nil {
+			m.l.Println("Error cancelling booking for maintenance", booking.ID, err)
+			continue
+		}
+		result.Bumped = append(result.Bumped, booking.ID)
+		m.n.NotifyBooking("booking.bumped", booking, db)
+		publishEvent(m.l, "booking.cancelled", booking, db)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusCreated)
+	json.NewEncoder(rw).Encode(result)
+	publishEvent(m.l, "hood.maintenance", window, db)
+}
+
+// cancelWindow calls off a maintenance window, so the hood can be booked again at that time.
+// Bookings that were cancelled when the window was scheduled are not restored.
+// A hood.maintenance event is published with cancelled_at set, so subscribers know the hood is available again.
+func (m *Maintenance) cancelWindow(rw http.ResponseWriter, id int, db *sql.DB) {
+	m.l.Println("Handling DELETE request for maintenance window", id)
+
+	err := data.CancelMaintenanceWindow(id, db)
+	if err == data.ErrMaintenanceNotFound {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		m.l.Println(err)
+		http.Error(rw, "Error cancelling maintenance window", http.StatusInternalServerError)
+		return
+	}
+
+	window, err := data.GetMaintenanceWindow(id, db)
+	if err != nil {
+		m.l.Println(err)
+		return
+	}
+	publishEvent(m.l, "hood.maintenance", window, db)
+}
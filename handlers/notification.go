@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+
+	"bookings.com/m/auth"
+	"bookings.com/m/data"
+	"bookings.com/m/database"
+)
+
+// Notifications struct is created to enable dependency injection of a logger.
+type Notifications struct {
+	l *log.Logger
+}
+
+// NewNotificationHandler takes a logger object and returns a Notifications object.
+// This function is used in the main() function to return the Notifications handler that is required to pass to the created servemux.
+func NewNotificationHandler(l *log.Logger) *Notifications {
+	return &Notifications{l}
+}
+
+// ServeHTTP is called on a Notifications object.
+// It takes an http ResponseWriter and Request as parameters.
+// GET requests return the events the logged in user has opted out of being emailed about, and PUT requests replace that list.
+func (n *Notifications) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	// Initialise database connection
+	db, err := database.InitialiseConnection(n.l)
+	if err != nil {
+		n.l.Println("Database connection error", err)
+		return
+	}
+	defer db.Close()
+
+	p := authorise(rw, r, db, auth.Authenticated)
+	if p == nil {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		n.getPreferences(rw, p.UserID, db)
+	case http.MethodPut:
+		n.updatePreferences(rw, r, p.UserID, db)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// getPreferences encodes the user's notification preferences to the ResponseWriter.
+func (n *Notifications) getPreferences(rw http.ResponseWriter, userID int, db *sql.DB) {
+	n.l.Println("Handling GET request for notification preferences")
+
+	prefs, err := data.GetNotificationPreferences(userID, db)
+	if err != nil {
+		n.l.Println(err)
+		http.Error(rw, "Error retrieving notification preferences", http.StatusInternalServerError)
+		return
+	}
+
+	if err := prefs.ToJSON(rw); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+// updatePreferences decodes the user's new list of opted out events from the request body, checks each event is valid, and stores the list.
+func (n *Notifications) updatePreferences(rw http.ResponseWriter, r *http.Request, userID int, db *sql.DB) {
+	n.l.Println("Handling PUT request for notification preferences")
+
+	prefs := &data.NotificationPreferences{}
+	if err := prefs.FromJSON(r.Body); err != nil {
+		http.Error(rw, "Unable to unmarshal JSON", http.StatusBadRequest)
+		return
+	}
+
+	for _, event := range prefs.OptedOut {
+		if !data.ValidNotificationEvent(event) {
+			http.Error(rw, "Unknown notification event: "+event, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := data.SetNotificationPreferences(userID, prefs, db); err != nil {
+		n.l.Println(err)
+		http.Error(rw, "Error updating notification preferences", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+
+	"bookings.com/m/config"
+	"bookings.com/m/data"
+	"bookings.com/m/database"
+	"bookings.com/m/session"
+	"bookings.com/m/sso"
+)
+
+// oidcCookieName is the cookie that carries the state and nonce of an OpenID Connect login between the redirect and the callback.
+const oidcCookieName = "oidc_login"
+
+// OIDCLogins struct is created to enable dependency injection of a logger and the OpenID Connect provider.
+type OIDCLogins struct {
+	l *log.Logger
+	o *sso.OIDC
+}
+
+// NewOIDCLoginHandler takes a logger object and an OpenID Connect provider and returns an OIDCLogins object.
+// The provider is nil when OpenID Connect logins are not enabled in the config file.
+// This function is used in the main() function to return the OIDCLogins handler that is required to pass to the created servemux.
+func NewOIDCLoginHandler(l *log.Logger, o *sso.OIDC) *OIDCLogins {
+	return &OIDCLogins{l, o}
+}
+
+// ServeHTTP is called on an OIDCLogins object.
+// It takes an http ResponseWriter and Request as parameters.
+// GET /login/oidc redirects the user to the provider to log in, and the provider sends them back to GET /login/oidc/callback, where the session is created.
+func (ol *OIDCLogins) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if ol.o == nil {
+		http.Error(rw, "OpenID Connect login is not enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/login/oidc":
+		ol.start(rw, r)
+	case "/login/oidc/callback":
+		ol.callback(rw, r)
+	default:
+		http.Error(rw, "Invalid URI", http.StatusNotFound)
+	}
+}
+
+// start is called on an OIDCLogins object and redirects the user to the provider's login page.
+// A random state and nonce are generated and kept in a short-lived cookie, so the callback can check that it belongs to this login.
+func (ol *OIDCLogins) start(rw http.ResponseWriter, r *http.Request) {
+	state, err := session.GenerateSecureToken(16)
+	if err != nil {
+		http.Error(rw, "Error starting login", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := session.GenerateSecureToken(16)
+	if err != nil {
+		http.Error(rw, "Error starting login", http.StatusInternalServerError)
+		return
+	}
+
+	target, err := ol.o.AuthCodeURL(r.Context(), state, nonce)
+	if err != nil {
+		ol.l.Println(err)
+		http.Error(rw, "Unable to reach the login provider", http.StatusBadGateway)
+		return
+	}
+
+	// the provider redirects back as a top-level navigation, so the cookie must be SameSite Lax rather than Strict
+	http.SetCookie(rw, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    state + "." + nonce,
+		Path:     "/login/oidc",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(rw, r, target, http.StatusFound)
+}
+
+// callback is called on an OIDCLogins object when the provider sends the user back with an authorisation code.
+// The state is checked against the cookie, the code is exchanged for the user's identity and the user is provisioned on their first login.
+// A session cookie is then stored, exactly as for a password login, and the attempt is recorded in the login audit log.
+func (ol *OIDCLogins) callback(rw http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(rw, "Login was cancelled or refused by the provider: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcCookieName)
+	if err != nil {
+		http.Error(rw, "Login has expired, please start again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(rw, &http.Cookie{Name: oidcCookieName, Path: "/login/oidc", MaxAge: -1})
+
+	state, nonce, ok := strings.Cut(cookie.Value, ".")
+	if !ok || subtle.ConstantTimeCompare([]byte(state), []byte(q.Get("state"))) != 1 || q.Get("code") == "" {
+		http.Error(rw, "Invalid login state, please start again", http.StatusBadRequest)
+		return
+	}
+
+	identity, err := ol.o.Exchange(r.Context(), q.Get("code"), nonce)
+	if err != nil {
+		ol.l.Println(err)
+		http.Error(rw, "Unable to log in with the login provider", http.StatusBadGateway)
+		return
+	}
+
+	// Initialise database connection
+	db, err := database.InitialiseConnection(ol.l)
+	if err != nil {
+		ol.l.Println("Database connection error", err)
+		return
+	}
+	defer db.Close()
+
+	attempt := &data.LoginAttempt{Username: identity.Name, Provider: ol.o.Name(), IPAddress: session.ClientIP(r), UserAgent: r.UserAgent()}
+	userID, err := data.ProvisionExternalUser(identity, db)
+	if err != nil {
+		ol.l.Println(err)
+		attempt.Outcome = data.LoginProvisionFail
+		if err := data.RecordLoginAttempt(attempt, db); err != nil {
+			ol.l.Println("Unable to record login attempt", err)
+		}
+		if err == data.ErrUsernameTaken {
+			http.Error(rw, "That username belongs to a local account, please ask an admin to resolve this", http.StatusConflict)
+			return
+		}
+		http.Error(rw, "Error logging in", http.StatusInternalServerError)
+		return
+	}
+	attempt.UserID = &userID
+
+	token, err := session.CreateSession(userID, r, "", db)
+	if err != nil {
+		ol.l.Println(err)
+		http.Error(rw, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	attempt.Outcome = data.LoginSucceeded
+	if err := data.RecordLoginAttempt(attempt, db); err != nil {
+		ol.l.Println("Unable to record login attempt", err)
+	}
+
+	session.StoreCookie(rw, token)
+	ol.l.Println("User successfully logged in with OpenID Connect, welcome", identity.Name)
+
+	// send the browser back to the site if we know where it is
+	if cfg, err := config.ReadConfigFile(config.FileName); err == nil && cfg.Server.PublicURL != "" {
+		http.Redirect(rw, r, cfg.Server.PublicURL, http.StatusFound)
+		return
+	}
+	rw.Write([]byte("Logged in as " + identity.Name + "\n"))
+}
@@ -0,0 +1,356 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"bookings.com/m/auth"
+	"bookings.com/m/config"
+	"bookings.com/m/data"
+	"bookings.com/m/database"
+	"bookings.com/m/notify"
+	"bookings.com/m/session"
+)
+
+// resetTokenValidFor is how long an emailed password reset link can be used for.
+const resetTokenValidFor = time.Hour
+
+// minPasswordLength is the shortest new password that is accepted when a password is changed or reset.
+const minPasswordLength = 8
+
+// limits on password reset requests, so the endpoint can't be used to flood a user's inbox or to probe many addresses.
+// Requests for an account over its limit get the usual response but no email, and requests from an address over its limit are refused.
+const (
+	maxResetsPerUser = 3
+	maxResetsPerIP   = 10
+	resetLimitWindow = time.Hour
+)
+
+// Passwords struct is created to enable dependency injection of a logger and the email notifier.
+type Passwords struct {
+	l *log.Logger
+	n *notify.Notifier
+}
+
+// passwordChangeRequest is the body of a PUT request to /password.
+// RevokeAPITokens also revokes every API token the user has, for when the password was changed because the account may have been compromised.
+type passwordChangeRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+	RevokeAPITokens bool   `json:"revoke_api_tokens"`
+}
+
+// resetRequest is the body of a POST request to /password/reset.
+type resetRequest struct {
+	Email string `json:"email"`
+}
+
+// resetConfirmRequest is the body of a POST request to /password/reset/confirm.
+type resetConfirmRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// NewPasswordHandler takes a logger object and a notifier and returns a Passwords object.
+// This function is used in the main() function to return the Passwords handler that is required to pass to the created servemux.
+func NewPasswordHandler(l *log.Logger, n *notify.Notifier) *Passwords {
+	return &Passwords{l, n}
+}
+
+// ServeHTTP is called on a Passwords struct.
+// It takes an http ResponseWriter and Request as parameters.
+// PUT /password changes the logged in user's password, POST /password/reset emails a reset link and POST /password/reset/confirm sets a new password using the emailed token.
+// GET /password/reset/confirm is the page the emailed link opens, with a form that sends the token and new password to POST /password/reset/confirm.
+func (pw *Passwords) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+
+	// Initialise database connection
+	db, err := database.InitialiseConnection(pw.l)
+	if err != nil {
+		pw.l.Println("Database connection error", err)
+		return
+	}
+	defer db.Close()
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+
+	if path == "/password" && r.Method == http.MethodPut {
+		p := authorise(rw, r, db, auth.Authenticated)
+		if p == nil {
+			return
+		}
+		pw.changePassword(rw, r, p, db)
+		return
+	}
+
+	if path == "/password/reset" && r.Method == http.MethodPost {
+		pw.requestReset(rw, r, db)
+		return
+	}
+
+	if path == "/password/reset/confirm" && r.Method == http.MethodGet {
+		pw.resetPage(rw, r)
+		return
+	}
+
+	if path == "/password/reset/confirm" && r.Method == http.MethodPost {
+		pw.confirmReset(rw, r, db)
+		return
+	}
+
+	if path == "/password" || path == "/password/reset" || path == "/password/reset/confirm" {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	http.Error(rw, "Invalid URI", http.StatusNotFound)
+}
+
+// changePassword can be called on a Passwords object and takes an http ResponseWriter and Request, the authenticated user and a sql DB connection as parameters.
+// The user's current password must be supplied and correct before the new password is stored.
+// Every other session the user has is revoked, so a stolen session can't outlive the password change, and the user's API tokens are revoked too if they ask.
+func (pw *Passwords) changePassword(rw http.ResponseWriter, r *http.Request, p *auth.Principal, db *sql.DB) {
+	pw.l.Println("Handling PUT request")
+
+	var req passwordChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusBadRequest)
+		return
+	}
+	if req.CurrentPassword == "" {
+		http.Error(rw, "Please enter your current password", http.StatusBadRequest)
+		return
+	}
+	if len(req.NewPassword) < minPasswordLength {
+		http.Error(rw, "New password is too short", http.StatusBadRequest)
+		return
+	}
+
+	// users who log in through the directory change their password there
+	provider, err := data.GetAuthProvider(p.UserID, db)
+	if err == nil && provider != data.LocalProvider {
+		http.Error(rw, "Your password is managed by your institute account", http.StatusBadRequest)
+		return
+	}
+
+	current, err := data.GetPasswordHash(p.UserID, db)
+	if err != nil {
+		pw.l.Println(err)
+		http.Error(rw, "Error changing password", http.StatusInternalServerError)
+		return
+	}
+	if err := comparePasswords(current, req.CurrentPassword); err != nil {
+		http.Error(rw, "Incorrect password", http.StatusUnauthorized)
+		return
+	}
+
+	if err := pw.setPassword(p.UserID, req.NewPassword, db); err != nil {
+		pw.l.Println(err)
+		http.Error(rw, "Error changing password", http.StatusInternalServerError)
+		return
+	}
+
+	if err := session.RevokeOtherSessions(p.UserID, p.Token, db); err != nil {
+		pw.l.Println(err)
+	}
+	if req.RevokeAPITokens {
+		if err := data.RevokeUserAPITokens(db, p.UserID); err != nil {
+			pw.l.Println(err)
+			http.Error(rw, "Password changed but failed to revoke API tokens", http.StatusInternalServerError)
+			return
+		}
+	}
+	pw.l.Println("Password changed for user", p.UserID)
+}
+
+// requestReset can be called on a Passwords object and takes an http ResponseWriter and Request and a sql DB connection as parameters.
+// If the email address belongs to a user, a single-use reset token is stored and a link containing it is emailed to them.
+// The same response is returned whether or not the email address is known, so the endpoint can't be used to find registered users.
+// Requests are limited per account and per IP address: an account over its limit gets no more emails until the window has passed, and an address over its limit gets 429.
+func (pw *Passwords) requestReset(rw http.ResponseWriter, r *http.Request, db *sql.DB) {
+	pw.l.Println("Handling POST request")
+
+	var req resetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		http.Error(rw, "Please enter your email address", http.StatusBadRequest)
+		return
+	}
+
+	ip := session.ClientIP(r)
+	since := time.Now().Add(-resetLimitWindow)
+	fromIP, err := data.CountResetRequestsFromIP(ip, since, db)
+	if err != nil {
+		pw.l.Println(err)
+		http.Error(rw, "Error requesting password reset", http.StatusInternalServerError)
+		return
+	}
+	if fromIP >= maxResetsPerIP {
+		pw.l.Println("Password reset rate limit reached for", ip)
+		rw.Header().Set("Retry-After", strconv.Itoa(int(resetLimitWindow.Seconds())))
+		http.Error(rw, "Too many password reset requests, please try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	user, err := data.GetLocalUserByEmail(req.Email, db)
+	if err != nil && err != data.ErrUserNotFound {
+		pw.l.Println(err)
+		http.Error(rw, "Error requesting password reset", http.StatusInternalServerError)
+		return
+	}
+
+	var userID *int
+	if user != nil {
+		userID = &user.ID
+	}
+	forUser := 0
+	if user != nil {
+		if forUser, err = data.CountResetRequestsForUser(user.ID, since, db); err != nil {
+			pw.l.Println(err)
+			http.Error(rw, "Error requesting password reset", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := data.RecordResetRequest(userID, ip, db); err != nil {
+		pw.l.Println(err)
+		http.Error(rw, "Error requesting password reset", http.StatusInternalServerError)
+		return
+	}
+
+	if user != nil && forUser >= maxResetsPerUser {
+		pw.l.Println("Password reset rate limit reached for user", user.ID)
+	} else if user != nil {
+		token, err := session.GenerateSecureToken(32)
+		if err == nil {
+			err = data.AddPasswordReset(user.ID, token, resetTokenValidFor, db)
+		}
+		if err != nil {
+			pw.l.Println(err)
+			http.Error(rw, "Error requesting password reset", http.StatusInternalServerError)
+			return
+		}
+		pw.n.NotifyPasswordReset(user, publicLink("/password/reset/confirm", token), resetTokenValidFor)
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+	rw.Write([]byte("If that email address is registered, a password reset link has been sent to it\n"))
+}
+
+// resetPage can be called on a Passwords object and takes an http ResponseWriter and Request as parameters.
+// It serves the page opened by the emailed link, with a form to choose a new password that sends the token from the link to POST /password/reset/confirm.
+// Opening the page doesn't use the token, so a mail scanner following the link can't spend it.
+func (pw *Passwords) resetPage(rw http.ResponseWriter, r *http.Request) {
+	pw.l.Println("Handling GET request")
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(rw, "The reset link is missing its token", http.StatusBadRequest)
+		return
+	}
+
+	// the token is in the URL, so it mustn't be cached or sent on to other sites
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Referrer-Policy", "no-referrer")
+	if err := resetPage.Execute(rw, struct {
+		Token     string
+		MinLength int
+	}{token, minPasswordLength}); err != nil {
+		pw.l.Println(err)
+	}
+}
+
+// confirmReset can be called on a Passwords object and takes an http ResponseWriter and Request and a sql DB connection as parameters.
+// The token and new password can be sent as JSON, or as a form from the page served by resetPage.
+// The reset token is used up, the new password stored and the user's API tokens revoked together, so the token is only spent if the password is changed. Every session the user has is then revoked so they must log in again.
+func (pw *Passwords) confirmReset(rw http.ResponseWriter, r *http.Request, db *sql.DB) {
+	pw.l.Println("Handling POST request")
+
+	var req resetConfirmRequest
+	form := strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded")
+	if form {
+		req.Token = r.PostFormValue("token")
+		req.NewPassword = r.PostFormValue("new_password")
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "Please ensure there is no missing data entered", http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" {
+		http.Error(rw, "Please ensure there is no missing data entered", http.StatusBadRequest)
+		return
+	}
+	if len(req.NewPassword) < minPasswordLength {
+		http.Error(rw, "New password is too short", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := hashPass(req.NewPassword)
+	if err != nil {
+		pw.l.Println(err)
+		http.Error(rw, "Error resetting password", http.StatusInternalServerError)
+		return
+	}
+	userID, err := data.ResetPassword(req.Token, hash, db)
+	if err == data.ErrInvalidResetToken {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		pw.l.Println(err)
+		http.Error(rw, "Error resetting password", http.StatusInternalServerError)
+		return
+	}
+
+	if err := session.RevokeAllSessions(userID, db); err != nil {
+		pw.l.Println(err)
+		http.Error(rw, "Password reset but failed to revoke existing sessions", http.StatusInternalServerError)
+		return
+	}
+	session.ClearCookie(rw)
+	pw.l.Println("Password reset for user", userID)
+	if form {
+		rw.Write([]byte("Your password has been reset, you can now log in with your new password\n"))
+	}
+}
+
+// setPassword takes a user ID, a plain text password and a sql DB connection, and stores the bcrypt hash of the password for the user.
+func (pw *Passwords) setPassword(userID int, password string, db *sql.DB) error {
+	hash, err := hashPass(password)
+	if err != nil {
+		return err
+	}
+	return data.SetPasswordHash(userID, hash, db)
+}
+
+// publicLink takes a path and a token and returns the link that is emailed to the user.
+// The link is built from the server's public_url in the config file, and falls back to the bare token if that isn't set.
+func publicLink(path, token string) string {
+	cfg, err := config.ReadConfigFile(config.FileName)
+	if err != nil || cfg.Server.PublicURL == "" {
+		return "Token: " + token
+	}
+	return strings.TrimSuffix(cfg.Server.PublicURL, "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+// resetPage is the page opened by the emailed password reset link.
+var resetPage = template.Must(template.New("reset").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Reset your password</title>
+</head>
+<body>
+<h1>Reset your password</h1>
+<form method="post" action="/password/reset/confirm">
+<input type="hidden" name="token" value="{{.Token}}">
+<p><label>New password <input type="password" name="new_password" minlength="{{.MinLength}}" autocomplete="new-password" required></label></p>
+<p><button type="submit">Reset password</button></p>
+</form>
+</body>
+</html>
+`))
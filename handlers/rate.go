@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+
+	"bookings.com/m/auth"
+	"bookings.com/m/data"
+	"bookings.com/m/database"
+)
+
+// Rates struct is created to enable dependency injection of a logger.
+type Rates struct {
+	l *log.Logger
+}
+
+// NewRateHandler takes a logger object and returns a Rates object.
+// This function is used in the main() function to return the Rates handler that is required to pass to the created servemux.
+func NewRateHandler(l *log.Logger) *Rates {
+	return &Rates{l}
+}
+
+// ServeHTTP is called on a Rates object.
+// It takes an http ResponseWriter and Request as parameters.
+// GET requests list every hourly hood rate, and POST requests add a new rate for a hood from its effective date.
+func (rt *Rates) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	// Initialise database connection
+	db, err := database.InitialiseConnection(rt.l)
+	if err != nil {
+		rt.l.Println("Database connection error", err)
+		return
+	}
+	defer db.Close()
+
+	p := authorise(rw, r, db, auth.Authenticated)
+	if p == nil {
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && p.Can(auth.ViewReports):
+		rt.getRates(rw, db)
+	case r.Method == http.MethodPost && p.Can(auth.ManageRecharge):
+		rt.addRate(rw, r, db)
+	case r.Method == http.MethodGet || r.Method == http.MethodPost:
+		http.Error(rw, "Permission Denied", http.StatusForbidden)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// getRates encodes every stored hood rate to the ResponseWriter.
+func (rt *Rates) getRates(rw http.ResponseWriter, db *sql.DB) {
+	rt.l.Println("Handling GET request for hood rates")
+
+	rates, err := data.GetHoodRates(db)
+	if err != nil {
+		rt.l.Println(err)
+		http.Error(rw, "Error retrieving hood rates", http.StatusInternalServerError)
+		return
+	}
+
+	if err := rates.ToJSON(rw); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+// addRate decodes a hood rate from the request body, checks the hood exists and that the rate is valid, and stores it.
+func (rt *Rates) addRate(rw http.ResponseWriter, r *http.Request, db *sql.DB) {
+	rt.l.Println("Handling POST request for hood rates")
+
+	rate := &data.HoodRate{}
+	if err := rate.FromJSON(r.Body); err != nil {
+		http.Error(rw, "Unable to unmarshal JSON", http.StatusBadRequest)
+		return
+	}
+
+	if rate.HoodNumber == 0 || rate.EffectiveFrom.IsZero() {
+		http.Error(rw, "Please ensure there is no missing data entered", http.StatusBadRequest)
+		return
+	}
+	if rate.HourlyRate < 0 {
+		http.Error(rw, "Hourly rate cannot be negative", http.StatusBadRequest)
+		return
+	}
+	if _, err := data.GetHoodByNumber(rate.HoodNumber, db); err != nil {
+		http.Error(rw, "That hood number does not exist", http.StatusBadRequest)
+		return
+	}
+
+	if err := data.AddHoodRate(rate, db); err != nil {
+		rt.l.Println(err)
+		http.Error(rw, "Error adding hood rate to database", http.StatusInternalServerError)
+		return
+	}
+	rt.l.Printf("Hood rate: %#v", rate)
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"bookings.com/m/auth"
+	"bookings.com/m/config"
+	"bookings.com/m/data"
+	"bookings.com/m/database"
+)
+
+// Recharges struct is created to enable dependency injection of a logger.
+type Recharges struct {
+	l *log.Logger
+}
+
+// NewRechargeHandler takes a logger object and returns a Recharges object.
+// This function is used in the main() function to return the Recharges handler that is required to pass to the created servemux.
+func NewRechargeHandler(l *log.Logger) *Recharges {
+	return &Recharges{l}
+}
+
+// ServeHTTP is called on a Recharges object.
+// It takes an http ResponseWriter and Request as parameters.
+// GET /recharge?month=YYYY-MM returns the monthly recharge report per research group, as JSON or, with format=csv, as CSV for finance.
+// POST /recharge/lock?month=YYYY-MM locks an invoiced month so later edits to bookings can't change its numbers.
+func (rc *Recharges) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	// Initialise database connection
+	db, err := database.InitialiseConnection(rc.l)
+	if err != nil {
+		rc.l.Println("Database connection error", err)
+		return
+	}
+	defer db.Close()
+
+	p := authorise(rw, r, db, auth.ViewReports)
+	if p == nil {
+		return
+	}
+
+	// months are on the lab's clock
+	cfg, err := config.ReadConfigFile(config.FileName)
+	if err != nil {
+		rc.l.Println(err)
+		http.Error(rw, "Error reading config file", http.StatusInternalServerError)
+		return
+	}
+	loc, err := cfg.Location()
+	if err != nil {
+		rc.l.Println(err)
+		http.Error(rw, "Error reading lab timezone", http.StatusInternalServerError)
+		return
+	}
+
+	month := r.URL.Query().Get("month")
+	if _, _, err := data.MonthBounds(month, loc); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var report *data.RechargeReport
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/recharge":
+		rc.l.Println("Handling GET request for recharge report", month)
+		report, err = data.GetRechargeReport(month, loc, db)
+	case r.Method == http.MethodPost && r.URL.Path == "/recharge/lock":
+		if !p.Can(auth.ManageRecharge) {
+			http.Error(rw, "Permission Denied", http.StatusForbidden)
+			return
+		}
+		rc.l.Println("Locking recharge period", month)
+		report, err = data.LockRechargePeriod(month, loc, db)
+		if err == data.ErrPeriodLocked {
+			http.Error(rw, err.Error(), http.StatusConflict)
+			return
+		}
+		if err == data.ErrPeriodNotEnded {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		rc.l.Println(err)
+		http.Error(rw, "Error building recharge report", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		rw.Header().Set("Content-Type", "text/csv")
+		rw.Header().Set("Content-Disposition", "attachment; filename=\"recharge-"+month+".csv\"")
+		err = report.ToCSV(rw)
+	} else {
+		rw.Header().Set("Content-Type", "application/json")
+		err = report.ToJSON(rw)
+	}
+	if err != nil {
+		http.Error(rw, "Unable to encode recharge report", http.StatusInternalServerError)
+	}
+}
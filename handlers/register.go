@@ -3,29 +3,56 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/mail"
 	"reflect"
+	"strings"
+	"time"
 
+	"bookings.com/m/config"
 	"bookings.com/m/data"
 	"bookings.com/m/database"
+	"bookings.com/m/notify"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// Registers is a instantiated as a struct to allow dependency injection of a logger.
+// Registers is a instantiated as a struct to allow dependency injection of a logger and the email notifier used to send verification links.
 type Registers struct {
 	l *log.Logger
+	n *notify.Notifier
 }
 
-// NewRegisterHandler takes a logger as a parameter and returns a Registers struct that is assigned that logger.
+// defaultVerificationValidFor is how long an email verification link lasts when the config file doesn't say.
+const defaultVerificationValidFor = 48 * time.Hour
+
+// optionalFields are the fields of a registration request that may be left empty.
+// The research group is optional so a fresh install can be set up: the first admin registers before there are any groups to join.
+var optionalFields = map[string]bool{"Research_Group": true}
+
+// registrationRequest is the body of a POST request to /register: the new user's details, and an optional invitation code.
+type registrationRequest struct {
+	userRequest
+	InvitationCode string `json:"invitation_code"`
+}
+
+// resendRequest is the body of a POST request to /register/verify/resend.
+type resendRequest struct {
+	Email string `json:"email"`
+}
+
+// NewRegisterHandler takes a logger and a notifier as parameters and returns a Registers struct that is assigned them.
 // This function is used to generate the registration handler used in our main function to handle any requests on the registration url path specified in the mux.Handle function.
 // This function is used in the main() function to allow user registration.
-func NewRegisterHandler(l *log.Logger) *Registers {
-	return &Registers{l}
+func NewRegisterHandler(l *log.Logger, n *notify.Notifier) *Registers {
+	return &Registers{l, n}
 }
 
 // ServeHTTP is called on Registers objects and takes an http ResponseWriter and Request as parameters.
-// For registration, only POST http requests are handled. An http.StatusMethodNotAllowed is passed to the ResponseWriter if any other request types are performed.
+// POST /register registers a new user, GET /register/verify verifies their email address with the emailed link and POST /register/verify/resend sends the link again.
+// An http.StatusMethodNotAllowed is passed to the ResponseWriter if any other request types are performed.
 // A database connection is initialised and the closure of the connection deferred until the function is returned (a request has been made).
 func (reg *Registers) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
@@ -37,50 +64,124 @@ func (reg *Registers) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
-	if r.Method == http.MethodPost {
+	switch path := strings.TrimSuffix(r.URL.Path, "/"); {
+	case path == "/register" && r.Method == http.MethodPost:
+		// when local passwords are kept for break-glass admins, users log in with their institute account instead
+		if localLoginAdminsOnly() {
+			http.Error(rw, "Registration is disabled, please log in with your institute account", http.StatusForbidden)
+			return
+		}
 		reg.register(rw, r, db)
-		return
+	case path == "/register/verify" && r.Method == http.MethodGet:
+		reg.verify(rw, r, db)
+	case path == "/register/verify/resend" && r.Method == http.MethodPost:
+		reg.resend(rw, r, db)
+	case path == "/register" || path == "/register/verify" || path == "/register/verify/resend":
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	default:
+		http.Error(rw, "Invalid URI", http.StatusNotFound)
 	}
-
-	rw.WriteHeader(http.StatusMethodNotAllowed)
 }
 
 // register is called on Registers handler struct objects and takes an http ResponseWriter, http Request and the sql database connection as parameters.
 // This function is used to authenticate the data that is provided by the user during registration and then add the user to the userList to enable login.
 // In order, the data provided in the request body is decoded into a newly instantiated User object.
+// checkSignupAllowed applies the allowed email domains and invitation codes from the config file. An invitation places the user in its research group.
 // checkMissingValues ensure the user has no left any required field empty.
 // checkExistingUser ensures that a user with the same name doesn't already exist (due to the small number of people who will be using the API, using the name as an identifier is permissible).
 // hashPass hashes the users provided password using the bcrypt package.
 // The user is then added to the users table of the database using the data.AddUser function.
+// The account stays inactive until the user follows the verification link that is emailed to them.
 func (reg *Registers) register(rw http.ResponseWriter, r *http.Request, db *sql.DB) {
 	reg.l.Println("Registering new user...")
 
-	// attempt to decode request body into new user struct
-	usr := &data.User{}
-	if err := json.NewDecoder(r.Body).Decode(usr); err != nil {
+	// attempt to decode request body into a registration request
+	req := &registrationRequest{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(req); err != nil {
 		http.Error(rw, "Unable to unmarshal JSON", http.StatusBadRequest)
 		return
 	}
+	usr := req.toUser()
+
+	if addr, err := mail.ParseAddress(usr.Email); err != nil || addr.Address != usr.Email {
+		http.Error(rw, "Please enter a valid email address", http.StatusBadRequest)
+		return
+	}
+
+	// the new account can't be activated without a verification link, so refuse to register if links can't be signed
+	settings, err := registrationSettings()
+	if err != nil {
+		reg.l.Println(err)
+		http.Error(rw, "Error reading registration settings", http.StatusInternalServerError)
+		return
+	}
+
+	// check the email domain or invitation code is allowed to sign up
+	invitation, err := checkSignupAllowed(settings, usr.Email, req.InvitationCode, db)
+	if err != nil {
+		if err == data.ErrInvitationNotFound || err == ErrSignupNotAllowed {
+			http.Error(rw, err.Error(), http.StatusForbidden)
+			return
+		}
+		reg.l.Println(err)
+		http.Error(rw, "Error checking invitation", http.StatusInternalServerError)
+		return
+	}
+	registered := false
+	if invitation != nil {
+		usr.Research_Group = invitation.ResearchGroup
+		req.Research_Group = invitation.ResearchGroup
+
+		// give the invitation back if the registration doesn't complete
+		defer func() {
+			if !registered {
+				if err := data.ReleaseInvitation(invitation.ID, db); err != nil {
+					reg.l.Println(err)
+				}
+			}
+		}()
+	}
 
 	// check for missing data in registration request
-	if result := checkMissingValues(usr); !result {
+	if result := checkMissingValues(&req.userRequest); !result {
 		http.Error(rw, "Please ensure there is no missing data entered", http.StatusBadRequest)
 		return
 	}
 
-	// need to check user of same name doesn't exist
-	nameCheck, err := checkExistingUser(usr, db)
-	if nameCheck {
-		http.Error(rw, "A user with that name already exists, ensure you don't already have an account", http.StatusBadRequest)
+	// the research group is optional, so the first users can register before any groups exist
+	// if one is given it must be one of the existing groups, in its own spelling
+	if usr.Research_Group != "" {
+		if usr.Research_Group, err = resolveResearchGroup(usr.Research_Group, db); err != nil {
+			if err == data.ErrGroupNotFound {
+				http.Error(rw, unknownGroupMessage, http.StatusBadRequest)
+				return
+			}
+			reg.l.Println(err)
+			http.Error(rw, "Error checking research group", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// names like those given to erased accounts are kept for them
+	if data.IsReservedUsername(usr.Name) {
+		http.Error(rw, "Usernames starting with erased-user- are reserved, please choose another", http.StatusBadRequest)
 		return
 	}
+
+	// need to check user of same name doesn't exist
+	nameCheck, err := checkExistingUser(usr, db)
 	if err != nil {
 		reg.l.Println(err)
+		http.Error(rw, "Error checking username", http.StatusInternalServerError)
+		return
+	}
+	if nameCheck {
+		http.Error(rw, "A user with that name already exists, ensure you don't already have an account", http.StatusBadRequest)
 		return
 	}
 
 	// hash password
-	if hash, err := hashPass(usr.Hash); err != nil {
+	if hash, err := hashPass(req.Password); err != nil {
 		http.Error(rw, "Hashing of password failed", http.StatusBadRequest)
 		return
 	} else {
@@ -89,57 +190,176 @@ func (reg *Registers) register(rw http.ResponseWriter, r *http.Request, db *sql.
 
 	// add new user to the UserList
 	if err := data.AddUser(usr, db); err != nil {
+		if err == data.ErrUsernameTaken {
+			http.Error(rw, "A user with that name already exists, ensure you don't already have an account", http.StatusBadRequest)
+			return
+		}
 		reg.l.Println(err)
 		http.Error(rw, "Error adding user to database", http.StatusInternalServerError)
 		return
 	}
+	registered = true
+	if invitation != nil {
+		if err := data.SetInvitationUser(invitation.ID, usr.ID, db); err != nil {
+			reg.l.Println(err)
+		}
+	}
+
+	publishEvent(reg.l, "user.created", struct {
+		ID             int    `json:"id"`
+		Name           string `json:"name"`
+		Research_Group string `json:"research_group"`
+	}{usr.ID, usr.Name, usr.Research_Group}, db)
+
+	sendVerification(reg.n, usr, settings)
 
+	rw.WriteHeader(http.StatusCreated)
+	rw.Write([]byte("Registration complete, please follow the link emailed to you to activate your account\n"))
 	reg.l.Println("Registration complete!")
 }
 
+// verify is called on Registers handler struct objects, and activates the account named in a signed verification link.
+func (reg *Registers) verify(rw http.ResponseWriter, r *http.Request, db *sql.DB) {
+	settings, err := registrationSettings()
+	if err != nil {
+		reg.l.Println(err)
+		http.Error(rw, "Error reading registration settings", http.StatusInternalServerError)
+		return
+	}
+
+	userID, email, err := data.ParseEmailVerification(r.URL.Query().Get("token"), []byte(settings.VerificationSecret))
+	if err == nil {
+		err = data.MarkEmailVerified(userID, email, db)
+	}
+	if err == data.ErrInvalidVerification {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		reg.l.Println(err)
+		http.Error(rw, "Error verifying email address", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Write([]byte("Email address verified, you can now log in\n"))
+	reg.l.Println("Email address verified for user", userID)
+}
+
+// resend is called on Registers handler struct objects, and emails a new verification link to an unverified local account.
+// The same response is returned whatever the address, so the endpoint can't be used to find registered users.
+func (reg *Registers) resend(rw http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req resendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+		http.Error(rw, "Please enter your email address", http.StatusBadRequest)
+		return
+	}
+
+	// the settings are read before the address is looked up, so a failure doesn't depend on whether it is registered
+	settings, err := registrationSettings()
+	if err != nil {
+		reg.l.Println(err)
+		http.Error(rw, "Error reading registration settings", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := data.GetLocalUserByEmail(req.Email, db)
+	if err == nil {
+		verified, err := data.IsEmailVerified(user.ID, db)
+		if err != nil {
+			reg.l.Println(err)
+		} else if !verified {
+			sendVerification(reg.n, user, settings)
+		}
+	} else if err != data.ErrUserNotFound {
+		reg.l.Println(err)
+	}
+
+	rw.WriteHeader(http.StatusAccepted)
+	rw.Write([]byte("If that email address belongs to an account waiting for verification, a new link has been sent to it\n"))
+}
+
+// sendVerification takes a notifier, a user and the registration settings, and emails the user a signed link that verifies their current email address.
+// It is used at registration, when a new link is requested, and when a user changes their email address.
+func sendVerification(n *notify.Notifier, u *data.User, cfg config.Registration) {
+	validFor := defaultVerificationValidFor
+	if cfg.VerificationHours > 0 {
+		validFor = time.Duration(cfg.VerificationHours) * time.Hour
+	}
+
+	token := data.SignEmailVerification(u.ID, u.Email, time.Now().Add(validFor), []byte(cfg.VerificationSecret))
+	n.NotifyEmailVerification(u, publicLink("/register/verify", token), validFor)
+}
+
+// registrationSettings reads the registration settings from the config file.
+// Verification links are signed with verification_secret, so the structured ErrNoVerificationSecret is returned if it isn't set.
+func registrationSettings() (config.Registration, error) {
+	cfg, err := config.ReadConfigFile(config.FileName)
+	if err != nil {
+		return config.Registration{}, err
+	}
+	if cfg.Registration.VerificationSecret == "" {
+		return config.Registration{}, ErrNoVerificationSecret
+	}
+	return cfg.Registration, nil
+}
+
+// checkSignupAllowed takes the registration settings, the email address registering, the invitation code (which may be empty) and a sql DB connection.
+// If an invitation code is given it is claimed and returned, and it allows the registration whatever the email domain.
+// Otherwise the registration must not require an invitation, and the email address must be at one of the allowed domains if any are set.
+// ErrSignupNotAllowed is returned if the registration isn't allowed, and data.ErrInvitationNotFound if the code can't be used.
+func checkSignupAllowed(cfg config.Registration, email, code string, db *sql.DB) (*data.Invitation, error) {
+	if code != "" {
+		return data.ClaimInvitation(code, email, db)
+	}
+	if cfg.RequireInvitation {
+		return nil, ErrSignupNotAllowed
+	}
+	if len(cfg.AllowedDomains) == 0 {
+		return nil, nil
+	}
+
+	domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+	for _, allowed := range cfg.AllowedDomains {
+		if domain == strings.ToLower(strings.TrimPrefix(allowed, "@")) {
+			return nil, nil
+		}
+	}
+	return nil, ErrSignupNotAllowed
+}
+
 // checkMissingValues ensures that the user has entered all required data for registration.
-// The function takes the previously created User struct as a pointer.
-// The user struct is then dereferenced to allow the use of reflect.NumField() to calculate the number of fields within the struct.
-// The user should have supplied 5/6 fields, with the hash being blank as this will be generated later in the registration request.
-// If the count of missing values is 1, then no data is missing and the function returns true to enable continuation of the request.
-func checkMissingValues(u *data.User) bool {
+// The function takes the decoded registration request as a pointer.
+// The request is then dereferenced to allow the use of reflect.NumField() to calculate the number of fields within the struct.
+// Fields listed in optionalFields may be left empty.
+// If none of the fields are missing, the function returns true to enable continuation of the request.
+func checkMissingValues(u *userRequest) bool {
 	var count int
 
 	vals := reflect.ValueOf(u).Elem()
 
 	for i := 0; i < vals.NumField(); i++ {
+		if optionalFields[vals.Type().Field(i).Name] {
+			continue
+		}
 		if fieldValue := vals.Field(i); fieldValue.IsZero() {
 			count++
 		}
 	}
-	return count == 1
+	return count == 0
 }
 
 // checkExistingUser takes a User struct object and a sql DB connection as parameters, and returns a bool and an error.
 // queries the users table of the database to make sure that a use wth the same name provided at registration doesn't exist.
 // As there are a small and limited number of employees who would use this microservice, using name as an identifier of duplicate registrations is fair.
-// The function gathers all usernames from the users table of the database.
-// Iterating over the rows returned by the query, the username of each row is compared to the name of the user passed as a parameter.
+// Names are compared ignoring case and surrounding spaces, as logins and lockouts are, so "Alice" can't register alongside "alice".
 // If the passed name matches any user, then true is returned which will halt the registration.
 func checkExistingUser(u *data.User, db *sql.DB) (bool, error) {
-
-	// query db for all usernames
-	userRows, err := db.Query("SELECT username FROM users;")
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE LOWER(username) = LOWER(TRIM($1)));", u.Name).Scan(&exists)
 	if err != nil {
 		return false, err
 	}
-
-	for userRows.Next() {
-		var user data.User
-		err := userRows.Scan(&user.Name)
-		if err != nil {
-			return false, err
-		}
-		if u.Name == user.Name {
-			return true, nil
-		}
-	}
-	return false, nil
+	return exists, nil
 }
 
 // hashPass takes in the user's inputted password, and returns a hashed version of the password and an error.
@@ -151,3 +371,7 @@ func hashPass(password string) (string, error) {
 	}
 	return string(hashedPassword), nil
 }
+
+// create structured error
+var ErrNoVerificationSecret = fmt.Errorf("verification_secret must be set in the registration section of the config file")
+var ErrSignupNotAllowed = fmt.Errorf("registration needs an invitation code or an email address at an allowed domain")
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bookings.com/m/auth"
+	"bookings.com/m/config"
+	"bookings.com/m/data"
+	"bookings.com/m/database"
+)
+
+// maxRecentMinutes is the furthest back the roll-call can include bookings that have ended.
+const maxRecentMinutes = 24 * 60
+
+// RollCalls struct is created to enable dependency injection of a logger.
+type RollCalls struct {
+	l *log.Logger
+}
+
+// NewRollCallHandler takes a logger object and returns a RollCalls object.
+// This function is used in the main() function to return the RollCalls handler that is required to pass to the created servemux.
+func NewRollCallHandler(l *log.Logger) *RollCalls {
+	return &RollCalls{l}
+}
+
+// ServeHTTP is called on a RollCalls object.
+// It takes an http ResponseWriter and Request as parameters.
+// Only GET requests are handled, and they are restricted to fire wardens, lab managers and admins. The following query parameters are accepted:
+// room limits the roll-call to one room,
+// recent_minutes is how long ago a booking can have ended and still be included (defaulting to 60),
+// and format is json or html (defaulting to json, or html if the Accept header asks for text/html). The html version is laid out to be printed, with times in the lab's time zone.
+func (rc *RollCalls) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Initialise database connection
+	db, err := database.InitialiseConnection(rc.l)
+	if err != nil {
+		rc.l.Println("Database connection error", err)
+		return
+	}
+	defer db.Close()
+
+	if p := authorise(rw, r, db, auth.ViewRollCall); p == nil {
+		return
+	}
+
+	rc.l.Println("Handling GET request for roll-call")
+
+	query := r.URL.Query()
+	recent := 60
+	if v := query.Get("recent_minutes"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > maxRecentMinutes {
+			http.Error(rw, "recent_minutes must be a number from 0 to 1440", http.StatusBadRequest)
+			return
+		}
+		recent = n
+	}
+
+	format := query.Get("format")
+	if format == "" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		format = "html"
+	}
+	if format != "" && format != "json" && format != "html" {
+		http.Error(rw, "format must be json or html", http.StatusBadRequest)
+		return
+	}
+
+	// the printed roll-call shows times in the lab's time zone
+	loc := time.Local
+	if format == "html" {
+		cfg, err := config.ReadConfigFile(config.FileName)
+		if err == nil {
+			loc, err = cfg.Location()
+		}
+		if err != nil {
+			rc.l.Println(err)
+			http.Error(rw, "Error reading lab timezone", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	rollCall, err := data.GetRollCall(time.Now(), time.Duration(recent)*time.Minute, strings.TrimSpace(query.Get("room")), db)
+	if err != nil {
+		rc.l.Println(err)
+		http.Error(rw, "Error building roll-call", http.StatusInternalServerError)
+		return
+	}
+
+	// the roll-call changes from minute to minute, so it should never be served from a cache
+	rw.Header().Set("Cache-Control", "no-store")
+
+	if format == "html" {
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = rollCall.ToHTML(rw, loc)
+	} else {
+		rw.Header().Set("Content-Type", "application/json")
+		err = rollCall.ToJSON(rw)
+	}
+	if err != nil {
+		http.Error(rw, "Unable to encode roll-call", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+
+	"bookings.com/m/auth"
+	"bookings.com/m/database"
+	"bookings.com/m/session"
+)
+
+// Sessions struct is created to enable dependency injection of a logger.
+type Sessions struct {
+	l *log.Logger
+}
+
+// NewSessionHandler takes a logger object and returns a Sessions object.
+// This function is used in the main() function to return the Sessions handler that is required to pass to the created servemux.
+func NewSessionHandler(l *log.Logger) *Sessions {
+	return &Sessions{l}
+}
+
+// ServeHTTP is called on a Sessions object.
+// It takes an http ResponseWriter and Request as parameters.
+// GET /sessions lists the logged in user's active sessions, DELETE /sessions/{id} revokes one of them,
+// and DELETE /sessions revokes every session except the one making the request.
+func (s *Sessions) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	// Initialise database connection
+	db, err := database.InitialiseConnection(s.l)
+	if err != nil {
+		s.l.Println("Database connection error", err)
+		return
+	}
+	defer db.Close()
+
+	p := authorise(rw, r, db, auth.Authenticated)
+	if p == nil {
+		return
+	}
+
+	collection := r.URL.Path == "/sessions" || r.URL.Path == "/sessions/"
+
+	switch {
+	case collection && r.Method == http.MethodGet:
+		s.getSessions(rw, p.UserID, p.Token, db)
+	case collection && r.Method == http.MethodDelete:
+		s.revokeOtherSessions(rw, p.UserID, p.Token, db)
+	case !collection && r.Method == http.MethodDelete:
+		id, err := getIDFromURI(r.URL.Path)
+		if err != nil {
+			http.Error(rw, "Invalid URI", http.StatusBadRequest)
+			return
+		}
+		s.revokeSession(rw, p.UserID, id, db)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// getSessions encodes the user's active sessions to the ResponseWriter, with the current session marked.
+func (s *Sessions) getSessions(rw http.ResponseWriter, userID int, token string, db *sql.DB) {
+	s.l.Println("Handling GET request for sessions")
+
+	sessions, err := session.ListSessions(userID, token, db)
+	if err != nil {
+		s.l.Println(err)
+		http.Error(rw, "Error retrieving sessions", http.StatusInternalServerError)
+		return
+	}
+
+	if err := sessions.ToJSON(rw); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+// revokeSession revokes a single one of the user's sessions.
+func (s *Sessions) revokeSession(rw http.ResponseWriter, userID, id int, db *sql.DB) {
+	s.l.Println("Revoking session", id)
+
+	if err := session.RevokeSessionByID(userID, id, db); err == session.ErrSessionNotFound {
+		http.Error(rw, "Session not found", http.StatusNotFound)
+	} else if err != nil {
+		s.l.Println(err)
+		http.Error(rw, "Error revoking session", http.StatusInternalServerError)
+	}
+}
+
+// revokeOtherSessions revokes every one of the user's sessions except the current one.
+func (s *Sessions) revokeOtherSessions(rw http.ResponseWriter, userID int, token string, db *sql.DB) {
+	s.l.Println("Revoking all other sessions")
+
+	if err := session.RevokeOtherSessions(userID, token, db); err != nil {
+		s.l.Println(err)
+		http.Error(rw, "Error revoking sessions", http.StatusInternalServerError)
+	}
+}
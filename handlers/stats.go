@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"bookings.com/m/auth"
+	"bookings.com/m/config"
+	"bookings.com/m/data"
+	"bookings.com/m/database"
+)
+
+// Stats struct is created to enable dependency injection of a logger.
+type Stats struct {
+	l *log.Logger
+}
+
+// NewStatsHandler takes a logger object and returns a Stats object.
+// This function is used in the main() function to return the Stats handler that is required to pass to the created servemux.
+func NewStatsHandler(l *log.Logger) *Stats {
+	return &Stats{l}
+}
+
+// ServeHTTP is called on a Stats object.
+// It takes an http ResponseWriter and Request as parameters.
+// Only GET requests are handled, with the following query parameters:
+// from and to set the date range (YYYY-MM-DD in the lab's time zone or RFC 3339, defaulting to the last 30 days), and a plain to date includes the whole of that day,
+// group_by is one of hood, room, research_group, user, weekday or hour (defaulting to hood),
+// and format is json or csv (defaulting to json, or csv if the Accept header asks for text/csv).
+func (s *Stats) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Initialise database connection
+	db, err := database.InitialiseConnection(s.l)
+	if err != nil {
+		s.l.Println("Database connection error", err)
+		return
+	}
+	defer db.Close()
+
+	if p := authorise(rw, r, db, auth.ViewReports); p == nil {
+		return
+	}
+
+	s.l.Println("Handling GET request for usage statistics")
+
+	// plain dates, weekdays and hours are on the lab's clock
+	cfg, err := config.ReadConfigFile(config.FileName)
+	if err != nil {
+		s.l.Println(err)
+		http.Error(rw, "Error reading config file", http.StatusInternalServerError)
+		return
+	}
+	loc, err := cfg.Location()
+	if err != nil {
+		s.l.Println(err)
+		http.Error(rw, "Error reading lab timezone", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+
+	now := time.Now()
+	until := now
+	from := until.AddDate(0, 0, -30)
+	if v := query.Get("from"); v != "" {
+		if from, _, err = parseDate(v, loc); err != nil {
+			http.Error(rw, "Invalid from date, use YYYY-MM-DD or RFC 3339", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		var dateOnly bool
+		if until, dateOnly, err = parseDate(v, loc); err != nil {
+			http.Error(rw, "Invalid to date, use YYYY-MM-DD or RFC 3339", http.StatusBadRequest)
+			return
+		}
+		// a plain date includes bookings made at any time on that day
+		if dateOnly {
+			until = until.AddDate(0, 0, 1)
+		}
+	}
+	if !until.After(from) {
+		http.Error(rw, "The to date must be after the from date", http.StatusBadRequest)
+		return
+	}
+
+	groupBy := query.Get("group_by")
+	if groupBy == "" {
+		groupBy = "hood"
+	}
+	if !data.ValidStatGrouping(groupBy) {
+		http.Error(rw, "group_by must be one of hood, room, research_group, user, weekday or hour", http.StatusBadRequest)
+		return
+	}
+
+	stats, err := data.GetUsageStats(groupBy, from, until, now, loc, db)
+	if err != nil {
+		s.l.Println(err)
+		http.Error(rw, "Error calculating usage statistics", http.StatusInternalServerError)
+		return
+	}
+
+	format := query.Get("format")
+	if format == "" && strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		format = "csv"
+	}
+
+	if format == "csv" {
+		rw.Header().Set("Content-Type", "text/csv")
+		rw.Header().Set("Content-Disposition", "attachment; filename=\"usage-"+groupBy+".csv\"")
+		err = stats.ToCSV(rw)
+	} else {
+		rw.Header().Set("Content-Type", "application/json")
+		err = stats.ToJSON(rw)
+	}
+	if err != nil {
+		http.Error(rw, "Unable to encode statistics", http.StatusInternalServerError)
+	}
+}
+
+// parseDate takes a date from a query parameter as a string and the lab's time zone, and returns the time it represents, and whether it was a plain date.
+// Both plain dates (YYYY-MM-DD, taken as midnight in the lab's time zone) and full RFC 3339 timestamps are accepted.
+func parseDate(v string, loc *time.Location) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation("2006-01-02", v, loc); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	return t, false, err
+}
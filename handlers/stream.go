@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"bookings.com/m/auth"
+	"bookings.com/m/data"
+	"bookings.com/m/stream"
+)
+
+// keepAliveInterval is how often a comment is sent on an idle stream, so proxies and load balancers don't close the connection.
+const keepAliveInterval = 25 * time.Second
+
+// replayPageSize is how many missed events are read at a time when a client catches up after a reconnect.
+const replayPageSize = 1000
+
+// Streams struct is created to enable dependency injection of a logger and the stream broker.
+type Streams struct {
+	l *log.Logger
+	b *stream.Broker
+}
+
+// NewStreamHandler takes a logger object and a stream broker and returns a Streams object.
+// The broker may be nil if the database was unavailable at start up, in which case the stream responds with 503.
+// This function is used in the main() function to return the Streams handler that is required to pass to the created servemux.
+func NewStreamHandler(l *log.Logger, b *stream.Broker) *Streams {
+	return &Streams{l, b}
+}
+
+// ServeHTTP is called on a Streams object.
+// It takes an http ResponseWriter and Request as parameters.
+// GET /stream opens a Server-Sent Events stream of booking and hood changes, optionally filtered with the room and hood query parameters.
+// Each event's SSE id is its position in the stream, made from its transaction and event IDs. A client that reconnects with the Last-Event-ID header (or last_event_id query parameter) is first sent every event it missed.
+func (s *Streams) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if s.b == nil {
+		http.Error(rw, "Live updates are unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	db := s.b.DB()
+	if p := authorise(rw, r, db, auth.Authenticated); p == nil {
+		return
+	}
+
+	query := r.URL.Query()
+	room := query.Get("room")
+	hood := 0
+	if v := query.Get("hood"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(rw, "hood must be a hood number", http.StatusBadRequest)
+			return
+		}
+		hood = n
+	}
+
+	var last data.StreamCursor
+	resume := r.Header.Get("Last-Event-ID")
+	if resume == "" {
+		resume = query.Get("last_event_id")
+	}
+	if resume != "" {
+		c, err := data.ParseStreamCursor(resume, db)
+		if err == data.ErrInvalidStreamCursor {
+			http.Error(rw, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			s.l.Println(err)
+			http.Error(rw, "Error reading Last-Event-ID", http.StatusInternalServerError)
+			return
+		}
+		last = c
+	}
+
+	// the server's write timeout would otherwise close the stream, so it is lifted for this connection.
+	rc := http.NewResponseController(rw)
+	rc.SetWriteDeadline(time.Time{})
+
+	// subscribe before replaying, so no event can be missed between the two.
+	events, unsubscribe := s.b.Subscribe()
+	defer unsubscribe()
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Connection", "keep-alive")
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(http.StatusOK)
+
+	s.l.Println("Stream opened", r.RemoteAddr)
+	defer s.l.Println("Stream closed", r.RemoteAddr)
+
+	// every missed event is replayed, a page at a time, until a page comes back short
+	for resume != "" {
+		missed, err := data.GetStreamEventsAfter(last, replayPageSize, db)
+		if err != nil {
+			s.l.Println("Error replaying stream events", err)
+			return
+		}
+		for _, e := range missed {
+			if err := writeStreamEvent(rw, e, room, hood); err != nil {
+				return
+			}
+			last = e.Cursor()
+		}
+		if len(missed) < replayPageSize || r.Context().Err() != nil {
+			break
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			// skip anything already sent during the replay
+			if !last.Before(e.Cursor()) {
+				continue
+			}
+			last = e.Cursor()
+			if err := writeStreamEvent(rw, e, room, hood); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(rw, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// writeStreamEvent writes a single event in SSE format, unless it is filtered out by room or hood.
+func writeStreamEvent(rw http.ResponseWriter, e *data.StreamEvent, room string, hood int) error {
+	if room != "" && e.Room != room {
+		return nil
+	}
+	if hood != 0 && e.HoodNumber != hood {
+		return nil
+	}
+
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(rw, "id: %s\nevent: %s\ndata: %s\n\n", e.Cursor(), e.Event, payload)
+	return err
+}
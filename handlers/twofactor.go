@@ -0,0 +1,455 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"bookings.com/m/auth"
+	"bookings.com/m/data"
+	"bookings.com/m/database"
+	"bookings.com/m/qr"
+	"bookings.com/m/session"
+	"bookings.com/m/totp"
+)
+
+// totpIssuer is the name authenticator apps show next to the user's codes.
+const totpIssuer = "Hood Booking"
+
+// recoveryCodeCount is how many recovery codes a user is given each time they are generated.
+const recoveryCodeCount = 10
+
+// TwoFactors struct is created to enable dependency injection of a logger.
+type TwoFactors struct {
+	l *log.Logger
+}
+
+// twoFactorStatus is returned by GET /2fa.
+// Pending is true when enrolment has started but hasn't been confirmed with a code.
+type twoFactorStatus struct {
+	Enabled           bool `json:"enabled"`
+	Pending           bool `json:"pending"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left"`
+	RequiredForRole   bool `json:"required_for_role"`
+}
+
+// twoFactorEnrolment is returned by POST /2fa/enrol.
+// The secret can be typed into an authenticator app by hand, or the QR code at QRCode scanned instead.
+type twoFactorEnrolment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+	QRCode string `json:"qr_code"`
+}
+
+// twoFactorCodeRequest is the body of requests that need a code from the user's authenticator app or a recovery code.
+type twoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// twoFactorRoleRequest is the body of a PUT request to /2fa/roles.
+type twoFactorRoleRequest struct {
+	Role     string `json:"role"`
+	Required bool   `json:"required"`
+}
+
+// NewTwoFactorHandler takes a logger object and returns a TwoFactors object.
+// This function is used in the main() function to return the TwoFactors handler that is required to pass to the created servemux.
+func NewTwoFactorHandler(l *log.Logger) *TwoFactors {
+	return &TwoFactors{l}
+}
+
+// ServeHTTP is called on a TwoFactors object.
+// It takes an http ResponseWriter and Request as parameters.
+// GET /2fa shows whether two-factor is turned on, POST /2fa/enrol starts enrolment, GET /2fa/qr returns the enrolment QR code,
+// POST /2fa/confirm turns two-factor on, POST /2fa/recovery-codes replaces the recovery codes and DELETE /2fa turns it off.
+// Users who can manage users can also choose which roles require two-factor with GET and PUT /2fa/roles, and turn it off for a user who has lost their device with DELETE /2fa/users/{id}.
+// Two-factor settings can only be changed from a logged in session, not with an API token.
+func (tf *TwoFactors) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	// Initialise database connection
+	db, err := database.InitialiseConnection(tf.l)
+	if err != nil {
+		tf.l.Println("Database connection error", err)
+		return
+	}
+	defer db.Close()
+
+	p := authorise(rw, r, db, auth.Authenticated)
+	if p == nil {
+		return
+	}
+	if p.ViaAPIToken {
+		http.Error(rw, "Permission Denied, two-factor settings can only be changed from a logged in session", http.StatusForbidden)
+		return
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case path == auth.TwoFactorPath && r.Method == http.MethodGet:
+		tf.getStatus(rw, p, db)
+	case path == auth.TwoFactorPath && r.Method == http.MethodDelete:
+		tf.disable(rw, r, p, db)
+	case path == auth.TwoFactorPath+"/enrol" && r.Method == http.MethodPost:
+		tf.enrol(rw, p, db)
+	case path == auth.TwoFactorPath+"/qr" && r.Method == http.MethodGet:
+		tf.getQRCode(rw, p, db)
+	case path == auth.TwoFactorPath+"/confirm" && r.Method == http.MethodPost:
+		tf.confirm(rw, r, p, db)
+	case path == auth.TwoFactorPath+"/recovery-codes" && r.Method == http.MethodPost:
+		tf.regenerateRecoveryCodes(rw, r, p, db)
+	case path == auth.TwoFactorPath+"/roles" && (r.Method == http.MethodGet || r.Method == http.MethodPut):
+		if !p.Can(auth.ManageUsers) {
+			http.Error(rw, "Permission Denied", http.StatusForbidden)
+			return
+		}
+		if r.Method == http.MethodGet {
+			tf.getRoles(rw, db)
+			return
+		}
+		tf.setRole(rw, r, db)
+	case strings.HasPrefix(path, auth.TwoFactorPath+"/users/") && r.Method == http.MethodDelete:
+		if !p.Can(auth.ManageUsers) {
+			http.Error(rw, "Permission Denied", http.StatusForbidden)
+			return
+		}
+		id, err := getIDFromURI(path)
+		if err != nil {
+			http.Error(rw, "Invalid URI", http.StatusBadRequest)
+			return
+		}
+		tf.reset(rw, id, db)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// getStatus encodes the user's two-factor status to the ResponseWriter.
+func (tf *TwoFactors) getStatus(rw http.ResponseWriter, p *auth.Principal, db *sql.DB) {
+	tf.l.Println("Handling GET request for two-factor status")
+
+	var status twoFactorStatus
+	t, err := data.GetTOTP(p.UserID, db)
+	if err != nil && err != data.ErrTwoFactorNotEnrolled {
+		tf.l.Println(err)
+		http.Error(rw, "Error retrieving two-factor status", http.StatusInternalServerError)
+		return
+	}
+	if t != nil {
+		status.Enabled = t.Confirmed
+		status.Pending = !t.Confirmed
+	}
+	if status.RecoveryCodesLeft, err = data.CountRecoveryCodes(p.UserID, db); err != nil {
+		tf.l.Println(err)
+		http.Error(rw, "Error retrieving two-factor status", http.StatusInternalServerError)
+		return
+	}
+	if status.RequiredForRole, err = data.RoleRequiresTwoFactor(string(p.Role), db); err != nil {
+		tf.l.Println(err)
+		http.Error(rw, "Error retrieving two-factor status", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(status)
+}
+
+// enrol starts two-factor enrolment by generating a new secret for the user and returning it.
+// Two-factor isn't turned on until the user confirms a code from their authenticator app, and users who log in with OpenID Connect can't enrol, as their identity provider handles the second factor.
+func (tf *TwoFactors) enrol(rw http.ResponseWriter, p *auth.Principal, db *sql.DB) {
+	tf.l.Println("Handling POST request to enrol in two-factor")
+
+	provider, err := data.GetAuthProvider(p.UserID, db)
+	if err != nil {
+		tf.l.Println(err)
+		http.Error(rw, "Error starting two-factor enrolment", http.StatusInternalServerError)
+		return
+	}
+	if provider == "oidc" {
+		http.Error(rw, "Two-factor for your account is managed by your institute login", http.StatusForbidden)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		http.Error(rw, "Error starting two-factor enrolment", http.StatusInternalServerError)
+		return
+	}
+	err = data.SetPendingTOTP(p.UserID, secret, db)
+	if err == data.ErrTwoFactorEnabled {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		tf.l.Println(err)
+		http.Error(rw, "Error starting two-factor enrolment", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusCreated)
+	json.NewEncoder(rw).Encode(twoFactorEnrolment{
+		Secret: secret,
+		URI:    totp.URI(totpIssuer, p.Name, secret),
+		QRCode: auth.TwoFactorPath + "/qr",
+	})
+}
+
+// getQRCode writes the enrolment QR code as a PNG image, for the user to scan with their authenticator app.
+// The QR code is only available while enrolment is pending, so the secret can't be shown again once two-factor is turned on.
+func (tf *TwoFactors) getQRCode(rw http.ResponseWriter, p *auth.Principal, db *sql.DB) {
+	tf.l.Println("Handling GET request for two-factor QR code")
+
+	t, err := data.GetTOTP(p.UserID, db)
+	if err == data.ErrTwoFactorNotEnrolled {
+		http.Error(rw, "Please start enrolment with POST "+auth.TwoFactorPath+"/enrol first", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		tf.l.Println(err)
+		http.Error(rw, "Error creating QR code", http.StatusInternalServerError)
+		return
+	}
+	if t.Confirmed {
+		http.Error(rw, data.ErrTwoFactorEnabled.Error(), http.StatusConflict)
+		return
+	}
+
+	code, err := qr.Encode(totp.URI(totpIssuer, p.Name, t.Secret))
+	if err != nil {
+		tf.l.Println(err)
+		http.Error(rw, "Error creating QR code", http.StatusInternalServerError)
+		return
+	}
+	img, err := code.PNG(6)
+	if err != nil {
+		tf.l.Println(err)
+		http.Error(rw, "Error creating QR code", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "image/png")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Write(img)
+}
+
+// confirm turns two-factor on once the user sends a code from their authenticator app, which shows the app was set up correctly.
+// The user's recovery codes are returned, and this is the only time they are shown.
+func (tf *TwoFactors) confirm(rw http.ResponseWriter, r *http.Request, p *auth.Principal, db *sql.DB) {
+	tf.l.Println("Handling POST request to confirm two-factor")
+
+	var req twoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusBadRequest)
+		return
+	}
+
+	t, err := data.GetTOTP(p.UserID, db)
+	if err == data.ErrTwoFactorNotEnrolled {
+		http.Error(rw, "Please start enrolment with POST "+auth.TwoFactorPath+"/enrol first", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		tf.l.Println(err)
+		http.Error(rw, "Error confirming two-factor", http.StatusInternalServerError)
+		return
+	}
+	if t.Confirmed {
+		http.Error(rw, data.ErrTwoFactorEnabled.Error(), http.StatusConflict)
+		return
+	}
+
+	step, err := totp.Validate(t.Secret, req.Code, time.Now(), 0)
+	if err != nil {
+		tf.l.Println(err)
+		http.Error(rw, "Error confirming two-factor", http.StatusInternalServerError)
+		return
+	}
+	if step == 0 {
+		http.Error(rw, "Invalid two-factor code, please check the time on your device and try again", http.StatusBadRequest)
+		return
+	}
+	if err := data.ConfirmTOTP(p.UserID, step, db); err != nil {
+		tf.l.Println(err)
+		http.Error(rw, "Error confirming two-factor", http.StatusInternalServerError)
+		return
+	}
+
+	tf.writeRecoveryCodes(rw, p.UserID, db)
+	tf.l.Println("Two-factor turned on for", p.Name)
+}
+
+// regenerateRecoveryCodes replaces the user's recovery codes with new ones, for example once they have used most of them.
+// A current code or an unused recovery code is needed, so a stolen session can't be used to take them.
+func (tf *TwoFactors) regenerateRecoveryCodes(rw http.ResponseWriter, r *http.Request, p *auth.Principal, db *sql.DB) {
+	tf.l.Println("Handling POST request to regenerate recovery codes")
+
+	if !tf.checkCode(rw, r, p, db) {
+		return
+	}
+	tf.writeRecoveryCodes(rw, p.UserID, db)
+}
+
+// disable turns two-factor off for the user, after checking a current code or an unused recovery code.
+// Users whose role requires two-factor can't turn it off.
+func (tf *TwoFactors) disable(rw http.ResponseWriter, r *http.Request, p *auth.Principal, db *sql.DB) {
+	tf.l.Println("Handling DELETE request for two-factor")
+
+	required, err := data.RoleRequiresTwoFactor(string(p.Role), db)
+	if err != nil {
+		tf.l.Println(err)
+		http.Error(rw, "Error turning off two-factor", http.StatusInternalServerError)
+		return
+	}
+	if required {
+		http.Error(rw, "Two-factor is required for your role and can't be turned off", http.StatusForbidden)
+		return
+	}
+
+	if !tf.checkCode(rw, r, p, db) {
+		return
+	}
+	if err := data.DeleteTOTP(p.UserID, db); err != nil {
+		tf.l.Println(err)
+		http.Error(rw, "Error turning off two-factor", http.StatusInternalServerError)
+		return
+	}
+	tf.l.Println("Two-factor turned off for", p.Name)
+}
+
+// reset turns two-factor off for another user, who has lost both their device and their recovery codes.
+// They will need to enrol again if their role requires two-factor.
+func (tf *TwoFactors) reset(rw http.ResponseWriter, userID int, db *sql.DB) {
+	tf.l.Println("Handling DELETE request for two-factor of user", userID)
+
+	err := data.DeleteTOTP(userID, db)
+	if err == data.ErrTwoFactorNotEnrolled {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		tf.l.Println(err)
+		http.Error(rw, "Error turning off two-factor", http.StatusInternalServerError)
+	}
+}
+
+// getRoles encodes the roles that require two-factor to the ResponseWriter.
+func (tf *TwoFactors) getRoles(rw http.ResponseWriter, db *sql.DB) {
+	tf.l.Println("Handling GET request for two-factor roles")
+
+	roles, err := data.GetTwoFactorRoles(db)
+	if err != nil {
+		tf.l.Println(err)
+		http.Error(rw, "Error retrieving two-factor roles", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string][]string{"required_for": roles})
+}
+
+// setRole sets whether a role requires two-factor.
+// Users with the role who haven't turned two-factor on are then only able to use the /2fa endpoints until they do.
+func (tf *TwoFactors) setRole(rw http.ResponseWriter, r *http.Request, db *sql.DB) {
+	tf.l.Println("Handling PUT request for two-factor roles")
+
+	var req twoFactorRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusBadRequest)
+		return
+	}
+	if !auth.ValidRole(req.Role) {
+		http.Error(rw, "Unknown role, use user, fire_warden, lab_manager or admin", http.StatusBadRequest)
+		return
+	}
+	if err := data.SetRoleRequiresTwoFactor(req.Role, req.Required, db); err != nil {
+		tf.l.Println(err)
+		http.Error(rw, "Error updating two-factor roles", http.StatusInternalServerError)
+	}
+}
+
+// checkCode decodes a code from the request body and checks it against the user's authenticator app or recovery codes.
+// If the code is wrong, or two-factor isn't turned on, the error response is written and false is returned.
+// Wrong codes are recorded in the login audit log and count towards locking the username, as they do at login, so a stolen session can't be used to guess codes.
+// While the username or IP address is locked out, codes aren't checked at all and 429 is returned.
+func (tf *TwoFactors) checkCode(rw http.ResponseWriter, r *http.Request, p *auth.Principal, db *sql.DB) bool {
+	var req twoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusBadRequest)
+		return false
+	}
+
+	limits := loginLimits()
+	attempt := &data.LoginAttempt{Username: p.Name, UserID: &p.UserID, IPAddress: session.ClientIP(r), UserAgent: r.UserAgent()}
+	if provider, err := data.GetAuthProvider(p.UserID, db); err == nil {
+		attempt.Provider = provider
+	}
+	windowStart := time.Now().Add(-limits.window)
+	if refused(tf.l, rw, attempt, windowStart, limits, db) {
+		return false
+	}
+
+	ok, err := verifySecondFactor(p.UserID, req.Code, db)
+	if err == data.ErrTwoFactorNotEnrolled {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		tf.l.Println(err)
+		http.Error(rw, "Error checking two-factor code", http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		attempt.Outcome = data.LoginBadTwoFactor
+		recordAttempt(tf.l, attempt, db)
+		lockIfNeeded(tf.l, p.Name, windowStart, limits, db)
+		http.Error(rw, "Invalid two-factor code", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// writeRecoveryCodes generates a new set of recovery codes for the user, stores hashes of them and writes the codes to the ResponseWriter.
+func (tf *TwoFactors) writeRecoveryCodes(rw http.ResponseWriter, userID int, db *sql.DB) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := session.GenerateSecureToken(5)
+		if err != nil {
+			http.Error(rw, "Error creating recovery codes", http.StatusInternalServerError)
+			return
+		}
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	if err := data.ReplaceRecoveryCodes(userID, codes, db); err != nil {
+		tf.l.Println(err)
+		http.Error(rw, "Error creating recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// verifySecondFactor takes a user ID, a code and a sql DB connection, and reports whether the code is the user's current TOTP code or one of their unused recovery codes.
+// An accepted code is used up, so it can't be used again. ErrTwoFactorNotEnrolled is returned if the user hasn't turned two-factor on.
+func verifySecondFactor(userID int, code string, db *sql.DB) (bool, error) {
+	t, err := data.GetTOTP(userID, db)
+	if err != nil {
+		return false, err
+	}
+	if !t.Confirmed {
+		return false, data.ErrTwoFactorNotEnrolled
+	}
+
+	step, err := totp.Validate(t.Secret, code, time.Now(), t.LastStep)
+	if err != nil {
+		return false, err
+	}
+	if step != 0 {
+		return data.UseTOTPStep(userID, step, db)
+	}
+	if strings.TrimSpace(code) == "" {
+		return false, nil
+	}
+	return data.UseRecoveryCode(userID, code, db)
+}
@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// idPattern matches each numeric segment of a URI path, e.g. the 3 in /lottery/3.
+var idPattern = regexp.MustCompile(`/([0-9]+)`)
+
+// getIDFromURI takes a URI path and returns the single numeric ID it contains and an error.
+// An error is returned if the path does not contain exactly one ID.
+func getIDFromURI(path string) (int, error) {
+	g := idPattern.FindAllStringSubmatch(path, -1)
+
+	// ensure only one ID has been returned, with one capture group
+	if len(g) != 1 || len(g[0]) != 2 {
+		return 0, ErrInvalidURI
+	}
+	return strconv.Atoi(g[0][1])
+}
+
+// create structured error
+var ErrInvalidURI = fmt.Errorf("invalid URI")
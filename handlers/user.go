@@ -2,151 +2,507 @@ package handlers
 
 import (
 	"database/sql"
+	"encoding/json"
 	"log"
 	"net/http"
-	"regexp"
 	"strconv"
+	"strings"
 
+	"bookings.com/m/auth"
+	"bookings.com/m/config"
 	"bookings.com/m/data"
 	"bookings.com/m/database"
+	"bookings.com/m/notify"
 	"bookings.com/m/session"
 )
 
-// create a Users struct to enable addition of a logger and to be used as a handler (http.handler) struct.
+// create a Users struct to enable addition of a logger and the email notifier, and to be used as a handler (http.handler) struct.
 type Users struct {
 	l *log.Logger
+	n *notify.Notifier
 }
 
-// NewBookingHandler takes a logger object and returns a User object.
-// The logger passed will be assigned to the Users object logger field.
+// userRequest is the body of a registration or profile update request.
+// The password is sent in the "hash" field, matching the login request. It is only accepted at registration.
+type userRequest struct {
+	Name                string `json:"name"`
+	Password            string `json:"hash"`
+	Email               string `json:"email"`
+	Emergency_Telephone int    `json:"emergency_telephone"`
+	Research_Group      string `json:"research_group"`
+}
+
+// toUser returns the user described by the request, without the password, ready to store.
+func (ur *userRequest) toUser() *data.User {
+	return &data.User{Name: ur.Name, Email: ur.Email, Emergency_Telephone: ur.Emergency_Telephone, Research_Group: ur.Research_Group}
+}
+
+// publicUser is how a user is shown to other users: just who they are and which group they belong to.
+type publicUser struct {
+	ID             int    `json:"id"`
+	Name           string `json:"name"`
+	Research_Group string `json:"research_group"`
+}
+
+// privateUser is how a user is shown to themselves, and to roles that need to contact anyone in an emergency.
+type privateUser struct {
+	ID                  int    `json:"id"`
+	Name                string `json:"name"`
+	Email               string `json:"email"`
+	Emergency_Telephone int    `json:"emergency_telephone"`
+	Research_Group      string `json:"research_group"`
+}
+
+// userView takes a stored user and the principal asking for them, and returns the representation the principal is allowed to see.
+// Contact details are only included for the user themselves, or for principals who can view everyone's contact details.
+func userView(u *data.User, p *auth.Principal) interface{} {
+	if p.UserID == u.ID || p.Can(auth.ViewContactDetails) {
+		return &privateUser{u.ID, u.Name, u.Email, u.Emergency_Telephone, u.Research_Group}
+	}
+	return &publicUser{u.ID, u.Name, u.Research_Group}
+}
+
+// NewUserHandler takes a logger object and a notifier and returns a User object.
+// The logger and notifier passed will be assigned to the Users object fields, the notifier being used to send verification links when an email address is changed.
 // This function is used in the main() function to return the Users handler that is required to pass to the created servemux and handle relevant http requests on the passed url path.
-func NewUserHandler(l *log.Logger) *Users {
-	return &Users{l}
+func NewUserHandler(l *log.Logger, n *notify.Notifier) *Users {
+	return &Users{l, n}
 }
 
 // ServeHTTP is called on a Users object.
 // It takes an http ResponseWriter and Request as parameters.
 // This function deals with GET and PUT HTTP request methods that are queried, as POST methods are covered in the registration handler.
 // The session cookie that is generated and stored at login is retrieved here to authenticate the user before returning data client-side.
+// PUT /user/{id}/role changes a user's role, and PUT /user/{id}/verify activates an account without email verification. Both are restricted to admins.
+// GET /user/{id}/export returns all the personal data held about a user, and DELETE /user/{id} erases it. Users can do both for their own account, and admins for anyone's.
 func (u *Users) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
+	// Initialise database connection
+	db, err := database.InitialiseConnection(u.l)
+	if err != nil {
+		u.l.Println("Database connection error", err)
+		return
+	}
+	defer db.Close()
+
+	if r.Method == http.MethodGet && strings.HasSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/export") {
+		id, err := getIDFromURI(r.URL.Path)
+		if err != nil {
+			http.Error(rw, "Invalid URI", http.StatusBadRequest)
+			return
+		}
+		p := authorise(rw, r, db, auth.Authenticated)
+		if p == nil {
+			return
+		}
+		if p.UserID != id && !p.Can(auth.ManageUsers) {
+			http.Error(rw, "Permission Denied, User IDs do not match", http.StatusForbidden)
+			return
+		}
+
+		u.exportUser(id, p, rw, db)
+		return
+	}
+
 	if r.Method == http.MethodGet {
-		token := session.RetrieveCookie(r)
-		if token == "" {
-			http.Error(rw, "Unable to retrieve cookie", http.StatusBadRequest)
+		p := authorise(rw, r, db, auth.Authenticated)
+		if p == nil {
 			return
 		}
 
-		// Initialise database connection
-		db, err := database.InitialiseConnection(u.l)
+		// GET /user/{id} returns one user, and GET /user returns them all
+		if id, err := getIDFromURI(r.URL.Path); err == nil {
+			u.getUser(id, p, rw, db)
+			return
+		}
+		u.getUsers(p, rw, db)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		id, err := getIDFromURI(r.URL.Path)
 		if err != nil {
-			u.l.Println("Database connection error", err)
+			http.Error(rw, "Invalid URI", http.StatusBadRequest)
+			return
+		}
+		p := authorise(rw, r, db, auth.Authenticated)
+		if p == nil {
+			return
+		}
+		if p.UserID != id && !p.Can(auth.ManageUsers) {
+			http.Error(rw, "Permission Denied, User IDs do not match", http.StatusForbidden)
 			return
 		}
-		defer db.Close()
 
-		u.getUsers(rw, r, db)
+		u.eraseUser(id, p, rw, r, db)
 		return
 	}
 
 	if r.Method == http.MethodPut {
+		u.l.Println("Handling PUT Request for user")
 
-		// Initialise database connection
-		db, err := database.InitialiseConnection(u.l)
+		// expect the ID in the URI
+		id, err := getIDFromURI(r.URL.Path)
 		if err != nil {
-			u.l.Println("Database connection error", err)
+			u.l.Println("Invalid URI", r.URL.Path)
+			http.Error(rw, "Invalid URI", http.StatusBadRequest)
 			return
 		}
-		defer db.Close()
 
-		u.l.Println("Handling PUT Request for user")
+		if strings.HasSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/verify") {
+			if p := authorise(rw, r, db, auth.ManageUsers); p == nil {
+				return
+			}
 
-		// authenticate cookie
-		token := session.RetrieveCookie(r)
-		if token == "" {
-			http.Error(rw, "Unable to retrieve cookie", http.StatusBadRequest)
+			u.verifyUser(id, rw, db)
 			return
 		}
 
-		// expect the ID in the URI
-		reg := regexp.MustCompile(`/([0-9]+)`)
-		g := reg.FindAllStringSubmatch(r.URL.Path, -1)
-
-		u.l.Println(g)
+		if strings.HasSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/role") {
+			if p := authorise(rw, r, db, auth.ManageUsers); p == nil {
+				return
+			}
 
-		// ensure only one ID has been returned
-		if len(g) != 1 {
-			u.l.Println("Invalid URI more than one ID")
-			http.Error(rw, "Invalid URI", http.StatusBadRequest)
+			u.updateRole(id, rw, r, db)
 			return
 		}
-		// ensure only one capture group returned
-		if len(g[0]) != 2 {
-			u.l.Println("Invalid URI more than one capture group")
-			http.Error(rw, "Invalid URI", http.StatusBadRequest)
-			return
-		}
-		// collect the ID
-		idString := g[0][1]
-		// convert to int
-		id, err := strconv.Atoi(idString)
 
-		// ensure the user can only update their own User object.
-		idCheck := session.UserTokenAuthentication(token, db)
-		if idCheck == -1 {
-			http.Error(rw, "Error whilst trying to retrieve matching user ID using token", http.StatusBadRequest)
-			return
-		} else if idCheck != id {
-			http.Error(rw, "Permission Denied, User IDs do not match", http.StatusBadRequest)
+		p := authorise(rw, r, db, auth.Authenticated)
+		if p == nil {
 			return
 		}
 
-		if err != nil {
-			u.l.Println("Invalid URI unable to convert ID to integer")
-			http.Error(rw, "Invalid URI", http.StatusBadRequest)
+		// ensure the user can only update their own User object.
+		if p.UserID != id {
+			http.Error(rw, "Permission Denied, User IDs do not match", http.StatusForbidden)
 			return
 		}
 
-		u.updateUsers(id, rw, r, db)
-
+		u.updateUsers(id, p, rw, r, db)
+		return
 	}
 
 	rw.WriteHeader(http.StatusMethodNotAllowed)
 }
 
-// getUsers is called on a Users tye object and takes an HTTP ResponseWriter and Request as parameters.
+// getUsers is called on a Users tye object and takes the principal making the request, an HTTP ResponseWriter and a sql DB connection as parameters.
 // This function is involved in handling GET requests of all users.
 // Session cookies are authenticated before this function is executed in the ServeHTTP function.
-// The full userList is pulled using GetUsers and the data from this list is encoded into this struct.
-func (u *Users) getUsers(rw http.ResponseWriter, r *http.Request, db *sql.DB) {
+// Each user is encoded as the representation the principal may see, so other people's contact details are only shown to safety roles.
+func (u *Users) getUsers(p *auth.Principal, rw http.ResponseWriter, db *sql.DB) {
 	u.l.Println("Handling GET request for users")
 
-	userList := data.GetUsers(db)
+	userList, err := data.GetUsers(db)
+	if err != nil {
+		u.l.Println(err)
+		http.Error(rw, "Error retrieving users", http.StatusInternalServerError)
+		return
+	}
+
+	views := make([]interface{}, len(userList))
+	for i, usr := range userList {
+		views[i] = userView(usr, p)
+	}
 
-	err := userList.ToJSON(rw)
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(views); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+// getUser is called on a Users type object and takes the ID of the user to return, the principal making the request, an HTTP ResponseWriter and a sql DB connection.
+// The user is encoded as the representation the principal may see.
+func (u *Users) getUser(id int, p *auth.Principal, rw http.ResponseWriter, db *sql.DB) {
+	u.l.Println("Handling GET request for user", id)
+
+	usr, err := data.GetUserByID(id, db)
+	if err == data.ErrUserNotFound {
+		http.Error(rw, "User not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
+		u.l.Println(err)
+		http.Error(rw, "Error retrieving user", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(userView(usr, p)); err != nil {
 		http.Error(rw, "Unable to Marshal JSON", http.StatusInternalServerError)
 	}
 }
 
-// updateUsers is called on Users type objects and takes the ID of the user to be updated as an int, and an HTTP ResponseWriter and Request as parameters.
+// updateUsers is called on Users type objects and takes the ID of the user to be updated as an int, the principal making the request, and an HTTP ResponseWriter and Request as parameters.
 // This function is involved in handling PUT requests for users,
-// The data stored in the request body is decoded into a newly instantiated User struct object.
+// The data stored in the request body is decoded into a userRequest, and passwords are refused as they are changed through /password.
 // Using the UpdateUser function, the User with the corresponding ID is updated.
-func (u *Users) updateUsers(id int, rw http.ResponseWriter, r *http.Request, db *sql.DB) {
+// A changed email address has to be verified again, so a verification link is sent to the new address.
+// Changing research group records a request for the new group's leader to approve, and 202 Accepted is returned. Admins move straight away.
+func (u *Users) updateUsers(id int, p *auth.Principal, rw http.ResponseWriter, r *http.Request, db *sql.DB) {
 	u.l.Println("Handle PUT request for user")
 
-	ur := &data.User{}
+	ur := &userRequest{}
 
 	// decode supplied data
-	err := ur.FromJSON(r.Body)
+	err := json.NewDecoder(r.Body).Decode(ur)
 	if err != nil {
 		http.Error(rw, "Unable to unmarshal JSON", http.StatusBadRequest)
 		return
 	}
 
-	data.UpdateUser(rw, id, ur, db)
+	// ensure the password can't be changed here
+	if ur.Password != "" {
+		http.Error(rw, "Unable to edit password hash", http.StatusBadRequest)
+		return
+	}
+
+	before, err := data.GetUserByID(id, db)
+	if err != nil && err != data.ErrUserNotFound {
+		u.l.Println(err)
+		http.Error(rw, "Error retrieving user", http.StatusInternalServerError)
+		return
+	}
+
+	// a changed address has to be verified again, so make sure a link can be sent before changing it
+	var settings config.Registration
+	if before != nil && ur.Email != "" && !strings.EqualFold(ur.Email, before.Email) {
+		if settings, err = registrationSettings(); err != nil {
+			u.l.Println(err)
+			http.Error(rw, "Error reading registration settings", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// a new research group must be one of the existing groups, in its own spelling
+	// moving into it needs the approval of its leader or a lab manager, so until then the user stays in their current group
+	var move *data.GroupMoveRequest
+	if ur.Research_Group != "" {
+		group, err := data.FindResearchGroup(ur.Research_Group, db)
+		if err == data.ErrGroupNotFound {
+			http.Error(rw, unknownGroupMessage, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			u.l.Println(err)
+			http.Error(rw, "Error checking research group", http.StatusInternalServerError)
+			return
+		}
+		ur.Research_Group = group.Name
+		if before != nil && group.Name != before.Research_Group && !p.Can(auth.ManageUsers) {
+			if move, err = data.RequestGroupMove(id, group.ID, db); err != nil {
+				u.l.Println(err)
+				http.Error(rw, "Error requesting research group move", http.StatusInternalServerError)
+				return
+			}
+			move.GroupName = group.Name
+			ur.Research_Group = ""
+		}
+	}
+
+	data.UpdateUser(rw, id, ur.toUser(), db)
+
+	// UpdateUser clears the verification of a changed address, so send a link to the new one
+	if before != nil {
+		after, err := data.GetUserByID(id, db)
+		if err != nil {
+			u.l.Println(err)
+			return
+		}
+		if !strings.EqualFold(after.Email, before.Email) {
+			sendVerification(u.n, after, settings)
+		}
+	}
+
+	if move != nil {
+		rw.WriteHeader(http.StatusAccepted)
+		rw.Write([]byte("Your request to join " + move.GroupName + " is waiting for the group leader's approval\n"))
+	}
 
 	u.l.Println("Update complete!")
 
 }
+
+// roleRequest is the body of a request to change a user's role.
+type roleRequest struct {
+	Role string `json:"role"`
+}
+
+// updateRole is called on Users type objects and takes the ID of the user to be updated, and an HTTP ResponseWriter and Request as parameters.
+// The new role is decoded from the request body, checked against the roles known to the auth package, and stored.
+func (u *Users) updateRole(id int, rw http.ResponseWriter, r *http.Request, db *sql.DB) {
+	u.l.Println("Handle PUT request for user role")
+
+	req := &roleRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(rw, "Unable to unmarshal JSON", http.StatusBadRequest)
+		return
+	}
+
+	if !auth.ValidRole(req.Role) {
+		http.Error(rw, "Role must be one of user, fire_warden, lab_manager or admin", http.StatusBadRequest)
+		return
+	}
+
+	if err := data.SetUserRole(id, req.Role, db); err == data.ErrUserNotFound {
+		http.Error(rw, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		u.l.Println(err)
+		http.Error(rw, "Error updating user role", http.StatusInternalServerError)
+		return
+	}
+
+	u.l.Printf("User %d given role %s", id, req.Role)
+}
+
+// verifyUser is called on Users type objects and takes the ID of the user to activate and an HTTP ResponseWriter.
+// The user's email address is marked as verified, for accounts that can't receive the verification email.
+func (u *Users) verifyUser(id int, rw http.ResponseWriter, db *sql.DB) {
+	u.l.Println("Handle PUT request to verify user", id)
+
+	err := data.SetEmailVerified(id, db)
+	if err == data.ErrUserNotFound {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		u.l.Println(err)
+		http.Error(rw, "Error verifying user", http.StatusInternalServerError)
+	}
+}
+
+// userExport is the archive returned by GET /user/{id}/export, adding the user's sessions to the data held in the data package.
+type userExport struct {
+	*data.UserExport
+	Sessions session.SessionsList `json:"sessions"`
+}
+
+// exportUser is called on Users type objects and takes the ID of the user to export, the user making the request, and an HTTP ResponseWriter.
+// All the personal data held about the user is written as a JSON file to download: their profile, bookings, lottery requests, sessions, API tokens, notification settings and login audit entries.
+// Password hashes, token values and two-factor secrets are never included.
+func (u *Users) exportUser(id int, p *auth.Principal, rw http.ResponseWriter, db *sql.DB) {
+	u.l.Println("Handle GET request to export user", id)
+
+	export, err := data.ExportUser(id, db)
+	if err == data.ErrUserNotFound {
+		http.Error(rw, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		u.l.Println(err)
+		http.Error(rw, "Error exporting user data", http.StatusInternalServerError)
+		return
+	}
+
+	// the current session is only marked when users export their own data
+	current := ""
+	if p.UserID == id {
+		current = p.Token
+	}
+	sessions, err := session.ListSessions(id, current, db)
+	if err != nil {
+		u.l.Println(err)
+		http.Error(rw, "Error exporting user data", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Content-Disposition", `attachment; filename="user-`+strconv.Itoa(id)+`-export.json"`)
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(userExport{export, sessions}); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+// eraseRequest is the body of a DELETE request to /user/{id}.
+// Confirm must be the username of the account being erased. Users erasing their own local account must also give their password.
+type eraseRequest struct {
+	Confirm  string `json:"confirm"`
+	Password string `json:"password"`
+}
+
+// eraseUser is called on Users type objects and takes the ID of the user to erase, the user making the request, and an HTTP ResponseWriter and Request.
+// The user's personal data is erased and their bookings are kept under an anonymous name, so usage statistics still add up. This can't be undone.
+// The last admin can't be erased, so there is always someone left who can manage the service.
+func (u *Users) eraseUser(id int, p *auth.Principal, rw http.ResponseWriter, r *http.Request, db *sql.DB) {
+	u.l.Println("Handle DELETE request to erase user", id)
+
+	req := &eraseRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(rw, "Unable to unmarshal JSON", http.StatusBadRequest)
+		return
+	}
+
+	user, err := data.GetUserByID(id, db)
+	if err == data.ErrUserNotFound {
+		http.Error(rw, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		u.l.Println(err)
+		http.Error(rw, "Error erasing user", http.StatusInternalServerError)
+		return
+	}
+	if req.Confirm != user.Name {
+		http.Error(rw, "Please confirm by sending the account's username in the confirm field", http.StatusBadRequest)
+		return
+	}
+
+	// users erasing themselves prove it's them with their password, unless it's managed by their institute account
+	if p.UserID == id {
+		provider, err := data.GetAuthProvider(id, db)
+		if err != nil {
+			u.l.Println(err)
+			http.Error(rw, "Error erasing user", http.StatusInternalServerError)
+			return
+		}
+		if provider == data.LocalProvider {
+			hash, err := data.GetPasswordHash(id, db)
+			if err != nil || comparePasswords(hash, req.Password) != nil {
+				http.Error(rw, "Current password is incorrect", http.StatusForbidden)
+				return
+			}
+		}
+	}
+
+	role, err := data.GetUserRole(id, db)
+	if err != nil {
+		u.l.Println(err)
+		http.Error(rw, "Error erasing user", http.StatusInternalServerError)
+		return
+	}
+	if auth.Role(role) == auth.RoleAdmin {
+		others, err := data.CountOtherAdmins(id, db)
+		if err != nil {
+			u.l.Println(err)
+			http.Error(rw, "Error erasing user", http.StatusInternalServerError)
+			return
+		}
+		if others == 0 {
+			http.Error(rw, "The last admin can't be erased, please make someone else an admin first", http.StatusConflict)
+			return
+		}
+	}
+
+	newName, err := data.EraseUser(id, db)
+	if err == data.ErrUserNotFound {
+		http.Error(rw, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		u.l.Println(err)
+		http.Error(rw, "Error erasing user", http.StatusInternalServerError)
+		return
+	}
+
+	publishEvent(u.l, "user.erased", struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}{id, newName}, db)
+
+	if p.UserID == id {
+		session.ClearCookie(rw)
+	}
+	u.l.Printf("User %d erased, bookings kept as %s", id, newName)
+}
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"bookings.com/m/auth"
+	"bookings.com/m/data"
+	"bookings.com/m/database"
+	"bookings.com/m/session"
+)
+
+// Webhooks struct is created to enable dependency injection of a logger.
+type Webhooks struct {
+	l *log.Logger
+}
+
+// NewWebhookHandler takes a logger object and returns a Webhooks object.
+// This function is used in the main() function to return the Webhooks handler that is required to pass to the created servemux.
+func NewWebhookHandler(l *log.Logger) *Webhooks {
+	return &Webhooks{l}
+}
+
+// ServeHTTP is called on a Webhooks object.
+// It takes an http ResponseWriter and Request as parameters, and routes on the path:
+// GET and POST /webhooks list and register webhooks,
+// DELETE /webhooks/{id} deactivates a webhook,
+// GET /webhooks/{id}/deliveries returns a webhook's delivery log,
+// and POST /webhooks/deliveries/{id}/redeliver sends a delivery again.
+func (wh *Webhooks) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	// Initialise database connection
+	db, err := database.InitialiseConnection(wh.l)
+	if err != nil {
+		wh.l.Println("Database connection error", err)
+		return
+	}
+	defer db.Close()
+
+	if p := authorise(rw, r, db, auth.ManageWebhooks); p == nil {
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		wh.getWebhooks(rw, db)
+	case len(parts) == 1 && r.Method == http.MethodPost:
+		wh.addWebhook(rw, r, db)
+	case len(parts) == 2 && r.Method == http.MethodDelete:
+		id, err := getIDFromURI(r.URL.Path)
+		if err != nil {
+			http.Error(rw, "Invalid URI", http.StatusBadRequest)
+			return
+		}
+		wh.deactivateWebhook(rw, id, db)
+	case len(parts) == 3 && parts[2] == "deliveries" && r.Method == http.MethodGet:
+		id, err := getIDFromURI(r.URL.Path)
+		if err != nil {
+			http.Error(rw, "Invalid URI", http.StatusBadRequest)
+			return
+		}
+		wh.getDeliveries(rw, id, db)
+	case len(parts) == 4 && parts[1] == "deliveries" && parts[3] == "redeliver" && r.Method == http.MethodPost:
+		id, err := getIDFromURI(r.URL.Path)
+		if err != nil {
+			http.Error(rw, "Invalid URI", http.StatusBadRequest)
+			return
+		}
+		wh.redeliver(rw, id, db)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// getWebhooks encodes every registered webhook, without its secret, to the ResponseWriter.
+func (wh *Webhooks) getWebhooks(rw http.ResponseWriter, db *sql.DB) {
+	wh.l.Println("Handling GET request for webhooks")
+
+	webhooks, err := data.GetWebhooks(db)
+	if err != nil {
+		wh.l.Println(err)
+		http.Error(rw, "Error retrieving webhooks", http.StatusInternalServerError)
+		return
+	}
+
+	if err := webhooks.ToJSON(rw); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+// addWebhook decodes a webhook from the request body, validates its URL and events, and registers it.
+// If no secret is supplied one is generated. The webhook is returned with its secret, which is the only time the secret is shown.
+func (wh *Webhooks) addWebhook(rw http.ResponseWriter, r *http.Request, db *sql.DB) {
+	wh.l.Println("Handling POST request for webhooks")
+
+	hook := &data.Webhook{}
+	if err := hook.FromJSON(r.Body); err != nil {
+		http.Error(rw, "Unable to unmarshal JSON", http.StatusBadRequest)
+		return
+	}
+
+	if u, err := url.Parse(hook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(rw, "Please supply a valid http or https URL", http.StatusBadRequest)
+		return
+	}
+	if len(hook.Events) == 0 {
+		http.Error(rw, "Please subscribe to at least one event", http.StatusBadRequest)
+		return
+	}
+	for _, event := range hook.Events {
+		if !data.ValidWebhookEvent(event) {
+			http.Error(rw, "Unknown webhook event: "+event, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if hook.Secret == "" {
+		secret, err := session.GenerateSecureToken(32)
+		if err != nil {
+			http.Error(rw, "Failed to generate webhook secret", http.StatusInternalServerError)
+			return
+		}
+		hook.Secret = secret
+	}
+
+	if err := data.AddWebhook(hook, db); err != nil {
+		wh.l.Println(err)
+		http.Error(rw, "Error adding webhook to database", http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusCreated)
+	if err := hook.ToJSON(rw); err != nil {
+		wh.l.Println("Unable to Marshal JSON", err)
+	}
+}
+
+// deactivateWebhook stops any further events being sent to the webhook with the given ID.
+func (wh *Webhooks) deactivateWebhook(rw http.ResponseWriter, id int, db *sql.DB) {
+	wh.l.Println("Handling DELETE request for webhook", id)
+
+	if err := data.DeactivateWebhook(id, db); err == data.ErrWebhookNotFound {
+		http.Error(rw, "Webhook not found", http.StatusNotFound)
+	} else if err != nil {
+		wh.l.Println(err)
+		http.Error(rw, "Error deactivating webhook", http.StatusInternalServerError)
+	}
+}
+
+// getDeliveries encodes the delivery log of the webhook with the given ID to the ResponseWriter.
+func (wh *Webhooks) getDeliveries(rw http.ResponseWriter, id int, db *sql.DB) {
+	wh.l.Println("Handling GET request for webhook deliveries", id)
+
+	deliveries, err := data.GetWebhookDeliveries(id, db)
+	if err != nil {
+		wh.l.Println(err)
+		http.Error(rw, "Error retrieving webhook deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	if err := deliveries.ToJSON(rw); err != nil {
+		http.Error(rw, "Unable to Marshal JSON", http.StatusInternalServerError)
+	}
+}
+
+// redeliver puts the delivery with the given ID back in the outbox to be sent again straight away.
+func (wh *Webhooks) redeliver(rw http.ResponseWriter, id int, db *sql.DB) {
+	wh.l.Println("Handling redelivery of webhook delivery", id)
+
+	if err := data.RedeliverWebhook(id, db); err == data.ErrWebhookDeliveryNotFound {
+		http.Error(rw, "Webhook delivery not found", http.StatusNotFound)
+	} else if err == data.ErrWebhookInactive {
+		http.Error(rw, "The webhook has been deactivated, so its deliveries can't be sent again", http.StatusConflict)
+	} else if err != nil {
+		wh.l.Println(err)
+		http.Error(rw, "Error redelivering webhook", http.StatusInternalServerError)
+	}
+}
+
+// publishEvent adds an event to the webhook outbox and, for hood and booking changes, the live stream.
+// Errors are logged rather than returned, as a failure to publish should never fail the request that caused the event.
+func publishEvent(l *log.Logger, event string, v interface{}, db *sql.DB) {
+	if err := data.PublishEvent(event, v, db); err != nil {
+		l.Println("Error publishing event", event, err)
+	}
+}
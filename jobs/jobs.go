@@ -0,0 +1,23 @@
+// Package jobs contains the background tasks that run alongside the HTTP server.
+package jobs
+
+import (
+	"context"
+	"time"
+)
+
+// Every takes a context, an interval and a function, and calls the function once straight away and then once every interval.
+// It blocks until the context is cancelled, so it is expected to be started in its own Goroutine from the main function.
+func Every(ctx context.Context, interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		fn()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
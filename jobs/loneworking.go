@@ -0,0 +1,86 @@
+package jobs
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"bookings.com/m/config"
+	"bookings.com/m/data"
+	"bookings.com/m/notify"
+)
+
+// endedSlack is how much longer than the grace period a booking is still checked after it ends, in case this job was held up.
+const endedSlack = time.Hour
+
+// CheckLoneWorkers takes a logger, a notifier, the lone working config, the lab's timezone and a sql DB connection, and escalates every missed check-in.
+// Every booking that falls outside working hours is checked, and once its next check-in is overdue by the grace period the safety contacts are alerted.
+// Bookings are still checked after they end, until the last check-in that fell due while they were running has passed its grace period, so a user who stops checking in just before the end is still escalated.
+// Each missed check-in is claimed in the escalation log before the alert is sent, so it is only escalated once.
+func CheckLoneWorkers(l *log.Logger, n *notify.Notifier, cfg config.LoneWorking, loc *time.Location, db *sql.DB) {
+	now := time.Now()
+	grace := data.CheckInGrace(cfg)
+
+	bookings, err := data.GetBookingsRunningSince(now.Add(-grace-endedSlack), now, db)
+	if err != nil {
+		l.Println("Error finding running bookings", err)
+		return
+	}
+
+	for _, booking := range bookings {
+		outOfHours, err := data.OutOfHours(booking.BookingDate, booking.EndDate, cfg, loc)
+		if err != nil {
+			l.Println("Error checking working hours", err)
+			return
+		}
+		if !outOfHours {
+			continue
+		}
+
+		due, err := data.NextCheckIn(booking, cfg, db)
+		if err != nil {
+			l.Println("Error finding last check-in", booking.ID, err)
+			continue
+		}
+		// no check-in is due once the booking has ended
+		if !due.Before(booking.EndDate) || now.Before(due.Add(grace)) {
+			continue
+		}
+		escalate(l, n, cfg, booking, due, db)
+	}
+}
+
+// escalate logs a missed check-in for a booking and, if this instance claimed it, alerts the safety contacts.
+func escalate(l *log.Logger, n *notify.Notifier, cfg config.LoneWorking, booking *data.Booking, due time.Time, db *sql.DB) {
+	e := &data.Escalation{BookingID: booking.ID, UserName: booking.UserName, HoodNumber: booking.HoodNumber, DueAt: due, Contacts: cfg.SafetyContacts}
+	if e.Contacts == nil {
+		e.Contacts = []string{}
+	}
+
+	// the alert is still sent without these, as it matters more that someone is told
+	if user, err := data.GetUserByName(booking.UserName, db); err != nil {
+		l.Println("Unable to find lone worker", booking.UserName, err)
+	} else {
+		e.Emergency_Telephone = user.Emergency_Telephone
+	}
+	if hood, err := data.GetHoodByNumber(booking.HoodNumber, db); err != nil {
+		l.Println("Unable to find hood", booking.HoodNumber, err)
+	} else {
+		e.Room = hood.Room
+	}
+
+	claimed, err := data.ClaimEscalation(e, db)
+	if err != nil {
+		l.Println("Error logging escalation", booking.ID, err)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	l.Printf("Lone worker %s missed the check-in due at %s on hood %d, alerting %d safety contacts", e.UserName, due.Format(time.RFC3339), e.HoodNumber, len(e.Contacts))
+	n.NotifyEscalation(e.Contacts, e)
+	if err := data.PublishEvent("lone_worker.escalated", e, db); err != nil {
+		l.Println("Error publishing event", err)
+	}
+}
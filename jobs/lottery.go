@@ -0,0 +1,159 @@
+package jobs
+
+import (
+	"database/sql"
+	"log"
+	"math/rand"
+	"time"
+
+	"bookings.com/m/config"
+	"bookings.com/m/data"
+	"bookings.com/m/notify"
+)
+
+// usageLookback is how far back bookings are counted when weighting the lottery by past usage.
+const usageLookback = 30 * 24 * time.Hour
+
+// staleClaim is how long a window can stay "allocating" before it is assumed that the instance allocating it has stopped, and it is claimed again.
+const staleClaim = 10 * time.Minute
+
+// AllocateLotteries takes a logger, a notifier and a sql DB connection and allocates every lottery window whose request period has closed.
+// Each window is claimed before it is allocated, so when several instances are running a window is only ever allocated once.
+// Windows left "allocating" by an instance that stopped part way through are claimed again once the claim is stale, so they don't block direct bookings forever.
+func AllocateLotteries(l *log.Logger, n *notify.Notifier, db *sql.DB) {
+	for {
+		now := time.Now()
+		window, err := data.ClaimClosedLotteryWindow(now, now.Add(-staleClaim), db)
+		if err != nil {
+			l.Println("Error claiming lottery window", err)
+			return
+		}
+		if window == nil {
+			return
+		}
+
+		if err := allocateWindow(l, n, window, db); err != nil {
+			l.Println("Error allocating lottery window", window.ID, err)
+			// nothing has been booked yet, so hand the window back to be retried on the next run
+			if err := data.SetLotteryWindowStatus(window.ID, data.LotteryOpen, db); err != nil {
+				l.Println("Error handing back lottery window", window.ID, err)
+			}
+			return
+		}
+	}
+}
+
+// allocateWindow runs the allocation for a single claimed window, confirms the winning requests as bookings and stores the outcome of every request.
+// Winners go through the same checks as direct bookings, as if they were booked when the window closed, and lose if they fail one.
+// Each winner's booking and outcome are stored in one transaction, so if the window is claimed again after a crash, requests that were already confirmed are kept and only the rest are allocated.
+// An error is only returned if the window could not be allocated at all. Once bookings start being confirmed, any further errors are logged instead.
+func allocateWindow(l *log.Logger, n *notify.Notifier, window *data.LotteryWindow, db *sql.DB) error {
+	cfg, err := config.ReadConfigFile(config.FileName)
+	if err != nil {
+		return err
+	}
+	loc, err := cfg.Location()
+	if err != nil {
+		return err
+	}
+
+	all, err := data.GetBookingRequests(window.ID, "", db)
+	if err != nil {
+		return err
+	}
+	var requests data.BookingRequestsList
+	for _, req := range all {
+		if req.Status == data.RequestWon && req.BookingID != 0 {
+			continue
+		}
+		requests = append(requests, req)
+	}
+
+	until := window.SlotsUntil
+	for _, req := range requests {
+		if req.EndDate.After(until) {
+			until = req.EndDate
+		}
+	}
+	existing, err := data.GetBookingsBetween(window.SlotsFrom, until, db)
+	if err != nil {
+		return err
+	}
+
+	usage, err := data.GetUsageHours(window.ClosesAt.Add(-usageLookback), window.ClosesAt, db)
+	if err != nil {
+		return err
+	}
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	winners := data.AllocateRequests(requests, existing, usage, rnd)
+
+	for _, req := range winners {
+		booking := &data.Booking{UserName: req.UserName, HoodNumber: req.HoodNumber, BookingDate: req.BookingDate, EndDate: req.EndDate}
+		// the hood may have been retired, the month locked or the slot booked since the request was made
+		if err := data.CheckBookable(booking, cfg, window.ClosesAt, db); err != nil {
+			if !data.IsBookingRejection(err) {
+				l.Println("Error checking lottery booking", err)
+			}
+			lose(req, err)
+			continue
+		}
+
+		// requests outside working hours need the user's own lone-worker acknowledgement, which requests submitted before it was asked for don't have
+		loneWorking := false
+		if cfg.LoneWorking.Enabled {
+			if loneWorking, err = data.OutOfHours(booking.BookingDate, booking.EndDate, cfg.LoneWorking, loc); err != nil {
+				l.Println("Error checking working hours", err)
+				req.Status = data.RequestLost
+				req.Reason = "booking could not be confirmed"
+				continue
+			}
+		}
+		if loneWorking && !req.LoneWorkerAck {
+			req.Status = data.RequestLost
+			req.Reason = "slot is outside working hours and the lone-worker protocol was not acknowledged"
+			continue
+		}
+
+		if err := data.ConfirmRequestBooking(req, booking, loneWorking, db); err != nil {
+			if !data.IsBookingRejection(err) {
+				l.Println("Error confirming lottery booking", err)
+			}
+			req.BookingID = 0
+			lose(req, err)
+			continue
+		}
+		n.NotifyBooking("booking.created", booking, db)
+		if err := data.PublishEvent("booking.created", booking, db); err != nil {
+			l.Println("Error publishing event", err)
+		}
+	}
+
+	for _, req := range requests {
+		if req.BookingID != 0 {
+			continue
+		}
+		if err := data.SaveRequestOutcome(req, db); err != nil {
+			l.Println("Error saving lottery request outcome", req.ID, err)
+		}
+	}
+
+	if err := data.SetLotteryWindowStatus(window.ID, data.LotteryAllocated, db); err != nil {
+		l.Println("Error marking lottery window as allocated", window.ID, err)
+	}
+	l.Printf("Lottery window %d allocated, %d of %d requests won", window.ID, len(winners), len(requests))
+	return nil
+}
+
+// lose marks a winning request as lost because its booking couldn't be made, giving the reason for a booking that was rejected.
+func lose(req *data.BookingRequest, err error) {
+	req.Status = data.RequestLost
+	switch {
+	case err == data.ErrHoodRetired || err == data.ErrHoodNotFound:
+		req.Reason = "hood is no longer in service"
+	case data.IsBookingRejection(err):
+		req.Reason = err.Error()
+	default:
+		req.Reason = "booking could not be confirmed"
+	}
+}
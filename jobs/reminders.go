@@ -0,0 +1,59 @@
+package jobs
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"bookings.com/m/config"
+	"bookings.com/m/data"
+	"bookings.com/m/notify"
+)
+
+// SendReminders takes a logger, a notifier, the reminder config and a sql DB connection, and emails every reminder that is now due.
+// A reminder is due once the booking is within the configured offset of starting (or ending, for the end nudge), as long as it hasn't started (or ended) yet.
+// Cancelled bookings are skipped, so cancelling a booking also cancels its reminders.
+// A reminder is also skipped if its send time had already passed when the booking was made, so a booking made 5 minutes before it starts doesn't get every reminder at once.
+func SendReminders(l *log.Logger, n *notify.Notifier, cfg config.Reminders, db *sql.DB) {
+	now := time.Now()
+
+	for _, offset := range cfg.StartOffsetsMinutes {
+		if offset <= 0 {
+			continue
+		}
+		kind := fmt.Sprintf("start-%d", offset)
+		d := time.Duration(offset) * time.Minute
+		bookings, err := data.GetBookingsStartingBetween(kind, d, now, now.Add(d), db)
+		if err != nil {
+			l.Println("Error finding bookings to remind", err)
+			return
+		}
+		sendReminder(l, n, "booking.reminder", kind, bookings, db)
+	}
+
+	if cfg.EndNudgeMinutes > 0 {
+		kind := fmt.Sprintf("end-%d", cfg.EndNudgeMinutes)
+		d := time.Duration(cfg.EndNudgeMinutes) * time.Minute
+		bookings, err := data.GetBookingsEndingBetween(kind, d, now, now.Add(d), db)
+		if err != nil {
+			l.Println("Error finding bookings to nudge", err)
+			return
+		}
+		sendReminder(l, n, "booking.ending", kind, bookings, db)
+	}
+}
+
+// sendReminder claims the reminder of the given kind for each booking, and only notifies the user if this instance won the claim.
+func sendReminder(l *log.Logger, n *notify.Notifier, event, kind string, bookings data.BookingsList, db *sql.DB) {
+	for _, booking := range bookings {
+		claimed, err := data.ClaimReminder(booking.ID, kind, db)
+		if err != nil {
+			l.Println("Error claiming reminder", booking.ID, kind, err)
+			continue
+		}
+		if claimed {
+			n.NotifyBooking(event, booking, db)
+		}
+	}
+}
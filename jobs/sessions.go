@@ -0,0 +1,30 @@
+package jobs
+
+import (
+	"database/sql"
+	"log"
+
+	"bookings.com/m/data"
+	"bookings.com/m/session"
+)
+
+// CleanupSessions takes a logger and a sql DB connection and deletes every expired session, and every expired two-factor login challenge.
+func CleanupSessions(l *log.Logger, db *sql.DB) {
+	n, err := session.DeleteExpiredSessions(db)
+	if err != nil {
+		l.Println("Error deleting expired sessions", err)
+		return
+	}
+	if n > 0 {
+		l.Println("Deleted expired sessions:", n)
+	}
+
+	n, err = data.DeleteExpiredLoginChallenges(db)
+	if err != nil {
+		l.Println("Error deleting expired login challenges", err)
+		return
+	}
+	if n > 0 {
+		l.Println("Deleted expired login challenges:", n)
+	}
+}
@@ -0,0 +1,101 @@
+package jobs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"bookings.com/m/data"
+)
+
+// webhook delivery settings
+const (
+	webhookBatchSize   = 20
+	webhookLease       = 2 * time.Minute
+	webhookMaxAttempts = 10
+	webhookBaseBackoff = 30 * time.Second
+)
+
+// webhookClient is used for every delivery, with a timeout so one slow endpoint can't hold up the rest of the outbox.
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// DeliverWebhooks takes a logger and a sql DB connection and sends every webhook delivery in the outbox that is due.
+// Failed deliveries are retried with exponential backoff, and marked as failed after webhookMaxAttempts attempts.
+func DeliverWebhooks(l *log.Logger, db *sql.DB) {
+	for {
+		deliveries, err := data.ClaimWebhookDeliveries(webhookBatchSize, webhookLease, db)
+		if err != nil {
+			l.Println("Error claiming webhook deliveries", err)
+			return
+		}
+		if len(deliveries) == 0 {
+			return
+		}
+
+		for _, d := range deliveries {
+			code, err := sendWebhook(d)
+			if err == nil {
+				if err := data.RecordWebhookDelivered(d.ID, code, db); err != nil {
+					l.Println("Error recording webhook delivery", d.ID, err)
+				}
+				continue
+			}
+
+			var retryAt time.Time
+			if d.Attempts+1 < webhookMaxAttempts {
+				retryAt = time.Now().Add(webhookBaseBackoff << d.Attempts)
+			}
+			l.Printf("Webhook delivery %d to %s failed: %s", d.ID, d.URL, err)
+			if err := data.RecordWebhookFailure(d.ID, code, err.Error(), retryAt, db); err != nil {
+				l.Println("Error recording webhook failure", d.ID, err)
+			}
+		}
+	}
+}
+
+// sendWebhook POSTs a single delivery to its endpoint and returns the response code.
+// The request is signed with HMAC-SHA256 over the timestamp and body, using the webhook's secret, so the receiver can check it came from this service and is not a replay.
+// Any response other than 2xx is treated as a failure.
+func sendWebhook(d *data.WebhookDelivery) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Hood-Event", d.Event)
+	req.Header.Set("X-Hood-Delivery", strconv.Itoa(d.ID))
+	req.Header.Set("X-Hood-Timestamp", timestamp)
+	req.Header.Set("X-Hood-Signature", "sha256="+SignWebhook(d.Secret, timestamp, d.Payload))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded with %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// SignWebhook returns the hex encoded HMAC-SHA256 of "timestamp.body" using the secret.
+// Receivers compute the same value and compare it to the X-Hood-Signature header.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -8,32 +8,159 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+	_ "time/tzdata"
 
+	"bookings.com/m/config"
+	"bookings.com/m/database"
 	"bookings.com/m/handlers"
+	"bookings.com/m/jobs"
+	"bookings.com/m/notify"
+	"bookings.com/m/session"
+	"bookings.com/m/sso"
+	"bookings.com/m/stream"
 )
 
 func main() {
 	// instantiate a new logger
 	l := log.New(os.Stdout, "booking-api", log.LstdFlags)
 
+	// read the config file for the settings used outside of the database connection
+	cfg, err := config.ReadConfigFile(config.FileName)
+	if err != nil {
+		l.Println("Unable to read config file, email notifications disabled", err)
+	}
+
+	// apply the session lifetimes, token key and cookie attributes from the config file
+	if !session.Configure(cfg.Sessions) {
+		l.Println("No session token_key in the config file, using a random key so sessions will not survive a restart")
+	}
+
+	// client addresses are only taken from X-Forwarded-For when the request comes through one of these proxies
+	if err := session.ConfigureProxies(cfg.Server.TrustedProxies); err != nil {
+		l.Println("Ignoring trusted_proxies, client addresses will be taken from the connection", err)
+	}
+
+	// instantiate the email notifier shared by the handlers and background jobs
+	notifier := notify.NewNotifier(l, cfg.Email)
+
+	// start background jobs, which share a single database connection pool and stop when the server shuts down.
+	jobsContext, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+
+	go notifier.Run(jobsContext)
+
+	// the stream broker is left nil if the database is unavailable, and the stream handler reports this to clients.
+	var broker *stream.Broker
+
+	db, err := database.InitialiseConnection(l)
+	if err != nil {
+		l.Println("Database connection error, background jobs not started", err)
+	} else {
+		defer db.Close()
+		go jobs.Every(jobsContext, time.Minute, func() { jobs.AllocateLotteries(l, notifier, db) })
+		go jobs.Every(jobsContext, time.Minute, func() { jobs.SendReminders(l, notifier, cfg.Reminders, db) })
+		go jobs.Every(jobsContext, 15*time.Second, func() { jobs.DeliverWebhooks(l, db) })
+		go jobs.Every(jobsContext, time.Hour, func() { jobs.CleanupSessions(l, db) })
+		if cfg.LoneWorking.Enabled {
+			if loc, err := cfg.Location(); err != nil {
+				l.Println("Unable to load the lab timezone, lone worker checks not started", err)
+			} else {
+				go jobs.Every(jobsContext, time.Minute, func() { jobs.CheckLoneWorkers(l, notifier, cfg.LoneWorking, loc, db) })
+			}
+		}
+
+		if broker, err = stream.NewBroker(l, db); err != nil {
+			l.Println("Unable to start stream broker", err)
+		} else {
+			go broker.Run(jobsContext, database.ConnectionString(cfg))
+		}
+	}
+
 	// instantiate handlers
-	regHandler := handlers.NewRegisterHandler(l)
-	loginHandler := handlers.NewLoginHandler(l)
-	userHandler := handlers.NewUserHandler(l)
-	hoodHandler := handlers.NewHoodHandler(l)
-	bookingHandler := handlers.NewBookingHandler(l)
+	regHandler := handlers.NewRegisterHandler(l, notifier)
+	// institute accounts can log in through the LDAP directory and the OpenID Connect provider, when they are enabled
+	var authenticators []sso.Authenticator
+	if cfg.SSO.LDAP.Enabled {
+		authenticators = append(authenticators, sso.NewLDAP(cfg.SSO.LDAP))
+	}
+	var oidc *sso.OIDC
+	if cfg.SSO.OIDC.Enabled {
+		oidc = sso.NewOIDC(cfg.SSO.OIDC)
+	}
+
+	loginHandler := handlers.NewLoginHandler(l, authenticators...)
+	oidcHandler := handlers.NewOIDCLoginHandler(l, oidc)
+	logoutHandler := handlers.NewLogoutHandler(l)
+	passwordHandler := handlers.NewPasswordHandler(l, notifier)
+	loginAuditHandler := handlers.NewLoginAuditHandler(l)
+	sessionHandler := handlers.NewSessionHandler(l)
+	apiTokenHandler := handlers.NewAPITokenHandler(l)
+	invitationHandler := handlers.NewInvitationHandler(l)
+	twoFactorHandler := handlers.NewTwoFactorHandler(l)
+	userHandler := handlers.NewUserHandler(l, notifier)
+	hoodHandler := handlers.NewHoodHandler(l, notifier)
+	maintenanceHandler := handlers.NewMaintenanceHandler(l, notifier)
+	bookingHandler := handlers.NewBookingHandler(l, notifier)
+	lotteryHandler := handlers.NewLotteryHandler(l)
+	statsHandler := handlers.NewStatsHandler(l)
+	rateHandler := handlers.NewRateHandler(l)
+	rechargeHandler := handlers.NewRechargeHandler(l)
+	notificationHandler := handlers.NewNotificationHandler(l)
+	webhookHandler := handlers.NewWebhookHandler(l)
+	streamHandler := handlers.NewStreamHandler(l, broker)
+	groupHandler := handlers.NewGroupHandler(l)
+	delegateHandler := handlers.NewDelegateHandler(l)
+	escalationHandler := handlers.NewEscalationHandler(l)
+	rollCallHandler := handlers.NewRollCallHandler(l)
 
 	mux := http.NewServeMux()
 
 	// assign routes to handlers
 	mux.Handle("/register", regHandler)
+	mux.Handle("/register/", regHandler)
 	mux.Handle("/login", loginHandler)
+	mux.Handle("/login/2fa", loginHandler)
+	mux.Handle("/login/oidc", oidcHandler)
+	mux.Handle("/login/oidc/", oidcHandler)
+	mux.Handle("/logout", logoutHandler)
+	mux.Handle("/password", passwordHandler)
+	mux.Handle("/password/", passwordHandler)
+	mux.Handle("/lockouts", loginAuditHandler)
+	mux.Handle("/lockouts/", loginAuditHandler)
+	mux.Handle("/login-attempts", loginAuditHandler)
+	mux.Handle("/sessions", sessionHandler)
+	mux.Handle("/sessions/", sessionHandler)
+	mux.Handle("/tokens", apiTokenHandler)
+	mux.Handle("/tokens/", apiTokenHandler)
+	mux.Handle("/invitations", invitationHandler)
+	mux.Handle("/invitations/", invitationHandler)
+	mux.Handle("/2fa", twoFactorHandler)
+	mux.Handle("/2fa/", twoFactorHandler)
 	mux.Handle("/user", userHandler)
 	mux.Handle("/user/", userHandler)
+	mux.Handle("/groups", groupHandler)
+	mux.Handle("/groups/", groupHandler)
 	mux.Handle("/hood", hoodHandler)
 	mux.Handle("/hood/", hoodHandler)
+	mux.Handle("/maintenance", maintenanceHandler)
+	mux.Handle("/maintenance/", maintenanceHandler)
 	mux.Handle("/booking", bookingHandler)
 	mux.Handle("/booking/", bookingHandler)
+	mux.Handle("/delegates", delegateHandler)
+	mux.Handle("/delegates/", delegateHandler)
+	mux.Handle("/escalations", escalationHandler)
+	mux.Handle("/escalations/", escalationHandler)
+	mux.Handle("/rollcall", rollCallHandler)
+	mux.Handle("/lottery", lotteryHandler)
+	mux.Handle("/lottery/", lotteryHandler)
+	mux.Handle("/stats", statsHandler)
+	mux.Handle("/rates", rateHandler)
+	mux.Handle("/recharge", rechargeHandler)
+	mux.Handle("/recharge/", rechargeHandler)
+	mux.Handle("/notifications", notificationHandler)
+	mux.Handle("/webhooks", webhookHandler)
+	mux.Handle("/webhooks/", webhookHandler)
+	mux.Handle("/stream", streamHandler)
 
 	// instantiate server
 	srvr := &http.Server{
@@ -62,6 +189,7 @@ func main() {
 
 	sig := <-signalChannel
 	l.Println("Server terminating, gracefully exiting", sig)
+	stopJobs()
 
 	timeoutContext, cancelCtx := context.WithTimeout(context.Background(), 30*time.Second)
 
@@ -0,0 +1,230 @@
+// Package notify sends email notifications about booking lifecycle events.
+// Messages are queued and sent by a background worker, so a slow or unavailable mail server never holds up an HTTP request.
+package notify
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"bookings.com/m/config"
+	"bookings.com/m/data"
+)
+
+// queueSize is the number of messages that can be waiting to be sent before new messages are dropped.
+const queueSize = 256
+
+// Message is a single email waiting to be sent.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+
+	attempts int
+}
+
+// Sender is implemented by anything that can deliver a Message.
+// SMTPSender is used by the service, and the interface allows a stand-in to be used when testing.
+type Sender interface {
+	Send(msg Message) error
+}
+
+// SMTPSender sends messages through an SMTP server using net/smtp.
+type SMTPSender struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+// Send delivers the message through the SMTP server at s.Addr.
+func (s *SMTPSender) Send(msg Message) error {
+	body := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		s.From, msg.To, msg.Subject, strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return smtp.SendMail(s.Addr, s.Auth, s.From, []string{msg.To}, []byte(body))
+}
+
+// Notifier renders and queues notification emails, and sends them from a background worker with retries.
+// A nil *Notifier, or one created with email disabled in the config, accepts notifications and silently drops them.
+type Notifier struct {
+	l          *log.Logger
+	sender     Sender
+	queue      chan Message
+	maxRetries int
+	retryDelay time.Duration
+}
+
+// NewNotifier takes a logger and the email config and returns a Notifier that sends through SMTP.
+// If email is disabled in the config, the Notifier drops every notification.
+func NewNotifier(l *log.Logger, cfg config.Email) *Notifier {
+	if !cfg.Enabled {
+		return &Notifier{l: l}
+	}
+
+	sender := &SMTPSender{
+		Addr: net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		From: cfg.From,
+	}
+	if cfg.Username != "" {
+		sender.Auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+
+	return NewNotifierWithSender(l, sender, cfg.MaxRetries, time.Duration(cfg.RetryDelaySeconds)*time.Second)
+}
+
+// NewNotifierWithSender takes a logger, a Sender, the number of times to retry a failed message and the delay before the first retry, and returns a Notifier.
+// The delay doubles after each failed attempt.
+func NewNotifierWithSender(l *log.Logger, sender Sender, maxRetries int, retryDelay time.Duration) *Notifier {
+	if retryDelay <= 0 {
+		retryDelay = 30 * time.Second
+	}
+	return &Notifier{
+		l:          l,
+		sender:     sender,
+		queue:      make(chan Message, queueSize),
+		maxRetries: maxRetries,
+		retryDelay: retryDelay,
+	}
+}
+
+// Run sends queued messages until the context is cancelled.
+// It is expected to be started in its own Goroutine from the main function.
+func (n *Notifier) Run(ctx context.Context) {
+	if n == nil || n.sender == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-n.queue:
+			n.send(ctx, msg)
+		}
+	}
+}
+
+// send delivers a single message.
+// If it fails, the message is put back on the queue after a delay that doubles with each attempt, so one failing message doesn't hold up the rest of the queue.
+func (n *Notifier) send(ctx context.Context, msg Message) {
+	err := n.sender.Send(msg)
+	if err == nil {
+		return
+	}
+	if msg.attempts >= n.maxRetries {
+		n.l.Printf("Giving up sending %q to %s after %d attempts: %s", msg.Subject, msg.To, msg.attempts+1, err)
+		return
+	}
+
+	delay := n.retryDelay << msg.attempts
+	n.l.Printf("Error sending %q to %s, retrying in %s: %s", msg.Subject, msg.To, delay, err)
+
+	msg.attempts++
+	time.AfterFunc(delay, func() {
+		if ctx.Err() == nil {
+			n.Enqueue(msg)
+		}
+	})
+}
+
+// Enqueue adds a message to the send queue without blocking.
+// If the queue is full the message is dropped and logged.
+func (n *Notifier) Enqueue(msg Message) {
+	if n == nil || n.sender == nil {
+		return
+	}
+
+	select {
+	case n.queue <- msg:
+	default:
+		n.l.Printf("Notification queue full, dropping %q to %s", msg.Subject, msg.To)
+	}
+}
+
+// NotifyBooking takes an event, a booking and a sql DB connection, and queues an email about the event to the user the booking is for.
+// Nothing is sent if the user has no email address or has opted out of the event.
+// Any error looking up the user is logged rather than returned, as a failed notification should never fail the request that caused it.
+func (n *Notifier) NotifyBooking(event string, b *data.Booking, db *sql.DB) {
+	if n == nil || n.sender == nil {
+		return
+	}
+
+	user, err := data.GetUserByName(b.UserName, db)
+	if err != nil {
+		n.l.Println("Unable to find user to notify", b.UserName, err)
+		return
+	}
+	if user.Email == "" {
+		return
+	}
+
+	optedOut, err := data.IsOptedOut(user.ID, event, db)
+	if err != nil {
+		n.l.Println("Unable to check notification preferences", err)
+		return
+	}
+	if optedOut {
+		return
+	}
+
+	msg, err := render(event, user, b)
+	if err != nil {
+		n.l.Println("Unable to render notification", event, err)
+		return
+	}
+	n.Enqueue(msg)
+}
+
+// NotifyPasswordReset takes a user and the link or token they need to reset their password, and queues the reset email.
+// Password reset emails can't be opted out of, as they are only sent when asked for.
+func (n *Notifier) NotifyPasswordReset(u *data.User, link string, validFor time.Duration) {
+	if n == nil || n.sender == nil || u.Email == "" {
+		return
+	}
+
+	n.Enqueue(Message{
+		To:      u.Email,
+		Subject: "Reset your hood booking password",
+		Body: fmt.Sprintf("Hi %s,\n\nA password reset was requested for your account. To choose a new password, use this link within %s:\n\n%s\n\n"+
+			"The link can only be used once. If you didn't ask for this, you can ignore this email.\n", u.Name, validFor, link),
+	})
+}
+
+// NotifyEmailVerification takes a newly registered user and the link that verifies their email address, and queues the verification email.
+// As with password resets, verification emails can't be opted out of.
+func (n *Notifier) NotifyEmailVerification(u *data.User, link string, validFor time.Duration) {
+	if n == nil || n.sender == nil || u.Email == "" {
+		return
+	}
+
+	n.Enqueue(Message{
+		To:      u.Email,
+		Subject: "Verify your email address for hood booking",
+		Body: fmt.Sprintf("Hi %s,\n\nThanks for registering. Your account will be activated once you verify your email address with this link within %s:\n\n%s\n\n"+
+			"If you didn't register, you can ignore this email.\n", u.Name, validFor, link),
+	})
+}
+
+// NotifyEscalation takes the safety contacts' email addresses and an escalation, and queues an alert to each contact that a lone worker has missed a check-in.
+// Alerts can't be opted out of, and include the worker's emergency telephone number so they can be called straight away.
+func (n *Notifier) NotifyEscalation(contacts []string, e *data.Escalation) {
+	if n == nil || n.sender == nil {
+		return
+	}
+
+	body := fmt.Sprintf("%s is working alone on hood %d in %s and missed a check-in due at %s.\n\n"+
+		"Emergency telephone: %d\n\nPlease contact them now, and follow the lone working emergency procedure if you can't reach them.\n",
+		e.UserName, e.HoodNumber, e.Room, e.DueAt.Format("15:04 Mon 2 Jan"), e.Emergency_Telephone)
+	for _, to := range contacts {
+		n.Enqueue(Message{
+			To:      to,
+			Subject: fmt.Sprintf("URGENT: lone worker %s missed a check-in on hood %d", e.UserName, e.HoodNumber),
+			Body:    body,
+		})
+	}
+}
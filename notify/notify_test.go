@@ -0,0 +1,239 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bookings.com/m/data"
+)
+
+// fakeSender records every message it is given, and fails the first failures calls.
+type fakeSender struct {
+	mu       sync.Mutex
+	failures int
+	calls    int
+	sent     []Message
+	done     chan struct{}
+}
+
+func newFakeSender(failures int) *fakeSender {
+	return &fakeSender{failures: failures, done: make(chan struct{}, queueSize)}
+}
+
+func (f *fakeSender) Send(msg Message) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.calls <= f.failures {
+		return errors.New("mail server unavailable")
+	}
+	f.sent = append(f.sent, msg)
+	f.done <- struct{}{}
+	return nil
+}
+
+// wait blocks until n messages have been sent, and fails the test if that takes too long.
+func (f *fakeSender) wait(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-f.done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for message %d of %d", i+1, n)
+		}
+	}
+}
+
+func startNotifier(t *testing.T, sender Sender, maxRetries int) *Notifier {
+	t.Helper()
+	n := NewNotifierWithSender(log.New(io.Discard, "", 0), sender, maxRetries, time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go n.Run(ctx)
+	return n
+}
+
+func TestNotifierSendsQueuedMessages(t *testing.T) {
+	sender := newFakeSender(0)
+	n := startNotifier(t, sender, 0)
+
+	n.Enqueue(Message{To: "a@example.com", Subject: "first"})
+	n.Enqueue(Message{To: "b@example.com", Subject: "second"})
+	sender.wait(t, 2)
+
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	if sender.sent[0].To != "a@example.com" || sender.sent[1].To != "b@example.com" {
+		t.Errorf("sent %+v, want messages to a@ and b@ in order", sender.sent)
+	}
+}
+
+func TestNotifierRetriesFailedMessages(t *testing.T) {
+	sender := newFakeSender(2)
+	n := startNotifier(t, sender, 3)
+
+	n.Enqueue(Message{To: "a@example.com", Subject: "retried"})
+	sender.wait(t, 1)
+
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	if sender.calls != 3 {
+		t.Errorf("Send called %d times, want 3", sender.calls)
+	}
+}
+
+func TestNotifierGivesUpAfterMaxRetries(t *testing.T) {
+	sender := newFakeSender(10)
+	n := startNotifier(t, sender, 1)
+
+	n.Enqueue(Message{To: "a@example.com", Subject: "dropped"})
+	time.Sleep(100 * time.Millisecond)
+
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	if sender.calls != 2 || len(sender.sent) != 0 {
+		t.Errorf("Send called %d times and sent %d messages, want 2 calls and none sent", sender.calls, len(sender.sent))
+	}
+}
+
+func TestNilNotifierDropsNotifications(t *testing.T) {
+	var n *Notifier
+	n.Enqueue(Message{To: "a@example.com"})
+	n.NotifyEscalation([]string{"safety@example.com"}, &data.Escalation{})
+
+	disabled := &Notifier{}
+	disabled.Enqueue(Message{To: "a@example.com"})
+}
+
+func TestNotifyEscalationAlertsEveryContact(t *testing.T) {
+	sender := newFakeSender(0)
+	n := startNotifier(t, sender, 0)
+
+	n.NotifyEscalation([]string{"one@example.com", "two@example.com"}, &data.Escalation{
+		UserName:            "ada",
+		HoodNumber:          3,
+		Room:                "Lab 2.14",
+		DueAt:               time.Date(2026, 3, 2, 21, 30, 0, 0, time.UTC),
+		Emergency_Telephone: 5551234,
+	})
+	sender.wait(t, 2)
+
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	for i, to := range []string{"one@example.com", "two@example.com"} {
+		msg := sender.sent[i]
+		if msg.To != to {
+			t.Errorf("message %d sent to %s, want %s", i, msg.To, to)
+		}
+		if !strings.Contains(msg.Subject, "ada") || !strings.Contains(msg.Body, "Lab 2.14") || !strings.Contains(msg.Body, "5551234") {
+			t.Errorf("message %d is missing the worker's details: %+v", i, msg)
+		}
+	}
+}
+
+func TestRenderEveryBookingTemplate(t *testing.T) {
+	u := &data.User{Name: "ada", Email: "ada@example.com"}
+	b := &data.Booking{
+		HoodNumber:  4,
+		BookingDate: time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC),
+		EndDate:     time.Date(2026, 3, 2, 11, 0, 0, 0, time.UTC),
+	}
+
+	for event := range templates {
+		msg, err := render(event, u, b)
+		if err != nil {
+			t.Errorf("render(%s): %s", event, err)
+			continue
+		}
+		if msg.To != u.Email || msg.Subject == "" {
+			t.Errorf("render(%s) = %+v, want a subject addressed to %s", event, msg, u.Email)
+		}
+		if !strings.Contains(msg.Body, "Hi ada") || !strings.Contains(msg.Body, "Mon 2 Mar 2026 09:00") {
+			t.Errorf("render(%s) body is missing the user or booking details:\n%s", event, msg.Body)
+		}
+	}
+
+	if _, err := render("booking.unknown", u, b); err == nil {
+		t.Error("render of an unknown event succeeded, want an error")
+	}
+}
+
+// smtpListener runs a minimal SMTP server on a local port that accepts one message and passes the DATA section to received.
+func smtpListener(t *testing.T, received chan<- string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		tp.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+			case "EHLO", "HELO":
+				tp.PrintfLine("250 localhost")
+			case "MAIL", "RCPT", "RSET", "NOOP":
+				tp.PrintfLine("250 OK")
+			case "DATA":
+				tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+				body, err := io.ReadAll(tp.DotReader())
+				if err != nil {
+					return
+				}
+				received <- string(body)
+				tp.PrintfLine("250 OK")
+			case "QUIT":
+				tp.PrintfLine("221 Bye")
+				return
+			default:
+				tp.PrintfLine("502 Command not implemented")
+			}
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestSMTPSenderDeliversToLocalServer(t *testing.T) {
+	received := make(chan string, 1)
+	addr := smtpListener(t, received)
+
+	sender := &SMTPSender{Addr: addr, From: "bookings@example.com"}
+	n := startNotifier(t, sender, 0)
+	n.Enqueue(Message{To: "ada@example.com", Subject: "Hood 4 booked", Body: "Hi ada,\nYour booking has been confirmed."})
+
+	select {
+	case body := <-received:
+		headers, err := textproto.NewReader(bufio.NewReader(strings.NewReader(body))).ReadMIMEHeader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if headers.Get("To") != "ada@example.com" || headers.Get("From") != "bookings@example.com" || headers.Get("Subject") != "Hood 4 booked" {
+			t.Errorf("unexpected headers %v", headers)
+		}
+		if !strings.Contains(body, "Hi ada,\nYour booking has been confirmed.") {
+			t.Errorf("body not delivered:\n%s", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the SMTP server to receive the message")
+	}
+}
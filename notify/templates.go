@@ -0,0 +1,81 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+
+	"bookings.com/m/data"
+)
+
+// emailTemplate holds the subject and body templates for one event.
+type emailTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+// templateData is passed to every template when a message is rendered.
+type templateData struct {
+	User    *data.User
+	Booking *data.Booking
+}
+
+// bookingDetails is shared by every booking template.
+const bookingDetails = `
+Hood:  {{.Booking.HoodNumber}}
+Start: {{.Booking.BookingDate.Format "Mon 2 Jan 2006 15:04"}}
+End:   {{.Booking.EndDate.Format "Mon 2 Jan 2006 15:04"}}
+`
+
+// templates maps each notification event to its email.
+var templates = map[string]emailTemplate{
+	"booking.created": newTemplate(
+		"Hood {{.Booking.HoodNumber}} booked",
+		"Hi {{.User.Name}},\n\nYour booking has been confirmed.\n"+bookingDetails),
+	"booking.moved": newTemplate(
+		"Hood booking moved",
+		"Hi {{.User.Name}},\n\nYour booking has been moved. The new details are:\n"+bookingDetails),
+	"booking.cancelled": newTemplate(
+		"Hood {{.Booking.HoodNumber}} booking cancelled",
+		"Hi {{.User.Name}},\n\nThe following booking has been cancelled.\n"+bookingDetails),
+	"booking.bumped": newTemplate(
+		"Hood {{.Booking.HoodNumber}} booking cancelled for maintenance",
+		"Hi {{.User.Name}},\n\nSorry, the following booking has been cancelled because the hood is unavailable. Please book another slot.\n"+bookingDetails),
+	"booking.retired": newTemplate(
+		"Hood {{.Booking.HoodNumber}} booking cancelled, hood retired",
+		"Hi {{.User.Name}},\n\nSorry, the following booking has been cancelled because the hood has been taken out of service and it couldn't be moved to another hood. Please book another hood.\n"+bookingDetails),
+	"booking.reminder": newTemplate(
+		"Reminder: hood {{.Booking.HoodNumber}} at {{.Booking.BookingDate.Format \"15:04 Mon 2 Jan\"}}",
+		"Hi {{.User.Name}},\n\nThis is a reminder of your upcoming booking.\n"+bookingDetails),
+	"booking.ending": newTemplate(
+		"Your session on hood {{.Booking.HoodNumber}} ends at {{.Booking.EndDate.Format \"15:04\"}}",
+		"Hi {{.User.Name}},\n\nYour session ends soon, please start clearing down the hood.\n"+bookingDetails),
+}
+
+// newTemplate parses a subject and body template, and panics if either is invalid.
+// It is only used to build the templates map when the package is loaded.
+func newTemplate(subject, body string) emailTemplate {
+	return emailTemplate{
+		subject: template.Must(template.New("subject").Parse(subject)),
+		body:    template.Must(template.New("body").Parse(body)),
+	}
+}
+
+// render takes an event, the user to notify and the booking, and returns the email for that event.
+func render(event string, u *data.User, b *data.Booking) (Message, error) {
+	t, ok := templates[event]
+	if !ok {
+		return Message{}, fmt.Errorf("no template for event %s", event)
+	}
+
+	td := templateData{User: u, Booking: b}
+
+	var subject, body bytes.Buffer
+	if err := t.subject.Execute(&subject, td); err != nil {
+		return Message{}, err
+	}
+	if err := t.body.Execute(&body, td); err != nil {
+		return Message{}, err
+	}
+	return Message{To: u.Email, Subject: subject.String(), Body: body.String()}, nil
+}
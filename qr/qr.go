@@ -0,0 +1,252 @@
+// Package qr encodes short strings, such as TOTP enrolment URIs, as QR codes.
+// Only byte mode with error correction level M and versions 1 to 10 are supported, which is enough for up to 213 bytes.
+package qr
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// blockSpec describes how the codewords of one version are split into error correction blocks at level M.
+type blockSpec struct {
+	total    int // total codewords in the symbol
+	ecPerBlk int // error correction codewords per block
+	blocks1  int // blocks in group 1
+	data1    int // data codewords per group 1 block
+	blocks2  int // blocks in group 2
+	data2    int // data codewords per group 2 block
+}
+
+// specs holds the level M block structure of versions 1 to 10, from ISO/IEC 18004 table 9.
+var specs = [...]blockSpec{
+	1:  {26, 10, 1, 16, 0, 0},
+	2:  {44, 16, 1, 28, 0, 0},
+	3:  {70, 26, 1, 44, 0, 0},
+	4:  {100, 18, 2, 32, 0, 0},
+	5:  {134, 24, 2, 43, 0, 0},
+	6:  {172, 16, 4, 27, 0, 0},
+	7:  {196, 18, 4, 31, 0, 0},
+	8:  {242, 22, 2, 38, 2, 39},
+	9:  {292, 22, 3, 36, 2, 37},
+	10: {346, 26, 4, 43, 1, 44},
+}
+
+// alignment holds the alignment pattern centre coordinates of versions 1 to 10.
+var alignment = [...][]int{
+	1: nil, 2: {6, 18}, 3: {6, 22}, 4: {6, 26}, 5: {6, 30},
+	6: {6, 34}, 7: {6, 22, 38}, 8: {6, 24, 42}, 9: {6, 26, 46}, 10: {6, 28, 50},
+}
+
+// Code is an encoded QR code. Modules are indexed [y][x], and true is a dark module.
+type Code struct {
+	Size    int
+	modules [][]bool
+}
+
+// Encode takes a string and returns the smallest QR code that holds it.
+// An error is returned if the string is too long for version 10.
+func Encode(text string) (*Code, error) {
+	payload := []byte(text)
+
+	version := 0
+	for v := 1; v < len(specs); v++ {
+		if len(payload) <= capacity(v) {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, fmt.Errorf("qr: %d bytes is too long to encode", len(payload))
+	}
+
+	data := dataCodewords(payload, version)
+	all := addErrorCorrection(data, specs[version])
+
+	s := newSymbol(version)
+	s.drawFunctionPatterns()
+	s.drawCodewords(all)
+
+	// try every mask and keep the one with the lowest penalty
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		s.applyMask(mask)
+		s.drawFormatBits(mask)
+		if p := s.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		s.applyMask(mask) // masking twice undoes it
+	}
+	s.applyMask(best)
+	s.drawFormatBits(best)
+
+	return &Code{Size: s.size, modules: s.modules}, nil
+}
+
+// Dark reports whether the module at x, y is dark.
+func (c *Code) Dark(x, y int) bool {
+	return c.modules[y][x]
+}
+
+// PNG returns the QR code as a PNG image, with each module drawn as scale pixels square and the four module quiet zone around it.
+func (c *Code) PNG(scale int) ([]byte, error) {
+	const quiet = 4
+	width := (c.Size + 2*quiet) * scale
+	img := image.NewPaletted(image.Rect(0, 0, width, width), color.Palette{color.White, color.Black})
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex((x+quiet)*scale+dx, (y+quiet)*scale+dy, 1)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// capacity returns how many bytes a version holds in byte mode at level M.
+func capacity(version int) int {
+	sp := specs[version]
+	dataBits := (sp.blocks1*sp.data1 + sp.blocks2*sp.data2) * 8
+	return (dataBits - 4 - countBits(version)) / 8
+}
+
+// countBits returns the length of the byte mode character count indicator for a version.
+func countBits(version int) int {
+	if version <= 9 {
+		return 8
+	}
+	return 16
+}
+
+// dataCodewords builds the data codewords for a payload: the byte mode indicator, the length, the bytes, then the terminator and padding.
+func dataCodewords(payload []byte, version int) []byte {
+	sp := specs[version]
+	capacityBytes := sp.blocks1*sp.data1 + sp.blocks2*sp.data2
+
+	var bits bitBuffer
+	bits.append(0x4, 4)
+	bits.append(len(payload), countBits(version))
+	for _, b := range payload {
+		bits.append(int(b), 8)
+	}
+
+	remaining := capacityBytes*8 - len(bits)
+	if remaining > 4 {
+		remaining = 4
+	}
+	bits.append(0, remaining)
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+	for pad := 0xEC; len(bits) < capacityBytes*8; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+	return bits.bytes()
+}
+
+// addErrorCorrection splits the data codewords into blocks, adds Reed-Solomon error correction to each block and interleaves them.
+func addErrorCorrection(data []byte, sp blockSpec) []byte {
+	divisor := rsDivisor(sp.ecPerBlk)
+
+	var dataBlocks, ecBlocks [][]byte
+	pos := 0
+	for i := 0; i < sp.blocks1+sp.blocks2; i++ {
+		n := sp.data1
+		if i >= sp.blocks1 {
+			n = sp.data2
+		}
+		block := data[pos : pos+n]
+		pos += n
+		dataBlocks = append(dataBlocks, block)
+		ecBlocks = append(ecBlocks, rsRemainder(block, divisor))
+	}
+
+	var out []byte
+	for i := 0; i < sp.data2 || i < sp.data1; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := 0; i < sp.ecPerBlk; i++ {
+		for _, block := range ecBlocks {
+			out = append(out, block[i])
+		}
+	}
+	return out
+}
+
+// bitBuffer is a sequence of bits, most significant first.
+type bitBuffer []bool
+
+// append adds the low n bits of v to the buffer.
+func (b *bitBuffer) append(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, (v>>i)&1 == 1)
+	}
+}
+
+// bytes packs the buffer into bytes. The buffer's length must be a multiple of 8.
+func (b bitBuffer) bytes() []byte {
+	out := make([]byte, len(b)/8)
+	for i, bit := range b {
+		if bit {
+			out[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return out
+}
+
+// gfMultiply multiplies two elements of GF(256) with the QR code field polynomial 0x11D.
+func gfMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// rsDivisor returns the Reed-Solomon generator polynomial of the given degree, without its leading term.
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := 0; j < degree; j++ {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < degree {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+// rsRemainder returns the Reed-Solomon error correction codewords for a block of data.
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coef := range divisor {
+			result[i] ^= gfMultiply(coef, factor)
+		}
+	}
+	return result
+}
@@ -0,0 +1,360 @@
+package qr
+
+import (
+	"bytes"
+	"flag"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden QR code matrices in testdata")
+
+// enrolmentURI is a TOTP enrolment URI of the length the two-factor handler produces, which needs a version 7 symbol.
+const enrolmentURI = "otpauth://totp/Hood%20Booking:ada?algorithm=SHA1&digits=6&issuer=Hood+Booking&period=30&secret=JBSWY3DPEHPK3PXP"
+
+// render draws a code as text, one row per line, with # for dark modules and . for light ones.
+func render(c *Code) string {
+	var b strings.Builder
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.Dark(x, y) {
+				b.WriteByte('#')
+			} else {
+				b.WriteByte('.')
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func TestEncodeMatchesGoldenMatrices(t *testing.T) {
+	for name, text := range map[string]string{
+		"hello.golden":   "hello",
+		"otpauth.golden": enrolmentURI,
+	} {
+		c, err := Encode(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := render(c)
+
+		path := filepath.Join("testdata", name)
+		if *update {
+			if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != string(want) {
+			t.Errorf("Encode(%q) differs from %s:\n%s", text, path, got)
+		}
+	}
+}
+
+func TestGoldenMatricesDecode(t *testing.T) {
+	for name, text := range map[string]string{
+		"hello.golden":   "hello",
+		"otpauth.golden": enrolmentURI,
+	} {
+		golden, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := decode(t, parseMatrix(t, string(golden))); got != text {
+			t.Errorf("%s decodes as %q, want %q", name, got, text)
+		}
+	}
+}
+
+func TestEncodeRoundTripsEveryVersion(t *testing.T) {
+	for version := 1; version < len(specs); version++ {
+		text := strings.Repeat("a", capacity(version))
+		c, err := Encode(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := 17 + 4*version; c.Size != want {
+			t.Errorf("%d bytes encoded at size %d, want version %d (size %d)", len(text), c.Size, version, want)
+		}
+		if got := decode(t, c); got != text {
+			t.Errorf("version %d decodes as %q", version, got)
+		}
+	}
+
+	if _, err := Encode(strings.Repeat("a", capacity(len(specs)-1)+1)); err == nil {
+		t.Error("text too long for version 10 was encoded")
+	}
+}
+
+// TestReedSolomonKnownAnswer checks the error correction of the version 1-M example in ISO/IEC 18004 annex I, which encodes "01234567".
+func TestReedSolomonKnownAnswer(t *testing.T) {
+	data := []byte{0x10, 0x20, 0x0C, 0x56, 0x61, 0x80, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11}
+	want := []byte{0xA5, 0x24, 0xD4, 0xC1, 0xED, 0x36, 0xC7, 0x87, 0x2C, 0x55}
+	if got := rsRemainder(data, rsDivisor(10)); !bytes.Equal(got, want) {
+		t.Errorf("error correction = % X, want % X", got, want)
+	}
+}
+
+// TestFormatAndVersionInformation checks the BCH coded format and version information against the tables in ISO/IEC 18004 annexes C and D.
+func TestFormatAndVersionInformation(t *testing.T) {
+	formats := []string{
+		"101010000010010", "101000100100101", "101111001111100", "101101101001011",
+		"100010111111001", "100000011001110", "100111110010111", "100101010100000",
+	}
+	for mask, want := range formats {
+		s := newSymbol(1)
+		s.drawFormatBits(mask)
+		first, second := readFormatBits(s.modules, s.size)
+		if first != want || second != want {
+			t.Errorf("format information for mask %d = %s and %s, want %s", mask, first, second, want)
+		}
+	}
+
+	versions := map[int]int{7: 0x07C94, 8: 0x085BC, 9: 0x09A99, 10: 0x0A4D3}
+	for version, want := range versions {
+		s := newSymbol(version)
+		s.drawVersion()
+		got := 0
+		for i := 0; i < 18; i++ {
+			if s.modules[i/3][s.size-11+i%3] {
+				got |= 1 << i
+			}
+			if s.modules[i/3][s.size-11+i%3] != s.modules[s.size-11+i%3][i/3] {
+				t.Errorf("version %d: the two copies of bit %d differ", version, i)
+			}
+		}
+		if got != want {
+			t.Errorf("version information for version %d = %#05x, want %#05x", version, got, want)
+		}
+	}
+}
+
+func TestPNGDrawsEveryModule(t *testing.T) {
+	c, err := Encode("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := c.PNG(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if width := (c.Size + 8) * 2; img.Bounds().Dx() != width || img.Bounds().Dy() != width {
+		t.Fatalf("image is %v, want %dx%d", img.Bounds(), width, width)
+	}
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			r, _, _, _ := img.At((x+4)*2+1, (y+4)*2+1).RGBA()
+			if dark := r == 0; dark != c.Dark(x, y) {
+				t.Fatalf("pixel for module %d,%d has the wrong colour", x, y)
+			}
+		}
+	}
+}
+
+// parseMatrix reads a matrix drawn by render back into a Code.
+func parseMatrix(t *testing.T, text string) *Code {
+	t.Helper()
+	rows := strings.Split(strings.TrimSpace(text), "\n")
+	c := &Code{Size: len(rows), modules: make([][]bool, len(rows))}
+	for y, row := range rows {
+		if len(row) != len(rows) {
+			t.Fatalf("row %d of the matrix has %d modules, want %d", y, len(row), len(rows))
+		}
+		c.modules[y] = make([]bool, len(row))
+		for x, m := range row {
+			c.modules[y][x] = m == '#'
+		}
+	}
+	return c
+}
+
+// readFormatBits returns both copies of the format information, most significant bit first.
+// The first copy wraps around the top left finder pattern, and the second is split between the other two.
+func readFormatBits(modules [][]bool, size int) (first, second string) {
+	var positions1, positions2 [][2]int // x, y of bits 0 to 14
+	for i := 0; i <= 5; i++ {
+		positions1 = append(positions1, [2]int{8, i})
+	}
+	positions1 = append(positions1, [2]int{8, 7}, [2]int{8, 8}, [2]int{7, 8})
+	for i := 9; i < 15; i++ {
+		positions1 = append(positions1, [2]int{14 - i, 8})
+	}
+	for i := 0; i < 8; i++ {
+		positions2 = append(positions2, [2]int{size - 1 - i, 8})
+	}
+	for i := 8; i < 15; i++ {
+		positions2 = append(positions2, [2]int{8, size - 15 + i})
+	}
+
+	read := func(positions [][2]int) string {
+		var b strings.Builder
+		for i := 14; i >= 0; i-- {
+			if modules[positions[i][1]][positions[i][0]] {
+				b.WriteByte('1')
+			} else {
+				b.WriteByte('0')
+			}
+		}
+		return b.String()
+	}
+	return read(positions1), read(positions2)
+}
+
+// decode reads a level M byte mode QR code the way a scanner would: it reads the format information, removes the mask,
+// reads the codewords in placement order, checks every block's Reed-Solomon syndromes are zero and returns the decoded text.
+func decode(t *testing.T, c *Code) string {
+	t.Helper()
+	version := (c.Size - 17) / 4
+	if version < 1 || version >= len(specs) || 17+4*version != c.Size {
+		t.Fatalf("size %d is not a supported version", c.Size)
+	}
+
+	format, copy2 := readFormatBits(c.modules, c.Size)
+	if format != copy2 {
+		t.Fatalf("the two copies of the format information differ: %s and %s", format, copy2)
+	}
+	if !c.Dark(8, c.Size-8) {
+		t.Fatal("the dark module is missing")
+	}
+	var formatBits int
+	for _, r := range format {
+		formatBits = formatBits<<1 | int(r-'0')
+	}
+	formatBits ^= 0x5412
+	if level := formatBits >> 13; level != 0 {
+		t.Fatalf("error correction level bits are %02b, want 00 for level M", level)
+	}
+	rem := formatBits >> 10
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	if rem&0x3ff != formatBits&0x3ff {
+		t.Fatalf("format information %s fails its BCH check", format)
+	}
+	mask := formatBits >> 10 & 7
+
+	layout := newSymbol(version)
+	layout.drawFunctionPatterns()
+	masked := func(x, y int) bool {
+		switch mask {
+		case 0:
+			return (x+y)%2 == 0
+		case 1:
+			return y%2 == 0
+		case 2:
+			return x%3 == 0
+		case 3:
+			return (x+y)%3 == 0
+		case 4:
+			return (x/3+y/2)%2 == 0
+		case 5:
+			return x*y%2+x*y%3 == 0
+		case 6:
+			return (x*y%2+x*y%3)%2 == 0
+		default:
+			return ((x+y)%2+x*y%3)%2 == 0
+		}
+	}
+
+	// read the data modules in the upward and downward two column zigzag, skipping the vertical timing pattern
+	var bits bitBuffer
+	upward := true
+	for right := c.Size - 1; right > 0; right -= 2 {
+		if right == 6 {
+			right--
+		}
+		for i := 0; i < c.Size; i++ {
+			y := i
+			if upward {
+				y = c.Size - 1 - i
+			}
+			for _, x := range []int{right, right - 1} {
+				if !layout.isFunction[y][x] {
+					bits = append(bits, c.Dark(x, y) != masked(x, y))
+				}
+			}
+		}
+		upward = !upward
+	}
+
+	sp := specs[version]
+	codewords := bits[:sp.total*8].bytes()
+
+	// undo the interleaving into blocks, then check each block is a Reed-Solomon codeword
+	nBlocks := sp.blocks1 + sp.blocks2
+	blocks := make([][]byte, nBlocks)
+	pos := 0
+	for i := 0; i < sp.data1 || i < sp.data2; i++ {
+		for b := range blocks {
+			size := sp.data1
+			if b >= sp.blocks1 {
+				size = sp.data2
+			}
+			if i < size {
+				blocks[b] = append(blocks[b], codewords[pos])
+				pos++
+			}
+		}
+	}
+	var data []byte
+	for _, block := range blocks {
+		data = append(data, block...)
+	}
+	for i := 0; i < sp.ecPerBlk; i++ {
+		for b := range blocks {
+			blocks[b] = append(blocks[b], codewords[pos])
+			pos++
+		}
+	}
+	for b, block := range blocks {
+		root := byte(1)
+		for i := 0; i < sp.ecPerBlk; i++ {
+			var syndrome byte
+			for _, cw := range block {
+				syndrome = gfMultiply(syndrome, root) ^ cw
+			}
+			if syndrome != 0 {
+				t.Fatalf("block %d has a non-zero syndrome at root %d", b, i)
+			}
+			root = gfMultiply(root, 0x02)
+		}
+	}
+
+	// the data is a byte mode segment followed by the terminator and padding
+	var read bitBuffer
+	for _, d := range data {
+		read.append(int(d), 8)
+	}
+	take := func(n int) int {
+		v := 0
+		for i := 0; i < n; i++ {
+			v <<= 1
+			if read[i] {
+				v |= 1
+			}
+		}
+		read = read[n:]
+		return v
+	}
+	if mode := take(4); mode != 0x4 {
+		t.Fatalf("mode indicator %04b, want byte mode", mode)
+	}
+	n := take(countBits(version))
+	out := make([]byte, n)
+	for i := range out {
+		out[i] = byte(take(8))
+	}
+	return string(out)
+}
@@ -0,0 +1,270 @@
+package qr
+
+// symbol is a QR code while it is being drawn.
+// isFunction marks the finder, timing, alignment, format and version modules, which hold no data and are never masked.
+type symbol struct {
+	version    int
+	size       int
+	modules    [][]bool
+	isFunction [][]bool
+}
+
+// newSymbol returns an empty symbol of the given version.
+func newSymbol(version int) *symbol {
+	size := 17 + 4*version
+	s := &symbol{version: version, size: size}
+	s.modules = make([][]bool, size)
+	s.isFunction = make([][]bool, size)
+	for y := range s.modules {
+		s.modules[y] = make([]bool, size)
+		s.isFunction[y] = make([]bool, size)
+	}
+	return s
+}
+
+// setFunction sets a function module at x, y.
+func (s *symbol) setFunction(x, y int, dark bool) {
+	s.modules[y][x] = dark
+	s.isFunction[y][x] = true
+}
+
+// drawFunctionPatterns draws the timing, finder and alignment patterns, and reserves the format and version areas.
+func (s *symbol) drawFunctionPatterns() {
+	for i := 0; i < s.size; i++ {
+		s.setFunction(6, i, i%2 == 0)
+		s.setFunction(i, 6, i%2 == 0)
+	}
+
+	s.drawFinder(3, 3)
+	s.drawFinder(s.size-4, 3)
+	s.drawFinder(3, s.size-4)
+
+	centres := alignment[s.version]
+	last := len(centres) - 1
+	for i, x := range centres {
+		for j, y := range centres {
+			// skip the three corners that hold finder patterns
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			s.drawAlignment(x, y)
+		}
+	}
+
+	// reserve the format areas with a dummy mask, they are drawn properly once the mask is chosen
+	s.drawFormatBits(0)
+	s.drawVersion()
+}
+
+// drawFinder draws a finder pattern and its separator centred on x, y.
+func (s *symbol) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || xx >= s.size || yy < 0 || yy >= s.size {
+				continue
+			}
+			dist := max(abs(dx), abs(dy))
+			s.setFunction(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+// drawAlignment draws an alignment pattern centred on x, y.
+func (s *symbol) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			s.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// drawFormatBits draws both copies of the format information for level M and the given mask, and the dark module.
+func (s *symbol) drawFormatBits(mask int) {
+	data := 0<<3 | mask // level M is 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+
+	for i := 0; i <= 5; i++ {
+		s.setFunction(8, i, bit(bits, i))
+	}
+	s.setFunction(8, 7, bit(bits, 6))
+	s.setFunction(8, 8, bit(bits, 7))
+	s.setFunction(7, 8, bit(bits, 8))
+	for i := 9; i < 15; i++ {
+		s.setFunction(14-i, 8, bit(bits, i))
+	}
+
+	for i := 0; i < 8; i++ {
+		s.setFunction(s.size-1-i, 8, bit(bits, i))
+	}
+	for i := 8; i < 15; i++ {
+		s.setFunction(8, s.size-15+i, bit(bits, i))
+	}
+	s.setFunction(8, s.size-8, true)
+}
+
+// drawVersion draws both copies of the version information, which only versions 7 and above have.
+func (s *symbol) drawVersion() {
+	if s.version < 7 {
+		return
+	}
+	rem := s.version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	bits := s.version<<12 | rem
+
+	for i := 0; i < 18; i++ {
+		a, b := s.size-11+i%3, i/3
+		s.setFunction(a, b, bit(bits, i))
+		s.setFunction(b, a, bit(bits, i))
+	}
+}
+
+// drawCodewords places the codewords in the zigzag order, skipping function modules.
+func (s *symbol) drawCodewords(codewords []byte) {
+	i := 0
+	for right := s.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < s.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = s.size - 1 - vert
+				}
+				if !s.isFunction[y][x] && i < len(codewords)*8 {
+					s.modules[y][x] = (codewords[i>>3]>>(7-uint(i&7)))&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules selected by the mask pattern. Applying the same mask twice undoes it.
+func (s *symbol) applyMask(mask int) {
+	for y := 0; y < s.size; y++ {
+		for x := 0; x < s.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !s.isFunction[y][x] {
+				s.modules[y][x] = !s.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol with the four rules of ISO/IEC 18004 section 8.8.2. Lower scores are easier to scan.
+func (s *symbol) penalty() int {
+	score := 0
+	get := func(x, y int, rows bool) bool {
+		if rows {
+			return s.modules[y][x]
+		}
+		return s.modules[x][y]
+	}
+
+	for _, rows := range []bool{true, false} {
+		for a := 0; a < s.size; a++ {
+			// rule 1: runs of five or more modules of the same colour
+			run := 1
+			for b := 1; b < s.size; b++ {
+				if get(b, a, rows) == get(b-1, a, rows) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += run - 2
+				}
+				run = 1
+			}
+			if run >= 5 {
+				score += run - 2
+			}
+
+			// rule 3: patterns that look like finder patterns
+			for b := 0; b+11 <= s.size; b++ {
+				var pattern [11]bool
+				for k := range pattern {
+					pattern[k] = get(b+k, a, rows)
+				}
+				if pattern == finderLike1 || pattern == finderLike2 {
+					score += 40
+				}
+			}
+		}
+	}
+
+	// rule 2: 2x2 blocks of the same colour
+	dark := 0
+	for y := 0; y < s.size; y++ {
+		for x := 0; x < s.size; x++ {
+			if s.modules[y][x] {
+				dark++
+			}
+			if x+1 < s.size && y+1 < s.size {
+				c := s.modules[y][x]
+				if c == s.modules[y][x+1] && c == s.modules[y+1][x] && c == s.modules[y+1][x+1] {
+					score += 3
+				}
+			}
+		}
+	}
+
+	// rule 4: how far the proportion of dark modules is from half
+	total := s.size * s.size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	if k > 0 {
+		score += k * 10
+	}
+	return score
+}
+
+// finder-like patterns penalised by rule 3, 1011101 with four light modules on one side.
+var (
+	finderLike1 = [11]bool{true, false, true, true, true, false, true, false, false, false, false}
+	finderLike2 = [11]bool{false, false, false, false, true, false, true, true, true, false, true}
+)
+
+// bit reports whether bit i of v is set.
+func bit(v, i int) bool {
+	return (v>>i)&1 == 1
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -1,18 +1,97 @@
 package session
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 
-	"bookings.com/m/data"
+	"bookings.com/m/config"
 )
 
-// create a map to store tokens in.
-// This is not the safest option, but for this proof of concept works well for verifying that a user has their own token being passed.
-// var SessionTokens = make(map[string]int)
+// default session lifetimes, used when they are not set in the config file.
+const (
+	defaultIdleTimeout = 24 * time.Hour
+	defaultMaxLifetime = 7 * 24 * time.Hour
+)
+
+// names of the cookies set at login, and the header the CSRF token is sent back in.
+const (
+	CookieName     = "session_token"
+	CSRFCookieName = "csrf_token"
+	CSRFHeader     = "X-CSRF-Token"
+)
+
+// IdleTimeout is how long a session lasts without being used, and MaxLifetime is the longest a session can last however often it is used.
+// They are set from the config file by Configure when the server starts.
+var (
+	IdleTimeout = defaultIdleTimeout
+	MaxLifetime = defaultMaxLifetime
+)
+
+// tokenKey is the secret session tokens are hashed with before they are stored, so a copy of the database can't be used to take over sessions.
+// Until Configure sets it from the config file it is random, and sessions stop working when the server restarts.
+var tokenKey = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+// cookieSameSite and cookieSecure are the attributes given to the session and CSRF cookies.
+var (
+	cookieSameSite = http.SameSiteLaxMode
+	cookieSecure   = false
+)
+
+// Configure takes the sessions section of the config file and sets IdleTimeout, MaxLifetime, the token key and the cookie attributes, keeping the defaults for any value that is not set.
+// It returns false if no token key is set, in which case a random key is used.
+func Configure(cfg config.Sessions) bool {
+	if cfg.IdleTimeoutMinutes > 0 {
+		IdleTimeout = time.Duration(cfg.IdleTimeoutMinutes) * time.Minute
+	}
+	if cfg.MaxLifetimeHours > 0 {
+		MaxLifetime = time.Duration(cfg.MaxLifetimeHours) * time.Hour
+	}
+
+	switch strings.ToLower(cfg.CookieSameSite) {
+	case "strict":
+		cookieSameSite = http.SameSiteStrictMode
+	case "none":
+		// browsers refuse SameSite=None cookies that aren't also Secure
+		cookieSameSite = http.SameSiteNoneMode
+		cfg.CookieSecure = true
+	default:
+		cookieSameSite = http.SameSiteLaxMode
+	}
+	cookieSecure = cfg.CookieSecure
+
+	if cfg.TokenKey == "" {
+		return false
+	}
+	tokenKey = []byte(cfg.TokenKey)
+	return true
+}
+
+// hashToken returns the keyed hash of a session token, which is what is stored in the sessiontokens table in place of the token.
+func hashToken(token string) string {
+	return keyedHash("session", token)
+}
+
+// keyedHash returns the hex HMAC-SHA256 of a value under the token key. The purpose keeps hashes made for different uses apart.
+func keyedHash(purpose, value string) string {
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte(purpose + "\x00" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
 
 // GenerateSecureToken takes in a length (desired length of secure token) as an int and returns a string and an error.
 // a slice of bytes of the given length is instantiated.
@@ -26,52 +105,279 @@ func GenerateSecureToken(length int) (string, error) {
 	}
 }
 
+// Session describes one of a user's logged in devices.
+// The token itself is never included, so sessions can be listed without exposing them.
+type Session struct {
+	ID          int       `json:"id"`
+	DeviceLabel string    `json:"device_label"`
+	UserAgent   string    `json:"user_agent"`
+	IPAddress   string    `json:"ip_address"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Current     bool      `json:"current"`
+}
+
+// SessionsList is a type defined to characterise an array of the Session struct type variables.
+type SessionsList []*Session
+
+// ToJSON can be used on SessionsList type variables.
+// It takes in an io.Writer parameter and encodes the sessions to the io.Writer.
+func (sl *SessionsList) ToJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(sl)
+}
+
+// CreateSession takes a user ID, the http Request the user logged in with, an optional device label and a sql DB connection, and returns a new session token for that user and an error.
+// The session is stored in the sessiontokens table with the device label, user agent and IP address, and its creation time, last seen time and expiry time.
+// Only a keyed hash of the token is stored. Users can have several sessions at once, one per device.
+func CreateSession(userID int, r *http.Request, deviceLabel string, db *sql.DB) (string, error) {
+	token, err := GenerateSecureToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec(`INSERT INTO sessiontokens (token_hash, user_id, device_label, user_agent, ip_address, created_at, last_seen_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, NOW(), NOW(), NOW() + $6 * INTERVAL '1 second');`,
+		hashToken(token), userID, deviceLabel, r.UserAgent(), ClientIP(r), IdleTimeout.Seconds())
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// trustedProxies are the reverse proxies whose X-Forwarded-For header is believed, set by ConfigureProxies.
+// Until then no proxy is trusted, so the header can't be used to dodge the per-IP limits.
+var trustedProxies []*net.IPNet
+
+// ConfigureProxies takes the trusted_proxies list from the server section of the config file, IP addresses or CIDR ranges, and trusts the X-Forwarded-For header of requests from them.
+// An error is returned, and no proxy is trusted, if any entry isn't an IP address or CIDR range.
+func ConfigureProxies(proxies []string) error {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				trustedProxies = nil
+				return fmt.Errorf("trusted proxy %q is not an IP address or CIDR range", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			trustedProxies = nil
+			return fmt.Errorf("trusted proxy %q is not an IP address or CIDR range", p)
+		}
+		nets = append(nets, n)
+	}
+	trustedProxies = nets
+	return nil
+}
+
+// isTrustedProxy reports whether an IP address is one of the trusted proxies.
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP takes an http Request and returns the IP address it was sent from, without the port.
+// If the request came through a trusted proxy, the X-Forwarded-For header is read from the right, skipping the trusted proxies, and the first address that isn't one is the client.
+// Addresses further left were added by the client itself, so they are never believed.
+func ClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// ListSessions takes a user ID, the token of the current request and a sql DB connection, and returns every session of the user that has not expired, most recently used first.
+// The session belonging to the current token is marked as current.
+func ListSessions(userID int, currentToken string, db *sql.DB) (SessionsList, error) {
+	rows, err := db.Query(`SELECT id, device_label, user_agent, ip_address, created_at, last_seen_at, expires_at, token_hash = $2
+		FROM sessiontokens WHERE user_id = $1 AND expires_at > NOW() ORDER BY last_seen_at DESC;`, userID, hashToken(currentToken))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := SessionsList{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.DeviceLabel, &s.UserAgent, &s.IPAddress, &s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &s.Current); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &s)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSessionByID takes a user ID, a session ID and a sql DB connection and deletes that session, as long as it belongs to the user.
+// If the user has no session with that ID, the structured ErrSessionNotFound is returned.
+func RevokeSessionByID(userID, id int, db *sql.DB) error {
+	res, err := db.Exec("DELETE FROM sessiontokens WHERE id = $1 AND user_id = $2;", id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeOtherSessions takes a user ID, the token of the current request and a sql DB connection, and deletes every session of the user except the current one.
+func RevokeOtherSessions(userID int, currentToken string, db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM sessiontokens WHERE user_id = $1 AND token_hash <> $2;", userID, hashToken(currentToken))
+	return err
+}
+
 // UserTokenAuthentication takes a token as a string and returns an int.
 // This function is used to ensure that the user attempting a PUT http request is editing their own user object and not someone elses.
 // The verification of the ID is performed in the relevant handler file on the ID that is returned from this function.
+// Expired sessions are rejected. Each successful use renews the session for another IdleTimeout, up to MaxLifetime after it was created.
 func UserTokenAuthentication(token string, db *sql.DB) int {
-	// Query the db for the token, if present return the id, otherwise return -1
-
-	rows, err := db.Query("SELECT user_id FROM sessiontokens WHERE token = $1;", token)
+	// Update the session if it has not expired and return the id, otherwise return -1
+	var userID int
+	err := db.QueryRow(`UPDATE sessiontokens
+		SET last_seen_at = NOW(), expires_at = LEAST(NOW() + $2 * INTERVAL '1 second', created_at + $3 * INTERVAL '1 second')
+		WHERE token_hash = $1 AND expires_at > NOW()
+		RETURNING user_id;`, hashToken(token), IdleTimeout.Seconds(), MaxLifetime.Seconds()).Scan(&userID)
 	if err != nil {
 		return -1
 	}
+	return userID
+}
 
-	for rows.Next() {
-		var user data.User
-		err := rows.Scan(&user.ID)
-		if err != nil {
-			return -1
-		} else {
-			return user.ID
-		}
-	}
-	return -1
+// RevokeSession takes a token and a sql DB connection and deletes the session, so the token can no longer be used.
+func RevokeSession(token string, db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM sessiontokens WHERE token_hash = $1;", hashToken(token))
+	return err
+}
+
+// RevokeAllSessions takes a user ID and a sql DB connection and deletes every session the user has, logging them out everywhere.
+func RevokeAllSessions(userID int, db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM sessiontokens WHERE user_id = $1;", userID)
+	return err
+}
 
+// DeleteExpiredSessions takes a sql DB connection, deletes every session that has expired and returns how many were deleted.
+func DeleteExpiredSessions(db *sql.DB) (int64, error) {
+	res, err := db.Exec("DELETE FROM sessiontokens WHERE expires_at <= NOW();")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
 
 // StoreCookie takes an HTTP ResponseWriter and a token as a string as parameters.
 // This function stores the token as an http.Cookie struct.
 // The cookie is then set to the ResponseWriters header.
+// The cookie lasts for MaxLifetime, as the session itself may be renewed up to that point. Expiry before then is enforced by UserTokenAuthentication.
+// The session's CSRF token is stored alongside it in a cookie scripts can read, and also returned in the X-CSRF-Token header.
 func StoreCookie(rw http.ResponseWriter, token string) {
+	expires := time.Now().Add(MaxLifetime)
 	cookie := http.Cookie{
-		Name:     "session_token",
+		Name:     CookieName,
 		Value:    token,
 		Path:     "/",
-		Expires:  time.Now().Add(24 * time.Hour),
+		Expires:  expires,
 		HttpOnly: true,
+		Secure:   cookieSecure,
+		SameSite: cookieSameSite,
 	}
+	http.SetCookie(rw, &cookie)
+
+	csrf := CSRFToken(token)
+	http.SetCookie(rw, &http.Cookie{
+		Name:     CSRFCookieName,
+		Value:    csrf,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   cookieSecure,
+		SameSite: cookieSameSite,
+	})
+	rw.Header().Set(CSRFHeader, csrf)
+}
 
+// ClearCookie takes an HTTP ResponseWriter and tells the client to delete its session and CSRF cookies.
+func ClearCookie(rw http.ResponseWriter) {
+	cookie := http.Cookie{
+		Name:     CookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   cookieSecure,
+		SameSite: cookieSameSite,
+	}
 	http.SetCookie(rw, &cookie)
+
+	http.SetCookie(rw, &http.Cookie{Name: CSRFCookieName, Path: "/", MaxAge: -1, Secure: cookieSecure, SameSite: cookieSameSite})
+}
+
+// CSRFToken takes a session token and returns the CSRF token that goes with it.
+// It is derived from the session token with the token key, so it doesn't need storing and can't be forged for another session.
+func CSRFToken(token string) string {
+	return keyedHash("csrf", token)
+}
+
+// CheckCSRF takes an http Request and its session token, and reports whether the request carries the session's CSRF token in the X-CSRF-Token header.
+// Another site can make a browser send the session cookie, but can't read the CSRF cookie to copy it into the header.
+func CheckCSRF(r *http.Request, token string) bool {
+	sent := r.Header.Get(CSRFHeader)
+	if sent == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(sent), []byte(CSRFToken(token))) == 1
+}
+
+// SafeMethod reports whether an HTTP method only reads, so requests using it don't need a CSRF token.
+func SafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
 }
 
 // RetrieveCookie takes an http Request as a parameter anf returns a string.
 // This function attempts to retrieve the set cookie from the http request.
 // The value of the cookie is returned if there is no error, otherwise an empty string is returned.
 func RetrieveCookie(r *http.Request) string {
-	cookie, err := r.Cookie("session_token")
+	cookie, err := r.Cookie(CookieName)
 	if err != nil {
 		return ""
 	}
 	return cookie.Value
 }
+
+// create structured error
+var ErrSessionNotFound = fmt.Errorf("session not found")
@@ -0,0 +1,144 @@
+package sso
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// BER identifier octets used by LDAP messages.
+// Only the small subset of BER that LDAP needs is supported: single octet tags and definite lengths.
+const (
+	berClassApplication = 0x40
+	berClassContext     = 0x80
+	berConstructed      = 0x20
+
+	berTagBoolean     = 0x01
+	berTagInteger     = 0x02
+	berTagOctetString = 0x04
+	berTagEnumerated  = 0x0a
+	berTagSequence    = 0x30
+	berTagSet         = 0x31
+)
+
+// maxBERLength is the largest element that will be read from the directory, which stops a broken server exhausting memory.
+const maxBERLength = 1 << 20
+
+// berElement is one decoded BER element. The value of a constructed element holds its encoded children.
+type berElement struct {
+	tag   byte
+	value []byte
+}
+
+// berEncode takes a tag and the contents of an element, and returns the encoded element.
+func berEncode(tag byte, value []byte) []byte {
+	out := []byte{tag}
+	n := len(value)
+	if n < 0x80 {
+		out = append(out, byte(n))
+	} else {
+		var length []byte
+		for ; n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		out = append(out, 0x80|byte(len(length)))
+		out = append(out, length...)
+	}
+	return append(out, value...)
+}
+
+// berConstruct takes a tag and already encoded children, and returns the constructed element holding them.
+func berConstruct(tag byte, children ...[]byte) []byte {
+	return berEncode(tag, bytes.Join(children, nil))
+}
+
+// berString returns an encoded octet string, or another primitive string type when given a different tag.
+func berString(tag byte, s string) []byte {
+	return berEncode(tag, []byte(s))
+}
+
+// berInt takes a tag and a non-negative integer, and returns the encoded integer or enumerated value.
+func berInt(tag byte, v int) []byte {
+	b := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return berEncode(tag, b)
+}
+
+// berBool returns an encoded boolean.
+func berBool(v bool) []byte {
+	if v {
+		return berEncode(berTagBoolean, []byte{0xff})
+	}
+	return berEncode(berTagBoolean, []byte{0x00})
+}
+
+// readBER reads one complete BER element from r.
+func readBER(r *bufio.Reader) (berElement, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return berElement{}, err
+	}
+	if tag&0x1f == 0x1f {
+		return berElement{}, fmt.Errorf("ldap: multi-octet BER tags are not supported")
+	}
+
+	first, err := r.ReadByte()
+	if err != nil {
+		return berElement{}, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		octets := int(first &^ 0x80)
+		if octets == 0 || octets > 4 {
+			return berElement{}, fmt.Errorf("ldap: unsupported BER length")
+		}
+		length = 0
+		for i := 0; i < octets; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return berElement{}, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxBERLength {
+		return berElement{}, fmt.Errorf("ldap: BER element of %d bytes is too large", length)
+	}
+
+	value := make([]byte, length)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return berElement{}, err
+	}
+	return berElement{tag, value}, nil
+}
+
+// children decodes the elements held in a constructed element.
+func (e berElement) children() ([]berElement, error) {
+	var out []berElement
+	r := bufio.NewReader(bytes.NewReader(e.value))
+	for {
+		child, err := readBER(r)
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, child)
+	}
+}
+
+// int returns the value of an integer or enumerated element.
+func (e berElement) int() int {
+	v := 0
+	for _, b := range e.value {
+		v = v<<8 | int(b)
+	}
+	return v
+}
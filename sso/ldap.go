@@ -0,0 +1,442 @@
+package sso
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"bookings.com/m/config"
+	"bookings.com/m/data"
+)
+
+// LDAP result codes and protocol operation tags used by the client.
+const (
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+
+	ldapBindRequest       = berClassApplication | berConstructed | 0
+	ldapBindResponse      = berClassApplication | berConstructed | 1
+	ldapUnbindRequest     = berClassApplication | 2
+	ldapSearchRequest     = berClassApplication | berConstructed | 3
+	ldapSearchEntry       = berClassApplication | berConstructed | 4
+	ldapSearchDone        = berClassApplication | berConstructed | 5
+	ldapSearchReference   = berClassApplication | berConstructed | 19
+	ldapExtendedRequest   = berClassApplication | berConstructed | 23
+	ldapExtendedResponse  = berClassApplication | berConstructed | 24
+	ldapExtendedName      = berClassContext | 0
+	ldapSimpleAuth        = berClassContext | 0
+	ldapFilterEquality    = berClassContext | berConstructed | 3
+	ldapFilterPresent     = berClassContext | 7
+	ldapScopeBaseObject   = 0
+	ldapScopeWholeSubtree = 2
+
+	// ldapStartTLSOID names the StartTLS extended operation from RFC 4511.
+	ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+)
+
+// LDAP authenticates users with a simple bind against the institute directory.
+// Dial opens the connection to the directory, and can be replaced to point the authenticator at a mock server.
+// TLSConfig is used for ldaps:// connections and StartTLS. If it is nil the system's trusted roots are used, and the server name is always taken from the URL unless TLSConfig sets one.
+type LDAP struct {
+	cfg       config.LDAP
+	Dial      func(ctx context.Context) (net.Conn, error)
+	TLSConfig *tls.Config
+}
+
+// NewLDAP takes the LDAP section of the config file and returns an LDAP authenticator that dials the configured URL.
+// The user attribute defaults to "uid", the subject attribute to "entryUUID", the email attribute to "mail" and the timeout to 10 seconds.
+func NewLDAP(cfg config.LDAP) *LDAP {
+	if cfg.UserAttribute == "" {
+		cfg.UserAttribute = "uid"
+	}
+	if cfg.SubjectAttribute == "" {
+		cfg.SubjectAttribute = "entryUUID"
+	}
+	if cfg.EmailAttribute == "" {
+		cfg.EmailAttribute = "mail"
+	}
+	if cfg.TimeoutSeconds <= 0 {
+		cfg.TimeoutSeconds = 10
+	}
+
+	l := &LDAP{cfg: cfg}
+	l.Dial = l.dialURL
+	return l
+}
+
+// Name returns "ldap", the provider name used in login requests and stored against provisioned users.
+func (l *LDAP) Name() string {
+	return "ldap"
+}
+
+// Authenticate takes a username and password and checks them with a bind against the directory, returning the user's identity.
+// Empty passwords are always refused, as many directories treat a bind with no password as an anonymous bind that succeeds.
+// With StartTLS set, the connection is upgraded to TLS before anything else is sent, and the login fails if the directory won't do so.
+// The user is identified by the subject attribute rather than their uid, as uids can be given to someone else after a user leaves.
+func (l *LDAP) Authenticate(ctx context.Context, username, password string) (*data.ExternalIdentity, error) {
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	if l.cfg.StartTLS && strings.HasPrefix(l.cfg.URL, "ldaps:") {
+		return nil, fmt.Errorf("ldap: start_tls can't be used with an ldaps:// URL")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(l.cfg.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	nc, err := l.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+	conn := &ldapConn{c: nc, r: bufio.NewReader(nc)}
+	defer conn.close()
+
+	if l.cfg.StartTLS {
+		tlsConfig, err := l.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.startTLS(ctx, tlsConfig); err != nil {
+			return nil, fmt.Errorf("ldap: StartTLS failed: %w", err)
+		}
+	}
+
+	attrs := []string{l.cfg.UserAttribute, l.cfg.SubjectAttribute, l.cfg.EmailAttribute}
+	if l.cfg.GroupAttribute != "" {
+		attrs = append(attrs, l.cfg.GroupAttribute)
+	}
+
+	var entry *ldapEntry
+	if l.cfg.UserDNTemplate != "" {
+		// bind straight in as the user, then read their own entry
+		dn := fmt.Sprintf(l.cfg.UserDNTemplate, escapeDN(username))
+		if err := conn.bind(dn, password); err != nil {
+			return nil, err
+		}
+		entries, err := conn.search(dn, ldapScopeBaseObject, berString(ldapFilterPresent, "objectClass"), attrs)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) != 1 {
+			return nil, fmt.Errorf("ldap: could not read the entry for %s", dn)
+		}
+		entry = entries[0]
+	} else {
+		// find the user's entry, then bind as it to check the password
+		if l.cfg.BindDN != "" {
+			if err := conn.bind(l.cfg.BindDN, l.cfg.BindPassword); err != nil {
+				return nil, fmt.Errorf("ldap: service account bind failed: %w", err)
+			}
+		}
+		filter := berConstruct(ldapFilterEquality, berString(berTagOctetString, l.cfg.UserAttribute), berString(berTagOctetString, username))
+		entries, err := conn.search(l.cfg.BaseDN, ldapScopeWholeSubtree, filter, attrs)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) != 1 {
+			return nil, ErrInvalidCredentials
+		}
+		entry = entries[0]
+		if err := conn.bind(entry.dn, password); err != nil {
+			return nil, err
+		}
+	}
+
+	name := entry.first(l.cfg.UserAttribute)
+	if name == "" {
+		name = username
+	}
+	subject := subjectValue(entry.first(l.cfg.SubjectAttribute))
+	if subject == "" {
+		return nil, fmt.Errorf("%w: the entry for %s has no %s attribute", ErrProviderError, entry.dn, l.cfg.SubjectAttribute)
+	}
+	identity := &data.ExternalIdentity{
+		Provider: l.Name(),
+		Subject:  subject,
+		// users were stored under their lowercased uid before the subject attribute was used
+		LegacySubject: strings.ToLower(name),
+		Name:          name,
+		Email:         entry.first(l.cfg.EmailAttribute),
+	}
+	if l.cfg.GroupAttribute != "" {
+		identity.ResearchGroup = mapGroup(entry.first(l.cfg.GroupAttribute), l.cfg.GroupMap)
+	}
+	return identity, nil
+}
+
+// dialURL opens a connection to the configured ldap:// or ldaps:// URL.
+func (l *LDAP) dialURL(ctx context.Context) (net.Conn, error) {
+	u, err := url.Parse(l.cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	var d net.Dialer
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		return d.DialContext(ctx, "tcp", host)
+	case "ldaps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		tlsConfig, err := l.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		td := tls.Dialer{NetDialer: &d, Config: tlsConfig}
+		return td.DialContext(ctx, "tcp", host)
+	}
+	return nil, fmt.Errorf("ldap: unsupported URL scheme %q", u.Scheme)
+}
+
+// tlsConfig returns the TLS settings for the directory, with the server name taken from the URL unless TLSConfig already sets one.
+func (l *LDAP) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if l.TLSConfig != nil {
+		cfg = l.TLSConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		u, err := url.Parse(l.cfg.URL)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ServerName = u.Hostname()
+	}
+	return cfg, nil
+}
+
+// subjectValue returns an attribute value as it is stored as a user's subject.
+// Text values such as entryUUID are kept as they are, while binary values such as Active Directory's objectGUID are hex encoded.
+func subjectValue(v string) string {
+	for _, r := range v {
+		if r == unicode.ReplacementChar || !unicode.IsPrint(r) {
+			return hex.EncodeToString([]byte(v))
+		}
+	}
+	return v
+}
+
+// ldapEntry is one entry returned by a search, with its attribute values.
+type ldapEntry struct {
+	dn    string
+	attrs map[string][]string
+}
+
+// first returns the first value of an attribute, or an empty string if the entry doesn't have it.
+// Attribute names are matched without regard to case, as they are in LDAP.
+func (e *ldapEntry) first(attr string) string {
+	if vals := e.attrs[strings.ToLower(attr)]; len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+// ldapConn is a connection to the directory, which sends one request at a time.
+type ldapConn struct {
+	c     net.Conn
+	r     *bufio.Reader
+	msgID int
+}
+
+// send wraps a protocol operation in an LDAPMessage with the next message ID and writes it to the connection.
+func (c *ldapConn) send(op []byte) error {
+	c.msgID++
+	_, err := c.c.Write(berConstruct(berTagSequence, berInt(berTagInteger, c.msgID), op))
+	return err
+}
+
+// receive reads the next LDAPMessage for the current request and returns its protocol operation.
+func (c *ldapConn) receive() (berElement, error) {
+	for {
+		msg, err := readBER(c.r)
+		if err != nil {
+			return berElement{}, err
+		}
+		parts, err := msg.children()
+		if err != nil || msg.tag != berTagSequence || len(parts) < 2 {
+			return berElement{}, fmt.Errorf("ldap: malformed message from server")
+		}
+		// skip unsolicited notifications, which use message ID 0
+		if parts[0].int() == c.msgID {
+			return parts[1], nil
+		}
+	}
+}
+
+// startTLS asks the directory to start TLS with the StartTLS extended operation, and then replaces the connection with a TLS connection over it.
+func (c *ldapConn) startTLS(ctx context.Context, cfg *tls.Config) error {
+	if err := c.send(berConstruct(ldapExtendedRequest, berString(ldapExtendedName, ldapStartTLSOID))); err != nil {
+		return err
+	}
+
+	op, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapExtendedResponse {
+		return fmt.Errorf("ldap: unexpected response to StartTLS")
+	}
+	if err := ldapResultError(op); err != nil {
+		return err
+	}
+
+	tc := tls.Client(c.c, cfg)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return err
+	}
+	c.c = tc
+	c.r = bufio.NewReader(tc)
+	return nil
+}
+
+// bind sends a simple bind request and returns ErrInvalidCredentials if the directory rejects the password.
+func (c *ldapConn) bind(dn, password string) error {
+	err := c.send(berConstruct(ldapBindRequest,
+		berInt(berTagInteger, 3),
+		berString(berTagOctetString, dn),
+		berString(ldapSimpleAuth, password),
+	))
+	if err != nil {
+		return err
+	}
+
+	op, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapBindResponse {
+		return fmt.Errorf("ldap: unexpected response to bind")
+	}
+	return ldapResultError(op)
+}
+
+// search sends a search request and returns every entry it finds.
+func (c *ldapConn) search(base string, scope int, filter []byte, attrs []string) ([]*ldapEntry, error) {
+	attrList := make([][]byte, len(attrs))
+	for i, a := range attrs {
+		attrList[i] = berString(berTagOctetString, a)
+	}
+
+	err := c.send(berConstruct(ldapSearchRequest,
+		berString(berTagOctetString, base),
+		berInt(berTagEnumerated, scope),
+		berInt(berTagEnumerated, 0), // never dereference aliases
+		berInt(berTagInteger, 2),    // two entries is enough to know the result isn't unique
+		berInt(berTagInteger, 0),
+		berBool(false),
+		filter,
+		berConstruct(berTagSequence, attrList...),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*ldapEntry
+	for {
+		op, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case ldapSearchEntry:
+			entry, err := parseEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case ldapSearchReference:
+			// referrals to other servers are not followed
+		case ldapSearchDone:
+			if err := ldapResultError(op); err != nil {
+				return nil, err
+			}
+			return entries, nil
+		default:
+			return nil, fmt.Errorf("ldap: unexpected response to search")
+		}
+	}
+}
+
+// close sends an unbind request and closes the connection.
+func (c *ldapConn) close() {
+	c.send(berEncode(ldapUnbindRequest, nil))
+	c.c.Close()
+}
+
+// parseEntry decodes a SearchResultEntry into an ldapEntry.
+func parseEntry(op berElement) (*ldapEntry, error) {
+	parts, err := op.children()
+	if err != nil || len(parts) < 2 {
+		return nil, fmt.Errorf("ldap: malformed search entry")
+	}
+	entry := &ldapEntry{dn: string(parts[0].value), attrs: map[string][]string{}}
+
+	attrs, err := parts[1].children()
+	if err != nil {
+		return nil, fmt.Errorf("ldap: malformed search entry")
+	}
+	for _, attr := range attrs {
+		fields, err := attr.children()
+		if err != nil || len(fields) < 2 {
+			return nil, fmt.Errorf("ldap: malformed search entry")
+		}
+		vals, err := fields[1].children()
+		if err != nil {
+			return nil, fmt.Errorf("ldap: malformed search entry")
+		}
+		name := strings.ToLower(string(fields[0].value))
+		for _, v := range vals {
+			entry.attrs[name] = append(entry.attrs[name], string(v.value))
+		}
+	}
+	return entry, nil
+}
+
+// ldapResultError takes an LDAPResult and returns nil if it succeeded, ErrInvalidCredentials for a rejected bind, or an error holding the server's message.
+func ldapResultError(op berElement) error {
+	parts, err := op.children()
+	if err != nil || len(parts) < 3 {
+		return fmt.Errorf("ldap: malformed result from server")
+	}
+	switch code := parts[0].int(); code {
+	case ldapSuccess:
+		return nil
+	case ldapInvalidCredentials:
+		return ErrInvalidCredentials
+	default:
+		return fmt.Errorf("%w: ldap result %d: %s", ErrProviderError, code, parts[2].value)
+	}
+}
+
+// escapeDN escapes a value so it can be placed in a distinguished name, as described in RFC 4514.
+func escapeDN(value string) string {
+	var b strings.Builder
+	for i, r := range value {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, r),
+			r == '#' && i == 0,
+			r == ' ' && (i == 0 || i == len(value)-1):
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
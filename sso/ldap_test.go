@@ -0,0 +1,418 @@
+package sso
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"bookings.com/m/config"
+)
+
+// mockDirectory is an LDAP server holding a fixed set of entries, which the LDAP authenticator talks to through its Dial function.
+type mockDirectory struct {
+	t         *testing.T
+	entries   map[string]map[string][]string // attributes by DN
+	passwords map[string]string              // passwords by DN
+	tlsConfig *tls.Config                    // if set, StartTLS is offered and must be used before any bind
+	searches  []mockSearch
+}
+
+// mockSearch records what a search asked the directory for.
+type mockSearch struct {
+	base   string
+	filter string
+	attrs  []string
+}
+
+// dial returns a Dial function that serves each connection from the mock directory.
+func (d *mockDirectory) dial(ctx context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	go d.serve(server)
+	return client, nil
+}
+
+// serve answers requests on one connection until the client unbinds or hangs up.
+func (d *mockDirectory) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	secure := false
+
+	for {
+		msg, err := readBER(r)
+		if err != nil {
+			return
+		}
+		parts, err := msg.children()
+		if err != nil || len(parts) < 2 {
+			d.t.Errorf("malformed LDAPMessage from client")
+			return
+		}
+		id := parts[0].int()
+		op := parts[1]
+		reply := func(op []byte) {
+			conn.Write(berConstruct(berTagSequence, berInt(berTagInteger, id), op))
+		}
+
+		switch op.tag {
+		case ldapExtendedRequest:
+			fields, _ := op.children()
+			if d.tlsConfig == nil || len(fields) == 0 || string(fields[0].value) != ldapStartTLSOID {
+				reply(ldapResult(ldapExtendedResponse, 2, "unsupported extended operation"))
+				continue
+			}
+			reply(ldapResult(ldapExtendedResponse, ldapSuccess, ""))
+			tc := tls.Server(conn, d.tlsConfig)
+			if err := tc.Handshake(); err != nil {
+				// the client refused the certificate
+				return
+			}
+			conn, r, secure = tc, bufio.NewReader(tc), true
+		case ldapBindRequest:
+			if d.tlsConfig != nil && !secure {
+				reply(ldapResult(ldapBindResponse, 13, "confidentiality required"))
+				continue
+			}
+			fields, _ := op.children()
+			dn, password := string(fields[1].value), string(fields[2].value)
+			if want, ok := d.passwords[dn]; !ok || want != password {
+				reply(ldapResult(ldapBindResponse, ldapInvalidCredentials, "invalid credentials"))
+				continue
+			}
+			reply(ldapResult(ldapBindResponse, ldapSuccess, ""))
+		case ldapSearchRequest:
+			fields, _ := op.children()
+			search := mockSearch{base: string(fields[0].value)}
+			for _, a := range mustChildren(d.t, fields[7]) {
+				search.attrs = append(search.attrs, string(a.value))
+			}
+			var match func(dn string, attrs map[string][]string) bool
+			switch filter := fields[6]; filter.tag {
+			case ldapFilterPresent:
+				search.filter = "(" + string(filter.value) + "=*)"
+				match = func(dn string, attrs map[string][]string) bool { return dn == search.base }
+			case ldapFilterEquality:
+				ava := mustChildren(d.t, filter)
+				attr, value := string(ava[0].value), string(ava[1].value)
+				search.filter = "(" + attr + "=" + value + ")"
+				// uid and mail match without regard to case in real directories
+				match = func(dn string, attrs map[string][]string) bool {
+					return strings.HasSuffix(dn, search.base) && len(attrs[attr]) > 0 && strings.EqualFold(attrs[attr][0], value)
+				}
+			default:
+				d.t.Errorf("unexpected filter tag %#x", filter.tag)
+				return
+			}
+			d.searches = append(d.searches, search)
+			for dn, attrs := range d.entries {
+				if match(dn, attrs) {
+					reply(searchEntry(dn, attrs, search.attrs))
+				}
+			}
+			reply(ldapResult(ldapSearchDone, ldapSuccess, ""))
+		case ldapUnbindRequest:
+			return
+		default:
+			d.t.Errorf("unexpected operation %#x", op.tag)
+			return
+		}
+	}
+}
+
+func mustChildren(t *testing.T, e berElement) []berElement {
+	children, err := e.children()
+	if err != nil {
+		t.Fatalf("malformed BER from client: %s", err)
+	}
+	return children
+}
+
+// ldapResult encodes an LDAPResult with the given operation tag, result code and message.
+func ldapResult(tag byte, code int, message string) []byte {
+	return berConstruct(tag, berInt(berTagEnumerated, code), berString(berTagOctetString, ""), berString(berTagOctetString, message))
+}
+
+// searchEntry encodes a SearchResultEntry holding the requested attributes of an entry.
+func searchEntry(dn string, attrs map[string][]string, requested []string) []byte {
+	var list [][]byte
+	for _, name := range requested {
+		vals, ok := attrs[name]
+		if !ok {
+			continue
+		}
+		var encoded [][]byte
+		for _, v := range vals {
+			encoded = append(encoded, berString(berTagOctetString, v))
+		}
+		list = append(list, berConstruct(berTagSequence, berString(berTagOctetString, name), berConstruct(berTagSet, encoded...)))
+	}
+	return berConstruct(ldapSearchEntry, berString(berTagOctetString, dn), berConstruct(berTagSequence, list...))
+}
+
+const adaDN = "uid=ada,ou=people,dc=example,dc=org"
+
+func newMockDirectory(t *testing.T) *mockDirectory {
+	return &mockDirectory{
+		t: t,
+		entries: map[string]map[string][]string{
+			adaDN: {
+				"uid":       {"Ada"},
+				"entryUUID": {"5f1c2a9e-8d3b-4c71-9e0a-2b6f4d8c1e37"},
+				"mail":      {"ada@example.org"},
+				"ou":        {"chem-org"},
+			},
+			"cn=bookings,ou=services,dc=example,dc=org": {},
+		},
+		passwords: map[string]string{
+			adaDN: "correct horse",
+			"cn=bookings,ou=services,dc=example,dc=org": "service secret",
+		},
+	}
+}
+
+func newTestLDAP(d *mockDirectory, cfg config.LDAP) *LDAP {
+	if cfg.URL == "" {
+		cfg.URL = "ldap://directory.test"
+	}
+	l := NewLDAP(cfg)
+	l.Dial = d.dial
+	return l
+}
+
+func TestLDAPSearchesThenBindsAsTheUser(t *testing.T) {
+	d := newMockDirectory(t)
+	l := newTestLDAP(d, config.LDAP{
+		BaseDN:         "dc=example,dc=org",
+		BindDN:         "cn=bookings,ou=services,dc=example,dc=org",
+		BindPassword:   "service secret",
+		GroupAttribute: "ou",
+		GroupMap:       map[string]string{"chem-org": "Organic Synthesis"},
+	})
+
+	identity, err := l.Authenticate(context.Background(), "ada", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Provider != "ldap" || identity.Name != "Ada" || identity.Email != "ada@example.org" || identity.ResearchGroup != "Organic Synthesis" {
+		t.Errorf("identity = %+v", identity)
+	}
+	if identity.Subject != "5f1c2a9e-8d3b-4c71-9e0a-2b6f4d8c1e37" || identity.LegacySubject != "ada" {
+		t.Errorf("subject = %q, legacy subject = %q, want the entryUUID and the lowercased uid", identity.Subject, identity.LegacySubject)
+	}
+
+	if len(d.searches) != 1 {
+		t.Fatalf("%d searches, want 1", len(d.searches))
+	}
+	search := d.searches[0]
+	if search.base != "dc=example,dc=org" || search.filter != "(uid=ada)" {
+		t.Errorf("searched %q with %s", search.base, search.filter)
+	}
+	if strings.Join(search.attrs, ",") != "uid,entryUUID,mail,ou" {
+		t.Errorf("requested attributes %v", search.attrs)
+	}
+}
+
+func TestLDAPRefusesWrongPasswords(t *testing.T) {
+	d := newMockDirectory(t)
+	l := newTestLDAP(d, config.LDAP{BaseDN: "dc=example,dc=org"})
+
+	if _, err := l.Authenticate(context.Background(), "ada", "wrong"); err != ErrInvalidCredentials {
+		t.Errorf("wrong password gave %v, want ErrInvalidCredentials", err)
+	}
+	if _, err := l.Authenticate(context.Background(), "grace", "correct horse"); err != ErrInvalidCredentials {
+		t.Errorf("unknown user gave %v, want ErrInvalidCredentials", err)
+	}
+}
+
+func TestLDAPRefusesEmptyPasswordsWithoutDialing(t *testing.T) {
+	l := NewLDAP(config.LDAP{URL: "ldap://directory.test"})
+	l.Dial = func(ctx context.Context) (net.Conn, error) {
+		t.Error("dialled the directory for an empty password")
+		return nil, errors.New("unexpected dial")
+	}
+	if _, err := l.Authenticate(context.Background(), "ada", ""); err != ErrInvalidCredentials {
+		t.Errorf("empty password gave %v, want ErrInvalidCredentials", err)
+	}
+}
+
+func TestLDAPBindsWithTheUserDNTemplate(t *testing.T) {
+	d := newMockDirectory(t)
+	const dn = `uid=smith\, j,ou=people,dc=example,dc=org`
+	d.entries[dn] = map[string][]string{"uid": {"smith, j"}, "entryUUID": {"0c7d6d8e-31a3-4bb4-a1e4-5b0c9d6f2a10"}}
+	d.passwords[dn] = "pa55word"
+	l := newTestLDAP(d, config.LDAP{UserDNTemplate: "uid=%s,ou=people,dc=example,dc=org"})
+
+	identity, err := l.Authenticate(context.Background(), "smith, j", "pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Subject != "0c7d6d8e-31a3-4bb4-a1e4-5b0c9d6f2a10" {
+		t.Errorf("subject = %q", identity.Subject)
+	}
+	if len(d.searches) != 1 || d.searches[0].base != dn || d.searches[0].filter != "(objectClass=*)" {
+		t.Errorf("searches = %+v, want a base search of the escaped DN", d.searches)
+	}
+}
+
+func TestLDAPNeedsTheSubjectAttribute(t *testing.T) {
+	d := newMockDirectory(t)
+	delete(d.entries[adaDN], "entryUUID")
+	l := newTestLDAP(d, config.LDAP{BaseDN: "dc=example,dc=org"})
+
+	if _, err := l.Authenticate(context.Background(), "ada", "correct horse"); !errors.Is(err, ErrProviderError) {
+		t.Errorf("entry without entryUUID gave %v, want ErrProviderError", err)
+	}
+}
+
+func TestLDAPHexEncodesBinarySubjects(t *testing.T) {
+	d := newMockDirectory(t)
+	d.entries[adaDN]["objectGUID"] = []string{string([]byte{0x9e, 0x2b, 0x00, 0xff})}
+	l := newTestLDAP(d, config.LDAP{BaseDN: "dc=example,dc=org", SubjectAttribute: "objectGUID"})
+
+	identity, err := l.Authenticate(context.Background(), "ada", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Subject != "9e2b00ff" {
+		t.Errorf("subject = %q, want 9e2b00ff", identity.Subject)
+	}
+}
+
+// testCertificate returns a self-signed certificate for directory.test, and a pool that trusts it.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "directory.test"},
+		DNSNames:     []string{"directory.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestLDAPStartTLS(t *testing.T) {
+	cert, pool := testCertificate(t)
+	d := newMockDirectory(t)
+	d.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	// without StartTLS the directory refuses to take a password
+	plain := newTestLDAP(d, config.LDAP{BaseDN: "dc=example,dc=org"})
+	if _, err := plain.Authenticate(context.Background(), "ada", "correct horse"); !errors.Is(err, ErrProviderError) {
+		t.Errorf("plain bind gave %v, want the directory's confidentiality error", err)
+	}
+
+	secure := newTestLDAP(d, config.LDAP{BaseDN: "dc=example,dc=org", StartTLS: true})
+	secure.TLSConfig = &tls.Config{RootCAs: pool}
+	identity, err := secure.Authenticate(context.Background(), "ada", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Subject != "5f1c2a9e-8d3b-4c71-9e0a-2b6f4d8c1e37" {
+		t.Errorf("subject = %q", identity.Subject)
+	}
+
+	// the certificate must be for the host in the URL
+	wrongHost := newTestLDAP(d, config.LDAP{URL: "ldap://other.test", BaseDN: "dc=example,dc=org", StartTLS: true})
+	wrongHost.TLSConfig = &tls.Config{RootCAs: pool}
+	if _, err := wrongHost.Authenticate(context.Background(), "ada", "correct horse"); err == nil {
+		t.Error("StartTLS accepted a certificate for another host")
+	}
+}
+
+func TestLDAPStartTLSRefusedByDirectory(t *testing.T) {
+	d := newMockDirectory(t)
+	l := newTestLDAP(d, config.LDAP{BaseDN: "dc=example,dc=org", StartTLS: true})
+
+	if _, err := l.Authenticate(context.Background(), "ada", "correct horse"); err == nil || !strings.Contains(err.Error(), "StartTLS") {
+		t.Errorf("directory without StartTLS gave %v, want a StartTLS error", err)
+	}
+}
+
+func TestBERRoundTrip(t *testing.T) {
+	for _, v := range []int{0, 1, 127, 128, 255, 256, 65535, 1 << 24} {
+		e, err := readBER(bufio.NewReader(bytes.NewReader(berInt(berTagInteger, v))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.tag != berTagInteger || e.int() != v {
+			t.Errorf("berInt(%d) decoded as tag %#x value %d", v, e.tag, e.int())
+		}
+	}
+
+	// 128 needs a leading zero octet so it isn't read as a negative number
+	if got := berInt(berTagInteger, 128); !bytes.Equal(got, []byte{0x02, 0x02, 0x00, 0x80}) {
+		t.Errorf("berInt(128) = % x", got)
+	}
+
+	long := strings.Repeat("x", 300)
+	encoded := berString(berTagOctetString, long)
+	if !bytes.Equal(encoded[:4], []byte{0x04, 0x82, 0x01, 0x2c}) {
+		t.Errorf("300 byte string encoded with header % x, want 04 82 01 2c", encoded[:4])
+	}
+	seq, err := readBER(bufio.NewReader(bytes.NewReader(berConstruct(berTagSequence, encoded, berBool(true)))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	children, err := seq.children()
+	if err != nil || len(children) != 2 || string(children[0].value) != long || children[1].value[0] != 0xff {
+		t.Errorf("sequence decoded as %v, %v", children, err)
+	}
+}
+
+func TestReadBERRejectsUnsupportedInput(t *testing.T) {
+	for name, input := range map[string][]byte{
+		"multi-octet tag":   {0x1f, 0x81, 0x00, 0x00},
+		"indefinite length": {0x30, 0x80, 0x00, 0x00},
+		"too large":         {0x04, 0x84, 0x7f, 0xff, 0xff, 0xff},
+		"truncated":         {0x04, 0x05, 'a', 'b'},
+	} {
+		if _, err := readBER(bufio.NewReader(bytes.NewReader(input))); err == nil {
+			t.Errorf("%s: readBER succeeded, want an error", name)
+		}
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	for in, want := range map[string]string{
+		"ada":        "ada",
+		"smith, j":   `smith\, j`,
+		"#admin":     `\#admin`,
+		" padded ":   `\ padded\ `,
+		`a+b="c";<>`: `a\+b\=\"c\"\;\<\>`,
+	} {
+		if got := escapeDN(in); got != want {
+			t.Errorf("escapeDN(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
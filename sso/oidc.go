@@ -0,0 +1,326 @@
+package sso
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"bookings.com/m/config"
+	"bookings.com/m/data"
+)
+
+// clockSkew is how far the provider's clock may be ahead of or behind ours when checking ID token times.
+const clockSkew = time.Minute
+
+// OIDC logs users in with an OpenID Connect provider using the authorisation code flow.
+// The provider's endpoints and signing keys are discovered from the issuer on first use and cached.
+// Client is used for every request to the provider, and can be replaced to point at a mock provider.
+type OIDC struct {
+	cfg    config.OIDC
+	Client *http.Client
+
+	mu   sync.Mutex
+	meta *oidcMetadata
+	keys map[string]*rsa.PublicKey
+}
+
+// oidcMetadata is the part of the provider's discovery document that is used.
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewOIDC takes the OIDC section of the config file and returns an OIDC provider.
+// The scopes default to "openid email profile" and the username claim to "preferred_username".
+func NewOIDC(cfg config.OIDC) *OIDC {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "preferred_username"
+	}
+	return &OIDC{cfg: cfg, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Name returns "oidc", the provider name stored against provisioned users.
+func (o *OIDC) Name() string {
+	return "oidc"
+}
+
+// AuthCodeURL takes the state and nonce for a login and returns the provider URL the user should be redirected to.
+func (o *OIDC) AuthCodeURL(ctx context.Context, state, nonce string) (string, error) {
+	meta, err := o.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {o.cfg.ClientID},
+		"redirect_uri":  {o.cfg.RedirectURL},
+		"scope":         {strings.Join(o.cfg.Scopes, " ")},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange takes the authorisation code from the callback and the nonce the login was started with.
+// The code is exchanged for an ID token, whose signature, issuer, audience, expiry and nonce are checked before the user's identity is returned.
+func (o *OIDC) Exchange(ctx context.Context, code, nonce string) (*data.ExternalIdentity, error) {
+	meta, err := o.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {o.cfg.RedirectURL},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(o.cfg.ClientID), url.QueryEscape(o.cfg.ClientSecret))
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := o.do(req, &tokens); err != nil {
+		return nil, err
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("%w: no id_token in token response", ErrProviderError)
+	}
+
+	claims, err := o.verify(ctx, tokens.IDToken, meta)
+	if err != nil {
+		return nil, err
+	}
+	if claimString(claims, "nonce") != nonce {
+		return nil, fmt.Errorf("%w: id_token nonce does not match", ErrProviderError)
+	}
+
+	subject := claimString(claims, "sub")
+	name := claimString(claims, o.cfg.UsernameClaim)
+	if subject == "" || name == "" {
+		return nil, fmt.Errorf("%w: id_token is missing the sub or %s claim", ErrProviderError, o.cfg.UsernameClaim)
+	}
+	identity := &data.ExternalIdentity{
+		Provider: o.Name(),
+		Subject:  subject,
+		Name:     name,
+		Email:    claimString(claims, "email"),
+	}
+	if o.cfg.GroupClaim != "" {
+		identity.ResearchGroup = mapGroup(claimString(claims, o.cfg.GroupClaim), o.cfg.GroupMap)
+	}
+	return identity, nil
+}
+
+// metadata returns the provider's discovery document, fetching it the first time it is needed.
+func (o *OIDC) metadata(ctx context.Context) (*oidcMetadata, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.meta != nil {
+		return o.meta, nil
+	}
+
+	issuer := strings.TrimSuffix(o.cfg.Issuer, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var meta oidcMetadata
+	if err := o.do(req, &meta); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(meta.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("%w: discovery document is for issuer %q", ErrProviderError, meta.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: discovery document is missing endpoints", ErrProviderError)
+	}
+	o.meta = &meta
+	return o.meta, nil
+}
+
+// signingKey returns the provider's RSA key with the given key ID.
+// The key set is fetched again if the key is unknown, so keys the provider rotates in are picked up.
+func (o *OIDC) signingKey(ctx context.Context, kid string, meta *oidcMetadata) (*rsa.PublicKey, error) {
+	o.mu.Lock()
+	key, ok := o.keys[kid]
+	o.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, meta.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := o.do(req, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	o.mu.Lock()
+	o.keys = keys
+	o.mu.Unlock()
+
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: no signing key with id %q", ErrProviderError, kid)
+}
+
+// verify checks the signature and standard claims of an ID token and returns its claims.
+// Only RS256 signed tokens are accepted.
+func (o *OIDC) verify(ctx context.Context, token string, meta *oidcMetadata) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed id_token", ErrProviderError)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("%w: id_token signed with unsupported algorithm %q", ErrProviderError, header.Alg)
+	}
+
+	key, err := o.signingKey(ctx, header.Kid, meta)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed id_token signature", ErrProviderError)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, fmt.Errorf("%w: id_token signature is invalid", ErrProviderError)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSuffix(claimString(claims, "iss"), "/") != strings.TrimSuffix(meta.Issuer, "/") {
+		return nil, fmt.Errorf("%w: id_token issuer does not match", ErrProviderError)
+	}
+	if !audienceContains(claims["aud"], o.cfg.ClientID) {
+		return nil, fmt.Errorf("%w: id_token is not for this client", ErrProviderError)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return nil, fmt.Errorf("%w: id_token has expired", ErrProviderError)
+	}
+	if iat, ok := claims["iat"].(float64); ok && time.Unix(int64(iat), 0).After(now.Add(clockSkew)) {
+		return nil, fmt.Errorf("%w: id_token was issued in the future", ErrProviderError)
+	}
+	return claims, nil
+}
+
+// do sends a request to the provider and decodes its JSON response into v.
+func (o *OIDC) do(req *http.Request, v interface{}) error {
+	resp, err := o.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s returned %s", ErrProviderError, req.URL.Path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// decodeSegment decodes one base64url encoded JSON segment of a JWT into v.
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return fmt.Errorf("%w: malformed id_token", ErrProviderError)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%w: malformed id_token", ErrProviderError)
+	}
+	return nil
+}
+
+// claimString returns a claim as a string. Numbers are formatted and the first value of a list is used, so group claims can be of any of these types.
+func claimString(claims map[string]interface{}, name string) string {
+	switch v := claims[name].(type) {
+	case string:
+		return v
+	case float64:
+		return fmt.Sprint(v)
+	case []interface{}:
+		if len(v) > 0 {
+			if s, ok := v[0].(string); ok {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// audienceContains reports whether the aud claim, which may be a string or a list, contains the client ID.
+func audienceContains(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
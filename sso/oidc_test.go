@@ -0,0 +1,281 @@
+package sso
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bookings.com/m/config"
+)
+
+var (
+	idpKeyOnce sync.Once
+	idpKey     *rsa.PrivateKey
+	otherKey   *rsa.PrivateKey
+)
+
+// testKeys returns the mock provider's signing key and an unrelated key, generating them once for the package's tests.
+func testKeys(t *testing.T) (*rsa.PrivateKey, *rsa.PrivateKey) {
+	t.Helper()
+	idpKeyOnce.Do(func() {
+		var err error
+		if idpKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatal(err)
+		}
+		if otherKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return idpKey, otherKey
+}
+
+// mockIdP is an OpenID Connect provider that answers every code with the ID token in idToken.
+type mockIdP struct {
+	srv     *httptest.Server
+	key     *rsa.PrivateKey
+	idToken string
+	form    url.Values
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, _ := testKeys(t)
+	m := &mockIdP{key: key}
+
+	mux := http.NewServeMux()
+	discovery := func(rw http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]string{
+			"issuer":                 m.srv.URL,
+			"authorization_endpoint": m.srv.URL + "/authorize",
+			"token_endpoint":         m.srv.URL + "/token",
+			"jwks_uri":               m.srv.URL + "/jwks",
+		})
+	}
+	mux.HandleFunc("/.well-known/openid-configuration", discovery)
+	// a discovery document served under another path still names the root issuer
+	mux.HandleFunc("/tenant/.well-known/openid-configuration", discovery)
+	mux.HandleFunc("/jwks", func(rw http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "key-1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(rw http.ResponseWriter, r *http.Request) {
+		// RFC 6749 has the client ID and secret form encoded before they go in the Authorization header
+		id, secret, ok := r.BasicAuth()
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+		if !ok || id != "bookings" || secret != "client secret" {
+			http.Error(rw, "invalid_client", http.StatusUnauthorized)
+			return
+		}
+		r.ParseForm()
+		m.form = r.PostForm
+		json.NewEncoder(rw).Encode(map[string]string{"id_token": m.idToken})
+	})
+	m.srv = httptest.NewServer(mux)
+	t.Cleanup(m.srv.Close)
+	return m
+}
+
+// client returns an OIDC provider configured for the mock provider.
+func (m *mockIdP) client() *OIDC {
+	o := NewOIDC(config.OIDC{
+		Issuer:       m.srv.URL,
+		ClientID:     "bookings",
+		ClientSecret: "client secret",
+		RedirectURL:  "https://bookings.example.org/login/oidc/callback",
+		GroupClaim:   "groups",
+		GroupMap:     map[string]string{"chem-org": "Organic Synthesis"},
+	})
+	o.Client = m.srv.Client()
+	return o
+}
+
+// claims returns a valid set of ID token claims for the mock provider, which tests then break one at a time.
+func (m *mockIdP) claims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":                m.srv.URL,
+		"aud":                "bookings",
+		"sub":                "248289761001",
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              "n-0S6_WzA2Mj",
+		"preferred_username": "ada",
+		"email":              "ada@example.org",
+		"groups":             []string{"chem-org", "staff"},
+	}
+}
+
+// signJWT returns a JWT with the given header and claims, signed with RS256 by key.
+func signJWT(t *testing.T, key *rsa.PrivateKey, header, claims map[string]interface{}) string {
+	t.Helper()
+	segment := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signingInput := segment(header) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+var rs256Header = map[string]interface{}{"alg": "RS256", "kid": "key-1", "typ": "JWT"}
+
+func TestOIDCExchangeReturnsTheIdentity(t *testing.T) {
+	m := newMockIdP(t)
+	m.idToken = signJWT(t, m.key, rs256Header, m.claims())
+
+	identity, err := m.client().Exchange(context.Background(), "auth-code", "n-0S6_WzA2Mj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Provider != "oidc" || identity.Subject != "248289761001" || identity.Name != "ada" || identity.Email != "ada@example.org" || identity.ResearchGroup != "Organic Synthesis" {
+		t.Errorf("identity = %+v", identity)
+	}
+	if m.form.Get("grant_type") != "authorization_code" || m.form.Get("code") != "auth-code" || m.form.Get("redirect_uri") != "https://bookings.example.org/login/oidc/callback" {
+		t.Errorf("token request form = %v", m.form)
+	}
+}
+
+func TestOIDCExchangeRejectsBadTokens(t *testing.T) {
+	_, other := testKeys(t)
+
+	tests := map[string]func(m *mockIdP) string{
+		"signed by another key": func(m *mockIdP) string {
+			return signJWT(t, other, rs256Header, m.claims())
+		},
+		"tampered claims": func(m *mockIdP) string {
+			parts := strings.Split(signJWT(t, m.key, rs256Header, m.claims()), ".")
+			c := m.claims()
+			c["sub"] = "someone-else"
+			b, _ := json.Marshal(c)
+			return parts[0] + "." + base64.RawURLEncoding.EncodeToString(b) + "." + parts[2]
+		},
+		"unsigned": func(m *mockIdP) string {
+			parts := strings.Split(signJWT(t, m.key, map[string]interface{}{"alg": "none", "kid": "key-1"}, m.claims()), ".")
+			return parts[0] + "." + parts[1] + "."
+		},
+		"HMAC signed": func(m *mockIdP) string {
+			return signJWT(t, m.key, map[string]interface{}{"alg": "HS256", "kid": "key-1"}, m.claims())
+		},
+		"unknown key id": func(m *mockIdP) string {
+			return signJWT(t, m.key, map[string]interface{}{"alg": "RS256", "kid": "key-2"}, m.claims())
+		},
+		"wrong issuer": func(m *mockIdP) string {
+			c := m.claims()
+			c["iss"] = "https://evil.example.com"
+			return signJWT(t, m.key, rs256Header, c)
+		},
+		"wrong audience": func(m *mockIdP) string {
+			c := m.claims()
+			c["aud"] = []string{"another-client"}
+			return signJWT(t, m.key, rs256Header, c)
+		},
+		"expired": func(m *mockIdP) string {
+			c := m.claims()
+			c["exp"] = time.Now().Add(-clockSkew - time.Minute).Unix()
+			return signJWT(t, m.key, rs256Header, c)
+		},
+		"no expiry": func(m *mockIdP) string {
+			c := m.claims()
+			delete(c, "exp")
+			return signJWT(t, m.key, rs256Header, c)
+		},
+		"issued in the future": func(m *mockIdP) string {
+			c := m.claims()
+			c["iat"] = time.Now().Add(clockSkew + time.Minute).Unix()
+			return signJWT(t, m.key, rs256Header, c)
+		},
+		"wrong nonce": func(m *mockIdP) string {
+			c := m.claims()
+			c["nonce"] = "replayed"
+			return signJWT(t, m.key, rs256Header, c)
+		},
+		"no nonce": func(m *mockIdP) string {
+			c := m.claims()
+			delete(c, "nonce")
+			return signJWT(t, m.key, rs256Header, c)
+		},
+		"no subject": func(m *mockIdP) string {
+			c := m.claims()
+			delete(c, "sub")
+			return signJWT(t, m.key, rs256Header, c)
+		},
+		"malformed": func(m *mockIdP) string {
+			return "not-a-jwt"
+		},
+	}
+
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := newMockIdP(t)
+			m.idToken = token(m)
+			identity, err := m.client().Exchange(context.Background(), "auth-code", "n-0S6_WzA2Mj")
+			if !errors.Is(err, ErrProviderError) {
+				t.Errorf("Exchange returned %+v, %v, want ErrProviderError", identity, err)
+			}
+		})
+	}
+}
+
+func TestOIDCAcceptsAudienceLists(t *testing.T) {
+	m := newMockIdP(t)
+	c := m.claims()
+	c["aud"] = []string{"another-client", "bookings"}
+	m.idToken = signJWT(t, m.key, rs256Header, c)
+
+	if _, err := m.client().Exchange(context.Background(), "auth-code", "n-0S6_WzA2Mj"); err != nil {
+		t.Errorf("token for several audiences including this client was refused: %s", err)
+	}
+}
+
+func TestOIDCAuthCodeURL(t *testing.T) {
+	m := newMockIdP(t)
+
+	link, err := m.client().AuthCodeURL(context.Background(), "state-123", "nonce-456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if u.Path != "/authorize" || q.Get("response_type") != "code" || q.Get("client_id") != "bookings" ||
+		q.Get("state") != "state-123" || q.Get("nonce") != "nonce-456" || q.Get("scope") != "openid email profile" {
+		t.Errorf("AuthCodeURL = %s", link)
+	}
+}
+
+func TestOIDCRefusesDiscoveryForAnotherIssuer(t *testing.T) {
+	m := newMockIdP(t)
+	o := m.client()
+	o.cfg.Issuer = m.srv.URL + "/tenant"
+
+	if _, err := o.AuthCodeURL(context.Background(), "state", "nonce"); !errors.Is(err, ErrProviderError) || !strings.Contains(err.Error(), "issuer") {
+		t.Error("discovery document for another issuer was accepted")
+	}
+}
@@ -0,0 +1,34 @@
+// Package sso logs users in with their institute accounts, through an LDAP bind against the directory or an OpenID Connect provider.
+// Both return a data.ExternalIdentity, which the handlers use to find or provision the matching user.
+package sso
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"bookings.com/m/data"
+)
+
+// Authenticator is an identity provider that checks a username and password directly, such as an LDAP directory.
+// Local accounts are checked by the login handler itself, so they don't need an Authenticator.
+type Authenticator interface {
+	// Name returns the provider name that clients send in the "provider" field of a login request.
+	Name() string
+	// Authenticate checks the username and password and returns the user's identity, or ErrInvalidCredentials if they are wrong.
+	Authenticate(ctx context.Context, username, password string) (*data.ExternalIdentity, error)
+}
+
+// mapGroup takes a research group value from the directory and the configured group map, and returns the research group name to store.
+// Values with no entry in the map are stored as they are.
+func mapGroup(value string, groups map[string]string) string {
+	value = strings.TrimSpace(value)
+	if mapped, ok := groups[value]; ok {
+		return mapped
+	}
+	return value
+}
+
+// create structured errors
+var ErrInvalidCredentials = fmt.Errorf("invalid username or password")
+var ErrProviderError = fmt.Errorf("identity provider returned an error")
@@ -0,0 +1,135 @@
+// Package stream pushes hood and booking changes to live clients, such as the lab's wall display.
+// Events are read from the stream_events table in commit order, so every instance behind a load balancer sends the same events in the same order with the same IDs.
+package stream
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"bookings.com/m/data"
+	"github.com/lib/pq"
+)
+
+// settings for the broker
+const (
+	pollInterval  = 5 * time.Second
+	fetchLimit    = 500
+	subscriberBuf = 64
+)
+
+// Broker reads new stream events from the database and fans them out to every subscribed client of this instance.
+// It is woken by a PostgreSQL NOTIFY whenever any instance stores an event, and also polls in case a notification is missed.
+type Broker struct {
+	l    *log.Logger
+	db   *sql.DB
+	mu   sync.Mutex
+	subs map[chan *data.StreamEvent]struct{}
+	last data.StreamCursor
+}
+
+// NewBroker takes a logger and a sql DB connection and returns a Broker.
+// Only events stored after the broker is created are pushed to subscribers. Older events are sent by the handler when a client asks to catch up.
+func NewBroker(l *log.Logger, db *sql.DB) (*Broker, error) {
+	last, err := data.GetLatestStreamCursor(db)
+	if err != nil {
+		return nil, err
+	}
+	return &Broker{l: l, db: db, subs: make(map[chan *data.StreamEvent]struct{}), last: last}, nil
+}
+
+// DB returns the database connection used by the broker, so handlers can replay missed events from it.
+func (b *Broker) DB() *sql.DB {
+	return b.db
+}
+
+// Run listens for notifications on connStr and pushes new events to subscribers until the context is cancelled.
+// It is expected to be started in its own Goroutine from the main function.
+func (b *Broker) Run(ctx context.Context, connStr string) {
+	listener := pq.NewListener(connStr, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			b.l.Println("Stream listener error", err)
+		}
+	})
+	defer listener.Close()
+
+	if err := listener.Listen(data.StreamChannel); err != nil {
+		b.l.Println("Unable to listen for stream events, falling back to polling", err)
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			b.closeAll()
+			return
+		case <-listener.Notify:
+		case <-ticker.C:
+		}
+		b.fetch()
+	}
+}
+
+// fetch reads every event committed since the last fetch and sends it to each subscriber.
+// Events held back by a transaction that is still running are picked up by a later fetch, which the poll guarantees will happen.
+// A subscriber that is too slow to keep up is disconnected, and will catch up from its last event ID when it reconnects.
+func (b *Broker) fetch() {
+	for {
+		events, err := data.GetStreamEventsAfter(b.last, fetchLimit, b.db)
+		if err != nil {
+			b.l.Println("Error fetching stream events", err)
+			return
+		}
+		if len(events) == 0 {
+			return
+		}
+
+		b.mu.Lock()
+		for _, e := range events {
+			for ch := range b.subs {
+				select {
+				case ch <- e:
+				default:
+					delete(b.subs, ch)
+					close(ch)
+				}
+			}
+		}
+		b.mu.Unlock()
+
+		b.last = events[len(events)-1].Cursor()
+	}
+}
+
+// Subscribe registers a new client and returns the channel its events are sent on, and a function that must be called when the client disconnects.
+// The channel is closed if the client falls too far behind or the broker stops.
+func (b *Broker) Subscribe() (<-chan *data.StreamEvent, func()) {
+	ch := make(chan *data.StreamEvent, subscriberBuf)
+
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// closeAll disconnects every subscriber when the broker stops.
+func (b *Broker) closeAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
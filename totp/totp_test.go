@@ -0,0 +1,130 @@
+package totp
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 seed of RFC 6238 appendix B, the ASCII string "12345678901234567890", encoded as base32.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestCodeMatchesRFC6238 checks the SHA1 test vectors of RFC 6238 appendix B.
+// The RFC gives eight digit codes, and six digit codes are their last six digits.
+func TestCodeMatchesRFC6238(t *testing.T) {
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},          // 94287082
+		{1111111109, "081804"},  // 07081804
+		{1111111111, "050471"},  // 14050471
+		{1234567890, "005924"},  // 89005924
+		{2000000000, "279037"},  // 69279037
+		{20000000000, "353130"}, // 65353130
+	}
+	for _, v := range vectors {
+		got, err := Code(rfcSecret, Step(time.Unix(v.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != v.code {
+			t.Errorf("code at %d = %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+// TestCodeMatchesRFC4226 checks the HOTP test vectors of RFC 4226 appendix D, which use the same secret with counters 0 to 9.
+func TestCodeMatchesRFC4226(t *testing.T) {
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range want {
+		got, err := Code(rfcSecret, int64(counter))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != code {
+			t.Errorf("code for counter %d = %s, want %s", counter, got, code)
+		}
+	}
+}
+
+func TestCodeAcceptsSecretsAsTyped(t *testing.T) {
+	want, _ := Code(rfcSecret, 1)
+	for _, secret := range []string{"gezdgnbvgy3tqojqgezdgnbvgy3tqojq", " " + rfcSecret + "\n"} {
+		got, err := Code(secret, 1)
+		if err != nil || got != want {
+			t.Errorf("Code(%q) = %s, %v, want %s", secret, got, err, want)
+		}
+	}
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("invalid secret was accepted")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+	codeAt := func(step int64) string {
+		code, err := Code(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		want     int64
+	}{
+		{"current code", codeAt(current), 0, current},
+		{"code with spaces", codeAt(current)[:3] + " " + codeAt(current)[3:], 0, current},
+		{"previous step", codeAt(current - 1), 0, current - 1},
+		{"next step", codeAt(current + 1), 0, current + 1},
+		{"two steps old", codeAt(current - 2), 0, 0},
+		{"two steps ahead", codeAt(current + 2), 0, 0},
+		{"already used", codeAt(current), current, 0},
+		{"later than the last use", codeAt(current), current - 1, current},
+		{"wrong code", "000000", 0, 0},
+		{"too short", codeAt(current)[:5], 0, 0},
+		{"eight digits", "14050471", 0, 0},
+	}
+	for _, tt := range tests {
+		got, err := Validate(rfcSecret, tt.code, now, tt.lastStep)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: Validate(%q) = %d, want %d", tt.name, tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := GenerateSecret()
+	if len(a) != 32 || a == b {
+		t.Errorf("secrets %q and %q, want two different 32 character base32 secrets", a, b)
+	}
+	if _, err := Code(a, 1); err != nil {
+		t.Errorf("generated secret can't be used: %s", err)
+	}
+}
+
+func TestURI(t *testing.T) {
+	u, err := url.Parse(URI("Hood Booking", "ada", "JBSWY3DPEHPK3PXP"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Hood Booking:ada" {
+		t.Errorf("URI = %s", u)
+	}
+	q := u.Query()
+	if q.Get("secret") != "JBSWY3DPEHPK3PXP" || q.Get("issuer") != "Hood Booking" || q.Get("algorithm") != "SHA1" || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Errorf("URI query = %v", q)
+	}
+}